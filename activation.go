@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets on
+const listenFDsStart = 3
+
+// activatedSockets returns the sockets systemd passed serve with socket
+// activation (sd_listen_fds), nothing when it was started without, and
+// unsets LISTEN_PID and LISTEN_FDS so that child processes do not take
+// them for their own
+func activatedSockets() ([]net.PacketConn, []net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var packetConns []net.PacketConn
+	var listeners []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		if l, err := net.FileListener(f); err == nil {
+			listeners = append(listeners, l)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			packetConns = append(packetConns, pc)
+		} else {
+			return nil, nil, fmt.Errorf("socket activation: file descriptor %d is not a socket: %v", fd, err)
+		}
+		f.Close()
+	}
+	return packetConns, listeners, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// anchorRefreshInterval is how stale the anchor store may get before -dnssec
+// and dane refresh it
+const anchorRefreshInterval = 24 * time.Hour
+
+// defaultAnchorStore returns the path of the trust anchor store in the user
+// cache directory
+func defaultAnchorStore() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "tmp-dns", "trust-anchors.json")
+}
+
+// trustAnchors returns the anchors to validate with: those in file when it
+// is given, otherwise the stored ones, which are fetched from IANA on first
+// use and refreshed once they are older than anchorRefreshInterval. Failures
+// to update the store are logged and the anchors already known are used,
+// falling back to the built in ones.
+func trustAnchors(ctx context.Context, r resolver.Resolver, file string) ([]*dns.DS, error) {
+	if file != "" {
+		return resolver.ReadTrustAnchors(file)
+	}
+	path := defaultAnchorStore()
+	if path == "" {
+		return nil, nil
+	}
+	store, err := resolver.LoadAnchorStore(path)
+	if err != nil {
+		slog.Warn("using the built in trust anchors", "err", err)
+		return nil, nil
+	}
+	if time.Since(store.Checked) > anchorRefreshInterval {
+		if err := updateAnchors(ctx, store, r, resolver.RootAnchorsURL); err != nil {
+			slog.Warn("failed to update the trust anchor store", "err", err)
+		}
+		if err := store.Save(); err != nil {
+			slog.Warn("failed to save the trust anchor store", "err", err)
+		}
+	}
+	return store.Anchors(), nil
+}
+
+// updateAnchors bootstraps the root anchors from url when the store has
+// none, falling back to the built in ones, then follows rollovers
+func updateAnchors(ctx context.Context, store *resolver.AnchorStore, r resolver.Resolver, url string) error {
+	if !store.HasZone(".") {
+		if err := store.Bootstrap(ctx, url); err != nil {
+			slog.Warn("starting from the built in root anchors", "err", err)
+			store.Add(resolver.RootAnchors())
+		}
+	}
+	return store.Refresh(ctx, r)
+}
+
+// runAnchors implements the anchors subcommand: it shows the trust anchor
+// store and its RFC 5011 key states, and with -update or -add brings it up
+// to date
+func runAnchors(args []string) {
+	fs := flag.NewFlagSet("anchors", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	timeout := fs.Duration("timeout", 10*time.Second, "give up on the update after this `duration`")
+	storePath := fs.String("store", defaultAnchorStore(), "trust anchor store `file`")
+	update := fs.Bool("update", false, "fetch the DNSKEY sets of the tracked zones now, and the root anchors from -url when none are stored")
+	url := fs.String("url", resolver.RootAnchorsURL, "`URL` of the RFC 7958 root anchors document")
+	add := fs.String("add", "", "also trust the DS or DNSKEY records in `file`, such as the anchors of a TLD, and track their rollovers")
+	jsonOut := fs.Bool("json", false, "print the store as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s anchors [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "anchors"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *storePath == "" {
+		fatal("no user cache directory, give -store")
+	}
+	store, err := resolver.LoadAnchorStore(*storePath)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	var updateErr error
+	if *add != "" {
+		anchors, err := resolver.ReadTrustAnchors(*add)
+		if err != nil {
+			fatal("failed to read trust anchors", "err", err)
+		}
+		store.Add(anchors)
+	}
+	if *update || *add != "" {
+		servers := *serverFlag
+		if servers == "" {
+			servers = opts.defaultServer(*method)
+		}
+		upstreams, err := parseUpstreams(*method, servers, *port)
+		if err != nil {
+			fatal(err.Error())
+		}
+		r, err := opts.buildResolver(upstreams)
+		if err != nil {
+			fatal(err.Error())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		updateErr = updateAnchors(resolver.WithTraceID(ctx, resolver.NewTraceID()), store, r, *url)
+		cancel()
+		if err := store.Save(); err != nil {
+			fatal(err.Error())
+		}
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(store); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printAnchors(store)
+	}
+	if updateErr != nil {
+		fatal("trust anchor update failed", "err", updateErr)
+	}
+}
+
+// printAnchors lists the tracked keys and when their state last changed
+func printAnchors(store *resolver.AnchorStore) {
+	if len(store.Keys) == 0 {
+		fmt.Printf("No trust anchors in %s, the built in root anchors are used\n", store.Path)
+		return
+	}
+	if store.Checked.IsZero() {
+		fmt.Printf("Trust anchors in %s, never checked\n", store.Path)
+	} else {
+		fmt.Printf("Trust anchors in %s, checked %s\n", store.Path, store.Checked.Format(time.RFC3339))
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ZONE\tKEY TAG\tSTATE\tSINCE")
+	for _, k := range store.Keys {
+		since := k.Changed.Format(time.RFC3339)
+		if k.State == resolver.KeyAddPend {
+			since += fmt.Sprintf(" (trusted from %s)", k.FirstSeen.Add(resolver.AddHoldDown).Format(time.RFC3339))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", toUnicode(k.Zone), k.KeyTag, k.State, since)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// serveAPI serves the REST resolution API on addr. GET /resolve?name=&type=
+// passes the query through chain, the same way as the queries serve gets
+// over DNS, and answers with the JSON of a batch -json line.
+func serveAPI(addr string, chain *resolver.Chain) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resolve", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPI(w, http.StatusMethodNotAllowed, batchJSON{Error: "use GET"})
+			return
+		}
+		name, typeName := r.URL.Query().Get("name"), r.URL.Query().Get("type")
+		if typeName == "" {
+			typeName = "A"
+		}
+		line := batchJSON{Name: name, Type: strings.ToUpper(typeName)}
+		qtype, err := parseType(typeName)
+		if err == nil {
+			name, err = toASCII(name)
+		}
+		if err == nil && name == "" {
+			err = fmt.Errorf("the name parameter is missing")
+		}
+		if err != nil {
+			line.Error = err.Error()
+			writeAPI(w, http.StatusBadRequest, line)
+			return
+		}
+		line.Name, line.Type = dns.Fqdn(name), typeString(qtype)
+
+		local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		req := &resolver.Request{Msg: resolver.NewQuery(name, qtype), Client: apiClient(r.RemoteAddr), Local: local}
+		resp, err := chain.Serve(r.Context(), req)
+		switch {
+		case err != nil:
+			line.Error, line.ErrorClass = err.Error(), classify(nil, err).String()
+			writeAPI(w, http.StatusBadGateway, line)
+		case resp == nil:
+			line.Error = "query dropped"
+			writeAPI(w, http.StatusForbidden, line)
+		default:
+			out := newJSONResponse(resp, req.Trace)
+			line.ErrorClass = out.ErrorClass
+			line.jsonResponse = &out
+			writeAPI(w, http.StatusOK, line)
+		}
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fatal("API server failed", "listen", addr, "err", err)
+		}
+	}()
+	slog.Info("serving the resolution API", "listen", addr, "path", "/resolve")
+}
+
+// apiClient turns the host:port of an HTTP client into the TCP address
+// that the handlers of the chain expect, so that client limits apply
+func apiClient(hostport string) net.Addr {
+	addr, err := netip.ParseAddrPort(hostport)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(addr)
+}
+
+func writeAPI(w http.ResponseWriter, status int, line batchJSON) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(line); err != nil {
+		slog.Debug("failed to write an API response", "err", err)
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// auditServer is one address of one nameserver of the zone and what it
+// answered
+type auditServer struct {
+	ns      string
+	addr    string // host:port, "" when the name has no address
+	soa     *dns.SOA
+	rcode   int
+	aa      bool
+	rtt     time.Duration
+	err     error
+	records map[auditKey]string // the sorted answer set, or the rcode or error
+}
+
+// auditKey is a name and type whose records are compared across servers
+type auditKey struct {
+	name  string
+	qtype uint16
+}
+
+func (k auditKey) String() string {
+	return k.name + " " + typeString(k.qtype)
+}
+
+// label names the server in reports
+func (s *auditServer) label() string {
+	if s.addr == "" {
+		return s.ns
+	}
+	return s.ns + " (" + s.addr + ")"
+}
+
+// status sums up how the server answered the SOA query
+func (s *auditServer) status() string {
+	switch {
+	case s.addr == "":
+		return "no address"
+	case s.err != nil:
+		return "unreachable"
+	case s.lameReason() != "":
+		return "lame"
+	}
+	return "ok"
+}
+
+// lameReason says how the server fails to be an authority for the zone, or
+// returns "" when it is one
+func (s *auditServer) lameReason() string {
+	switch {
+	case s.rcode != dns.RcodeSuccess:
+		return "it answers " + rcodeString(s.rcode)
+	case !s.aa:
+		return "its answer is not authoritative"
+	case s.soa == nil:
+		return "it has no SOA record for the zone"
+	}
+	return ""
+}
+
+// runAudit implements the audit subcommand: it finds the nameservers of a
+// zone, asks every address of each directly for the SOA and the records
+// requested, and reports unreachable servers, lame delegations, serial
+// mismatches, records that differ between servers and a delegation that
+// differs from the NS records of the zone. It exits with status 1 when it
+// finds any of these.
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers` that look up the nameservers and their addresses, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 53, "`port` of the nameservers")
+	typeNames := fs.String("type", "NS", "record `types` to compare between the nameservers, comma separated, besides the SOA")
+	names := fs.String("names", "", "compare the records of these `names` too, comma separated, relative to the zone or absolute (default only the apex)")
+	parent := fs.Bool("parent", true, "compare the delegation in the parent zone, found from the root, with the NS records of the zone")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each query after this `duration`")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s audit [flags] <zone>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "audit"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	zone, err := toASCII(args[0])
+	if err != nil {
+		fatal(err.Error())
+	}
+	zone = strings.ToLower(dns.Fqdn(zone))
+	types, err := parseTypes(*typeNames)
+	if err != nil {
+		fatal(err.Error())
+	}
+	targets := []string{zone}
+	for _, name := range strings.Split(*names, ",") {
+		switch name = strings.ToLower(strings.TrimSpace(name)); {
+		case name == "":
+			continue
+		case name == "@":
+			name = zone
+		case !strings.HasSuffix(name, "."):
+			name += "." + zone
+		}
+		if !slices.Contains(targets, name) {
+			targets = append(targets, name)
+		}
+	}
+	var keys []auditKey
+	for _, name := range targets {
+		for _, t := range types {
+			keys = append(keys, auditKey{name, t})
+		}
+	}
+
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, 0)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	nsNames, err := zoneNameservers(r, zone, *timeout)
+	if err != nil {
+		fatal("failed to look up the nameservers", "zone", zone, "err", err)
+	}
+	var problems []string
+	if *parent {
+		delegation, err := parentDelegation(zone, *timeout, opts.family())
+		switch {
+		case err != nil:
+			slog.Warn("failed to look up the delegation in the parent zone, -parent=false skips it", "zone", zone, "err", err)
+		case !slices.Equal(delegation, nsNames):
+			problems = append(problems, fmt.Sprintf("! the parent delegates to %s, the zone lists %s", strings.Join(delegation, ", "), strings.Join(nsNames, ", ")))
+		}
+	}
+
+	var audited []*auditServer
+	for _, ns := range nsNames {
+		addrs, err := nameserverAddrs(r, ns, *timeout, opts.ipv4, opts.ipv6)
+		if err != nil || len(addrs) == 0 {
+			audited = append(audited, &auditServer{ns: ns, err: err})
+			continue
+		}
+		for _, addr := range addrs {
+			audited = append(audited, &auditServer{ns: ns, addr: net.JoinHostPort(addr, strconv.Itoa(*port)), records: map[auditKey]string{}})
+		}
+	}
+	var wg sync.WaitGroup
+	for _, s := range audited {
+		if s.addr == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.probe(zone, keys, *timeout)
+		}()
+	}
+	wg.Wait()
+
+	printAudit(zone, audited)
+	problems = append(problems, auditProblems(audited, keys)...)
+	if len(problems) == 0 {
+		fmt.Println("\nNo problems found")
+		return
+	}
+	fmt.Println()
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	os.Exit(1)
+}
+
+// zoneNameservers returns the sorted names of the NS records of zone
+func zoneNameservers(r resolver.Resolver, zone string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := r.Query(ctx, zone, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s", rcodeString(resp.Rcode))
+	}
+	names := nsTargets(resp.Answer, zone)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s is not a zone, it has no NS records", zone)
+	}
+	return names, nil
+}
+
+// parentDelegation resolves the NS records of zone from the root and
+// returns the names the referral from its parent gives
+func parentDelegation(zone string, timeout time.Duration, family int) ([]string, error) {
+	it := resolver.NewIterator()
+	it.Family = family
+	it.Timeout = timeout
+	step, err := parentReferral(it, zone, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return nsTargets(step.Response.Ns, zone), nil
+}
+
+// parentReferral resolves the NS records of zone with it and returns the
+// step in which a server of the parent zone referred to zone. With QNAME
+// minimization that referral comes from the query for zone itself.
+func parentReferral(it *resolver.Iterator, zone string, timeout time.Duration) (resolver.Step, error) {
+	var mu sync.Mutex
+	var referral resolver.Step
+	it.OnStep = func(s resolver.Step) {
+		if s.Response == nil || s.Zone == zone {
+			return
+		}
+		if len(nsTargets(s.Response.Ns, zone)) > 0 {
+			mu.Lock()
+			referral = s
+			mu.Unlock()
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 4*timeout)
+	defer cancel()
+	_, err := it.Query(ctx, zone, dns.TypeNS)
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case referral.Response != nil:
+		return referral, nil
+	case err != nil:
+		return referral, err
+	}
+	return referral, fmt.Errorf("no referral to %s was seen", zone)
+}
+
+// nsTargets returns the sorted, lowercased targets of the NS records of
+// zone among rrs
+func nsTargets(rrs []dns.RR, zone string) []string {
+	var names []string
+	for _, rr := range rrs {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, zone) {
+			if name := strings.ToLower(ns.Ns); !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nameserverAddrs looks up the IPv4 and IPv6 addresses of a nameserver,
+// only those of one family when ipv4 or ipv6 is set
+func nameserverAddrs(r resolver.Resolver, name string, timeout time.Duration, ipv4, ipv6 bool) ([]string, error) {
+	var addrs []string
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if qtype == dns.TypeA && ipv6 || qtype == dns.TypeAAAA && ipv4 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp, err := r.Query(ctx, name, qtype)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, lastErr
+	}
+	return addrs, nil
+}
+
+// probe asks the server for the SOA of zone and then for every key,
+// without recursion
+func (s *auditServer) probe(zone string, keys []auditKey, timeout time.Duration) {
+	start := time.Now()
+	resp, err := queryAuthority(s.addr, zone, dns.TypeSOA, timeout)
+	s.rtt = time.Since(start)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.rcode, s.aa = resp.Rcode, resp.Authoritative
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, zone) {
+			s.soa = soa
+		}
+	}
+	if s.status() != "ok" {
+		return
+	}
+	for _, key := range keys {
+		resp, err := queryAuthority(s.addr, key.name, key.qtype, timeout)
+		switch {
+		case err != nil:
+			s.records[key] = "ERROR " + err.Error()
+		case resp.Rcode != dns.RcodeSuccess:
+			s.records[key] = rcodeString(resp.Rcode)
+		default:
+			answers, _ := answerSet(resp)
+			s.records[key] = strings.Join(answers, ", ")
+		}
+	}
+}
+
+// queryAuthority sends a query without the RD bit over UDP, and again
+// over TCP when the response is truncated
+func queryAuthority(addr, name string, qtype uint16, timeout time.Duration) (*dns.Msg, error) {
+	return exchangeAuthority(addr, resolver.NewQuery(name, qtype), timeout)
+}
+
+// exchangeAuthority is queryAuthority for a message of the caller's
+func exchangeAuthority(addr string, q *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	q.RecursionDesired = false
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := resolver.NewUDP(addr).Exchange(ctx, q)
+	if err == nil && resp.Truncated {
+		resp, err = resolver.NewTCP(addr).Exchange(ctx, q)
+	}
+	return resp, err
+}
+
+// printAudit prints a line per nameserver address
+func printAudit(zone string, servers []*auditServer) {
+	fmt.Printf("Nameservers of %s:\n\n", zone)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESERVER\tADDRESS\tSTATUS\tSERIAL\tTIME")
+	for _, s := range servers {
+		addr, serial, rtt := s.addr, "-", "-"
+		if addr == "" {
+			addr = "-"
+		}
+		if s.soa != nil {
+			serial = fmt.Sprint(s.soa.Serial)
+		}
+		if s.addr != "" && s.err == nil {
+			rtt = s.rtt.Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.ns, addr, s.status(), serial, rtt)
+	}
+	w.Flush()
+}
+
+// auditProblems describes what is wrong with the servers: those that
+// cannot be asked, then serials and records that differ among the others
+func auditProblems(servers []*auditServer, keys []auditKey) []string {
+	var problems []string
+	var healthy []*auditServer
+	for _, s := range servers {
+		switch status := s.status(); {
+		case s.addr == "":
+			reason := "no address"
+			if s.err != nil {
+				reason = s.err.Error()
+			}
+			problems = append(problems, fmt.Sprintf("! %s cannot be reached: %s", s.ns, reason))
+		case s.err != nil:
+			problems = append(problems, fmt.Sprintf("! %s is unreachable: %v", s.label(), s.err))
+		case status != "ok":
+			problems = append(problems, fmt.Sprintf("! %s is a lame delegation, %s", s.label(), s.lameReason()))
+		default:
+			healthy = append(healthy, s)
+		}
+	}
+
+	if groups := groupAudit(healthy, func(s *auditServer) string { return fmt.Sprint(s.soa.Serial) }); len(groups) > 1 {
+		problems = append(problems, "! SOA serials differ:"+describeAuditGroups(groups))
+	}
+	for _, key := range keys {
+		if groups := groupAudit(healthy, func(s *auditServer) string { return s.records[key] }); len(groups) > 1 {
+			problems = append(problems, fmt.Sprintf("! %s differs:%s", key, describeAuditGroups(groups)))
+		}
+	}
+	return problems
+}
+
+// auditGroup is the servers that share a value
+type auditGroup struct {
+	key     string
+	servers []*auditServer
+}
+
+// groupAudit groups the servers by key, in the order each value was first
+// seen
+func groupAudit(servers []*auditServer, key func(*auditServer) string) []auditGroup {
+	var groups []auditGroup
+	index := map[string]int{}
+	for _, s := range servers {
+		k := key(s)
+		i, seen := index[k]
+		if !seen {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, auditGroup{key: k})
+		}
+		groups[i].servers = append(groups[i].servers, s)
+	}
+	return groups
+}
+
+// describeAuditGroups lists each value and the servers that gave it, one
+// per line
+func describeAuditGroups(groups []auditGroup) string {
+	var b strings.Builder
+	for _, g := range groups {
+		labels := make([]string, len(g.servers))
+		for i, s := range g.servers {
+			labels[i] = s.label()
+		}
+		key := g.key
+		if key == "" {
+			key = "no records"
+		}
+		fmt.Fprintf(&b, "\n    %s from %s", key, strings.Join(labels, ", "))
+	}
+	return b.String()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// runAXFR implements the axfr subcommand: a zone transfer over TCP that
+// prints the zone or saves it as a master file. With -ixfr only the changes
+// since a serial are transferred, and a zone saved by an earlier run is
+// brought up to date in place.
+func runAXFR(args []string) {
+	fs := flag.NewFlagSet("axfr", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "primary `server` to transfer from, as host[:port]")
+	port := fs.Int("port", 0, "server `port` (default 53)")
+	timeout := fs.Duration("timeout", time.Minute, "give up on the transfer after this `duration`")
+	ixfr := fs.Bool("ixfr", false, "transfer only the changes since the serial of the -o file, or -serial")
+	serial := fs.Int64("serial", -1, "with -ixfr and no existing -o file, the `serial` to transfer changes from")
+	output := fs.String("o", "", "save the zone to `file` in master file format instead of printing it")
+	tsig := fs.String("tsig", "", "sign the transfer with TSIG, the `key` given as [algorithm:]name:base64secret")
+	tsigFile := fs.String("tsig-file", "", "read the TSIG key from a BIND key `file`, as written by tsig-keygen")
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s axfr [flags] <zone>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := cfg.apply(fs, "axfr"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if fs.NArg() != 1 || *serverFlag == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	zone := dns.Fqdn(fs.Arg(0))
+
+	addr, err := serverAddress("tcp", *serverFlag, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	key, err := loadTSIGKey(*tsig, *tsigFile)
+	if err != nil {
+		fatal(err.Error())
+	}
+	xfr := resolver.NewTransfer(addr, key)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if !*ixfr {
+		records, err := xfr.AXFR(ctx, zone)
+		if err != nil {
+			fatal("zone transfer failed", "zone", zone, "server", addr, "err", err)
+		}
+		if *output == "" {
+			printRecords(records)
+			return
+		}
+		// The closing SOA only marks the end of the transfer
+		saveZone(*output, zone, addr, records[:len(records)-1])
+		return
+	}
+
+	// The saved zone, if any, says which version we have
+	var base []dns.RR
+	if *output != "" {
+		if base, err = readZoneFile(*output, zone); err != nil && !os.IsNotExist(err) {
+			fatal(err.Error())
+		}
+	}
+	from := uint32(*serial)
+	switch {
+	case len(base) > 0:
+		from = base[0].(*dns.SOA).Serial
+	case *serial < 0:
+		fatal("-ixfr needs the zone saved in the -o file by an earlier run, or -serial")
+	case *output != "":
+		fatal("-ixfr cannot apply changes without the zone, transfer it in full first", "serial", from)
+	}
+
+	changes, err := xfr.IXFR(ctx, zone, from)
+	if err != nil {
+		fatal("incremental zone transfer failed", "zone", zone, "server", addr, "serial", from, "err", err)
+	}
+	if *output == "" {
+		printRecords(changes)
+		return
+	}
+	updated, err := resolver.ApplyIXFR(base, changes)
+	if err != nil {
+		fatal(err.Error())
+	}
+	to := updated[0].(*dns.SOA).Serial
+	if to == from {
+		fmt.Printf("%s is up to date at serial %d\n", zone, from)
+		return
+	}
+	saveZone(*output, zone, addr, updated)
+	fmt.Printf("%s updated from serial %d to %d\n", zone, from, to)
+}
+
+// printRecords prints records in master file format
+func printRecords(records []dns.RR) {
+	w := bufio.NewWriter(os.Stdout)
+	for _, rr := range records {
+		fmt.Fprintln(w, rr.String())
+	}
+	w.Flush()
+}
+
+// saveZone writes the records of zone, SOA first, to path as a master file.
+// The file is replaced atomically so an interrupted transfer leaves the
+// previous version in place.
+func saveZone(path, zone, server string, records []dns.RR) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		fatal(err.Error())
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "; %s transferred from %s at %s\n", zone, server, time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "$ORIGIN %s\n", zone)
+	for _, rr := range records {
+		fmt.Fprintln(w, rr.String())
+	}
+	if err := w.Flush(); err != nil {
+		fatal(err.Error())
+	}
+	if err := f.Close(); err != nil {
+		fatal(err.Error())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		fatal(err.Error())
+	}
+}
+
+// readZoneFile reads a master file saved by saveZone, returning its records
+// with the SOA first
+func readZoneFile(path, zone string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var soa dns.RR
+	var records []dns.RR
+	zp := dns.NewZoneParser(f, zone, path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if _, isSOA := rr.(*dns.SOA); isSOA && soa == nil {
+			soa = rr
+			continue
+		}
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read zone file: %v", err)
+	}
+	if soa == nil {
+		return nil, fmt.Errorf("zone file %s has no SOA record", path)
+	}
+	return append([]dns.RR{soa}, records...), nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// batchJob is one input line to resolve
+type batchJob struct {
+	index int
+	name  string
+	qtype uint16
+	typ   string // the type as given, for reporting bad ones
+	err   error
+}
+
+// batchResult is the outcome of a batchJob
+type batchResult struct {
+	batchJob
+	resp  *dns.Msg
+	trace resolver.Trace
+}
+
+// batchJSON is the -json line for one input
+type batchJSON struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Error      string `json:"error,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+	*jsonResponse
+}
+
+// runBatch implements the batch subcommand: it resolves every name listed
+// in a file, or standard input, with a pool of workers and prints one
+// result per input line, in input order
+func runBatch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	typeName := fs.String("type", "A", "record `type` for lines that do not name one")
+	workers := fs.Int("workers", 16, "resolve up to `n` names at once")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each query after this `duration`")
+	cacheSize := fs.Int("cache", resolver.DefaultCacheSize, "cache up to `n` responses so repeated names are resolved once, 0 disables the cache")
+	dedup := fs.Bool("dedup", true, "send identical queries in flight at once upstream only once, sharing the answer")
+	jsonOut := fs.Bool("json", false, "print one JSON object per line instead of text")
+	metricsAddr := fs.String("metrics", "", "serve Prometheus metrics at /metrics on this `address` while the batch runs")
+	pcapFile := fs.String("pcap", "", pcapUsage)
+	var export exportOptions
+	export.register(fs)
+	opts := options{keepalive: true}
+	opts.register(fs)
+	var tap dnstapOptions
+	tap.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s batch [flags] [file]\n\nEach input line holds a domain and optionally a record type. With no file, or -, names are read from standard input.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := cfg.apply(fs, "batch"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+
+	defaultType, err := parseType(*typeName)
+	if err != nil {
+		fatal(err.Error())
+	}
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, 0)
+	if err != nil {
+		fatal(err.Error())
+	}
+	var m *metrics
+	if *metricsAddr != "" {
+		m = newMetrics()
+		opts.metrics = m
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if *dedup {
+		d := resolver.NewDedup(r)
+		if m != nil {
+			m.dedup = d
+		}
+		r = d
+	}
+	if *cacheSize > 0 {
+		cache := resolver.NewCache(r, *cacheSize)
+		if m != nil {
+			m.cache = cache
+		}
+		r = cache
+	}
+	if m != nil {
+		serveMetrics(*metricsAddr, m)
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+	tapper := tap.open()
+	defer tapper.close()
+	capture, err := openPcap(*pcapFile)
+	if err != nil {
+		fatal("failed to create the pcap file", "err", err)
+	}
+	defer closePcap(capture)
+	base := capture.context(context.Background())
+
+	in := os.Stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fatal(err.Error())
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var file *resultWriter
+	if export.active() {
+		if file, err = export.create(batchCSVHeader); err != nil {
+			fatal(err.Error())
+		}
+	}
+
+	jobs := make(chan batchJob)
+	results := make(chan batchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				results <- resolveBatchJob(base, r, job, *timeout, m, tapper)
+			}
+		}()
+	}
+	go func() {
+		if err := readBatchJobs(in, defaultType, jobs); err != nil {
+			slog.Error("reading input failed", "err", err)
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	// Results arrive in any order, hold them back until their turn
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	pending := map[int]batchResult{}
+	next := 0
+	for res := range results {
+		pending[res.index] = res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			switch {
+			case file != nil:
+				if err := file.write(newBatchJSON(res), batchCSVRows(res)); err != nil {
+					fatal("failed to write the results", "err", err)
+				}
+			case *jsonOut:
+				printBatchJSON(out, res)
+			default:
+				printBatchText(out, res)
+			}
+		}
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			fatal(err.Error())
+		}
+	}
+}
+
+// readBatchJobs sends a job for every non-empty, non-comment input line
+func readBatchJobs(in io.Reader, defaultType uint16, jobs chan<- batchJob) error {
+	scanner := bufio.NewScanner(in)
+	index := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		job := batchJob{index: index, name: fields[0], qtype: defaultType, typ: typeString(defaultType)}
+		if len(fields) > 1 {
+			job.typ = fields[1]
+			job.qtype, job.err = parseType(fields[1])
+		}
+		if ascii, err := toASCII(job.name); err != nil {
+			job.err = err
+		} else {
+			job.name = ascii
+		}
+		jobs <- job
+		index++
+	}
+	return scanner.Err()
+}
+
+func resolveBatchJob(base context.Context, r resolver.Resolver, job batchJob, timeout time.Duration, m *metrics, tap *dnstapLogger) batchResult {
+	res := batchResult{batchJob: job}
+	if job.err != nil {
+		return res
+	}
+	ctx, cancel := context.WithTimeout(resolver.WithTraceID(base, resolver.NewTraceID()), timeout)
+	defer cancel()
+	start := time.Now()
+	res.resp, res.err = r.Query(resolver.WithTrace(ctx, &res.trace), job.name, job.qtype)
+	m.observeQuery(job.qtype, res.resp, res.err, res.trace, time.Since(start))
+	if tap.sampled() {
+		query := resolver.NewQuery(job.name, job.qtype)
+		tap.log(dnstapMessage{typ: dnstapToolQuery, protocol: res.trace.Transport, responseAddr: res.trace.Server, queryTime: start, query: query})
+		if res.err == nil {
+			tap.log(dnstapMessage{typ: dnstapToolResponse, protocol: res.trace.Transport, responseAddr: res.trace.Server, queryTime: start, responseTime: time.Now(), query: query, response: res.resp})
+		}
+	}
+	if res.err != nil {
+		slog.DebugContext(ctx, "query failed", "line", job.index+1, "name", job.name, "type", job.typ, "err", res.err)
+	} else {
+		slog.DebugContext(ctx, "query answered", "line", job.index+1, "name", job.name, "type", job.typ, "rcode", dns.RcodeToString[res.resp.Rcode], "transport", res.trace.Transport, "rtt", res.trace.RTT)
+	}
+	return res
+}
+
+// printBatchText prints name, type, rcode and the answer data on one line
+func printBatchText(w io.Writer, res batchResult) {
+	if res.err != nil {
+		fmt.Fprintf(w, "%s\t%s\tERROR\t%v\n", res.name, res.typ, res.err)
+		return
+	}
+	var data []string
+	for _, rr := range res.resp.Answer {
+		data = append(data, typeString(rr.Header().Rrtype)+" "+strings.TrimSpace(rrData(rr)))
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", res.name, res.typ, dns.RcodeToString[res.resp.Rcode], strings.Join(data, ", "))
+}
+
+// newBatchJSON returns the -json line for res
+func newBatchJSON(res batchResult) batchJSON {
+	line := batchJSON{Name: res.name, Type: res.typ, ErrorClass: classify(res.resp, res.err).String()}
+	if res.err != nil {
+		line.Error = res.err.Error()
+	} else {
+		out := newJSONResponse(res.resp, res.trace)
+		line.jsonResponse = &out
+	}
+	return line
+}
+
+func printBatchJSON(w io.Writer, res batchResult) {
+	b, err := json.Marshal(newBatchJSON(res))
+	if err != nil {
+		fatal(err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+// batchCSVHeader names the columns of -o CSV files
+var batchCSVHeader = []string{"name", "type", "rcode", "error_class", "error", "server", "transport", "rtt_ms", "record_name", "record_type", "ttl", "data"}
+
+// batchCSVRows returns a CSV row per answer record of res, or one with the
+// record columns empty when it has none
+func batchCSVRows(res batchResult) [][]string {
+	if res.err != nil {
+		return [][]string{{res.name, res.typ, "", classify(nil, res.err).String(), res.err.Error(), "", "", "", "", "", "", ""}}
+	}
+	row := []string{res.name, res.typ, rcodeString(res.resp.Rcode), classify(res.resp, nil).String(), "", res.trace.Server, res.trace.Transport, fmt.Sprintf("%.3f", float64(res.trace.RTT.Microseconds())/1000)}
+	if len(res.resp.Answer) == 0 {
+		return [][]string{append(row, "", "", "", "")}
+	}
+	rows := make([][]string, len(res.resp.Answer))
+	for i, rr := range res.resp.Answer {
+		h := rr.Header()
+		rows[i] = append(row[:len(row):len(row)], h.Name, typeString(h.Rrtype), fmt.Sprint(h.Ttl), strings.TrimSpace(rrData(rr)))
+	}
+	return rows
+}
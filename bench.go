@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// benchQuery is one name to send in a benchmark
+type benchQuery struct {
+	name  string
+	qtype uint16
+}
+
+// benchStats collects the outcome of every benchmark query
+type benchStats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	rcodes    map[int]int
+	timeouts  int
+	errors    int
+}
+
+func (s *benchStats) record(resp *dns.Msg, err error, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, resolver.ErrTimeout):
+		s.timeouts++
+	case err != nil:
+		s.errors++
+	default:
+		s.latencies = append(s.latencies, latency)
+		s.rcodes[resp.Rcode]++
+	}
+}
+
+// runBench implements the bench subcommand: it sends queries at a steady
+// rate, or as fast as the workers can, for a while and reports throughput,
+// latency percentiles and failures, like a small dnsperf
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `server` to load, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for a server given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for a server given without one")
+	qps := fs.Float64("qps", 100, "send `n` queries per second, 0 sends as fast as the workers get answers")
+	duration := fs.Duration("duration", 10*time.Second, "send queries for this `duration`")
+	concurrency := fs.Int("concurrency", 32, "keep up to `n` queries outstanding")
+	timeout := fs.Duration("timeout", 5*time.Second, "count a query as timed out after this `duration`")
+	namesFile := fs.String("names", "", "take the names to query from `file`, one \"domain [type]\" per line, cycling through them (default random names under -domain)")
+	domain := fs.String("domain", "example.com", "with no -names, query random labels under this `domain`, which no cache can answer")
+	typeName := fs.String("type", "A", "record `type` for names that do not give one")
+	opts := options{keepalive: true}
+	opts.register(fs)
+	// A benchmark counts failures instead of hiding them behind retries
+	opts.retries = 0
+	fs.Lookup("retries").DefValue = "0"
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := cfg.apply(fs, "bench"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if fs.NArg() > 0 || *duration <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	qtype, err := parseType(*typeName)
+	if err != nil {
+		fatal(err.Error())
+	}
+	var queries []benchQuery
+	if *namesFile != "" {
+		if queries, err = readBenchNames(*namesFile, qtype); err != nil {
+			fatal(err.Error())
+		}
+	}
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	next := 0
+	nextQuery := func() benchQuery {
+		if len(queries) == 0 {
+			return benchQuery{name: fmt.Sprintf("%08x.%s", rand.Uint32(), dns.Fqdn(*domain)), qtype: qtype}
+		}
+		q := queries[next%len(queries)]
+		next++
+		return q
+	}
+
+	stats := &benchStats{rcodes: map[int]int{}}
+	jobs := make(chan benchQuery, *concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range jobs {
+				ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+				start := time.Now()
+				resp, err := r.Query(ctx, q.name, q.qtype)
+				stats.record(resp, err, time.Since(start))
+				cancel()
+				if err != nil {
+					slog.Debug("query failed", "name", q.name, "err", err)
+				}
+			}
+		}()
+	}
+
+	slog.Info("benchmark started", "server", upstreams[0].Addr, "qps", *qps, "duration", *duration, "concurrency", *concurrency)
+	start := time.Now()
+	sent, skipped := sendBenchQueries(jobs, nextQuery, *qps, *duration)
+	close(jobs)
+	wg.Wait()
+	printBenchReport(stats, sent, skipped, time.Since(start), *qps)
+}
+
+// sendBenchQueries feeds queries to the workers for duration, at qps per
+// second when it is positive. Queries that find every worker busy are
+// skipped rather than queued, so a slow server shows up as skipped sends
+// instead of a backlog. It returns the number sent and skipped.
+func sendBenchQueries(jobs chan<- benchQuery, next func() benchQuery, qps float64, duration time.Duration) (sent, skipped int) {
+	start := time.Now()
+	deadline := time.After(duration)
+	if qps <= 0 {
+		for {
+			select {
+			case <-deadline:
+				return sent, skipped
+			case jobs <- next():
+				sent++
+			}
+		}
+	}
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline:
+			return sent, skipped
+		case now := <-ticker.C:
+			due := int(now.Sub(start).Seconds()*qps) - sent - skipped
+			for ; due > 0; due-- {
+				select {
+				case jobs <- next():
+					sent++
+				default:
+					skipped++
+				}
+			}
+		}
+	}
+}
+
+// readBenchNames reads "domain [type]" lines, skipping blank lines and
+// comments
+func readBenchNames(path string, defaultType uint16) ([]benchQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var queries []benchQuery
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name, err := toASCII(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		q := benchQuery{name: name, qtype: defaultType}
+		if len(fields) > 1 {
+			if q.qtype, err = parseType(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		}
+		queries = append(queries, q)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("%s holds no names", path)
+	}
+	return queries, nil
+}
+
+// printBenchReport prints the benchmark summary
+func printBenchReport(s *benchStats, sent, skipped int, elapsed time.Duration, qps float64) {
+	completed := len(s.latencies)
+	percent := func(n int) float64 {
+		if sent == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(sent)
+	}
+
+	fmt.Printf("Queries sent:       %d\n", sent)
+	fmt.Printf("Queries completed:  %d (%.2f%%)\n", completed, percent(completed))
+	fmt.Printf("Queries timed out:  %d (%.2f%%)\n", s.timeouts, percent(s.timeouts))
+	fmt.Printf("Queries failed:     %d (%.2f%%)\n", s.errors, percent(s.errors))
+	if skipped > 0 {
+		fmt.Printf("Sends skipped:      %d (all workers busy, raise -concurrency or lower -qps)\n", skipped)
+	}
+	fmt.Printf("Run time:           %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput:         %.1f answers/s", float64(completed)/elapsed.Seconds())
+	if qps > 0 {
+		fmt.Printf(" (%.1f/s asked for)", qps)
+	}
+	fmt.Println()
+
+	if completed == 0 {
+		return
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	var total time.Duration
+	for _, l := range s.latencies {
+		total += l
+	}
+	pct := func(p float64) time.Duration {
+		return s.latencies[min(completed-1, int(p*float64(completed)))].Round(time.Microsecond)
+	}
+	fmt.Printf("Latency:            min %v, mean %v, max %v\n", s.latencies[0].Round(time.Microsecond), (total / time.Duration(completed)).Round(time.Microsecond), s.latencies[completed-1].Round(time.Microsecond))
+	fmt.Printf("Percentiles:        p50 %v, p90 %v, p99 %v, p99.9 %v\n", pct(0.5), pct(0.9), pct(0.99), pct(0.999))
+
+	rcodes := make([]int, 0, len(s.rcodes))
+	for rcode := range s.rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Ints(rcodes)
+	parts := make([]string, len(rcodes))
+	for i, rcode := range rcodes {
+		parts[i] = fmt.Sprintf("%s %d (%.2f%%)", rcodeString(rcode), s.rcodes[rcode], 100*float64(s.rcodes[rcode])/float64(completed))
+	}
+	fmt.Printf("Response codes:     %s\n", strings.Join(parts, ", "))
+}
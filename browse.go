@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// serviceTypesName is the meta-query that lists the service types of a
+// domain (RFC 6763 section 9)
+const serviceTypesName = "_services._dns-sd._udp"
+
+// browseInstance is one instance of a service, as its SRV and TXT records
+// describe it
+type browseInstance struct {
+	Name      string         `json:"name"`     // the instance's full name
+	Instance  string         `json:"instance"` // its label, unescaped
+	Target    string         `json:"target,omitempty"`
+	Port      uint16         `json:"port,omitempty"`
+	Priority  uint16         `json:"priority"`
+	Weight    uint16         `json:"weight"`
+	Addresses []string       `json:"addresses,omitempty"`
+	TXT       map[string]any `json:"txt,omitempty"` // a string value, or true for a key without one
+	Error     string         `json:"error,omitempty"`
+}
+
+// browseService is a service type and the instances found for it
+type browseService struct {
+	Type      string           `json:"type"`
+	Instances []browseInstance `json:"instances"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// browseJSON is the -json rendering of the browse subcommand
+type browseJSON struct {
+	Domain   string          `json:"domain"`
+	Services []browseService `json:"services"`
+}
+
+// runBrowse implements the browse subcommand: DNS-Based Service Discovery
+// (RFC 6763). It lists the service types of a domain, or takes one type,
+// then the instances of each type with their SRV target, addresses and TXT
+// attributes. The local domain is browsed over multicast DNS, others over
+// unicast DNS. It exits with status 1 when no instance is found.
+func runBrowse(args []string) {
+	fs := flag.NewFlagSet("browse", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json, odoh or mdns (default mdns for the local domain, else udp)")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	domainFlag := fs.String("domain", "local", "browse the services of this `domain`")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each lookup after this `duration`")
+	jsonOut := fs.Bool("json", false, "print the services and their instances as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s browse [flags] [service type]\n\nWithout a service type, such as _ipp._tcp, every type the domain lists is browsed.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "browse"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	domain, err := toASCII(*domainFlag)
+	if err != nil {
+		fatal(err.Error())
+	}
+	domain = dns.Fqdn(domain)
+	if *method == "" {
+		*method = "udp"
+		if *serverFlag == "" && isLocalName(domain) {
+			*method = "mdns"
+		}
+	}
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+	l := &srvLookup{r: r, timeout: *timeout}
+
+	var types []string
+	if len(args) == 1 {
+		types = []string{dns.Fqdn(strings.TrimSuffix(args[0], ".") + "." + domain)}
+		if dns.IsSubDomain(domain, dns.Fqdn(args[0])) {
+			types[0] = dns.Fqdn(args[0])
+		}
+	} else if types, err = l.serviceTypes(domain); err != nil {
+		fatal("service type lookup failed", "domain", domain, "err", err)
+	}
+
+	out := browseJSON{Domain: domain, Services: make([]browseService, len(types))}
+	var wg sync.WaitGroup
+	for i, t := range types {
+		out.Services[i].Type = t
+		wg.Add(1)
+		go func(s *browseService) {
+			defer wg.Done()
+			instances, err := l.browse(s.Type)
+			s.Instances = instances
+			if err != nil {
+				s.Error = err.Error()
+			}
+		}(&out.Services[i])
+	}
+	wg.Wait()
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printBrowse(out)
+	}
+	for _, s := range out.Services {
+		if len(s.Instances) > 0 {
+			return
+		}
+	}
+	os.Exit(1)
+}
+
+// lookup queries name for qtype, failing on an error rcode
+func (l *srvLookup) lookup(name string, qtype uint16) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	resp, err := l.r.Query(resolver.WithTraceID(ctx, resolver.NewTraceID()), name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s", rcodeString(resp.Rcode))
+	}
+	return resp, nil
+}
+
+// serviceTypes returns the service types domain lists, sorted
+func (l *srvLookup) serviceTypes(domain string) ([]string, error) {
+	resp, err := l.lookup(serviceTypesName+"."+domain, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	return ptrTargets(resp), nil
+}
+
+// browse returns the instances of the service type, sorted by name. An
+// answer from multicast DNS usually carries their SRV, TXT and address
+// records along, the rest are asked for.
+func (l *srvLookup) browse(serviceType string) ([]browseInstance, error) {
+	resp, err := l.lookup(serviceType, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	names := ptrTargets(resp)
+	instances := make([]browseInstance, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		instances[i].Name, instances[i].Instance = name, instanceLabel(name)
+		wg.Add(1)
+		go func(in *browseInstance) {
+			defer wg.Done()
+			l.describe(in, resp.Extra)
+		}(&instances[i])
+	}
+	wg.Wait()
+	return instances, nil
+}
+
+// describe fills in the SRV and TXT data of an instance and the addresses
+// of its target, from extra where it has them
+func (l *srvLookup) describe(in *browseInstance, extra []dns.RR) {
+	var errs []string
+	srv, txt := instanceRecords(extra, in.Name)
+	if srv == nil {
+		resp, err := l.lookup(in.Name, dns.TypeSRV)
+		if err != nil {
+			errs = append(errs, "SRV: "+err.Error())
+		} else {
+			extra = append(extra[:len(extra):len(extra)], resp.Extra...)
+			srv, _ = instanceRecords(resp.Answer, in.Name)
+		}
+	}
+	if txt == nil {
+		resp, err := l.lookup(in.Name, dns.TypeTXT)
+		if err != nil {
+			errs = append(errs, "TXT: "+err.Error())
+		} else {
+			_, txt = instanceRecords(resp.Answer, in.Name)
+		}
+	}
+	if txt != nil {
+		in.TXT = txtAttributes(txt.Txt)
+	}
+	if srv != nil {
+		in.Target, in.Port, in.Priority, in.Weight = srv.Target, srv.Port, srv.Priority, srv.Weight
+		addrs, err := l.addresses(extra, srv.Target)
+		in.Addresses = addrs
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	in.Error = strings.Join(errs, ", ")
+}
+
+// ptrTargets returns the names the PTR answers of resp point to, sorted
+// and without duplicates
+func ptrTargets(resp *dns.Msg) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, rr := range resp.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok && !seen[strings.ToLower(ptr.Ptr)] {
+			seen[strings.ToLower(ptr.Ptr)] = true
+			names = append(names, ptr.Ptr)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// instanceRecords picks the SRV and TXT records of name out of rrs
+func instanceRecords(rrs []dns.RR, name string) (*dns.SRV, *dns.TXT) {
+	var srv *dns.SRV
+	var txt *dns.TXT
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.SRV:
+			if srv == nil {
+				srv = rr
+			}
+		case *dns.TXT:
+			if txt == nil {
+				txt = rr
+			}
+		}
+	}
+	return srv, txt
+}
+
+// txtAttributes decodes the key/value strings of a DNS-SD TXT record (RFC
+// 6763 section 6): "key=value" gives a value, possibly empty, and "key"
+// alone is a boolean. Keys are case insensitive and the first of a key
+// counts.
+func txtAttributes(strs []string) map[string]any {
+	attrs := make(map[string]any)
+	for _, s := range strs {
+		s = unescapeTXT(s)
+		key, value, hasValue := strings.Cut(s, "=")
+		key = strings.ToLower(key)
+		if key == "" {
+			continue
+		}
+		if _, ok := attrs[key]; ok {
+			continue
+		}
+		if hasValue {
+			attrs[key] = value
+		} else {
+			attrs[key] = true
+		}
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	return attrs
+}
+
+// unescapeTXT undoes the presentation format escapes miekg/dns puts in TXT
+// strings, \" and \\ and \DDD
+func unescapeTXT(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			b.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		i++
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// instanceLabel returns the first label of an instance name, such as
+// "Office Printer" in Office\032Printer._ipp._tcp.local.
+func instanceLabel(name string) string {
+	end := len(name)
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' {
+			i++
+		} else if name[i] == '.' {
+			end = i
+			break
+		}
+	}
+	return unescapeTXT(name[:end])
+}
+
+// printBrowse prints each service type with one line per instance: its
+// name, target, addresses and TXT attributes
+func printBrowse(out browseJSON) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, s := range out.Services {
+		fmt.Fprintln(w, s.Type)
+		if s.Error != "" {
+			fmt.Fprintf(w, "  ;; %s\n", s.Error)
+		}
+		for _, in := range s.Instances {
+			target := ""
+			if in.Target != "" {
+				target = net.JoinHostPort(strings.TrimSuffix(in.Target, "."), strconv.Itoa(int(in.Port)))
+			}
+			line := fmt.Sprintf("  %s\t%s\t%s\t%s", in.Instance, target, strings.Join(in.Addresses, ", "), formatTXT(in.TXT))
+			if in.Error != "" {
+				line += "\t;; " + in.Error
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+	w.Flush()
+	if len(out.Services) == 0 {
+		fmt.Printf(";; no services in %s\n", out.Domain)
+	}
+}
+
+// formatTXT prints TXT attributes as sorted key=value pairs, quoting
+// values that are not plain words
+func formatTXT(attrs map[string]any) string {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		value, ok := attrs[key].(string)
+		switch {
+		case !ok:
+			parts[i] = key
+		case value == "" || strings.ContainsAny(value, " \"\\") || strconv.Quote(value) != `"`+value+`"`:
+			parts[i] = key + "=" + strconv.Quote(value)
+		default:
+			parts[i] = key + "=" + value
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// caaCritical is the issuer critical flag of a CAA record
+const caaCritical = 128
+
+// caaIssuer is a CA allowed to issue by an issue or issuewild record, with
+// the parameters that restrict it, such as accounturi and validationmethods
+type caaIssuer struct {
+	Domain     string            `json:"domain"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// caaPolicy is the CAA policy in effect for a name, also the -json
+// rendering of the caa subcommand
+type caaPolicy struct {
+	Name     string      `json:"name"`
+	Found    string      `json:"found,omitempty"` // the name the records were found at
+	Records  []string    `json:"records"`
+	Issue    []caaIssuer `json:"issue"`    // for certificates of the name, nil when any CA may issue
+	Wildcard []caaIssuer `json:"wildcard"` // for wildcard certificates
+	IODEF    []string    `json:"iodef,omitempty"`
+	Blocked  string      `json:"blocked,omitempty"` // why no CA may issue at all
+	// Whether -ca may issue, when given
+	CA        string `json:"ca,omitempty"`
+	Permitted *bool  `json:"permitted,omitempty"`
+}
+
+// runCAA implements the caa subcommand: it climbs from the name towards the
+// root to the first CAA records as RFC 8659 section 3 describes, and reports
+// which CAs they allow to issue certificates and wildcard certificates, and
+// where incident reports go. With -ca it exits with status 1 unless that CA
+// may issue.
+func runCAA(args []string) {
+	fs := flag.NewFlagSet("caa", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each lookup after this `duration`")
+	ca := fs.String("ca", "", "check whether the CA with this issuer `domain`, such as letsencrypt.org, may issue for the name")
+	jsonOut := fs.Bool("json", false, "print the policy as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s caa [flags] <domain>\n\nA domain given as *.name is checked for a wildcard certificate.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "caa"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name, wildcard := strings.CutPrefix(args[0], "*.")
+	name, err := toASCII(name)
+	if err != nil {
+		fatal(err.Error())
+	}
+	name = dns.Fqdn(name)
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	records, found, err := findCAA(r, name, *timeout)
+	if err != nil {
+		// A CA that cannot look the records up must not issue either
+		fatal("CAA lookup failed", "name", name, "err", err)
+	}
+	policy := newCAAPolicy(name, found, records)
+	if wildcard {
+		policy.Name = "*." + name
+	}
+	if *ca != "" {
+		permitted := policy.permits(*ca, wildcard)
+		policy.CA, policy.Permitted = strings.ToLower(*ca), &permitted
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(policy); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printCAAPolicy(policy)
+	}
+	if policy.Permitted != nil && !*policy.Permitted {
+		os.Exit(1)
+	}
+}
+
+// findCAA returns the first CAA records found at name or above it, and the
+// name they were found at. Aliases are followed by the resolver, so records
+// at the target of a CNAME count for the name.
+func findCAA(r resolver.Resolver, name string, timeout time.Duration) ([]*dns.CAA, string, error) {
+	for current := name; current != "."; current = parentName(current) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp, err := r.Query(resolver.WithTraceID(ctx, resolver.NewTraceID()), current, dns.TypeCAA)
+		cancel()
+		if err != nil {
+			return nil, "", err
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			return nil, "", fmt.Errorf("CAA lookup of %s: %s", current, rcodeString(resp.Rcode))
+		}
+		var records []*dns.CAA
+		for _, rr := range resp.Answer {
+			if caa, ok := rr.(*dns.CAA); ok {
+				records = append(records, caa)
+			}
+		}
+		if len(records) > 0 {
+			return records, current, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// newCAAPolicy works out who may issue from the records found
+func newCAAPolicy(name, found string, records []*dns.CAA) *caaPolicy {
+	p := &caaPolicy{Name: name, Found: found, Records: []string{}}
+	var issue, wildcard []caaIssuer
+	var hasIssue, hasWildcard bool
+	for _, rr := range records {
+		p.Records = append(p.Records, rr.String())
+		switch strings.ToLower(rr.Tag) {
+		case "issue":
+			hasIssue = true
+			if issuer, ok := parseCAAIssuer(rr.Value); ok {
+				issue = append(issue, issuer)
+			}
+		case "issuewild":
+			hasWildcard = true
+			if issuer, ok := parseCAAIssuer(rr.Value); ok {
+				wildcard = append(wildcard, issuer)
+			}
+		case "iodef":
+			p.IODEF = append(p.IODEF, rr.Value)
+		default:
+			if rr.Flag&caaCritical != 0 && p.Blocked == "" {
+				p.Blocked = fmt.Sprintf("the critical property %q is not understood", rr.Tag)
+			}
+		}
+	}
+	// Set but empty means no CA, unlike nil for no restriction. Without issue
+	// records any CA may issue, and issuewild records replace them for
+	// wildcards (RFC 8659 sections 4.2 and 4.3).
+	if hasIssue {
+		p.Issue = append([]caaIssuer{}, issue...)
+	}
+	p.Wildcard = p.Issue
+	if hasWildcard {
+		p.Wildcard = append([]caaIssuer{}, wildcard...)
+	}
+	if p.Blocked != "" {
+		p.Issue, p.Wildcard = []caaIssuer{}, []caaIssuer{}
+	}
+	return p
+}
+
+// parseCAAIssuer splits an issue or issuewild value into the issuer domain
+// and its parameters. The value ";" names no issuer at all.
+func parseCAAIssuer(value string) (caaIssuer, bool) {
+	domain, rest, _ := strings.Cut(value, ";")
+	issuer := caaIssuer{Domain: strings.ToLower(strings.TrimSpace(domain))}
+	if issuer.Domain == "" {
+		return issuer, false
+	}
+	for _, param := range strings.Split(rest, ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		if issuer.Parameters == nil {
+			issuer.Parameters = map[string]string{}
+		}
+		issuer.Parameters[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return issuer, true
+}
+
+// permits reports whether the CA with issuer domain ca may issue
+func (p *caaPolicy) permits(ca string, wildcard bool) bool {
+	issuers := p.Issue
+	if wildcard {
+		issuers = p.Wildcard
+	}
+	if issuers == nil {
+		return p.Blocked == ""
+	}
+	ca = strings.TrimSuffix(strings.ToLower(ca), ".")
+	for _, issuer := range issuers {
+		if issuer.Domain == ca {
+			return true
+		}
+	}
+	return false
+}
+
+// printCAAPolicy prints the records and what they mean
+func printCAAPolicy(p *caaPolicy) {
+	if p.Found == "" {
+		fmt.Printf("No CAA records for %s or its parents, any CA may issue\n", toUnicode(p.Name))
+	} else {
+		fmt.Printf("CAA records for %s, found at %s:\n", toUnicode(p.Name), toUnicode(p.Found))
+		for _, record := range p.Records {
+			fmt.Println(record)
+		}
+		fmt.Println()
+		if p.Blocked != "" {
+			fmt.Println("No CA may issue: " + p.Blocked)
+		} else {
+			fmt.Println("Certificates: " + describeIssuers(p.Issue))
+			fmt.Println("Wildcard certificates: " + describeIssuers(p.Wildcard))
+		}
+		if len(p.IODEF) > 0 {
+			fmt.Println("Incident reports: " + strings.Join(p.IODEF, ", "))
+		}
+	}
+	if p.Permitted != nil {
+		verdict := "may"
+		if !*p.Permitted {
+			verdict = "may not"
+		}
+		fmt.Printf("%s %s issue for %s\n", p.CA, verdict, toUnicode(p.Name))
+	}
+}
+
+// describeIssuers lists the issuers with their parameters
+func describeIssuers(issuers []caaIssuer) string {
+	switch {
+	case issuers == nil:
+		return "any CA"
+	case len(issuers) == 0:
+		return "no CA"
+	}
+	var names []string
+	for _, issuer := range issuers {
+		name := issuer.Domain
+		for _, key := range sortedKeys(issuer.Parameters) {
+			name += fmt.Sprintf(" %s=%s", key, issuer.Parameters[key])
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// maxClientBuckets is how many clients the rate limiter tracks before it
+// forgets those whose buckets have refilled
+const maxClientBuckets = 100000
+
+// clientLimits keeps the forwarder to the clients it is meant for, with
+// lists of networks to allow and deny and a token bucket per client
+// address. A nil *clientLimits admits every query.
+type clientLimits struct {
+	allow, deny []*net.IPNet
+	rate        float64 // tokens added per second, 0 for no rate limit
+	burst       float64 // tokens a bucket holds
+	drop        bool    // drop queries that are not admitted instead of REFUSED
+	metrics     *metrics
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills b at rate tokens per second up to burst and takes one token
+// if there is one
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// newClientLimits returns the limits for the comma separated allow and
+// deny networks, rate queries per second per client and burst, or nil
+// when there are none
+func newClientLimits(allow, deny string, rate float64, burst int, response string) (*clientLimits, error) {
+	if allow == "" && deny == "" && rate <= 0 {
+		return nil, nil
+	}
+	l := &clientLimits{rate: rate, burst: float64(burst), buckets: map[string]*tokenBucket{}}
+	var err error
+	if l.allow, err = parseNetworks(allow); err != nil {
+		return nil, fmt.Errorf("-allow-clients: %v", err)
+	}
+	if l.deny, err = parseNetworks(deny); err != nil {
+		return nil, fmt.Errorf("-deny-clients: %v", err)
+	}
+	if l.burst < 1 {
+		l.burst = max(1, rate)
+	}
+	switch strings.ToLower(response) {
+	case "refused":
+	case "drop":
+		l.drop = true
+	default:
+		return nil, fmt.Errorf("invalid limit response %q, use refused or drop", response)
+	}
+	return l, nil
+}
+
+// parseNetworks parses a comma separated list of CIDR networks and bare
+// addresses
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit returns why a query from ip is not admitted, "acl" or "rate", or ""
+// when it is
+func (l *clientLimits) admit(ip net.IP, now time.Time) string {
+	if l == nil {
+		return ""
+	}
+	if ip == nil || containsIP(l.deny, ip) || len(l.allow) > 0 && !containsIP(l.allow, ip) {
+		return "acl"
+	}
+	if l.rate <= 0 {
+		return ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := ip.String()
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= maxClientBuckets {
+			l.forget(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if !b.take(now, l.rate, l.burst) {
+		return "rate"
+	}
+	return ""
+}
+
+// forget drops the buckets that have refilled, which are the same as new
+// ones. The caller holds l.mu.
+func (l *clientLimits) forget(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ServeDNS implements resolver.Handler, answering the queries that are not
+// admitted REFUSED or dropping them
+func (l *clientLimits) ServeDNS(ctx context.Context, req *resolver.Request, next resolver.Next) (*dns.Msg, error) {
+	reason := l.admit(req.ClientIP(), time.Now())
+	if reason == "" {
+		return next(ctx, req)
+	}
+	slog.DebugContext(ctx, "query refused", "client", req.Client.String(), "reason", reason)
+	l.metrics.observeRefused(reason)
+	if l.drop {
+		return nil, nil
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(req.Msg, dns.RcodeRefused)
+	return resp, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// compareResult is the answer one server gave in compare mode
+type compareResult struct {
+	server  string
+	resp    *dns.Msg
+	err     error
+	rtt     time.Duration
+	answers []string // "TYPE data" of each answer record, sorted
+	ttl     uint32   // smallest answer TTL
+}
+
+// outcome is the rcode of the response, or ERROR when there was none
+func (r compareResult) outcome() string {
+	if r.err != nil {
+		return "ERROR"
+	}
+	return rcodeString(r.resp.Rcode)
+}
+
+// runCompare implements the compare subcommand: it sends one query to
+// several servers at once and reports where their rcodes, answers and TTLs
+// disagree, which shows censorship, split horizon setups and secondaries
+// that missed an update. It exits with status 1 when they disagree.
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers` to compare, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	typeName := fs.String("type", "A", "record `type` to query")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each server after this `duration`")
+	ttlSlack := fs.Uint("ttl-slack", 60, "ignore TTL differences up to `n` seconds, as caches count TTLs down")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compare [flags] -server <servers> <domain> [type]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "compare"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) < 1 || len(args) > 2 || *serverFlag == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if len(args) == 2 {
+		*typeName = args[1]
+	}
+	qtype, err := parseType(*typeName)
+	if err != nil {
+		fatal(err.Error())
+	}
+	domain, err := toASCII(args[0])
+	if err != nil {
+		fatal(err.Error())
+	}
+	upstreams, err := parseUpstreams(*method, *serverFlag, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if len(upstreams) < 2 {
+		fatal("compare needs at least two servers")
+	}
+
+	// Each server is asked on its own, retries only go back to the same one
+	results := make([]compareResult, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		r, err := opts.buildResolver([]upstream{u})
+		if err != nil {
+			fatal(err.Error())
+		}
+		results[i].server = upstreamLabel(u)
+		wg.Add(1)
+		go func(res *compareResult) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			var trace resolver.Trace
+			res.resp, res.err = r.Query(resolver.WithTrace(ctx, &trace), domain, qtype)
+			res.rtt = trace.RTT
+			if res.err == nil {
+				res.answers, res.ttl = answerSet(res.resp)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	printCompareTable(results)
+	diffs := compareDiffs(results, uint32(*ttlSlack))
+	if len(diffs) == 0 {
+		fmt.Println("\nAll servers agree")
+		return
+	}
+	fmt.Println()
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	os.Exit(1)
+}
+
+// upstreamLabel names an upstream the way it would be given to -server
+func upstreamLabel(u upstream) string {
+	switch u.Method {
+	case "http", "dnscrypt":
+		return u.Addr
+	case "json":
+		return "https+json://" + strings.TrimPrefix(u.Addr, "https://")
+	case "odoh":
+		return "odoh://" + strings.TrimPrefix(u.Addr, "https://")
+	}
+	return u.Method + "://" + u.Addr
+}
+
+// answerSet returns the answer records of resp as sorted "TYPE data"
+// strings, leaving out TTLs and signatures, and the smallest TTL among them
+func answerSet(resp *dns.Msg) ([]string, uint32) {
+	var answers []string
+	var ttl uint32
+	for i, rr := range resp.Answer {
+		h := rr.Header()
+		if i == 0 || h.Ttl < ttl {
+			ttl = h.Ttl
+		}
+		if h.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		answers = append(answers, typeString(h.Rrtype)+" "+strings.TrimSpace(rrData(rr)))
+	}
+	sort.Strings(answers)
+	return answers, ttl
+}
+
+// printCompareTable prints one line per server with its outcome
+func printCompareTable(results []compareResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tRCODE\tTIME\tTTL\tANSWER")
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(w, "%s\tERROR\t-\t-\t%v\n", r.server, r.err)
+			continue
+		}
+		answers, ttl := "-", "-"
+		if len(r.answers) > 0 {
+			answers = strings.Join(r.answers, ", ")
+			ttl = fmt.Sprint(r.ttl)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\n", r.server, r.outcome(), r.rtt.Round(time.Microsecond), ttl, answers)
+	}
+	w.Flush()
+}
+
+// compareDiffs describes where the results disagree: the rcodes, the answer
+// sets of the servers that answered, and the TTLs of identical answers
+// differing by more than slack
+func compareDiffs(results []compareResult, slack uint32) []string {
+	var diffs []string
+
+	byOutcome := groupResults(results, func(r compareResult) (string, bool) { return r.outcome(), true })
+	if len(byOutcome) > 1 {
+		diffs = append(diffs, "! rcodes differ:"+describeGroups(byOutcome))
+	}
+
+	byAnswers := groupResults(results, func(r compareResult) (string, bool) {
+		return strings.Join(r.answers, ", "), r.err == nil && r.resp.Rcode == dns.RcodeSuccess
+	})
+	if len(byAnswers) > 1 {
+		diffs = append(diffs, "! answers differ:"+describeGroups(byAnswers))
+	}
+
+	for _, g := range byAnswers {
+		if g.key == "" {
+			continue
+		}
+		lo, hi := g.results[0].ttl, g.results[0].ttl
+		for _, r := range g.results[1:] {
+			lo, hi = min(lo, r.ttl), max(hi, r.ttl)
+		}
+		if hi-lo <= slack {
+			continue
+		}
+		byTTL := groupResults(g.results, func(r compareResult) (string, bool) { return fmt.Sprint(r.ttl), true })
+		diffs = append(diffs, fmt.Sprintf("! TTLs of %s differ by %ds:%s", g.key, hi-lo, describeGroups(byTTL)))
+	}
+	return diffs
+}
+
+// resultGroup is the servers that share a value
+type resultGroup struct {
+	key     string
+	results []compareResult
+}
+
+// groupResults groups the results by key, skipping those key does not
+// apply to, in the order each value was first seen
+func groupResults(results []compareResult, key func(compareResult) (string, bool)) []resultGroup {
+	var groups []resultGroup
+	index := map[string]int{}
+	for _, r := range results {
+		k, ok := key(r)
+		if !ok {
+			continue
+		}
+		i, seen := index[k]
+		if !seen {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, resultGroup{key: k})
+		}
+		groups[i].results = append(groups[i].results, r)
+	}
+	return groups
+}
+
+// describeGroups lists each value and the servers that gave it, one per line
+func describeGroups(groups []resultGroup) string {
+	var b strings.Builder
+	for _, g := range groups {
+		servers := make([]string, len(g.results))
+		for i, r := range g.results {
+			servers[i] = r.server
+		}
+		key := g.key
+		if key == "" {
+			key = "no answer"
+		}
+		fmt.Fprintf(&b, "\n    %s from %s", key, strings.Join(servers, ", "))
+	}
+	return b.String()
+}
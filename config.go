@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the -config flag. The file is YAML and sets defaults for
+// the flags of every command:
+//
+//	timeout: 3s
+//	tls:
+//	  ca: /etc/ssl/lab-ca.pem   # -tls-ca
+//	upstreams:
+//	  cloudflare: [https://cloudflare-dns.com/dns-query, tls://1.1.1.1]
+//	serve:
+//	  listen: 127.0.0.1:5353
+//	  upstream: cloudflare
+//
+// Keys are flag names. Top-level keys apply to every command that has the
+// flag, a section named after a command (query for plain lookups) applies to
+// that command only, and other nested keys are joined to their parent with
+// a dash. Lists become comma separated values. Names from upstreams can be
+// given wherever a server list is expected. Flags given on the command line
+// override the file.
+type configFile struct {
+	path string
+}
+
+// register adds the -config flag to fs
+func (c *configFile) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.path, "config", "", "read flag defaults and upstream groups from this YAML `file` (default tmp-dns/config.yaml in the user config directory, if it exists)")
+}
+
+// apply reads the file and sets the flags of fs it names that were not given
+// on the command line, then expands upstream group names in -server and
+// -upstream
+func (c *configFile) apply(fs *flag.FlagSet, command string) error {
+	return c.load(fs, command, givenFlags(fs))
+}
+
+// reload reads the file again for a command that is running: the flags
+// given on the command line keep their values and the others go back to
+// their defaults before taking those of the file, so that settings removed
+// from it are undone. It returns the names of the flags whose values
+// changed, and leaves them all as they were when the file is invalid.
+func (c *configFile) reload(fs *flag.FlagSet, command string, given map[string]bool) ([]string, error) {
+	before := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) { before[f.Name] = f.Value.String() })
+	restore := func() {
+		for name, value := range before {
+			fs.Set(name, value)
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !given[f.Name] {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	if err := c.load(fs, command, given); err != nil {
+		restore()
+		return nil, err
+	}
+	var changed []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() != before[f.Name] {
+			changed = append(changed, f.Name)
+		}
+	})
+	return changed, nil
+}
+
+// givenFlags returns the names of the flags of fs that were set, which
+// before apply are those given on the command line
+func givenFlags(fs *flag.FlagSet) map[string]bool {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	return given
+}
+
+// load sets the flags of fs the file names, except those in given
+func (c *configFile) load(fs *flag.FlagSet, command string, given map[string]bool) error {
+	path := c.path
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(dir, "tmp-dns", "config.yaml")
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	groups := map[string]string{}
+	if raw, ok := doc["upstreams"]; ok {
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: upstreams must map group names to server lists", path)
+		}
+		for name, servers := range m {
+			groups[name] = configValue(servers)
+		}
+		delete(doc, "upstreams")
+	}
+
+	section, _ := doc[command].(map[string]any)
+	delete(doc, command)
+	settings := map[string]string{}
+	flattenConfig(doc, "", settings)
+	local := map[string]string{}
+	flattenConfig(section, "", local)
+	// Top-level keys may belong to other commands, the section's may not
+	for _, name := range sortedKeys(local) {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: %s has no -%s flag", path, command, name)
+		}
+		settings[name] = local[name]
+	}
+
+	for _, name := range sortedKeys(settings) {
+		if given[name] || fs.Lookup(name) == nil || name == "config" {
+			continue
+		}
+		if err := fs.Set(name, settings[name]); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s: %v", path, settings[name], name, err)
+		}
+	}
+
+	for _, name := range []string{"server", "upstream"} {
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		servers := strings.Split(f.Value.String(), ",")
+		for i, s := range servers {
+			if group, ok := groups[strings.TrimSpace(s)]; ok {
+				servers[i] = group
+			}
+		}
+		if expanded := strings.Join(servers, ","); expanded != f.Value.String() {
+			fs.Set(name, expanded)
+		}
+	}
+	// The servers of a serve -route rule are joined with + instead
+	if f := fs.Lookup("route"); f != nil {
+		rules := strings.Split(f.Value.String(), ",")
+		for i, rule := range rules {
+			zone, servers, _ := strings.Cut(rule, "=")
+			if group, ok := groups[strings.TrimSpace(servers)]; ok {
+				rules[i] = zone + "=" + strings.ReplaceAll(group, ",", "+")
+			}
+		}
+		if expanded := strings.Join(rules, ","); expanded != f.Value.String() {
+			fs.Set("route", expanded)
+		}
+	}
+	return nil
+}
+
+// flattenConfig adds the settings of m to out, naming nested keys
+// parent-key
+func flattenConfig(m map[string]any, prefix string, out map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if nested, ok := m[k].(map[string]any); ok {
+			flattenConfig(nested, prefix+k+"-", out)
+			continue
+		}
+		out[prefix+k] = configValue(m[k])
+	}
+}
+
+// configValue formats a YAML value as a flag value, joining lists with
+// commas
+func configValue(v any) string {
+	list, ok := v.([]any)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	parts := make([]string, len(list))
+	for i, item := range list {
+		parts[i] = fmt.Sprint(item)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// TLSA certificate usages, selectors and matching types (RFC 7218 names)
+var (
+	tlsaUsages    = map[uint8]string{0: "PKIX-TA", 1: "PKIX-EE", 2: "DANE-TA", 3: "DANE-EE"}
+	tlsaSelectors = map[uint8]string{0: "Cert", 1: "SPKI"}
+	tlsaMatching  = map[uint8]string{0: "Full", 1: "SHA2-256", 2: "SHA2-512"}
+)
+
+// tlsaResult is one TLSA record and whether the server's chain satisfies it
+type tlsaResult struct {
+	Record  string `json:"record"`
+	Meaning string `json:"meaning"`
+	Match   bool   `json:"match"`
+	Reason  string `json:"reason"`
+}
+
+// daneResult is the outcome of the dane subcommand, also its -json rendering
+type daneResult struct {
+	Name    string       `json:"name"`
+	Address string       `json:"address"`
+	DNSSEC  string       `json:"dnssec"`
+	Records []tlsaResult `json:"records"`
+	Chain   []string     `json:"chain"`
+	Pass    bool         `json:"pass"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// runDANE implements the dane subcommand: it looks up the TLSA records of a
+// TLS service, connects to it and checks the certificate chain it presents
+// against each record's usage, selector and matching type (RFC 6698, RFC
+// 7671). The TLSA records must validate with DNSSEC, as DANE means nothing
+// without it. It exits with status 1 unless a record matches.
+func runDANE(args []string) {
+	fs := flag.NewFlagSet("dane", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "DNS server `port` for servers given without one")
+	timeout := fs.Duration("timeout", 10*time.Second, "give up on the lookups and the TLS handshake after this `duration`")
+	starttls := fs.String("starttls", "", "upgrade a plain text `protocol` connection with STARTTLS first, only smtp is supported")
+	anchorFile := fs.String("anchor", "", "read DNSSEC trust anchors (DS or DNSKEY records) from `file` instead of the stored root anchors")
+	skipDNSSEC := fs.Bool("skip-dnssec", false, "accept TLSA records that do not validate with DNSSEC (for testing only)")
+	jsonOut := fs.Bool("json", false, "print the result as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s dane [flags] <host>[:port]\n\nThe port defaults to 443, or 25 with -starttls smtp.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "dane"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *starttls != "" && *starttls != "smtp" {
+		fatal(fmt.Sprintf("unsupported -starttls protocol %q, only smtp is supported", *starttls))
+	}
+	host, service := args[0], "443"
+	if *starttls == "smtp" {
+		service = "25"
+	}
+	if h, p, err := net.SplitHostPort(args[0]); err == nil {
+		host, service = h, p
+	}
+	if _, err := strconv.ParseUint(service, 10, 16); err != nil {
+		fatal(fmt.Sprintf("invalid port %q", service))
+	}
+	host, err := toASCII(host)
+	if err != nil {
+		fatal(err.Error())
+	}
+	host = dns.Fqdn(host)
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	anchors, err := trustAnchors(ctx, r, *anchorFile)
+	if err != nil {
+		fatal("failed to read trust anchors", "err", err)
+	}
+	res := checkDANE(ctx, r, anchors, host, service, *starttls, *skipDNSSEC)
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(res); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printDANE(res)
+	}
+	if !res.Pass {
+		os.Exit(1)
+	}
+}
+
+// checkDANE looks up and validates the TLSA records, fetches the server's
+// chain and matches the two
+func checkDANE(ctx context.Context, r resolver.Resolver, anchors []*dns.DS, host, service, starttls string, skipDNSSEC bool) *daneResult {
+	res := &daneResult{Records: []tlsaResult{}, Chain: []string{}}
+	res.Name, _ = dns.TLSAName(host, service, "tcp")
+	resp, err := r.Exchange(ctx, resolver.NewDNSSECQuery(res.Name, dns.TypeTLSA))
+	if err != nil {
+		res.Error = fmt.Sprintf("TLSA lookup failed: %v", err)
+		return res
+	}
+	var records []*dns.TLSA
+	for _, rr := range resp.Answer {
+		if tlsa, ok := rr.(*dns.TLSA); ok {
+			records = append(records, tlsa)
+		}
+	}
+	if len(records) == 0 {
+		res.Error = fmt.Sprintf("no TLSA records at %s (%s)", res.Name, rcodeString(resp.Rcode))
+		return res
+	}
+	sec, err := resolver.NewValidator(r, anchors).Validate(ctx, resp)
+	res.DNSSEC = sec.String()
+	if sec != resolver.Secure && !skipDNSSEC {
+		res.Error = fmt.Sprintf("TLSA records are not DNSSEC secure (%s)", sec)
+		if err != nil {
+			res.Error = fmt.Sprintf("TLSA records are not DNSSEC secure (%s: %v)", sec, err)
+		}
+		for _, t := range records {
+			res.Records = append(res.Records, tlsaResult{Record: t.String(), Meaning: tlsaMeaning(t), Reason: "not used"})
+		}
+		return res
+	}
+
+	// The service is reached at the addresses from the same resolver
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, addr := range followChain(ctx, r, host, qtype, defaultChainDepth).addrs {
+			addrs = append(addrs, addr.Address)
+		}
+	}
+	if len(addrs) == 0 {
+		res.Error = fmt.Sprintf("no addresses for %s", host)
+		return res
+	}
+	res.Address = net.JoinHostPort(addrs[0], service)
+	chain, err := fetchChain(ctx, res.Address, strings.TrimSuffix(host, "."), starttls)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	for _, cert := range chain {
+		res.Chain = append(res.Chain, cert.Subject.String())
+	}
+
+	pkix := verifyPKIX(chain, strings.TrimSuffix(host, "."))
+	for _, t := range records {
+		match, reason := matchTLSA(t, chain, pkix, strings.TrimSuffix(host, "."))
+		res.Records = append(res.Records, tlsaResult{Record: t.String(), Meaning: tlsaMeaning(t), Match: match, Reason: reason})
+		res.Pass = res.Pass || match
+	}
+	return res
+}
+
+// fetchChain connects to addr, with STARTTLS first when asked, and returns
+// the certificates the server presents. They are checked against the TLSA
+// records rather than the system roots.
+func fetchChain(ctx context.Context, addr, serverName, starttls string) ([]*x509.Certificate, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if starttls == "smtp" {
+		if err := smtpStartTLS(conn); err != nil {
+			return nil, fmt.Errorf("STARTTLS with %s failed: %v", addr, err)
+		}
+	}
+	client := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := client.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s failed: %v", addr, err)
+	}
+	chain := client.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", addr)
+	}
+	return chain, nil
+}
+
+// smtpStartTLS reads the SMTP greeting, says EHLO and asks for STARTTLS
+// (RFC 3207)
+func smtpStartTLS(conn net.Conn) error {
+	br := bufio.NewReader(conn)
+	reply := func(want string) error {
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(line, want) {
+				return fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+			}
+			// Multiline replies continue with "250-"
+			if len(line) < 4 || line[3] != '-' {
+				return nil
+			}
+		}
+	}
+	if err := reply("220"); err != nil {
+		return err
+	}
+	fmt.Fprintf(conn, "EHLO tmp-dns.invalid\r\n")
+	if err := reply("250"); err != nil {
+		return err
+	}
+	fmt.Fprintf(conn, "STARTTLS\r\n")
+	return reply("220")
+}
+
+// pkixResult is the outcome of ordinary certificate validation, which the
+// PKIX-TA and PKIX-EE usages require on top of the match
+type pkixResult struct {
+	chains [][]*x509.Certificate
+	err    error
+}
+
+func verifyPKIX(chain []*x509.Certificate, host string) pkixResult {
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := chain[0].Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	return pkixResult{chains: chains, err: err}
+}
+
+// matchTLSA checks one TLSA record against the chain as its usage says
+// (RFC 7671 section 5) and explains the outcome
+func matchTLSA(t *dns.TLSA, chain []*x509.Certificate, pkix pkixResult, host string) (bool, string) {
+	if _, ok := tlsaSelectors[t.Selector]; !ok {
+		return false, "unusable: unknown selector"
+	}
+	if _, ok := tlsaMatching[t.MatchingType]; !ok {
+		return false, "unusable: unknown matching type"
+	}
+	leaf := chain[0]
+	switch t.Usage {
+	case 3:
+		// DANE-EE pins the server's own key, names and dates do not matter
+		if t.Verify(leaf) == nil {
+			return true, "matches the server certificate " + leaf.Subject.String()
+		}
+		return false, "does not match the server certificate"
+	case 1:
+		if t.Verify(leaf) != nil {
+			return false, "does not match the server certificate"
+		}
+		if pkix.err != nil {
+			return false, "matches the server certificate, but it fails PKIX validation: " + pkix.err.Error()
+		}
+		return true, "matches the server certificate, which passes PKIX validation"
+	case 2:
+		for _, ta := range chain {
+			if t.Verify(ta) != nil {
+				continue
+			}
+			if ta == leaf {
+				return true, "matches the server certificate as its own trust anchor"
+			}
+			roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+			roots.AddCert(ta)
+			for _, cert := range chain[1:] {
+				intermediates.AddCert(cert)
+			}
+			// The anchor vouches for the chain, but the name and dates still count
+			if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates}); err != nil {
+				return false, fmt.Sprintf("matches %s, but the chain does not validate from it: %v", ta.Subject, err)
+			}
+			return true, fmt.Sprintf("matches the trust anchor %s", ta.Subject)
+		}
+		return false, "matches no certificate in the chain"
+	case 0:
+		if pkix.err != nil {
+			return false, "the chain fails PKIX validation: " + pkix.err.Error()
+		}
+		for _, verified := range pkix.chains {
+			for _, ca := range verified[1:] {
+				if t.Verify(ca) == nil {
+					return true, fmt.Sprintf("matches the CA %s of a valid chain", ca.Subject)
+				}
+			}
+		}
+		return false, "matches no CA of the validated chain"
+	}
+	return false, "unusable: unknown certificate usage"
+}
+
+// tlsaMeaning names the parameters of a TLSA record, like "DANE-EE SPKI SHA2-256"
+func tlsaMeaning(t *dns.TLSA) string {
+	name := func(names map[uint8]string, v uint8) string {
+		if s, ok := names[v]; ok {
+			return s
+		}
+		return strconv.Itoa(int(v))
+	}
+	return name(tlsaUsages, t.Usage) + " " + name(tlsaSelectors, t.Selector) + " " + name(tlsaMatching, t.MatchingType)
+}
+
+// printDANE prints the records with their outcome, the chain and the verdict
+func printDANE(res *daneResult) {
+	if len(res.Records) > 0 {
+		fmt.Printf("TLSA records at %s (DNSSEC: %s):\n", res.Name, res.DNSSEC)
+		for _, t := range res.Records {
+			fmt.Println(t.Record)
+			fmt.Printf("  %s: %s\n", t.Meaning, t.Reason)
+		}
+	}
+	if len(res.Chain) > 0 {
+		fmt.Printf("\nCertificate chain from %s:\n", res.Address)
+		for i, subject := range res.Chain {
+			fmt.Printf("  %d %s\n", i, subject)
+		}
+	}
+	fmt.Println()
+	switch {
+	case res.Error != "":
+		fmt.Println("FAIL: " + res.Error)
+	case res.Pass:
+		fmt.Println("PASS")
+	default:
+		fmt.Println("FAIL: no TLSA record matches")
+	}
+}
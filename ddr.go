@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// ddrTimeout bounds the discovery and verification of the resolvers one
+// server designates
+const ddrTimeout = 5 * time.Second
+
+// ddrCandidate is a resolver a server designates, with the outcome of its
+// verification
+type ddrCandidate struct {
+	resolver.Designation
+	upstream upstream // the encrypted upstream it stands for
+	err      error    // why it cannot be used, nil once verified
+}
+
+// ddrDesignation is the -json rendering of a ddrCandidate
+type ddrDesignation struct {
+	Protocol  string   `json:"protocol"`
+	Priority  uint16   `json:"priority"`
+	Server    string   `json:"server"`
+	ALPN      []string `json:"alpn"`
+	Addresses []string `json:"addresses,omitempty"`
+	Verified  bool     `json:"verified"`
+	Address   string   `json:"address,omitempty"` // the one that verified
+	Error     string   `json:"error,omitempty"`
+}
+
+// ddrResult is what one server designates, also the -json rendering
+type ddrResult struct {
+	Resolver     string           `json:"resolver"`
+	Designations []ddrDesignation `json:"designations"`
+	Error        string           `json:"error,omitempty"`
+}
+
+// runDDR implements the ddr subcommand: it asks each server, the system
+// resolvers by default, for the encrypted resolvers it designates (RFC
+// 9462) and verifies them. It exits with status 1 when a server designates
+// none that verifies.
+func runDDR(args []string) {
+	fs := flag.NewFlagSet("ddr", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "unencrypted DNS `servers`, comma separated IP addresses with an optional port (default the system resolvers)")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	jsonOut := fs.Bool("json", false, "print the designations as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ddr [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "ddr"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	servers := *serverFlag
+	if servers == "" {
+		conf, err := loadSystemConfig()
+		if err != nil {
+			fatal(err.Error())
+		}
+		servers = conf.servers()
+	}
+	upstreams, err := parseUpstreams("udp", servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	results := make([]ddrResult, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		results[i].Resolver = upstreamLabel(u)
+		wg.Add(1)
+		go func(res *ddrResult) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), ddrTimeout)
+			defer cancel()
+			candidates, err := opts.discoverDesignated(ctx, u, tlsConfig)
+			if err != nil {
+				res.Error = err.Error()
+			}
+			res.Designations = []ddrDesignation{}
+			for _, c := range candidates {
+				d := ddrDesignation{Protocol: c.Protocol, Priority: c.Priority, Server: upstreamLabel(c.upstream), ALPN: c.ALPN, Verified: c.err == nil, Address: c.upstream.dial}
+				for _, ip := range c.Addrs {
+					d.Addresses = append(d.Addresses, ip.String())
+				}
+				if c.err != nil {
+					d.Error = c.err.Error()
+				}
+				res.Designations = append(res.Designations, d)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printDDR(results)
+	}
+	for _, res := range results {
+		if !slices.ContainsFunc(res.Designations, func(d ddrDesignation) bool { return d.Verified }) {
+			os.Exit(1)
+		}
+	}
+}
+
+// printDDR prints the designations of each server, the reason for those
+// that did not verify
+func printDDR(results []ddrResult) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, res := range results {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s\n", res.Resolver)
+		if res.Error != "" {
+			fmt.Fprintf(tw, "  %s\n", res.Error)
+			continue
+		}
+		if len(res.Designations) == 0 {
+			fmt.Fprintf(tw, "  designates no encrypted resolver\n")
+		}
+		for _, d := range res.Designations {
+			status := "verified at " + d.Address
+			if !d.Verified {
+				status = "NOT verified: " + d.Error
+			}
+			fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\n", d.Priority, d.Protocol, d.Server, status)
+		}
+	}
+	tw.Flush()
+}
+
+// discoverDesignated finds the resolvers u, an unencrypted server given by
+// its IP address, designates and verifies them all at once
+func (o *options) discoverDesignated(ctx context.Context, u upstream, tlsConfig *tls.Config) ([]ddrCandidate, error) {
+	host, _, _ := net.SplitHostPort(u.Addr)
+	designator := net.ParseIP(host)
+	if designator == nil || u.Method != "udp" && u.Method != "tcp" {
+		return nil, fmt.Errorf("DDR needs a udp or tcp server given by its IP address, not %s", upstreamLabel(u))
+	}
+	dialer, err := o.dialer(u, nil)
+	if err != nil {
+		return nil, err
+	}
+	designations, err := resolver.Discover(ctx, o.newResolver(u, nil, dialer))
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]ddrCandidate, len(designations))
+	var wg sync.WaitGroup
+	for i, d := range designations {
+		c := &candidates[i]
+		c.Designation = d
+		switch d.Protocol {
+		case "doh":
+			c.upstream = upstream{Method: "http", Addr: d.URL()}
+			if !slices.Contains(d.ALPN, "h2") && o.dohVersion() != "3" {
+				c.err = errors.New("offers DoH over HTTP/3 only, which takes -http-version 3")
+				continue
+			}
+		case "doq":
+			c.upstream = upstream{Method: "quic", Addr: net.JoinHostPort(d.Target, strconv.Itoa(d.Port))}
+		default:
+			c.upstream = upstream{Method: "tls", Addr: net.JoinHostPort(d.Target, strconv.Itoa(d.Port))}
+		}
+		dialer, err := o.dialer(c.upstream, nil)
+		if err != nil {
+			c.err = err
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.upstream.dial, c.err = c.Verify(ctx, designator, tlsConfig, dialer)
+		}()
+	}
+	wg.Wait()
+	return candidates, nil
+}
+
+// designated replaces the udp and tcp upstreams with the first resolver
+// each designates that verifies, leaving those that designate none
+func (o *options) designated(upstreams []upstream, tlsConfig *tls.Config) []upstream {
+	out := make([]upstream, len(upstreams))
+	for i, u := range upstreams {
+		out[i] = u
+		if u.Method != "udp" && u.Method != "tcp" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ddrTimeout)
+		candidates, err := o.discoverDesignated(ctx, u, tlsConfig)
+		cancel()
+		var reasons []string
+		for _, c := range candidates {
+			if c.err == nil {
+				slog.Info("upgraded to a designated resolver", "upstream", upstreamLabel(u), "designated", upstreamLabel(c.upstream), "address", c.upstream.dial)
+				out[i] = c.upstream
+				break
+			}
+			reasons = append(reasons, upstreamLabel(c.upstream)+": "+c.err.Error())
+		}
+		switch {
+		case out[i] != u:
+		case err != nil:
+			slog.Warn("staying unencrypted, DDR failed", "upstream", upstreamLabel(u), "err", err)
+		case len(reasons) == 0:
+			slog.Warn("staying unencrypted, no encrypted resolver designated", "upstream", upstreamLabel(u))
+		default:
+			slog.Warn("staying unencrypted, no designated resolver verified", "upstream", upstreamLabel(u), "err", strings.Join(reasons, "; "))
+		}
+	}
+	return out
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// Levels of the checks in a delegation report
+const (
+	levelPass = "PASS"
+	levelWarn = "WARN"
+	levelFail = "FAIL"
+)
+
+// delegationCheck is one line of a delegation report
+type delegationCheck struct {
+	level, check, message string
+}
+
+// delegationReport is the checks in the order they were made
+type delegationReport []delegationCheck
+
+func (r *delegationReport) add(level, check, format string, args ...any) {
+	*r = append(*r, delegationCheck{level, check, fmt.Sprintf(format, args...)})
+}
+
+// runDelegation implements the delegation subcommand: it follows referrals
+// from the root to the parent of a zone and checks what the parent hands
+// out against the zone itself, the NS records, the glue of the nameservers
+// inside the zone and the DS records against the DNSKEY set. It exits with
+// status 1 when any check fails.
+func runDelegation(args []string) {
+	fs := flag.NewFlagSet("delegation", flag.ExitOnError)
+	roots := fs.String("roots", "", "root hint `servers` to start from, comma separated, as host[:port] (default the root servers)")
+	port := fs.Int("port", 53, "`port` of the nameservers")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each query after this `duration`")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s delegation [flags] <zone>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "delegation"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	zone, err := toASCII(args[0])
+	if err != nil {
+		fatal(err.Error())
+	}
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if zone == "." {
+		fatal("the root zone has no parent")
+	}
+
+	it := resolver.NewIterator()
+	it.Family = opts.family()
+	it.Timeout = *timeout
+	it.Port = strconv.Itoa(*port)
+	if *roots != "" {
+		it.Roots = nil
+		for _, root := range strings.Split(*roots, ",") {
+			if root = strings.TrimSpace(root); root != "" {
+				it.Roots = append(it.Roots, root)
+			}
+		}
+	}
+	step, err := parentReferral(it, zone, *timeout)
+	if err != nil {
+		fatal("failed to find the delegation in the parent zone", "zone", zone, "err", err)
+	}
+	// The iterator goes on to look up the nameservers without glue
+	it.OnStep = nil
+	parentNS := nsTargets(step.Response.Ns, zone)
+	glue := glueAddrs(step.Response.Extra, parentNS)
+
+	var servers []*auditServer
+	for _, ns := range parentNS {
+		addrs, err := glue[ns], error(nil)
+		if len(addrs) == 0 {
+			addrs, err = nameserverAddrs(it, ns, *timeout, opts.ipv4, opts.ipv6)
+		}
+		addrs = slices.DeleteFunc(slices.Clone(addrs), func(a string) bool {
+			v4 := net.ParseIP(a).To4() != nil
+			return opts.ipv4 && !v4 || opts.ipv6 && v4
+		})
+		if len(addrs) == 0 {
+			servers = append(servers, &auditServer{ns: ns, err: err})
+			continue
+		}
+		for _, addr := range addrs {
+			servers = append(servers, &auditServer{ns: ns, addr: net.JoinHostPort(addr, it.Port), records: map[auditKey]string{}})
+		}
+	}
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		if s.addr == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.probe(zone, nil, *timeout)
+		}()
+	}
+	wg.Wait()
+
+	var report delegationReport
+	var child *auditServer
+	for _, s := range servers {
+		if s.status() == "ok" {
+			child = s
+			break
+		}
+	}
+	if child == nil {
+		report.add(levelFail, "ns", "no nameserver the parent lists answers for the zone, %s", strings.Join(parentNS, ", "))
+	} else {
+		checkNameservers(&report, zone, parentNS, child, *timeout)
+		checkGlue(&report, zone, parentNS, glue, child, *timeout)
+	}
+	for _, s := range servers {
+		switch status := s.status(); {
+		case s.addr == "":
+			reason := "no address"
+			if s.err != nil {
+				reason = s.err.Error()
+			}
+			report.add(levelFail, "server", "%s cannot be reached: %s", s.ns, reason)
+		case s.err != nil:
+			report.add(levelFail, "server", "%s is unreachable: %v", s.label(), s.err)
+		case status != "ok":
+			report.add(levelFail, "server", "%s is a lame delegation, %s", s.label(), s.lameReason())
+		default:
+			report.add(levelPass, "server", "%s answers with authority, serial %d", s.label(), s.soa.Serial)
+		}
+	}
+	if child != nil {
+		checkDelegationDS(&report, zone, step.Server, child, *timeout)
+	}
+
+	fmt.Printf("Delegation of %s from %s, as %s gives it:\n\n", zone, step.Zone, step.Server)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LEVEL\tCHECK\tMESSAGE")
+	counts := map[string]int{}
+	for _, c := range report {
+		counts[c.level]++
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.level, c.check, c.message)
+	}
+	w.Flush()
+	fmt.Printf("\n%d passed, %d warnings, %d failed\n", counts[levelPass], counts[levelWarn], counts[levelFail])
+	if counts[levelFail] > 0 {
+		os.Exit(1)
+	}
+}
+
+// glueAddrs returns the addresses the additional section of a referral
+// gives for each of the nameservers, sorted
+func glueAddrs(extra []dns.RR, nsNames []string) map[string][]string {
+	glue := map[string][]string{}
+	for _, rr := range extra {
+		owner := strings.ToLower(rr.Header().Name)
+		if !slices.Contains(nsNames, owner) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			glue[owner] = append(glue[owner], rr.A.String())
+		case *dns.AAAA:
+			glue[owner] = append(glue[owner], rr.AAAA.String())
+		}
+	}
+	for _, addrs := range glue {
+		sort.Strings(addrs)
+	}
+	return glue
+}
+
+// checkNameservers compares the NS records of the delegation with those
+// the zone has at its apex
+func checkNameservers(report *delegationReport, zone string, parentNS []string, child *auditServer, timeout time.Duration) {
+	resp, err := queryAuthority(child.addr, zone, dns.TypeNS, timeout)
+	if err == nil && resp.Rcode != dns.RcodeSuccess {
+		err = fmt.Errorf("it answers %s", rcodeString(resp.Rcode))
+	}
+	if err != nil {
+		report.add(levelFail, "ns", "failed to ask %s for the NS records of the zone: %v", child.label(), err)
+		return
+	}
+	childNS := nsTargets(resp.Answer, zone)
+	if slices.Equal(parentNS, childNS) {
+		report.add(levelPass, "ns", "the parent and the zone list the same nameservers, %s", strings.Join(parentNS, ", "))
+		return
+	}
+	for _, ns := range parentNS {
+		if !slices.Contains(childNS, ns) {
+			report.add(levelWarn, "ns", "the parent lists %s, the NS records of the zone do not", ns)
+		}
+	}
+	for _, ns := range childNS {
+		if !slices.Contains(parentNS, ns) {
+			report.add(levelWarn, "ns", "the zone lists %s, the delegation in the parent does not", ns)
+		}
+	}
+}
+
+// checkGlue checks that the parent gives glue for the nameservers inside
+// the zone, which cannot be looked up without it, and that the glue
+// matches the addresses in the zone
+func checkGlue(report *delegationReport, zone string, parentNS []string, glue map[string][]string, child *auditServer, timeout time.Duration) {
+	for _, ns := range parentNS {
+		if !dns.IsSubDomain(zone, ns) {
+			continue
+		}
+		if len(glue[ns]) == 0 {
+			report.add(levelFail, "glue", "%s is inside the zone and the parent has no glue for it", ns)
+			continue
+		}
+		addrs, err := zoneAddrs(child.addr, ns, timeout)
+		switch {
+		case err != nil:
+			report.add(levelWarn, "glue", "failed to compare the glue for %s with the zone: %v", ns, err)
+		case len(addrs) == 0:
+			report.add(levelWarn, "glue", "the parent has glue %s for %s, the zone has no address for it", strings.Join(glue[ns], ", "), ns)
+		case !slices.Equal(addrs, glue[ns]):
+			report.add(levelWarn, "glue", "the parent has glue %s for %s, the zone has %s", strings.Join(glue[ns], ", "), ns, strings.Join(addrs, ", "))
+		default:
+			report.add(levelPass, "glue", "the glue for %s matches the zone, %s", ns, strings.Join(addrs, ", "))
+		}
+	}
+}
+
+// zoneAddrs asks a server of the zone for the addresses of name, sorted
+func zoneAddrs(addr, name string, timeout time.Duration) ([]string, error) {
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := queryAuthority(addr, name, qtype, timeout)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// checkDelegationDS asks the parent for the DS records of the zone and the
+// zone for its DNSKEY set, and checks that a DS record leads to a key that
+// signs that set
+func checkDelegationDS(report *delegationReport, zone, parent string, child *auditServer, timeout time.Duration) {
+	resp, err := exchangeAuthority(parent, resolver.NewDNSSECQuery(zone, dns.TypeDS), timeout)
+	if err == nil && resp.Rcode != dns.RcodeSuccess {
+		err = fmt.Errorf("it answers %s", rcodeString(resp.Rcode))
+	}
+	if err != nil {
+		report.add(levelWarn, "ds", "failed to ask %s for the DS records: %v", parent, err)
+		return
+	}
+	var dsSet []*dns.DS
+	for _, rr := range resp.Answer {
+		if ds, ok := rr.(*dns.DS); ok && strings.EqualFold(ds.Hdr.Name, zone) {
+			dsSet = append(dsSet, ds)
+		}
+	}
+
+	resp, err = exchangeAuthority(child.addr, resolver.NewDNSSECQuery(zone, dns.TypeDNSKEY), timeout)
+	if err == nil && resp.Rcode != dns.RcodeSuccess {
+		err = fmt.Errorf("it answers %s", rcodeString(resp.Rcode))
+	}
+	if err != nil {
+		report.add(levelWarn, "ds", "failed to ask %s for the DNSKEY records: %v", child.label(), err)
+		return
+	}
+	var keys []*dns.DNSKEY
+	var keySet []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			keySet = append(keySet, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+
+	switch {
+	case len(dsSet) == 0 && len(keys) == 0:
+		report.add(levelPass, "ds", "the zone is unsigned and the parent has no DS records for it")
+		return
+	case len(dsSet) == 0:
+		report.add(levelWarn, "ds", "the zone has %d DNSKEY records and the parent no DS records, validators treat it as unsigned", len(keys))
+		return
+	case len(keys) == 0:
+		report.add(levelFail, "ds", "the parent has %d DS records and the zone no DNSKEY records, validators reject its answers", len(dsSet))
+		return
+	}
+	secure := false
+	for _, ds := range dsSet {
+		desc := fmt.Sprintf("DS %d (%s, digest type %d)", ds.KeyTag, dns.AlgorithmToString[ds.Algorithm], ds.DigestType)
+		key, supported := dsKey(ds, keys)
+		switch {
+		case !supported:
+			report.add(levelWarn, "ds", "%s has a digest type that cannot be checked", desc)
+		case key == nil:
+			report.add(levelWarn, "ds", "%s matches no DNSKEY of the zone", desc)
+		default:
+			if err := signsKeySet(key, keySet, sigs); err != nil {
+				report.add(levelWarn, "ds", "%s matches key %d, but %v", desc, key.KeyTag(), err)
+				continue
+			}
+			secure = true
+			report.add(levelPass, "ds", "%s matches key %d, which signs the DNSKEY set", desc, key.KeyTag())
+		}
+	}
+	if !secure {
+		report.add(levelFail, "ds", "no DS record leads to a key that signs the DNSKEY set, validators reject the answers of the zone")
+	}
+}
+
+// dsKey returns the key whose digest ds is, and whether the digest type
+// of ds is one that can be computed
+func dsKey(ds *dns.DS, keys []*dns.DNSKEY) (*dns.DNSKEY, bool) {
+	for _, key := range keys {
+		if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+			continue
+		}
+		d := key.ToDS(ds.DigestType)
+		if d == nil {
+			return nil, false
+		}
+		if strings.EqualFold(d.Digest, ds.Digest) {
+			return key, true
+		}
+	}
+	return nil, true
+}
+
+// signsKeySet checks that a currently valid signature by key covers the
+// DNSKEY set
+func signsKeySet(key *dns.DNSKEY, keySet []dns.RR, sigs []*dns.RRSIG) error {
+	if key.Flags&dns.ZONE == 0 {
+		return fmt.Errorf("it is not a zone key")
+	}
+	err := fmt.Errorf("it does not sign the DNSKEY set")
+	for _, sig := range sigs {
+		if sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm || !strings.EqualFold(sig.SignerName, key.Hdr.Name) {
+			continue
+		}
+		if verr := sig.Verify(key, keySet); verr != nil {
+			err = fmt.Errorf("its signature over the DNSKEY set does not verify: %v", verr)
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			err = fmt.Errorf("its signature over the DNSKEY set is outside its validity period")
+			continue
+		}
+		return nil
+	}
+	return err
+}
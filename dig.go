@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// digQuery describes the query being made in the terms dig understands
+type digQuery struct {
+	Name        string
+	Type        uint16
+	Class       uint16 // 0 or IN for the default
+	Opcode      int
+	Method      string
+	Server      string // DNS server host:port
+	DoHURL      string // DoH endpoint, or the ODoH target
+	DoHMethod   string
+	HTTPVersion string // required HTTP version for DoH, "" when negotiated
+	Timeout     time.Duration
+	Crafted     bool
+	DNSSEC      bool
+	Reverse     string // address given to -x
+	Trace       bool
+	Options     []string      // further dig options, such as the EDNS0 ones
+	Fallbacks   []string      // further servers tried when the first one fails
+	Race        bool          // the fallbacks are queried at the same time instead
+	Watch       time.Duration // interval of -watch, 0 for a single query
+}
+
+// digCommand returns the dig command line equivalent to q. Settings dig
+// cannot express are listed as shell comments after the command.
+func digCommand(q digQuery) string {
+	args := []string{"dig"}
+	var notes []string
+
+	switch q.Method {
+	case "udp", "tcp", "tls", "quic":
+		if q.Server == "" {
+			break
+		}
+		host, port, err := net.SplitHostPort(q.Server)
+		if err != nil {
+			host = q.Server
+		}
+		args = append(args, "@"+host)
+		if port != "" && port != strconv.Itoa(defaultPorts[q.Method]) {
+			args = append(args, "-p", port)
+		}
+	}
+
+	switch q.Method {
+	case "tcp":
+		args = append(args, "+tcp")
+	case "tls":
+		args = append(args, "+tls")
+	case "quic":
+		notes = append(notes, "dig has no DNS-over-QUIC support, kdig offers it with +quic")
+	case "dnscrypt":
+		notes = append(notes, "dig has no DNSCrypt support, dnscrypt-proxy can serve the stamp on a local address for it")
+	case "http", "json", "odoh":
+		u, err := url.Parse(q.DoHURL)
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("could not parse DoH URL %q", q.DoHURL))
+			break
+		}
+		args = append(args, "@"+u.Hostname())
+		if port := u.Port(); port != "" && port != "443" {
+			args = append(args, "-p", port)
+		}
+		if q.Method == "odoh" {
+			// dig cannot relay or encrypt, querying the target directly is the closest match
+			args = append(args, "+https="+u.Path)
+			notes = append(notes, "dig has no Oblivious DoH support, this queries the target directly")
+		} else if q.Method == "json" {
+			args = append(args, "+https-get="+u.Path)
+			notes = append(notes, "dig only speaks wire format DoH, the JSON API endpoint may not accept it")
+		} else if q.DoHMethod == "GET" {
+			args = append(args, "+https-get="+u.Path)
+		} else {
+			args = append(args, "+https="+u.Path)
+		}
+		switch {
+		case q.Method == "odoh":
+		case q.HTTPVersion == "1.1":
+			notes = append(notes, "dig always uses HTTP/2 for DoH, HTTP/1.1-only mode has no equivalent")
+		case q.HTTPVersion == "3":
+			notes = append(notes, "dig has no DoH over HTTP/3 support")
+		}
+	}
+
+	if q.Reverse != "" && q.Type == dns.TypePTR {
+		args = append(args, "-x", q.Reverse)
+	} else {
+		args = append(args, shellQuote(q.Name), typeString(q.Type))
+	}
+	if q.Class != 0 && q.Class != dns.ClassINET {
+		args = append(args, dns.Class(q.Class).String())
+	}
+	if q.Opcode != dns.OpcodeQuery {
+		op, ok := dns.OpcodeToString[q.Opcode]
+		if !ok {
+			op = strconv.Itoa(q.Opcode)
+		}
+		args = append(args, "+opcode="+strings.ToLower(op), "+norecurse")
+		if q.Opcode == dns.OpcodeNotify {
+			args = append(args, "+aaflag")
+		}
+	}
+	// dig waits 5 seconds by default and only takes whole seconds
+	if q.Timeout > 0 && q.Timeout != 5*time.Second {
+		secs := int((q.Timeout + time.Second - 1) / time.Second)
+		args = append(args, "+timeout="+strconv.Itoa(secs))
+	}
+	args = append(args, q.Options...)
+	if q.Trace {
+		args = append(args, "+trace")
+	}
+	if q.DNSSEC {
+		args = append(args, "+dnssec", "+cd")
+		notes = append(notes, "dig does not validate, delv performs the same chain validation")
+	}
+	if q.Watch > 0 {
+		notes = append(notes, fmt.Sprintf("dig queries once, watch -n %g repeats it but does not report the changes", q.Watch.Seconds()))
+	}
+	if len(q.Fallbacks) > 0 && q.Race {
+		notes = append(notes, "dig queries a single server, racing it against "+strings.Join(q.Fallbacks, ", ")+" has no equivalent")
+	} else if len(q.Fallbacks) > 0 {
+		notes = append(notes, "dig queries a single server, the fallbacks "+strings.Join(q.Fallbacks, ", ")+" are not included")
+	}
+	if q.Crafted {
+		notes = append(notes, "crafted messages (-raw, -raw-file, -answer, -*count) cannot be reproduced with dig")
+	}
+
+	cmd := strings.Join(args, " ")
+	for _, note := range notes {
+		cmd += "\n# " + note
+	}
+	return cmd
+}
+
+// shellQuote quotes s for a POSIX shell when it contains special characters
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:/@+=", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
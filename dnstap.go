@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+const (
+	// dnstapContentType names the payload of the Frame Streams
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+	// dnstapQueue is how many messages wait for the writer before new ones
+	// are dropped, so a slow collector never holds up DNS
+	dnstapQueue = 1024
+	// dnstapRetry is how long the writer waits to reconnect after losing
+	// the collector, dropping messages meanwhile
+	dnstapRetry = 5 * time.Second
+)
+
+// Frame Streams control frame types and the content type field
+const (
+	fstrmAccept      = 1
+	fstrmStart       = 2
+	fstrmStop        = 3
+	fstrmReady       = 4
+	fstrmFinish      = 5
+	fstrmContentType = 1
+)
+
+// dnstap message types, socket families and protocols from dnstap.proto
+const (
+	dnstapClientQuery    = 5
+	dnstapClientResponse = 6
+	dnstapToolQuery      = 11
+	dnstapToolResponse   = 12
+
+	dnstapINET  = 1
+	dnstapINET6 = 2
+)
+
+// dnstapProtocols maps Trace transports to dnstap socket protocols
+var dnstapProtocols = map[string]uint64{
+	"udp": 1, "tcp": 2, "tls": 3, "https": 4, "https-json": 4, "dnscrypt": 5, "quic": 7,
+}
+
+// dnstapOptions are the flags for dnstap logging, shared by serve and batch
+type dnstapOptions struct {
+	target   string
+	sample   int
+	identity string
+}
+
+// register adds the dnstap flags to fs
+func (o *dnstapOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.target, "dnstap", "", "log queries and responses in dnstap format to this `target`, unix:/path for a collector socket or a file path")
+	fs.IntVar(&o.sample, "dnstap-sample", 1, "log only one query in `n` with -dnstap, with its response")
+	fs.StringVar(&o.identity, "dnstap-identity", "", "server `identity` in the dnstap messages (default the host name)")
+}
+
+// open starts the dnstap writer the flags describe, or returns nil when
+// -dnstap is not given
+func (o *dnstapOptions) open() *dnstapLogger {
+	if o.target == "" {
+		return nil
+	}
+	identity := o.identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	l := &dnstapLogger{
+		target:   o.target,
+		sample:   uint64(max(o.sample, 1)),
+		identity: identity,
+		frames:   make(chan []byte, dnstapQueue),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// dnstapLogger encodes dnstap messages and writes them as Frame Streams in
+// the background. A nil *dnstapLogger logs nothing.
+type dnstapLogger struct {
+	target   string
+	sample   uint64
+	identity string
+	queries  atomic.Uint64
+	frames   chan []byte
+	done     chan struct{}
+	dropped  atomic.Uint64
+	once     sync.Once
+}
+
+// dnstapMessage is one query or response to log
+type dnstapMessage struct {
+	typ          uint64
+	protocol     string // a Trace transport
+	queryAddr    net.Addr
+	responseAddr string // host:port, URLs are left out
+	queryTime    time.Time
+	responseTime time.Time
+	query        *dns.Msg
+	response     *dns.Msg
+}
+
+// sampled reports whether the query about to be made should be logged
+func (l *dnstapLogger) sampled() bool {
+	return l != nil && (l.queries.Add(1)-1)%l.sample == 0
+}
+
+// ServeDNS implements resolver.Handler, logging the sampled client queries
+// and the responses of the handlers after it, a failure as the SERVFAIL
+// that the client gets
+func (l *dnstapLogger) ServeDNS(ctx context.Context, req *resolver.Request, next resolver.Next) (*dns.Msg, error) {
+	if !l.sampled() {
+		return next(ctx, req)
+	}
+	start := time.Now()
+	l.log(dnstapMessage{typ: dnstapClientQuery, protocol: req.Client.Network(), queryAddr: req.Client, responseAddr: req.Local.String(), queryTime: start, query: req.Msg})
+	resp, err := next(ctx, req)
+	logged := resp
+	if err != nil {
+		logged = new(dns.Msg)
+		logged.SetRcode(req.Msg, dns.RcodeServerFailure)
+	}
+	if logged != nil {
+		l.log(dnstapMessage{typ: dnstapClientResponse, protocol: req.Client.Network(), queryAddr: req.Client, responseAddr: req.Local.String(), queryTime: start, responseTime: time.Now(), query: req.Msg, response: logged})
+	}
+	return resp, err
+}
+
+// log queues m for writing, dropping it when the writer is behind
+func (l *dnstapLogger) log(m dnstapMessage) {
+	select {
+	case l.frames <- l.encode(m):
+	default:
+		if l.dropped.Add(1) == 1 {
+			slog.Warn("dnstap writer is behind, dropping messages", "target", l.target)
+		}
+	}
+}
+
+// close writes the messages still queued and ends the stream
+func (l *dnstapLogger) close() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() { close(l.frames) })
+	<-l.done
+}
+
+// encode returns m as a Dnstap protobuf message
+func (l *dnstapLogger) encode(m dnstapMessage) []byte {
+	var msg []byte
+	msg = protoVarint(msg, 1, m.typ)
+	if host, port, ok := splitAddr(m.queryAddr); ok {
+		msg = protoVarint(msg, 2, ipFamily(host))
+		msg = protoBytes(msg, 4, ipBytes(host))
+		msg = protoVarint(msg, 6, uint64(port))
+	}
+	if proto, ok := dnstapProtocols[m.protocol]; ok {
+		msg = protoVarint(msg, 3, proto)
+	}
+	if host, port, err := net.SplitHostPort(m.responseAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if m.queryAddr == nil {
+				msg = protoVarint(msg, 2, ipFamily(ip))
+			}
+			msg = protoBytes(msg, 5, ipBytes(ip))
+			if p, err := strconv.Atoi(port); err == nil {
+				msg = protoVarint(msg, 7, uint64(p))
+			}
+		}
+	}
+	if !m.queryTime.IsZero() {
+		msg = protoVarint(msg, 8, uint64(m.queryTime.Unix()))
+		msg = protoFixed32(msg, 9, uint32(m.queryTime.Nanosecond()))
+	}
+	if m.query != nil {
+		if wire, err := m.query.Pack(); err == nil {
+			msg = protoBytes(msg, 10, wire)
+		}
+	}
+	if !m.responseTime.IsZero() {
+		msg = protoVarint(msg, 12, uint64(m.responseTime.Unix()))
+		msg = protoFixed32(msg, 13, uint32(m.responseTime.Nanosecond()))
+	}
+	if m.response != nil {
+		if wire, err := m.response.Pack(); err == nil {
+			msg = protoBytes(msg, 14, wire)
+		}
+	}
+
+	var b []byte
+	b = protoBytes(b, 1, []byte(l.identity))
+	b = protoBytes(b, 2, []byte("tmp-dns"))
+	b = protoBytes(b, 14, msg)
+	return protoVarint(b, 15, 1) // MESSAGE
+}
+
+// run writes the queued frames, connecting to the target first and again
+// after it is lost
+func (l *dnstapLogger) run() {
+	defer close(l.done)
+	var w *fstrmWriter
+	var failed time.Time
+	for frame := range l.frames {
+		if w == nil {
+			if !failed.IsZero() && time.Since(failed) < dnstapRetry {
+				continue
+			}
+			var err error
+			if w, err = openFstrm(l.target); err != nil {
+				slog.Warn("failed to open the dnstap target", "target", l.target, "err", err)
+				failed = time.Now()
+				continue
+			}
+			failed = time.Time{}
+		}
+		err := w.writeFrame(frame)
+		if err == nil && len(l.frames) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			slog.Warn("lost the dnstap target", "target", l.target, "err", err)
+			w.conn.Close()
+			w, failed = nil, time.Now()
+		}
+	}
+	if w != nil {
+		if err := w.finish(); err != nil {
+			slog.Warn("failed to end the dnstap stream", "target", l.target, "err", err)
+		}
+	}
+}
+
+// fstrmWriter writes one unidirectional Frame Stream, to a file or to a
+// collector socket after the bidirectional handshake
+type fstrmWriter struct {
+	*bufio.Writer
+	conn   io.ReadWriteCloser
+	socket bool
+}
+
+// openFstrm opens target and starts the stream
+func openFstrm(target string) (*fstrmWriter, error) {
+	w := &fstrmWriter{}
+	if path, ok := strings.CutPrefix(target, "unix:"); ok {
+		conn, err := net.DialTimeout("unix", path, dnstapRetry)
+		if err != nil {
+			return nil, err
+		}
+		w.conn, w.socket = conn, true
+	} else {
+		f, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		w.conn = f
+	}
+	w.Writer = bufio.NewWriter(w.conn)
+
+	if w.socket {
+		if err := w.control(fstrmReady, true); err != nil {
+			w.conn.Close()
+			return nil, err
+		}
+		if err := w.expect(fstrmAccept); err != nil {
+			w.conn.Close()
+			return nil, err
+		}
+	}
+	if err := w.control(fstrmStart, true); err != nil {
+		w.conn.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// control writes and flushes a control frame
+func (w *fstrmWriter) control(typ uint32, contentType bool) error {
+	frame := binary.BigEndian.AppendUint32(nil, typ)
+	if contentType {
+		frame = binary.BigEndian.AppendUint32(frame, fstrmContentType)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(dnstapContentType)))
+		frame = append(frame, dnstapContentType...)
+	}
+	b := binary.BigEndian.AppendUint32(nil, 0) // the escape that marks control frames
+	b = binary.BigEndian.AppendUint32(b, uint32(len(frame)))
+	if _, err := w.Write(append(b, frame...)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// expect reads a control frame from the collector and checks its type
+func (w *fstrmWriter) expect(typ uint32) error {
+	var header [12]byte
+	if _, err := io.ReadFull(w.conn, header[:]); err != nil {
+		return fmt.Errorf("no Frame Streams handshake: %v", err)
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if binary.BigEndian.Uint32(header[:4]) != 0 || length < 4 || length > 1<<16 {
+		return fmt.Errorf("invalid Frame Streams control frame")
+	}
+	if got := binary.BigEndian.Uint32(header[8:]); got != typ {
+		return fmt.Errorf("got Frame Streams control frame %d instead of %d", got, typ)
+	}
+	_, err := io.CopyN(io.Discard, w.conn, int64(length-4))
+	return err
+}
+
+// writeFrame writes one data frame
+func (w *fstrmWriter) writeFrame(frame []byte) error {
+	if _, err := w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame)))); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// finish ends the stream and closes the target
+func (w *fstrmWriter) finish() error {
+	defer w.conn.Close()
+	if err := w.control(fstrmStop, false); err != nil {
+		return err
+	}
+	if w.socket {
+		return w.expect(fstrmFinish)
+	}
+	return nil
+}
+
+func splitAddr(addr net.Addr) (net.IP, int, bool) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port, true
+	case *net.TCPAddr:
+		return addr.IP, addr.Port, true
+	}
+	return nil, 0, false
+}
+
+func ipFamily(ip net.IP) uint64 {
+	if ip.To4() != nil {
+		return dnstapINET
+	}
+	return dnstapINET6
+}
+
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// protoVarint appends a varint field of a protobuf message
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// protoBytes appends a length-delimited field of a protobuf message
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// protoFixed32 appends a fixed32 field of a protobuf message
+func protoFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// ednsFlags holds the EDNS0 command line settings
+type ednsFlags struct {
+	bufsize uint
+	do      bool
+	nsid    bool
+	padding bool
+	cookie  optionalHex
+	subnet  string
+}
+
+func (e *ednsFlags) register(fs *flag.FlagSet) {
+	fs.UintVar(&e.bufsize, "bufsize", 0, "advertise this EDNS0 UDP buffer `size` (default 1232)")
+	fs.BoolVar(&e.do, "do", false, "set the EDNS0 DO bit to ask for DNSSEC records, without validating them")
+	fs.BoolVar(&e.nsid, "nsid", false, "ask the server for its name server identifier (NSID)")
+	fs.BoolVar(&e.padding, "padding", false, "pad queries to a multiple of 128 bytes (RFC 8467), meant for encrypted transports")
+	fs.StringVar(&e.subnet, "subnet", "", "send EDNS Client Subnet with this `prefix`, such as 192.0.2.0/24, or 0.0.0.0/0 to opt out")
+	fs.Var(&e.cookie, "cookie", "send a DNS cookie, random unless given as -cookie=`hex` (client cookie, optionally with a server cookie)")
+}
+
+// active reports whether any EDNS0 setting was asked for
+func (e *ednsFlags) active() bool {
+	return e.bufsize != 0 || e.do || e.nsid || e.padding || e.cookie.set || e.subnet != ""
+}
+
+// options converts the flags for resolver.EDNSOptions.Apply
+func (e *ednsFlags) options() (resolver.EDNSOptions, error) {
+	if e.bufsize > 65535 {
+		return resolver.EDNSOptions{}, fmt.Errorf("-bufsize must be at most 65535")
+	}
+	o := resolver.EDNSOptions{UDPSize: uint16(e.bufsize), DO: e.do, NSID: e.nsid, Padding: e.padding}
+	if e.cookie.set {
+		o.Cookie = e.cookie.value
+		if o.Cookie == nil {
+			o.Cookie = resolver.NewClientCookie()
+		}
+	}
+	if e.subnet != "" {
+		subnet, err := resolver.ParseSubnet(e.subnet)
+		if err != nil {
+			return resolver.EDNSOptions{}, err
+		}
+		o.Subnet = subnet
+	}
+	return o, nil
+}
+
+// digArgs returns the dig options matching the flags
+func (e *ednsFlags) digArgs() []string {
+	var args []string
+	if e.bufsize != 0 {
+		args = append(args, "+bufsize="+strconv.Itoa(int(e.bufsize)))
+	}
+	if e.do {
+		args = append(args, "+dnssec")
+	}
+	if e.nsid {
+		args = append(args, "+nsid")
+	}
+	if e.padding {
+		args = append(args, "+padding=128")
+	}
+	if e.cookie.set {
+		if e.cookie.value != nil {
+			args = append(args, "+cookie="+hex.EncodeToString(e.cookie.value))
+		} else {
+			args = append(args, "+cookie")
+		}
+	}
+	if e.subnet != "" {
+		args = append(args, "+subnet="+e.subnet)
+	}
+	return args
+}
+
+// optionalHex is a flag that works alone, like a boolean, or with a hex value
+type optionalHex struct {
+	set   bool
+	value []byte
+}
+
+func (h *optionalHex) String() string {
+	return hex.EncodeToString(h.value)
+}
+
+func (h *optionalHex) Set(s string) error {
+	switch s {
+	case "true":
+		h.set, h.value = true, nil
+	case "false":
+		h.set, h.value = false, nil
+	default:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("invalid hex: %v", err)
+		}
+		h.set, h.value = true, b
+	}
+	return nil
+}
+
+// IsBoolFlag lets the flag be given without a value
+func (h *optionalHex) IsBoolFlag() bool { return true }
+
+// describeOption renders an EDNS0 option for people, decoding the ones
+// whose raw form says little
+func describeOption(o dns.EDNS0) string {
+	switch o := o.(type) {
+	case *dns.EDNS0_NSID:
+		text, err := hex.DecodeString(o.Nsid)
+		if err == nil && printable(text) {
+			return fmt.Sprintf("NSID: %s (%q)", o.Nsid, text)
+		}
+		return "NSID: " + o.Nsid
+	case *dns.EDNS0_COOKIE:
+		if len(o.Cookie) > 16 {
+			return fmt.Sprintf("COOKIE: client %s, server %s", o.Cookie[:16], o.Cookie[16:])
+		}
+		return "COOKIE: client " + o.Cookie
+	case *dns.EDNS0_SUBNET:
+		return fmt.Sprintf("SUBNET: %s/%d, scope /%d", o.Address, o.SourceNetmask, o.SourceScope)
+	case *dns.EDNS0_PADDING:
+		return fmt.Sprintf("PADDING: %d bytes", len(o.Padding))
+	case *dns.EDNS0_EDE:
+		return "EDE: " + resolver.ExtendedError{Code: o.InfoCode, ExtraText: o.ExtraText}.String()
+	default:
+		return fmt.Sprintf("%s: %s", resolver.OptionName(o.Option()), o.String())
+	}
+}
+
+// explainRcode returns the rcode of resp followed by the Extended DNS
+// Errors that explain it, such as SERVFAIL, EDE: DNSSEC Bogus (6)
+func explainRcode(resp *dns.Msg) string {
+	s := rcodeString(resp.Rcode)
+	for _, e := range resolver.ExtendedErrors(resp) {
+		s += ", EDE: " + e.String()
+	}
+	return s
+}
+
+func printable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return len(b) > 0
+}
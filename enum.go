@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// enumProbes is how many random labels are looked up under each domain to
+// learn its wildcard answers, more than one catching wildcards that rotate
+// through several addresses
+const enumProbes = 2
+
+// enumResult is a name that exists, with the records found for it
+type enumResult struct {
+	Name    string   `json:"name"`
+	Depth   int      `json:"depth"`
+	Records []jsonRR `json:"records"`
+}
+
+// enumerator looks up the words of a list under a domain, and under the
+// names it finds when recursing, skipping answers that only a wildcard
+// gives
+type enumerator struct {
+	r       resolver.Resolver
+	types   []uint16
+	words   []string
+	timeout time.Duration
+	depth   int
+	found   func(enumResult)
+	slots   chan struct{} // one per name being looked up
+	wg      sync.WaitGroup
+
+	mu        sync.Mutex
+	seen      map[string]bool
+	wildcards map[string]map[string]bool // domain to the answer data of its wildcard
+	names     int
+	wildcard  int
+	failed    int
+}
+
+// runEnum implements the enum subcommand: subdomain enumeration from a
+// wordlist, with a wildcard check under every domain enumerated
+func runEnum(args []string) {
+	fs := flag.NewFlagSet("enum", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	wordlist := fs.String("wordlist", "", "read the labels to try from this `file`, one per line, - for standard input")
+	typeNames := fs.String("type", "A,AAAA", "record `types` to query for each name, comma separated")
+	workers := fs.Int("workers", 16, "look up to `n` names at once")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each query after this `duration`")
+	depth := fs.Int("depth", 0, "also enumerate under the names found, down to `n` more levels")
+	jsonOut := fs.Bool("json", false, "print one JSON object per name found instead of text")
+	var export exportOptions
+	export.register(fs)
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s enum [flags] -wordlist <file> <domain>\n\nOnly enumerate domains you are allowed to test.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "enum"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 1 || *wordlist == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	domain, err := toASCII(args[0])
+	if err != nil {
+		fatal(err.Error())
+	}
+	types, err := parseTypes(*typeNames)
+	if err != nil {
+		fatal(err.Error())
+	}
+	words, err := readWordlist(*wordlist)
+	if err != nil {
+		fatal("failed to read the wordlist", "err", err)
+	}
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	var file *resultWriter
+	if export.active() {
+		if file, err = export.create(enumCSVHeader); err != nil {
+			fatal(err.Error())
+		}
+	}
+	out := bufio.NewWriter(os.Stdout)
+	var outMu sync.Mutex
+	e := &enumerator{
+		r:         r,
+		types:     types,
+		words:     words,
+		timeout:   *timeout,
+		depth:     *depth,
+		slots:     make(chan struct{}, max(*workers, 1)),
+		seen:      map[string]bool{},
+		wildcards: map[string]map[string]bool{},
+		found: func(res enumResult) {
+			outMu.Lock()
+			defer outMu.Unlock()
+			if file != nil {
+				if err := file.write(res, enumCSVRows(res)); err != nil {
+					fatal("failed to write the results", "err", err)
+				}
+				return
+			}
+			if *jsonOut {
+				b, err := json.Marshal(res)
+				if err != nil {
+					fatal(err.Error())
+				}
+				fmt.Fprintf(out, "%s\n", b)
+			} else {
+				var data []string
+				for _, rr := range res.Records {
+					data = append(data, rr.Type+" "+rr.Data)
+				}
+				fmt.Fprintf(out, "%s\t%s\n", res.Name, strings.Join(data, ", "))
+			}
+			out.Flush()
+		},
+	}
+	e.enumerate(dns.Fqdn(strings.ToLower(domain)), 0)
+	e.wg.Wait()
+	if file != nil {
+		if err := file.Close(); err != nil {
+			fatal(err.Error())
+		}
+	}
+	fmt.Fprintf(os.Stderr, ";; %d names found, %d wildcard answers left out, %d queries failed\n", e.names, e.wildcard, e.failed)
+}
+
+// enumCSVHeader names the columns of -o CSV files
+var enumCSVHeader = []string{"name", "depth", "record_name", "record_type", "ttl", "data"}
+
+// enumCSVRows returns a CSV row per record found for the name of res
+func enumCSVRows(res enumResult) [][]string {
+	rows := make([][]string, len(res.Records))
+	for i, rr := range res.Records {
+		rows[i] = []string{res.Name, fmt.Sprint(res.Depth), rr.Name, rr.Type, fmt.Sprint(rr.TTL), rr.Data}
+	}
+	return rows
+}
+
+// readWordlist returns the distinct labels in path, leaving out blank
+// lines and # comments
+func readWordlist(path string) ([]string, error) {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+	var words []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		word := strings.ToLower(strings.Trim(strings.TrimSpace(scanner.Text()), "."))
+		if word == "" || strings.HasPrefix(word, "#") || seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+	}
+	return words, scanner.Err()
+}
+
+// enumerate learns the wildcard of domain and then tries every word under
+// it in the background, as slots become free
+func (e *enumerator) enumerate(domain string, level int) {
+	e.learnWildcard(domain)
+	for _, word := range e.words {
+		name, err := toASCII(word + "." + domain)
+		if err != nil {
+			slog.Debug("skipping an invalid name", "name", word+"."+domain, "err", err)
+			continue
+		}
+		name = strings.ToLower(name)
+		e.mu.Lock()
+		seen := e.seen[name]
+		e.seen[name] = true
+		e.mu.Unlock()
+		if seen {
+			continue
+		}
+		e.slots <- struct{}{}
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			records, exists := e.lookup(name, domain)
+			// Released before recursing, which waits for slots itself
+			<-e.slots
+			if !exists {
+				return
+			}
+			if len(records) > 0 {
+				e.mu.Lock()
+				e.names++
+				e.mu.Unlock()
+				e.found(enumResult{Name: name, Depth: level, Records: jsonRRs(records)})
+			}
+			if level < e.depth {
+				e.enumerate(name, level+1)
+			}
+		}()
+	}
+}
+
+// lookup queries name for every type and returns the records that are not
+// the wildcard of domain, and whether the name exists on its own
+func (e *enumerator) lookup(name, domain string) ([]dns.RR, bool) {
+	e.mu.Lock()
+	wildcard := e.wildcards[domain]
+	e.mu.Unlock()
+
+	var records []dns.RR
+	exists, fromWildcard := false, false
+	for _, qtype := range e.types {
+		resp, err := e.query(name, qtype)
+		if err != nil {
+			slog.Debug("query failed", "name", name, "type", typeString(qtype), "err", err)
+			e.mu.Lock()
+			e.failed++
+			e.mu.Unlock()
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		answers := resp.Answer
+		if wildcard != nil && matchesWildcard(answers, wildcard) {
+			// The same answer as a random label, or NODATA like it
+			fromWildcard = true
+			continue
+		}
+		exists = true
+		for _, rr := range answers {
+			// The CNAMEs of a name come back for every type
+			if !slices.ContainsFunc(records, func(prev dns.RR) bool { return dns.IsDuplicate(prev, rr) }) {
+				records = append(records, rr)
+			}
+		}
+	}
+	if fromWildcard && !exists {
+		e.mu.Lock()
+		e.wildcard++
+		e.mu.Unlock()
+	}
+	return records, exists
+}
+
+// learnWildcard looks up random labels under domain and stores their
+// answer data, or nothing when they do not exist
+func (e *enumerator) learnWildcard(domain string) {
+	var data map[string]bool
+	for i := 0; i < enumProbes; i++ {
+		label := make([]byte, 8)
+		rand.Read(label)
+		name := hex.EncodeToString(label) + "." + domain
+		for _, qtype := range e.types {
+			resp, err := e.query(name, qtype)
+			if err != nil || resp.Rcode != dns.RcodeSuccess {
+				continue
+			}
+			if data == nil {
+				data = map[string]bool{}
+			}
+			for _, rr := range resp.Answer {
+				data[wildcardKey(rr)] = true
+			}
+		}
+	}
+	if data == nil {
+		return
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	slog.Info("domain has a wildcard, names answered the same way are left out", "domain", domain, "answers", keys)
+	e.mu.Lock()
+	e.wildcards[domain] = data
+	e.mu.Unlock()
+}
+
+// query sends one query with the per query timeout
+func (e *enumerator) query(name string, qtype uint16) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	return e.r.Query(ctx, name, qtype)
+}
+
+// matchesWildcard reports whether every record of answers is one the
+// wildcard gives, which an empty answer is too
+func matchesWildcard(answers []dns.RR, wildcard map[string]bool) bool {
+	for _, rr := range answers {
+		if !wildcard[wildcardKey(rr)] {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcardKey identifies a record by type and data, as its owner is the
+// name asked for
+func wildcardKey(rr dns.RR) string {
+	return typeString(rr.Header().Rrtype) + " " + strings.ToLower(rrData(rr))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// errorClass is the kind of failure a query ended in. It decides the exit
+// status of the query command and the error_class of JSON output, so that
+// scripts can branch on it.
+type errorClass int
+
+const (
+	classNone errorClass = iota
+	classNXDomain
+	classServFail
+	classRefused
+	classRcode // any other error rcode
+	classTimeout
+	classNetwork
+	classBogus
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case classNone:
+		return ""
+	case classNXDomain:
+		return "nxdomain"
+	case classServFail:
+		return "servfail"
+	case classRefused:
+		return "refused"
+	case classRcode:
+		return "rcode"
+	case classTimeout:
+		return "timeout"
+	case classNetwork:
+		return "network"
+	default:
+		return "bogus"
+	}
+}
+
+// exitCode is the exit status for c. 1 stays for bad input and other
+// errors and 2 for flag errors, as the flag package exits with it.
+func (c errorClass) exitCode() int {
+	if c == classNone {
+		return 0
+	}
+	return int(c) + 2
+}
+
+// classify returns the class of a query that got resp or failed with err
+func classify(resp *dns.Msg, err error) errorClass {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, resolver.ErrTimeout):
+		return classTimeout
+	case err != nil:
+		return classNetwork
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		return classNone
+	case dns.RcodeNameError:
+		return classNXDomain
+	case dns.RcodeServerFailure:
+		return classServFail
+	case dns.RcodeRefused:
+		return classRefused
+	}
+	return classRcode
+}
+
+// queryFailed reports a query that got no response, also as a batch -json
+// line with -json, and exits with the status of its class
+func queryFailed(domain string, qtype uint16, err error, jsonOut bool) {
+	class := classify(nil, err)
+	slog.Error("DNS query failed", "name", domain, "class", class, "err", err)
+	if jsonOut {
+		line := batchJSON{Name: dns.Fqdn(domain), Type: typeString(qtype), Error: err.Error(), ErrorClass: class.String()}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(line)
+	}
+	os.Exit(class.exitCode())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// exportOptions are the flags that write the results of batch, sweep and
+// enum to a file for spreadsheets or jq
+type exportOptions struct {
+	path   string
+	format string
+}
+
+// register adds the export flags to fs
+func (o *exportOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.path, "o", "", "write the results to this `file` instead of standard output, as CSV or newline-delimited JSON by its extension (.csv, .ndjson or .jsonl), gzipped when it ends in .gz, - for standard output")
+	fs.StringVar(&o.format, "o-format", "", "`format` of the -o file, csv or ndjson, when its extension does not tell")
+}
+
+// active reports whether the results go to a file
+func (o *exportOptions) active() bool {
+	return o.path != ""
+}
+
+// resultWriter streams results to the -o file one at a time, so that large
+// result sets are never held in memory
+type resultWriter struct {
+	out    io.Writer
+	closer []io.Closer // closed in order once the output is flushed
+	buf    *bufio.Writer
+	csv    *csv.Writer
+}
+
+// create opens the -o file, writing the CSV header when it is one
+func (o *exportOptions) create(header []string) (*resultWriter, error) {
+	name := strings.TrimSuffix(strings.ToLower(o.path), ".gz")
+	format := strings.ToLower(o.format)
+	if format == "" {
+		switch {
+		case strings.HasSuffix(name, ".csv"):
+			format = "csv"
+		case strings.HasSuffix(name, ".ndjson"), strings.HasSuffix(name, ".jsonl"), strings.HasSuffix(name, ".json"):
+			format = "ndjson"
+		default:
+			return nil, fmt.Errorf("cannot tell the format of %s from its extension, give -o-format csv or ndjson", o.path)
+		}
+	}
+	if format != "csv" && format != "ndjson" {
+		return nil, fmt.Errorf("invalid -o-format %q, want csv or ndjson", o.format)
+	}
+
+	w := &resultWriter{}
+	var out io.Writer = os.Stdout
+	if o.path != "-" {
+		f, err := os.Create(o.path)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+		w.closer = append(w.closer, f)
+		if strings.HasSuffix(strings.ToLower(o.path), ".gz") {
+			gz := gzip.NewWriter(f)
+			out = gz
+			w.closer = append([]io.Closer{gz}, w.closer...)
+		}
+	}
+	w.buf = bufio.NewWriter(out)
+	w.out = w.buf
+	if format == "csv" {
+		w.csv = csv.NewWriter(w.buf)
+		if err := w.csv.Write(header); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// write adds one result: record as a JSON line, or rows as CSV records
+func (w *resultWriter) write(record any, rows [][]string) error {
+	if w.csv != nil {
+		return w.csv.WriteAll(rows)
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.out, "%s\n", b)
+	return err
+}
+
+// Close flushes the results and closes the file
+func (w *resultWriter) Close() error {
+	var first error
+	if w.csv != nil {
+		w.csv.Flush()
+		first = w.csv.Error()
+	}
+	if err := w.buf.Flush(); first == nil {
+		first = err
+	}
+	for _, c := range w.closer {
+		if err := c.Close(); first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("failed to write the results: %v", first)
+	}
+	return nil
+}
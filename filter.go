@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// filterFetchTimeout bounds the download of a list given as a URL
+const filterFetchTimeout = 30 * time.Second
+
+// domainSet holds the names of block or allow lists
+type domainSet struct {
+	exact      map[string]bool // the name only
+	subdomains map[string]bool // the name and everything below it
+	wildcards  map[string]bool // everything below the name, from *.name
+}
+
+func newDomainSet() domainSet {
+	return domainSet{exact: map[string]bool{}, subdomains: map[string]bool{}, wildcards: map[string]bool{}}
+}
+
+func (s domainSet) size() int {
+	return len(s.exact) + len(s.subdomains) + len(s.wildcards)
+}
+
+// contains reports whether name, a lowercased FQDN, matches an entry
+func (s domainSet) contains(name string) bool {
+	if s.exact[name] || s.subdomains[name] {
+		return true
+	}
+	for parent := name; parent != "."; {
+		parent = parentName(parent)
+		if s.subdomains[parent] || s.wildcards[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+// hostsLocalNames are the entries of a hosts file that are not blocked names
+var hostsLocalNames = map[string]bool{
+	"localhost.": true, "localhost.localdomain.": true, "local.": true, "broadcasthost.": true,
+	"ip6-localhost.": true, "ip6-loopback.": true, "0.0.0.0.": true,
+}
+
+// parseFilterLine adds one line of a list to block, and adblock style
+// exceptions to allow. It accepts hosts format ("0.0.0.0 name"), adblock
+// rules ("||name^", "@@||name^") and plain names, optionally "*.name".
+// Lines it does not understand, such as adblock rules for URLs or cosmetic
+// filters, are skipped.
+func parseFilterLine(line string, block, allow domainSet) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return
+	}
+	if rule, ok := strings.CutPrefix(line, "||"); ok || strings.HasPrefix(line, "@@||") {
+		target := block
+		if !ok {
+			rule, target = line[4:], allow
+		}
+		name, rest, _ := strings.Cut(rule, "^")
+		// Rules narrowed by options other than $important are not about whole names
+		if rest != "" && rest != "$important" {
+			return
+		}
+		if name = filterName(name); name != "" {
+			target.subdomains[name] = true
+		}
+		return
+	}
+
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	if net.ParseIP(fields[0]) != nil {
+		for _, f := range fields[1:] {
+			if name := filterName(f); name != "" && !hostsLocalNames[name] {
+				block.exact[name] = true
+			}
+		}
+		return
+	}
+	if len(fields) != 1 {
+		return
+	}
+	if rest, ok := strings.CutPrefix(fields[0], "*."); ok {
+		if name := filterName(rest); name != "" {
+			block.wildcards[name] = true
+		}
+	} else if name := filterName(fields[0]); name != "" {
+		block.exact[name] = true
+	}
+}
+
+// filterName returns the lowercased FQDN for a list entry, or "" when it
+// is not a domain name
+func filterName(s string) string {
+	name := strings.ToLower(dns.Fqdn(s))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." || strings.ContainsAny(name, "/*:") {
+		return ""
+	}
+	return name
+}
+
+// filterLists is one loaded generation of the block and allow lists
+type filterLists struct {
+	block domainSet
+	allow domainSet
+}
+
+// filter answers queries for blocked names in serve mode
+type filter struct {
+	blockSources []string
+	allowSources []string
+	response     string // nxdomain or null, or the sinkhole address
+	sinkhole     net.IP
+	ttl          uint32
+
+	lists atomic.Pointer[filterLists]
+	done  chan struct{} // closed by stop
+}
+
+// newFilter loads the block and allow lists, comma separated files or
+// URLs, and returns the filter, or nil when no blocklist is given. response
+// is nxdomain, null for the unspecified address, or a sinkhole address.
+func newFilter(blocklists, allowlists, response string, ttl uint32) (*filter, error) {
+	if blocklists == "" {
+		if allowlists != "" {
+			return nil, fmt.Errorf("-allowlist only makes exceptions to a -blocklist")
+		}
+		return nil, nil
+	}
+	f := &filter{blockSources: splitFiles(blocklists), allowSources: splitFiles(allowlists), response: strings.ToLower(response), ttl: ttl, done: make(chan struct{})}
+	switch f.response {
+	case "nxdomain", "null":
+	default:
+		if f.sinkhole = net.ParseIP(response); f.sinkhole == nil {
+			return nil, fmt.Errorf("invalid -block-response %q, use nxdomain, null or an IP address", response)
+		}
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load reads every list and swaps the new ones in
+func (f *filter) load() error {
+	lists := &filterLists{block: newDomainSet(), allow: newDomainSet()}
+	for _, src := range f.blockSources {
+		if err := readFilterList(src, lists.block, lists.allow); err != nil {
+			return err
+		}
+	}
+	for _, src := range f.allowSources {
+		// Everything in an allowlist is an exception, whatever its format
+		if err := readFilterList(src, lists.allow, lists.allow); err != nil {
+			return err
+		}
+	}
+	f.lists.Store(lists)
+	slog.Info("filter lists loaded", "blocked", lists.block.size(), "allowed", lists.allow.size())
+	return nil
+}
+
+// refresh reloads the lists every interval, keeping the old ones when a
+// reload fails, until stop is called
+func (f *filter) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+		if err := f.load(); err != nil {
+			slog.Warn("failed to reload filter lists, keeping the old ones", "err", err)
+		}
+	}
+}
+
+// stop ends refresh, once a new filter has replaced f
+func (f *filter) stop() {
+	if f != nil {
+		close(f.done)
+	}
+}
+
+// readFilterList parses the list at src, a file or an http(s) URL
+func readFilterList(src string, block, allow domainSet) error {
+	var r io.Reader
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		client := &http.Client{Timeout: filterFetchTimeout}
+		resp, err := client.Get(src)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %v", src, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to fetch %s: %s", src, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parseFilterLine(scanner.Text(), block, allow)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %v", src, err)
+	}
+	return nil
+}
+
+// ServeDNS implements resolver.Handler, answering the queries for blocked
+// names and passing on the others
+func (f *filter) ServeDNS(ctx context.Context, req *resolver.Request, next resolver.Next) (*dns.Msg, error) {
+	resp := f.answer(req.Msg)
+	if resp == nil {
+		return next(ctx, req)
+	}
+	req.Trace.Transport = "blocked"
+	slog.DebugContext(ctx, "query blocked", "question", questionString(req.Msg))
+	return resp, nil
+}
+
+// answer returns the response for a blocked name, or nil when req is not
+// blocked
+func (f *filter) answer(req *dns.Msg) *dns.Msg {
+	if f == nil || len(req.Question) != 1 {
+		return nil
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	lists := f.lists.Load()
+	if !lists.block.contains(name) || lists.allow.contains(name) {
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), false)
+	}
+	if f.response == "nxdomain" {
+		resp.Rcode = dns.RcodeNameError
+		return resp
+	}
+	v4, v6 := net.IPv4zero, net.IPv6unspecified
+	if f.sinkhole != nil {
+		v4, v6 = f.sinkhole.To4(), nil
+		if v4 == nil {
+			v6 = f.sinkhole
+		}
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: f.ttl}
+	switch {
+	case q.Qtype == dns.TypeA && v4 != nil:
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: v4})
+	case q.Qtype == dns.TypeAAAA && v6 != nil:
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: v6})
+	}
+	return resp
+}
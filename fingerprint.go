@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fingerprintEntry is the stored state for a single (name, type) pair
+type fingerprintEntry struct {
+	Hash    string    `json:"hash"`
+	Since   time.Time `json:"since"`
+	Checked time.Time `json:"checked"`
+}
+
+// fingerprintStatus describes how a fresh answer compares to the stored one
+type fingerprintStatus int
+
+const (
+	fingerprintNew fingerprintStatus = iota
+	fingerprintUnchanged
+	fingerprintChanged
+)
+
+func (s fingerprintStatus) String() string {
+	switch s {
+	case fingerprintNew:
+		return "new"
+	case fingerprintUnchanged:
+		return "unchanged"
+	default:
+		return "changed"
+	}
+}
+
+// fingerprintStore keeps a compact hash of each answer set in a JSON file so
+// later runs can tell when an answer has changed. A lock file next to the
+// store serialises access between concurrent processes.
+type fingerprintStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+const (
+	fingerprintLockWait  = 5 * time.Second
+	fingerprintLockStale = 30 * time.Second
+)
+
+func newFingerprintStore(path string) *fingerprintStore {
+	return &fingerprintStore{path: path}
+}
+
+// Record stores the fingerprint of resp for (name, qtype) and reports whether
+// it is new, unchanged or changed. For a changed answer the previous entry is
+// returned so the caller can say since when the old answer had been seen.
+func (s *fingerprintStore) Record(name string, qtype uint16, resp *dns.Msg) (fingerprintStatus, fingerprintEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock()
+	if err != nil {
+		return 0, fingerprintEntry{}, err
+	}
+	defer unlock()
+
+	entries, err := s.load()
+	if err != nil {
+		return 0, fingerprintEntry{}, err
+	}
+
+	key := fingerprintKey(name, qtype)
+	hash := answerFingerprint(resp)
+	now := time.Now().UTC()
+
+	prev, seen := entries[key]
+	status := fingerprintNew
+	switch {
+	case seen && prev.Hash == hash:
+		status = fingerprintUnchanged
+		entries[key] = fingerprintEntry{Hash: hash, Since: prev.Since, Checked: now}
+	case seen:
+		status = fingerprintChanged
+		entries[key] = fingerprintEntry{Hash: hash, Since: now, Checked: now}
+	default:
+		entries[key] = fingerprintEntry{Hash: hash, Since: now, Checked: now}
+	}
+
+	if err := s.save(entries); err != nil {
+		return 0, fingerprintEntry{}, err
+	}
+	return status, prev, nil
+}
+
+func (s *fingerprintStore) load() (map[string]fingerprintEntry, error) {
+	entries := make(map[string]fingerprintEntry)
+	data, err := ioutil.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fingerprint store: %v", err)
+	}
+	if len(data) == 0 {
+		return entries, nil
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse fingerprint store %s: %v", s.path, err)
+	}
+	return entries, nil
+}
+
+// save writes the store to a temporary file and renames it into place so a
+// crash never leaves a truncated store behind
+func (s *fingerprintStore) save(entries map[string]fingerprintEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode fingerprint store: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write fingerprint store: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write fingerprint store: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write fingerprint store: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace fingerprint store: %v", err)
+	}
+	return nil
+}
+
+// lock takes the inter-process lock, breaking locks left behind by crashed runs
+func (s *fingerprintStore) lock() (func(), error) {
+	lockPath := s.path + ".lock"
+	deadline := time.Now().Add(fingerprintLockWait)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to lock fingerprint store: %v", err)
+		}
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > fingerprintLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for fingerprint store lock %s", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func fingerprintKey(name string, qtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + "/" + dns.TypeToString[qtype]
+}
+
+// answerFingerprint hashes the rcode and answer records with TTLs zeroed and
+// owner names lowercased, so only changes in the data itself are detected
+func answerFingerprint(resp *dns.Msg) string {
+	records := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		records = append(records, rr.String())
+	}
+	sort.Strings(records)
+
+	h := sha256.New()
+	h.Write([]byte(dns.RcodeToString[resp.Rcode] + "\n"))
+	h.Write([]byte(strings.Join(records, "\n")))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerOf returns a response to an A query for name with the records rrs
+func answerOf(t *testing.T, name string, rrs ...string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m = m.SetReply(m)
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestFingerprintStoreRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprints.json")
+	store := newFingerprintStore(path)
+
+	first := answerOf(t, "example.com.", "example.com. 300 IN A 192.0.2.1", "example.com. 300 IN A 192.0.2.2")
+	status, _, err := store.Record("example.com", dns.TypeA, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != fingerprintNew {
+		t.Fatalf("first sighting is %v, want new", status)
+	}
+
+	// Another order, TTL and owner case make the same RRset
+	same := answerOf(t, "example.com.", "EXAMPLE.com. 60 IN A 192.0.2.2", "example.com. 60 IN A 192.0.2.1")
+	status, prev, err := store.Record("Example.COM.", dns.TypeA, same)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != fingerprintUnchanged {
+		t.Fatalf("same RRset is %v, want unchanged", status)
+	}
+	since := prev.Since
+
+	changed := answerOf(t, "example.com.", "example.com. 300 IN A 192.0.2.3")
+	status, prev, err = store.Record("example.com", dns.TypeA, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != fingerprintChanged {
+		t.Fatalf("different RRset is %v, want changed", status)
+	}
+	if !prev.Since.Equal(since) || prev.Hash != answerFingerprint(first) {
+		t.Errorf("changed answer returned previous entry %+v, want the first one seen since %v", prev, since)
+	}
+
+	// The entry is on disk, and a new store over the file carries on from it
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries map[string]fingerprintEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := entries["example.com./A"]
+	if !ok || entry.Hash != answerFingerprint(changed) {
+		t.Fatalf("stored entries %+v, want example.com./A with the changed hash", entries)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+	status, prev, err = newFingerprintStore(path).Record("example.com", dns.TypeA, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != fingerprintUnchanged || !prev.Since.Equal(entry.Since) {
+		t.Errorf("reloaded store says %v since %v, want unchanged since %v", status, prev.Since, entry.Since)
+	}
+
+	// Other types of the name are kept apart
+	status, _, err = store.Record("example.com", dns.TypeAAAA, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != fingerprintNew {
+		t.Errorf("first AAAA sighting is %v, want new", status)
+	}
+}
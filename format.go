@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// formatRecord is what a -format template sees: one answer record and the
+// response it came in
+type formatRecord struct {
+	QName string // the question
+	QType string
+
+	// The answer record, all empty when the response has none
+	Name  string
+	Type  string
+	Class string
+	TTL   uint32
+	Data  string
+
+	Rcode     string
+	RTT       time.Duration
+	RTTMillis float64
+	Server    string
+	Transport string
+}
+
+// parseFormat parses a -format template
+func parseFormat(text string) (*template.Template, error) {
+	return template.New("format").Parse(text)
+}
+
+// printFormat executes tmpl for every answer record of resp, or once with
+// empty record fields when there is none, ending each run with a newline
+// unless the template already does
+func printFormat(w io.Writer, tmpl *template.Template, resp *dns.Msg, trace resolver.Trace) error {
+	base := formatRecord{
+		Rcode:     rcodeString(resp.Rcode),
+		RTT:       trace.RTT,
+		RTTMillis: float64(trace.RTT.Microseconds()) / 1000,
+		Server:    trace.Server,
+		Transport: trace.Transport,
+	}
+	if len(resp.Question) > 0 {
+		base.QName, base.QType = resp.Question[0].Name, typeString(resp.Question[0].Qtype)
+	}
+	records := []formatRecord{base}
+	if len(resp.Answer) > 0 {
+		records = records[:0]
+		for _, rr := range resp.Answer {
+			h := rr.Header()
+			rec := base
+			rec.Name, rec.Type, rec.Class, rec.TTL = h.Name, typeString(h.Rrtype), dns.ClassToString[h.Class], h.Ttl
+			rec.Data = strings.TrimSpace(rrData(rr))
+			records = append(records, rec)
+		}
+	}
+	var buf bytes.Buffer
+	for _, rec := range records {
+		buf.Reset()
+		if err := tmpl.Execute(&buf, rec); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
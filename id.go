@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// chaosNames are the CH TXT names servers answer with their identity:
+// BIND's version.bind and hostname.bind, and id.server of RFC 4892
+var chaosNames = []string{"version.bind.", "hostname.bind.", "id.server."}
+
+// idField is one thing a server was asked about itself
+type idField struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// idResult is what one server revealed, also the -json rendering
+type idResult struct {
+	Server string    `json:"server"`
+	Fields []idField `json:"fields"`
+}
+
+// revealed reports whether any of the questions got an answer
+func (r idResult) revealed() bool {
+	for _, f := range r.Fields {
+		if f.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// runID implements the id subcommand: it asks each server for version.bind,
+// hostname.bind and id.server in the CHAOS class and for its NSID (RFC
+// 5001), which tells anycast instances apart. It exits with status 1 when
+// a server reveals nothing.
+func runID(args []string) {
+	fs := flag.NewFlagSet("id", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each server after this `duration`")
+	jsonOut := fs.Bool("json", false, "print the results as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s id [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "id"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	// Each server is asked on its own, so the answers say who gave them
+	results := make([]idResult, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		r, err := opts.buildResolver([]upstream{u})
+		if err != nil {
+			fatal(err.Error())
+		}
+		results[i].Server = upstreamLabel(u)
+		wg.Add(1)
+		go func(res *idResult) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			res.Fields = identify(ctx, r)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printID(results)
+	}
+	for _, res := range results {
+		if !res.revealed() {
+			os.Exit(1)
+		}
+	}
+}
+
+// identify sends the CHAOS queries and an NSID request at once
+func identify(ctx context.Context, r resolver.Resolver) []idField {
+	fields := make([]idField, len(chaosNames)+1)
+	var wg sync.WaitGroup
+	for i, name := range chaosNames {
+		fields[i].Name = strings.TrimSuffix(name, ".")
+		wg.Add(1)
+		go func(f *idField, name string) {
+			defer wg.Done()
+			q := resolver.NewQuery(name, dns.TypeTXT)
+			q.Question[0].Qclass = dns.ClassCHAOS
+			resp, err := r.Exchange(resolver.WithTraceID(ctx, resolver.NewTraceID()), q)
+			switch {
+			case err != nil:
+				f.Error = err.Error()
+			case resp.Rcode != dns.RcodeSuccess:
+				f.Error = rcodeString(resp.Rcode)
+			default:
+				f.Value = chaosText(resp)
+				if f.Value == "" {
+					f.Error = "no TXT record"
+				}
+			}
+		}(&fields[i], name)
+	}
+
+	// NSID rides on an ordinary query, servers refusing CHAOS ones still send it
+	nsid := &fields[len(chaosNames)]
+	nsid.Name = "NSID"
+	q := resolver.NewQuery(".", dns.TypeNS)
+	if err := (resolver.EDNSOptions{NSID: true}).Apply(q); err != nil {
+		nsid.Error = err.Error()
+	} else if resp, err := r.Exchange(resolver.WithTraceID(ctx, resolver.NewTraceID()), q); err != nil {
+		nsid.Error = err.Error()
+	} else {
+		nsid.Value = nsidText(resp)
+		if nsid.Value == "" {
+			nsid.Error = "not sent"
+		}
+	}
+	wg.Wait()
+	return fields
+}
+
+// chaosText joins the strings of the TXT answers
+func chaosText(resp *dns.Msg) string {
+	var parts []string
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			parts = append(parts, strings.Join(txt.Txt, " "))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// nsidText returns the NSID of resp as text when it is printable, otherwise
+// in hex
+func nsidText(resp *dns.Msg) string {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		if o, ok := o.(*dns.EDNS0_NSID); ok && o.Nsid != "" {
+			if text, err := hex.DecodeString(o.Nsid); err == nil && printable(text) {
+				return string(text)
+			}
+			return o.Nsid
+		}
+	}
+	return ""
+}
+
+// printID prints what each server revealed, with the reason for what it
+// did not
+func printID(results []idResult) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, res := range results {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintln(tw, res.Server)
+		for _, f := range res.Fields {
+			if f.Value != "" {
+				fmt.Fprintf(tw, "  %s\t%s\n", f.Name, f.Value)
+			} else {
+				fmt.Fprintf(tw, "  %s\t- (%s)\n", f.Name, f.Error)
+			}
+		}
+	}
+	tw.Flush()
+}
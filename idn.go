@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+// idnProfile converts internationalized names like a lookup does, but
+// without the hostname rules that would reject names such as _dmarc.example
+var idnProfile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.BidiRule(), idna.StrictDomainName(false))
+
+// toASCII returns name with its Unicode labels in their xn-- form, so that
+// bücher.de can be queried. ASCII names are returned unchanged.
+func toASCII(name string) (string, error) {
+	if isASCII(name) {
+		return name, nil
+	}
+	ascii, err := idnProfile.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid internationalized domain name %q: %v", name, err)
+	}
+	return ascii, nil
+}
+
+// toUnicode returns name with its xn-- labels decoded for display, or name
+// itself when it has none or they do not decode
+func toUnicode(name string) string {
+	if !strings.Contains(strings.ToLower(name), "xn--") {
+		return name
+	}
+	unicode, err := idnProfile.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return unicode
+}
+
+// displayRR formats rr with its owner name in Unicode. The record's own
+// formatting would escape the UTF-8 bytes, so the name is swapped in after.
+func displayRR(rr dns.RR) string {
+	s := rr.String()
+	name := rr.Header().Name
+	if unicode := toUnicode(name); unicode != name && strings.HasPrefix(s, name) {
+		s = unicode + s[len(name):]
+	}
+	return s
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// newTraceIterator returns an Iterator that starts at the given root hints
+// and prints each step the way dig +trace does
+func newTraceIterator(roots []upstream, port int, timeout time.Duration, family int, minimize bool) (*resolver.Iterator, error) {
+	it := resolver.NewIterator()
+	it.Family = family
+	it.Minimize = minimize
+	it.Roots = nil
+	for _, u := range roots {
+		if u.Method != "udp" && u.Method != "tcp" {
+			return nil, fmt.Errorf("-trace talks to authoritative servers and only supports the 'udp' and 'tcp' methods")
+		}
+		it.Roots = append(it.Roots, u.Addr)
+	}
+	if roots[0].Method == "tcp" {
+		it.Transport = func(addr string) resolver.Resolver { return resolver.NewTCP(addr) }
+	}
+	if port != 0 {
+		it.Port = strconv.Itoa(port)
+	}
+	it.Timeout = timeout
+	it.OnStep = printTraceStep
+	return it, nil
+}
+
+// printTraceStep shows the records a server returned, then where they came from
+func printTraceStep(s resolver.Step) {
+	if s.Err != nil {
+		fmt.Printf(";; %s: no response from %s for %s: %v\n\n", s.Name, s.Server, s.Zone, s.Err)
+		return
+	}
+	resp := s.Response
+	records := resp.Answer
+	if len(records) == 0 {
+		records = resp.Ns
+	}
+	for _, rr := range records {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			continue
+		}
+		fmt.Println(rr)
+	}
+	kind := "referral"
+	switch {
+	case len(resp.Answer) > 0:
+		kind = "answer"
+	case resp.Rcode != dns.RcodeSuccess:
+		kind = dns.RcodeToString[resp.Rcode]
+	case resp.Authoritative:
+		kind = "NODATA"
+	}
+	fmt.Printf(";; %s: received %d bytes from %s (%s servers) in %d ms, %s\n\n", s.Name, resp.Len(), s.Server, s.Zone, s.RTT.Milliseconds(), kind)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// jsonResponse is the -json rendering of a response
+type jsonResponse struct {
+	Server      string         `json:"server"`
+	Transport   string         `json:"transport"`
+	Protocol    string         `json:"protocol,omitempty"`
+	RTTMillis   float64        `json:"rtt_ms"`
+	Size        int            `json:"size"`
+	ID          uint16         `json:"id"`
+	Opcode      string         `json:"opcode"`
+	Rcode       string         `json:"rcode"`
+	EDE         []jsonEDE      `json:"extended_errors,omitempty"`
+	Flags       []string       `json:"flags"`
+	Question    []jsonQuestion `json:"question"`
+	Answer      []jsonRR       `json:"answer"`
+	Authority   []jsonRR       `json:"authority"`
+	Additional  []jsonRR       `json:"additional"`
+	EDNS        *jsonEDNS      `json:"edns,omitempty"`
+	DNSSEC      *dnssecResult  `json:"dnssec,omitempty"`
+	TLS         *jsonTLS       `json:"tls,omitempty"`
+	Fingerprint string         `json:"fingerprint,omitempty"`
+	Search      []searchTry    `json:"search,omitempty"`
+	ErrorClass  string         `json:"error_class,omitempty"`
+}
+
+type jsonQuestion struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+type jsonRR struct {
+	Name   string      `json:"name"`
+	Type   string      `json:"type"`
+	Class  string      `json:"class"`
+	TTL    uint32      `json:"ttl"`
+	Data   string      `json:"data"`
+	SVCB   *jsonSVCB   `json:"svcb,omitempty"`
+	TXT    *jsonTXT    `json:"txt,omitempty"`
+	SOA    *jsonSOA    `json:"soa,omitempty"`
+	DNSKEY *jsonDNSKEY `json:"dnskey,omitempty"`
+	DS     *jsonDS     `json:"ds,omitempty"`
+	RRSIG  *jsonRRSIG  `json:"rrsig,omitempty"`
+}
+
+// dnssecResult is the outcome of -dnssec validation
+type dnssecResult struct {
+	Status string      `json:"status"`
+	Reason string      `json:"reason,omitempty"`
+	Denial *jsonDenial `json:"denial,omitempty"`
+}
+
+// jsonDenial explains the NSEC or NSEC3 proof of a negative answer
+type jsonDenial struct {
+	Kind   string   `json:"kind"`
+	Type   string   `json:"type"`
+	Proof  []string `json:"proof"`
+	OptOut bool     `json:"opt_out,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// newJSONDenial converts d, returning nil for answers that deny nothing or
+// carry no NSEC or NSEC3 records at all
+func newJSONDenial(d *resolver.Denial) *jsonDenial {
+	if d == nil || d.Type == "" {
+		return nil
+	}
+	out := &jsonDenial{Kind: d.Kind, Type: d.Type, Proof: d.Steps, OptOut: d.OptOut}
+	if d.Err != nil {
+		out.Error = d.Err.Error()
+	}
+	return out
+}
+
+func (d *dnssecResult) String() string {
+	if d.Reason == "" {
+		return "DNSSEC: " + d.Status
+	}
+	return fmt.Sprintf("DNSSEC: %s (%s)", d.Status, d.Reason)
+}
+
+// jsonEDE is an Extended DNS Error (RFC 8914), which explains the rcode
+type jsonEDE struct {
+	Code      uint16 `json:"code"`
+	Name      string `json:"name"`
+	ExtraText string `json:"extra_text,omitempty"`
+}
+
+type jsonEDNS struct {
+	Version uint8    `json:"version"`
+	UDPSize uint16   `json:"udp_size"`
+	Flags   []string `json:"flags"`
+	Options []string `json:"options,omitempty"`
+}
+
+// newJSONResponse converts resp and the trace of the exchange that produced it
+func newJSONResponse(resp *dns.Msg, trace resolver.Trace) jsonResponse {
+	out := jsonResponse{
+		Server:     trace.Server,
+		Transport:  trace.Transport,
+		Protocol:   trace.Protocol,
+		RTTMillis:  float64(trace.RTT.Microseconds()) / 1000,
+		Size:       trace.ResponseSize,
+		ID:         resp.Id,
+		Opcode:     dns.OpcodeToString[resp.Opcode],
+		Rcode:      dns.RcodeToString[resp.Rcode],
+		Flags:      headerFlags(resp),
+		Question:   []jsonQuestion{},
+		Answer:     jsonRRs(resp.Answer),
+		Authority:  jsonRRs(resp.Ns),
+		Additional: jsonRRs(resp.Extra),
+		ErrorClass: classify(resp, nil).String(),
+	}
+	for _, q := range resp.Question {
+		out.Question = append(out.Question, jsonQuestion{Name: q.Name, Type: typeString(q.Qtype), Class: dns.ClassToString[q.Qclass]})
+	}
+	for _, e := range resolver.ExtendedErrors(resp) {
+		out.EDE = append(out.EDE, jsonEDE{Code: e.Code, Name: e.Name(), ExtraText: e.ExtraText})
+	}
+	if opt := resp.IsEdns0(); opt != nil {
+		edns := &jsonEDNS{Version: opt.Version(), UDPSize: opt.UDPSize(), Flags: []string{}}
+		if opt.Do() {
+			edns.Flags = append(edns.Flags, "do")
+		}
+		for _, o := range opt.Option {
+			edns.Options = append(edns.Options, describeOption(o))
+		}
+		out.EDNS = edns
+	}
+	return out
+}
+
+// jsonRRs converts a section, leaving out the OPT pseudo-record
+func jsonRRs(rrs []dns.RR) []jsonRR {
+	out := []jsonRR{}
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.OPT); ok {
+			continue
+		}
+		h := rr.Header()
+		out = append(out, jsonRR{
+			Name:   h.Name,
+			Type:   typeString(h.Rrtype),
+			Class:  dns.ClassToString[h.Class],
+			TTL:    h.Ttl,
+			Data:   rrData(rr),
+			SVCB:   newJSONSVCB(rr),
+			TXT:    newJSONTXT(rr),
+			SOA:    newJSONSOA(rr),
+			DNSKEY: newJSONDNSKEY(rr),
+			DS:     newJSONDS(rr),
+			RRSIG:  newJSONRRSIG(rr),
+		})
+	}
+	return out
+}
+
+// rrData returns the presentation form of the record data alone
+func rrData(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// headerFlags lists the header flags that are set, in dig's order
+func headerFlags(m *dns.Msg) []string {
+	flags := []string{}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{m.Response, "qr"},
+		{m.Authoritative, "aa"},
+		{m.Truncated, "tc"},
+		{m.RecursionDesired, "rd"},
+		{m.RecursionAvailable, "ra"},
+		{m.Zero, "z"},
+		{m.AuthenticatedData, "ad"},
+		{m.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errInterrupted is returned by readLine when the line is given up with
+// Ctrl-C
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads the lines of the shell. On a terminal it edits them in
+// raw mode, with the cursor keys, the history under up and down and the
+// candidates complete gives under tab; elsewhere it reads plain lines.
+type lineEditor struct {
+	in       *bufio.Reader
+	fd       int
+	terminal bool
+	out      io.Writer
+	history  []string
+	// complete returns the words that can replace the last word of line
+	complete func(line string) []string
+}
+
+func newLineEditor(in *os.File, out io.Writer) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(in), fd: int(in.Fd()), out: out}
+	if restore, err := makeRaw(e.fd); err == nil {
+		restore()
+		e.terminal = true
+	}
+	return e
+}
+
+// readLine shows prompt and returns the line entered, without its newline.
+// It fails with io.EOF at the end of the input or on Ctrl-D on an empty
+// line.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if !e.terminal {
+		line, err := e.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	var buf []rune
+	pos := 0
+	hist := len(e.history) // the history entry shown, len for the new line
+	pending := ""          // the new line while the history is browsed
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	show := func(line string) {
+		buf, pos = []rune(line), len([]rune(line))
+		redraw()
+	}
+	redraw()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 2: // Ctrl-B
+			if pos > 0 {
+				pos--
+			}
+		case 6: // Ctrl-F
+			if pos < len(buf) {
+				pos++
+			}
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf, pos = buf[pos:], 0
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && buf[start-1] != ' ' {
+				start--
+			}
+			buf, pos = append(buf[:start], buf[pos:]...), start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf, pos = append(buf[:pos-1], buf[pos:]...), pos-1
+			}
+		case '\t':
+			e.completeLine(prompt, &buf, &pos)
+		case 27: // an escape sequence
+			switch e.escape() {
+			case 'A':
+				if hist > 0 {
+					if hist == len(e.history) {
+						pending = string(buf)
+					}
+					hist--
+					show(e.history[hist])
+				}
+				continue
+			case 'B':
+				if hist < len(e.history) {
+					hist++
+					if hist == len(e.history) {
+						show(pending)
+					} else {
+						show(e.history[hist])
+					}
+				}
+				continue
+			case 'C':
+				if pos < len(buf) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(buf)
+			case '~': // Delete
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r < ' ' {
+				continue
+			}
+			buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+			pos++
+		}
+		redraw()
+	}
+}
+
+// escape reads the rest of an escape sequence and returns its final byte,
+// with the Home, End and Delete keys in their VT forms turned into H, F and ~
+func (e *lineEditor) escape() byte {
+	b, err := e.in.ReadByte()
+	if err != nil || b != '[' && b != 'O' {
+		return 0
+	}
+	var params []byte
+	for {
+		c, err := e.in.ReadByte()
+		if err != nil {
+			return 0
+		}
+		if c >= '0' && c <= '9' || c == ';' {
+			params = append(params, c)
+			continue
+		}
+		if c != '~' {
+			return c
+		}
+		switch string(params) {
+		case "1", "7":
+			return 'H'
+		case "4", "8":
+			return 'F'
+		case "3":
+			return '~'
+		}
+		return 0
+	}
+}
+
+// completeLine completes the word before the cursor: with one candidate
+// fully, with several as far as they agree, listing them when they agree
+// no further
+func (e *lineEditor) completeLine(prompt string, buf *[]rune, pos *int) {
+	if e.complete == nil {
+		return
+	}
+	line := string((*buf)[:*pos])
+	start := strings.LastIndexByte(line, ' ') + 1
+	if i := strings.LastIndexByte(line, '='); i+1 > start {
+		start = i + 1
+	}
+	word := line[start:]
+	var candidates []string
+	for _, c := range e.complete(line) {
+		if strings.HasPrefix(strings.ToLower(c), strings.ToLower(word)) {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(strings.ToLower(c), strings.ToLower(prefix)) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(candidates) == 1 && !strings.HasSuffix(prefix, "=") {
+		prefix += " "
+	}
+	if len(prefix) > len(word) {
+		insert := []rune(prefix[len(word):])
+		if !strings.HasPrefix(prefix, word) {
+			// Keep the case the candidate has
+			insert = []rune(prefix)
+			*buf, *pos = append((*buf)[:*pos-len([]rune(word))], (*buf)[*pos:]...), *pos-len([]rune(word))
+		}
+		*buf = append((*buf)[:*pos], append(insert, (*buf)[*pos:]...)...)
+		*pos += len(insert)
+		return
+	}
+	if len(candidates) > 1 {
+		fmt.Fprintf(e.out, "\n%s\n", strings.Join(candidates, "  "))
+	}
+}
+
+// remember adds line to the history, unless it repeats the last entry
+func (e *lineEditor) remember(line string) bool {
+	if line == "" || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return false
+	}
+	e.history = append(e.history, line)
+	return true
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// localData is what serve answers itself instead of forwarding: names from
+// hosts files and the contents of local zone files, for split horizon setups
+type localData struct {
+	hosts map[string][]net.IP // lowercased FQDN to its addresses
+	ptr   map[string]string   // reverse name to the first name given for its address
+	ttl   uint32              // TTL of answers from hosts files
+	zones []*localZone        // longest origin first
+}
+
+// loadLocalData reads the hosts and zone files, given as comma separated
+// lists. It returns nil when both are empty.
+func loadLocalData(hostsFiles, zoneFiles string, ttl uint32) (*localData, error) {
+	if hostsFiles == "" && zoneFiles == "" {
+		return nil, nil
+	}
+	l := &localData{hosts: map[string][]net.IP{}, ptr: map[string]string{}, ttl: ttl}
+	for _, path := range splitFiles(hostsFiles) {
+		if err := l.readHosts(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range splitFiles(zoneFiles) {
+		z, err := readLocalZone(path, "")
+		if err != nil {
+			return nil, err
+		}
+		l.zones = append(l.zones, z)
+	}
+	sort.SliceStable(l.zones, func(i, j int) bool {
+		return dns.CountLabel(l.zones[i].origin) > dns.CountLabel(l.zones[j].origin)
+	})
+	return l, nil
+}
+
+func splitFiles(list string) []string {
+	var files []string
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// readHosts adds the entries of an /etc/hosts style file: an address, then
+// the names it belongs to, with # starting a comment
+func (l *localData) readHosts(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		// Zone indexes such as fe80::1%eth0 mean nothing in DNS
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("%s:%d: want an address followed by names", path, line)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(dns.Fqdn(name))
+			if _, ok := dns.IsDomainName(name); !ok {
+				return fmt.Errorf("%s:%d: invalid name %q", path, line, name)
+			}
+			l.hosts[name] = append(l.hosts[name], ip)
+		}
+		if rev, err := dns.ReverseAddr(ip.String()); err == nil {
+			if _, seen := l.ptr[rev]; !seen {
+				l.ptr[rev] = dns.Fqdn(fields[1])
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// localZone is a zone loaded from a master file
+type localZone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR // lowercased owner name to its records
+	names   map[string]bool     // owner names and the empty non-terminals above them
+}
+
+// readLocalZone parses an RFC 1035 master file, whose SOA record names the
+// zone. Relative names are completed with origin when the file does not set
+// $ORIGIN itself.
+func readLocalZone(path, origin string) (*localZone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z := &localZone{records: map[string][]dns.RR{}, names: map[string]bool{}}
+	zp := dns.NewZoneParser(f, origin, path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			if z.soa != nil {
+				return nil, fmt.Errorf("%s: more than one SOA record", path)
+			}
+			z.soa = soa
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		z.records[owner] = append(z.records[owner], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("%s: no SOA record to take the zone name from", path)
+	}
+	z.origin = strings.ToLower(z.soa.Hdr.Name)
+	for owner := range z.records {
+		if !dns.IsSubDomain(z.origin, owner) {
+			return nil, fmt.Errorf("%s: %s is outside the zone %s", path, owner, z.origin)
+		}
+		for name := owner; ; {
+			z.names[name] = true
+			if name == z.origin {
+				break
+			}
+			name = parentName(name)
+		}
+	}
+	return z, nil
+}
+
+// parentName strips the first label of an FQDN
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// ServeDNS implements resolver.Handler, answering from the local data and
+// passing on the queries it has no answer for
+func (l *localData) ServeDNS(ctx context.Context, req *resolver.Request, next resolver.Next) (*dns.Msg, error) {
+	resp := l.answer(req.Msg)
+	if resp == nil {
+		return next(ctx, req)
+	}
+	req.Trace.Transport = "local"
+	return resp, nil
+}
+
+// answer returns the local response to req, or nil when req is to be
+// forwarded. Local responses are authoritative, NODATA for the types a
+// hosts file name has no records of.
+func (l *localData) answer(req *dns.Msg) *dns.Msg {
+	if l == nil || len(req.Question) != 1 || req.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+
+	if ips, ok := l.hosts[name]; ok && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: l.ttl}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip4})
+			} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		return resp
+	}
+	if target, ok := l.ptr[name]; ok && q.Qtype == dns.TypePTR {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: l.ttl}
+		resp.Answer = append(resp.Answer, &dns.PTR{Hdr: hdr, Ptr: target})
+		return resp
+	}
+
+	for _, z := range l.zones {
+		if dns.IsSubDomain(z.origin, name) {
+			z.answer(resp, q)
+			return resp
+		}
+	}
+	// The other types of local names have no data here, and asking upstream
+	// would leak the name and might bring back public data contradicting ours
+	_, host := l.hosts[name]
+	_, ptr := l.ptr[name]
+	if host || ptr {
+		return resp
+	}
+	return nil
+}
+
+// localCNAMELimit bounds CNAME chains followed inside a zone
+const localCNAMELimit = 8
+
+// answer fills in resp for a question inside the zone, following CNAMEs
+// that stay in it and synthesizing answers from wildcards. Names at or
+// below a delegation get a referral to its name servers.
+func (z *localZone) answer(resp *dns.Msg, q dns.Question) {
+	name := q.Name
+	seen := map[string]bool{}
+	for i := 0; i < localCNAMELimit; i++ {
+		lower := strings.ToLower(name)
+		seen[lower] = true
+		// The DS records of a cut are the zone's own, on the parent side
+		// of it (RFC 4035)
+		if cut := z.delegation(lower); cut != "" && (cut != lower || q.Qtype != dns.TypeDS) {
+			z.referral(resp, cut)
+			return
+		}
+		rrs, exists := z.lookup(name)
+		if !exists {
+			// The rcode is that of the last name in the chain, RFC 6604
+			resp.Rcode = dns.RcodeNameError
+			break
+		}
+		var cname *dns.CNAME
+		answered := false
+		for _, rr := range rrs {
+			switch {
+			case rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY:
+				resp.Answer = append(resp.Answer, rr)
+				answered = true
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+		if answered {
+			return
+		}
+		if cname == nil {
+			break
+		}
+		resp.Answer = append(resp.Answer, cname)
+		target := strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(z.origin, target) || seen[target] {
+			// Out of the zone the client's resolver follows it, a loop it gives up on
+			return
+		}
+		name = cname.Target
+	}
+	// NXDOMAIN or NODATA, with the SOA for negative caching (RFC 2308)
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	resp.Ns = append(resp.Ns, soa)
+}
+
+// referral adds the NS records of the delegation at cut to resp, with the
+// addresses the zone has for the name servers inside it as glue. The
+// response is not authoritative unless a CNAME of the zone led to the cut.
+func (z *localZone) referral(resp *dns.Msg, cut string) {
+	resp.Authoritative = len(resp.Answer) > 0
+	for _, rr := range z.records[cut] {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		resp.Ns = append(resp.Ns, ns)
+		target := strings.ToLower(ns.Ns)
+		if !dns.IsSubDomain(z.origin, target) {
+			continue
+		}
+		for _, glue := range z.records[target] {
+			if t := glue.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				resp.Extra = append(resp.Extra, glue)
+			}
+		}
+	}
+}
+
+// lookup returns the records owned by name, copied to carry that name when
+// they come from a wildcard, and whether the name exists at all
+func (z *localZone) lookup(name string) ([]dns.RR, bool) {
+	lower := strings.ToLower(name)
+	if z.names[lower] {
+		return z.records[lower], true
+	}
+	// The wildcard at the closest encloser, RFC 4592
+	for encloser := lower; encloser != z.origin; {
+		encloser = parentName(encloser)
+		if !z.names[encloser] {
+			continue
+		}
+		wild := z.records["*."+encloser]
+		if len(wild) == 0 {
+			return nil, false
+		}
+		rrs := make([]dns.RR, len(wild))
+		for i, rr := range wild {
+			rrs[i] = dns.Copy(rr)
+			rrs[i].Header().Name = name
+		}
+		return rrs, true
+	}
+	return nil, false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// writeFile writes content to a file in a temporary directory and returns
+// its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func question(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+func TestLocalOverrideTTL(t *testing.T) {
+	hosts := writeFile(t, "hosts", "192.0.2.10 host1.lan\n2001:db8::10 host1.lan\n")
+	l, err := loadLocalData(hosts, "", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []*dns.Msg{
+		question("host1.lan.", dns.TypeA),
+		question("HOST1.lan.", dns.TypeAAAA),
+		question("10.2.0.192.in-addr.arpa.", dns.TypePTR),
+	} {
+		resp := l.answer(q)
+		if resp == nil || len(resp.Answer) != 1 {
+			t.Fatalf("%v: got %v, want one local record", q.Question[0], resp)
+		}
+		if ttl := resp.Answer[0].Header().Ttl; ttl != 42 {
+			t.Errorf("%v: TTL %d, want the configured 42", q.Question[0], ttl)
+		}
+	}
+
+	blocklist := writeFile(t, "blocklist", "ads.example\n")
+	f, err := newFilter(blocklist, "", "null", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.stop()
+	resp := f.answer(question("ads.example.", dns.TypeA))
+	if resp == nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 42 {
+		t.Errorf("blocked name answered %v, want 0.0.0.0 with the configured TTL 42", resp)
+	}
+}
+
+func TestLocalNoData(t *testing.T) {
+	hosts := writeFile(t, "hosts", "192.0.2.10 host1.lan\n")
+	l, err := loadLocalData(hosts, "", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		q       *dns.Msg
+		answers int
+	}{
+		{question("host1.lan.", dns.TypeA), 1},
+		{question("host1.lan.", dns.TypeAAAA), 0},
+		{question("host1.lan.", dns.TypeMX), 0},
+		{question("HOST1.LAN.", dns.TypeTXT), 0},
+		{question("10.2.0.192.in-addr.arpa.", dns.TypePTR), 1},
+		{question("10.2.0.192.in-addr.arpa.", dns.TypeTXT), 0},
+	} {
+		resp := l.answer(tt.q)
+		if resp == nil {
+			t.Errorf("%v: forwarded, want a local answer", tt.q.Question[0])
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess || !resp.Authoritative || len(resp.Answer) != tt.answers {
+			t.Errorf("%v: got %v, want an authoritative NOERROR with %d records", tt.q.Question[0], resp, tt.answers)
+		}
+	}
+	for _, q := range []*dns.Msg{question("host2.lan.", dns.TypeMX), question("11.2.0.192.in-addr.arpa.", dns.TypePTR)} {
+		if resp := l.answer(q); resp != nil {
+			t.Errorf("%v: answered %v, want it forwarded", q.Question[0], resp)
+		}
+	}
+}
+
+func TestLocalZoneReferral(t *testing.T) {
+	zone := writeFile(t, "lan.zone", `$ORIGIN lan.
+$TTL 300
+@          IN SOA ns.lan. admin.lan. 1 7200 900 86400 600
+@          IN NS  ns.lan.
+ns         IN A   192.0.2.53
+www        IN A   192.0.2.80
+alias      IN CNAME www.sub
+sub        IN NS  ns.sub
+sub        IN NS  ns.example.net.
+sub        IN DS  12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF
+ns.sub     IN A   192.0.2.54
+*.sub      IN A   192.0.2.99
+`)
+	l, err := loadLocalData("", zone, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []*dns.Msg{
+		question("www.sub.lan.", dns.TypeA),
+		question("deep.below.sub.lan.", dns.TypeAAAA),
+		question("SUB.lan.", dns.TypeNS),
+		question("sub.lan.", dns.TypeA),
+		question("ns.sub.lan.", dns.TypeA),
+	} {
+		resp := l.answer(q)
+		if resp == nil || resp.Rcode != dns.RcodeSuccess || resp.Authoritative || len(resp.Answer) != 0 {
+			t.Errorf("%v: got %v, want a referral", q.Question[0], resp)
+			continue
+		}
+		if len(resp.Ns) != 2 || resp.Ns[0].Header().Rrtype != dns.TypeNS {
+			t.Errorf("%v: authority %v, want the two NS records of sub.lan", q.Question[0], resp.Ns)
+		}
+		// Only the name server inside the zone has glue
+		if len(resp.Extra) != 1 || resp.Extra[0].(*dns.A).A.String() != "192.0.2.54" {
+			t.Errorf("%v: additional %v, want the glue of ns.sub.lan", q.Question[0], resp.Extra)
+		}
+	}
+
+	// The DS records of the cut are the parent's own
+	resp := l.answer(question("sub.lan.", dns.TypeDS))
+	if resp == nil || !resp.Authoritative || len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeDS {
+		t.Errorf("DS at the cut: got %v, want the zone's DS record", resp)
+	}
+
+	// A CNAME in the zone leading below the cut
+	resp = l.answer(question("alias.lan.", dns.TypeA))
+	if resp == nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeCNAME || len(resp.Ns) != 2 {
+		t.Errorf("CNAME into the delegation: got %v, want the CNAME and a referral", resp)
+	}
+
+	// Above the cut the zone answers with its own authority
+	resp = l.answer(question("www.lan.", dns.TypeA))
+	if resp == nil || !resp.Authoritative || len(resp.Answer) != 1 {
+		t.Errorf("www.lan: got %v, want an authoritative answer", resp)
+	}
+	resp = l.answer(question("missing.lan.", dns.TypeA))
+	if resp == nil || !resp.Authoritative || resp.Rcode != dns.RcodeNameError {
+		t.Errorf("missing.lan: got %v, want an authoritative NXDOMAIN", resp)
+	}
+}
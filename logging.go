@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// logOptions are the flags controlling the diagnostics written to standard
+// error, shared by every command
+type logOptions struct {
+	level  string
+	format string
+	debug  bool
+}
+
+// register adds the logging flags to fs
+func (o *logOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.level, "log-level", "info", "log `level`: debug, info, warn or error")
+	fs.StringVar(&o.format, "log-format", "text", "log `format`: text or json")
+	fs.BoolVar(&o.debug, "debug", false, "log at debug level, including a hex dump of every message sent and received")
+}
+
+// setup installs the logger the flags describe. Records logged with a
+// context carrying a trace ID are tagged with it.
+func (o *logOptions) setup() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.level)); err != nil {
+		fatal("invalid -log-level, use debug, info, warn or error", "level", o.level)
+	}
+	if o.debug {
+		level = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch o.format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		fatal("invalid -log-format, use text or json", "format", o.format)
+	}
+	slog.SetDefault(slog.New(resolver.NewLogHandler(h)))
+}
+
+// fatal logs msg with its attributes at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
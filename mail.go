@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// spfLookupLimit is the number of DNS lookups an SPF check may make before
+// it fails with a permanent error (RFC 7208 section 4.6.4)
+const spfLookupLimit = 10
+
+// defaultDKIMSelectors are tried when -dkim-selectors names none: the
+// defaults of common mail providers and signing software
+const defaultDKIMSelectors = "default,dkim,mail,google,selector1,selector2,k1,k2,s1,s2,mxvault,everlytickey1"
+
+// mailHost is one MX record with the addresses of its exchange
+type mailHost struct {
+	Preference uint16   `json:"preference"`
+	Exchange   string   `json:"exchange"`
+	Addresses  []string `json:"addresses"`
+}
+
+// spfResult is the SPF policy of the domain
+type spfResult struct {
+	Record  string `json:"record,omitempty"`
+	All     string `json:"all,omitempty"` // the result for everyone else: fail, softfail, neutral or pass
+	Lookups int    `json:"lookups"`
+}
+
+// dkimKey is a DKIM public key found under a selector
+type dkimKey struct {
+	Selector string `json:"selector"`
+	Record   string `json:"record"`
+	KeyType  string `json:"key_type"`
+	Bits     int    `json:"bits,omitempty"`
+	Revoked  bool   `json:"revoked,omitempty"`
+}
+
+// dmarcResult is the DMARC policy of the domain
+type dmarcResult struct {
+	Record          string `json:"record,omitempty"`
+	Policy          string `json:"policy,omitempty"`
+	SubdomainPolicy string `json:"subdomain_policy,omitempty"`
+	Percent         string `json:"percent,omitempty"`
+	Reports         string `json:"reports,omitempty"`
+}
+
+// mailReport is what the mail subcommand found, also its -json rendering
+type mailReport struct {
+	Domain     string      `json:"domain"`
+	MX         []mailHost  `json:"mx"`
+	ImplicitMX bool        `json:"implicit_mx,omitempty"` // no MX records, mail goes to the domain's own addresses
+	NullMX     bool        `json:"null_mx,omitempty"`     // the domain accepts no mail, RFC 7505
+	SPF        spfResult   `json:"spf"`
+	DKIM       []dkimKey   `json:"dkim"`
+	DMARC      dmarcResult `json:"dmarc"`
+	Issues     []string    `json:"issues"`
+}
+
+func (m *mailReport) issue(format string, args ...any) {
+	m.Issues = append(m.Issues, fmt.Sprintf(format, args...))
+}
+
+// mailCheck runs the lookups behind a mailReport
+type mailCheck struct {
+	r       resolver.Resolver
+	timeout time.Duration
+}
+
+// runMail implements the mail subcommand: it gathers what decides whether
+// mail from and to a domain gets delivered, the MX hosts and their
+// addresses, the SPF policy with its DNS lookup count, DKIM keys under the
+// given or commonly used selectors and the DMARC policy, and reports the
+// problems it sees. It exits with status 1 when there are any.
+func runMail(args []string) {
+	fs := flag.NewFlagSet("mail", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each lookup after this `duration`")
+	selectors := fs.String("dkim-selectors", "", "DKIM `selectors` to look up, comma separated, each reported when missing (default a list of common ones, reported only when found)")
+	jsonOut := fs.Bool("json", false, "print the report as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s mail [flags] <domain>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "mail"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	domain, err := toASCII(args[0])
+	if err != nil {
+		fatal(err.Error())
+	}
+	domain = dns.Fqdn(domain)
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	c := &mailCheck{r: r, timeout: *timeout}
+	report := &mailReport{Domain: domain, MX: []mailHost{}, DKIM: []dkimKey{}, Issues: []string{}}
+	c.checkMX(report)
+	c.checkSPF(report)
+	if *selectors == "" {
+		c.checkDKIM(report, splitFiles(defaultDKIMSelectors), false)
+	} else {
+		c.checkDKIM(report, splitFiles(*selectors), true)
+	}
+	c.checkDMARC(report)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printMailReport(report)
+	}
+	if len(report.Issues) > 0 {
+		os.Exit(1)
+	}
+}
+
+// query asks for name and qtype, treating anything but an answer or NXDOMAIN
+// as an error
+func (c *mailCheck) query(name string, qtype uint16) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	resp, err := c.r.Query(resolver.WithTraceID(ctx, resolver.NewTraceID()), name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: %s", name, typeString(qtype), rcodeString(resp.Rcode))
+	}
+	return resp, nil
+}
+
+// txtRecords returns the TXT records of name that start with prefix, each
+// with its strings joined as RFC 7208 and RFC 6376 read them
+func (c *mailCheck) txtRecords(name, prefix string) ([]string, error) {
+	resp, err := c.query(name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var records []string
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			record := strings.Join(txt.Txt, "")
+			// The version tag has to end there, v=spf10 is not SPF
+			rest, ok := strings.CutPrefix(strings.ToLower(record), prefix)
+			if ok && (prefix == "" || rest == "" || rest[0] == ' ' || rest[0] == ';') {
+				records = append(records, record)
+			}
+		}
+	}
+	return records, nil
+}
+
+// addresses returns the A and AAAA addresses of name and the CNAME and
+// DNAME hops on the way to them
+func (c *mailCheck) addresses(name string) ([]string, []chainHop) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	var addrs []string
+	var hops []chainHop
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		res := followChain(ctx, c.r, name, qtype, defaultChainDepth)
+		for _, addr := range res.addrs {
+			addrs = append(addrs, addr.Address)
+		}
+		if len(res.hops) > len(hops) {
+			hops = res.hops
+		}
+	}
+	return addrs, hops
+}
+
+// checkMX finds the MX hosts and their addresses, falling back to the
+// implicit MX of RFC 5321 section 5.1
+func (c *mailCheck) checkMX(m *mailReport) {
+	resp, err := c.query(m.Domain, dns.TypeMX)
+	if err != nil {
+		m.issue("MX lookup failed: %v", err)
+		return
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		m.issue("%s does not exist", m.Domain)
+		return
+	}
+	var records []*dns.MX
+	for _, rr := range resp.Answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			records = append(records, mx)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Preference < records[j].Preference })
+	if len(records) == 1 && records[0].Mx == "." {
+		m.NullMX = true
+		return
+	}
+
+	if len(records) == 0 {
+		m.ImplicitMX = true
+		addrs, _ := c.addresses(m.Domain)
+		if len(addrs) == 0 {
+			m.issue("no MX records and no addresses, mail to %s cannot be delivered", m.Domain)
+			return
+		}
+		m.MX = append(m.MX, mailHost{Exchange: m.Domain, Addresses: addrs})
+		return
+	}
+	for _, mx := range records {
+		addrs, hops := c.addresses(mx.Mx)
+		host := mailHost{Preference: mx.Preference, Exchange: mx.Mx, Addresses: addrs}
+		if host.Addresses == nil {
+			host.Addresses = []string{}
+			m.issue("MX %s has no addresses", mx.Mx)
+		}
+		if len(hops) > 0 {
+			m.issue("MX %s is an alias for %s, which RFC 2181 forbids", mx.Mx, hops[len(hops)-1].Target)
+		}
+		m.MX = append(m.MX, host)
+	}
+}
+
+// checkSPF finds the SPF record, counts the DNS lookups its evaluation
+// takes and notes what it says about everyone else
+func (c *mailCheck) checkSPF(m *mailReport) {
+	records, err := c.txtRecords(m.Domain, "v=spf1")
+	switch {
+	case err != nil:
+		m.issue("SPF lookup failed: %v", err)
+		return
+	case len(records) == 0:
+		m.issue("no SPF record, receivers cannot tell which hosts may send for %s", m.Domain)
+		return
+	case len(records) > 1:
+		m.issue("%d SPF records, which is a permanent error (RFC 7208 section 4.5)", len(records))
+	}
+	m.SPF.Record = records[0]
+	m.SPF.All = "neutral"
+	m.SPF.Lookups = c.spfLookups(m, records[0], map[string]bool{strings.ToLower(m.Domain): true}, &m.SPF.All, true)
+	if m.SPF.Lookups > spfLookupLimit {
+		m.issue("SPF takes %d DNS lookups, more than the %d allowed, so checks fail with a permanent error", m.SPF.Lookups, spfLookupLimit)
+	}
+	if m.SPF.All == "pass" {
+		m.issue("SPF ends in +all, which lets any host send for %s", m.Domain)
+	}
+}
+
+// spfLookups counts the DNS lookups record takes, following include and
+// redirect, and sets all from the top level policy
+func (c *mailCheck) spfLookups(m *mailReport, record string, seen map[string]bool, all *string, top bool) int {
+	lookups := 0
+	for _, term := range strings.Fields(record)[1:] {
+		term = strings.ToLower(term)
+		qualifier := "pass"
+		switch term[0] {
+		case '+', '-', '~', '?':
+			qualifier = map[byte]string{'+': "pass", '-': "fail", '~': "softfail", '?': "neutral"}[term[0]]
+			term = term[1:]
+		}
+		mechanism, arg, _ := strings.Cut(term, ":")
+		if name, ok := strings.CutPrefix(term, "redirect="); ok {
+			mechanism, arg = "redirect", name
+		}
+		switch mechanism {
+		case "all":
+			if top {
+				*all = qualifier
+			}
+		case "a", "mx", "ptr", "exists":
+			lookups++
+		case "include", "redirect":
+			lookups++
+			if seen[arg] || lookups > spfLookupLimit {
+				continue
+			}
+			seen[arg] = true
+			records, err := c.txtRecords(dns.Fqdn(arg), "v=spf1")
+			if err != nil || len(records) != 1 {
+				m.issue("SPF %s:%s has no single SPF record to follow", mechanism, arg)
+				continue
+			}
+			// A redirect hands the whole policy over, all included
+			lookups += c.spfLookups(m, records[0], seen, all, top && mechanism == "redirect")
+		}
+	}
+	return lookups
+}
+
+// checkDKIM looks for DKIM keys under selectors. Missing ones are only
+// issues when the selectors were asked for.
+func (c *mailCheck) checkDKIM(m *mailReport, selectors []string, required bool) {
+	for _, selector := range selectors {
+		records, err := c.txtRecords(selector+"._domainkey."+m.Domain, "")
+		if err != nil {
+			m.issue("DKIM lookup for selector %s failed: %v", selector, err)
+			continue
+		}
+		var key *dkimKey
+		for _, record := range records {
+			tags := parseTags(record)
+			if v, ok := tags["v"]; ok && v != "DKIM1" {
+				continue
+			}
+			if _, ok := tags["p"]; !ok {
+				continue
+			}
+			key = &dkimKey{Selector: selector, Record: record, KeyType: "rsa"}
+			if k, ok := tags["k"]; ok {
+				key.KeyType = k
+			}
+			c.describeDKIMKey(m, key, tags["p"])
+			break
+		}
+		if key == nil {
+			if required {
+				m.issue("no DKIM key under selector %s", selector)
+			}
+			continue
+		}
+		m.DKIM = append(m.DKIM, *key)
+	}
+}
+
+// describeDKIMKey fills in the size of the key in p, an empty one meaning
+// the key was revoked
+func (c *mailCheck) describeDKIMKey(m *mailReport, key *dkimKey, p string) {
+	if p == "" {
+		key.Revoked = true
+		return
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(p), ""))
+	if err != nil {
+		m.issue("DKIM key under selector %s is not valid base64", key.Selector)
+		return
+	}
+	switch key.KeyType {
+	case "ed25519":
+		key.Bits = len(der) * 8
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if err != nil || !ok {
+			m.issue("DKIM key under selector %s is not an RSA public key", key.Selector)
+			return
+		}
+		key.Bits = rsaKey.N.BitLen()
+		if key.Bits < 1024 {
+			m.issue("DKIM key under selector %s has only %d bits, receivers ignore keys under 1024 (RFC 8301)", key.Selector, key.Bits)
+		}
+	}
+}
+
+// checkDMARC finds the DMARC policy of the domain
+func (c *mailCheck) checkDMARC(m *mailReport) {
+	records, err := c.txtRecords("_dmarc."+m.Domain, "v=dmarc1")
+	switch {
+	case err != nil:
+		m.issue("DMARC lookup failed: %v", err)
+		return
+	case len(records) == 0:
+		m.issue("no DMARC record at _dmarc.%s, receivers apply their own policy to mail failing SPF and DKIM", m.Domain)
+		return
+	case len(records) > 1:
+		m.issue("%d DMARC records, receivers ignore them all (RFC 7489 section 6.6.3)", len(records))
+		return
+	}
+	tags := parseTags(records[0])
+	m.DMARC = dmarcResult{Record: records[0], Policy: strings.ToLower(tags["p"]), SubdomainPolicy: strings.ToLower(tags["sp"]), Percent: tags["pct"], Reports: tags["rua"]}
+	switch m.DMARC.Policy {
+	case "none", "quarantine", "reject":
+	case "":
+		m.issue("DMARC record has no p= policy")
+	default:
+		m.issue("DMARC policy p=%s is not none, quarantine or reject", m.DMARC.Policy)
+	}
+	if m.DMARC.SubdomainPolicy == "" {
+		m.DMARC.SubdomainPolicy = m.DMARC.Policy
+	}
+	if m.DMARC.Percent == "" {
+		m.DMARC.Percent = "100"
+	}
+}
+
+// parseTags splits a DKIM or DMARC record into its tag=value pairs
+func parseTags(record string) map[string]string {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(record, ";") {
+		name, value, ok := strings.Cut(pair, "=")
+		if ok {
+			tags[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+	return tags
+}
+
+// printMailReport prints the report section by section, then the issues
+func printMailReport(m *mailReport) {
+	fmt.Printf("Mail report for %s\n\nMX\n", toUnicode(m.Domain))
+	switch {
+	case m.NullMX:
+		fmt.Println("  null MX, the domain accepts no mail")
+	case m.ImplicitMX && len(m.MX) > 0:
+		fmt.Printf("  none, implicitly %s: %s\n", m.MX[0].Exchange, strings.Join(m.MX[0].Addresses, ", "))
+	default:
+		for _, mx := range m.MX {
+			addrs := strings.Join(mx.Addresses, ", ")
+			if addrs == "" {
+				addrs = "no addresses"
+			}
+			fmt.Printf("  %d %s %s\n", mx.Preference, mx.Exchange, addrs)
+		}
+	}
+
+	fmt.Println("\nSPF")
+	if m.SPF.Record != "" {
+		fmt.Printf("  %s\n  %d of %d DNS lookups, %s for other hosts\n", m.SPF.Record, m.SPF.Lookups, spfLookupLimit, m.SPF.All)
+	} else {
+		fmt.Println("  none")
+	}
+
+	fmt.Println("\nDKIM")
+	for _, key := range m.DKIM {
+		switch {
+		case key.Revoked:
+			fmt.Printf("  %s: revoked\n", key.Selector)
+		case key.Bits > 0:
+			fmt.Printf("  %s: %s, %d bits\n", key.Selector, key.KeyType, key.Bits)
+		default:
+			fmt.Printf("  %s: %s\n", key.Selector, key.KeyType)
+		}
+	}
+	if len(m.DKIM) == 0 {
+		fmt.Println("  no keys under the selectors tried")
+	}
+
+	fmt.Println("\nDMARC")
+	if m.DMARC.Record != "" {
+		fmt.Printf("  %s\n  policy %s, subdomains %s, applied to %s%% of mail", m.DMARC.Record, m.DMARC.Policy, m.DMARC.SubdomainPolicy, m.DMARC.Percent)
+		if m.DMARC.Reports != "" {
+			fmt.Printf(", reports to %s", m.DMARC.Reports)
+		}
+		fmt.Println()
+	} else {
+		fmt.Println("  none")
+	}
+
+	if len(m.Issues) == 0 {
+		fmt.Println("\nNo issues found")
+		return
+	}
+	fmt.Println()
+	for _, issue := range m.Issues {
+		fmt.Println("! " + issue)
+	}
+}
@@ -1,163 +1,692 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net"
-	"net/http"
+	"log/slog"
 	"os"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
 )
 
-// DNSOverTCP performs a DNS query over TCP
-func DNSOverTCP(domain, dnsServer string, qtype uint16) (*dns.Msg, error) {
-	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(domain), qtype)
-	m.RecursionDesired = true
+// subcommands run instead of a single query when named as the first argument
+var subcommands = map[string]func(args []string){
+	"serve":       runServe,
+	"batch":       runBatch,
+	"axfr":        runAXFR,
+	"update":      runUpdate,
+	"compare":     runCompare,
+	"bench":       runBench,
+	"resolve":     runResolve,
+	"reach":       runReach,
+	"srv":         runSRV,
+	"browse":      runBrowse,
+	"rbl":         runRBL,
+	"shell":       runShell,
+	"mail":        runMail,
+	"caa":         runCAA,
+	"dane":        runDANE,
+	"anchors":     runAnchors,
+	"id":          runID,
+	"zone":        runZone,
+	"enum":        runEnum,
+	"sweep":       runSweep,
+	"propagation": runPropagation,
+	"audit":       runAudit,
+	"delegation":  runDelegation,
+	"service":     runService,
+	"ddr":         runDDR,
+}
 
-	// Create a TCP connection
-	conn, err := net.Dial("tcp", dnsServer+":53")
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to DNS server: %v", err)
+// usageLines are the ways to run the program -h lists, a single query
+// first and then each subcommand, whose own -h tells more
+var usageLines = []string{
+	"[flags] <domain> [udp|tcp|tls|quic|http|json|odoh|mdns] [type]",
+	"[flags] -x <address> [udp|tcp|tls|quic|http|json|odoh|mdns]",
+	"serve [flags]",
+	"service install|uninstall|start|stop|status [flags] [-- serve flags]",
+	"batch [flags] [file]",
+	"axfr [flags] <zone>",
+	"update [flags] -server <primary> -zone <zone> -add|-delete ...",
+	"compare [flags] -server <servers> <domain> [type]",
+	"bench [flags]",
+	"resolve [flags] <domain>",
+	"srv [flags] <service> <proto> <domain>",
+	"mail [flags] <domain>",
+	"caa [flags] <domain>",
+	"dane [flags] <host>[:port]",
+	"anchors [flags]",
+	"id [flags]",
+	"zone check [flags] <file> [name [type]]",
+	"enum [flags] -wordlist <file> <domain>",
+	"sweep [flags] <cidr>",
+	"propagation [flags] <domain> [type]",
+	"audit [flags] <zone>",
+	"delegation [flags] <zone>",
+	"browse [flags] [service type]",
+	"rbl [flags] <address or domain>...",
+	"shell [flags]",
+	"reach [flags] <host> <port>",
+	"ddr [flags]",
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments and returns the positional arguments in order
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
-	defer conn.Close()
+}
 
-	// Pack the message
-	msgBytes, err := m.Pack()
-	if err != nil {
-		return nil, fmt.Errorf("failed to pack DNS message: %v", err)
+// flagSet reports whether the named flag was given on the command line
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
 	}
 
-	// Prefix with two-byte length
-	var buf bytes.Buffer
-	length := uint16(len(msgBytes))
-	buf.WriteByte(byte(length >> 8))
-	buf.WriteByte(byte(length & 0xFF))
-	buf.Write(msgBytes)
+	fingerprints := flag.String("fingerprints", "", "record answer fingerprints in `file` and report changes since the previous run")
+	serverFlag := flag.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	via := flag.String("via", "", "try each query over this ordered `chain` of transport:server links instead of -server, falling back to the next on failure, such as doh:https://dns.google/dns-query,dot:9.9.9.9,udp:1.1.1.1")
+	port := flag.Int("port", 0, "server `port` (default 53, or 853 for tls and quic)")
+	dohURL := flag.String("doh-url", defaultServers["http"], "DoH endpoint `URL` for the http method")
+	reverse := flag.String("x", "", "reverse lookup: query the PTR record for this IPv4 or IPv6 `address`, the domain argument is then left out")
+	typeName := flag.String("type", "A", "record `type` to query: a name such as A, AAAA, MX, TXT, SRV, CAA or ANY, TYPE<n> or a number, or several comma separated to query them in parallel")
+	className := flag.String("class", "IN", "query `class`: IN, CH (CHAOS, as in version.bind), HS, CLASS<n> or a number")
+	opcodeName := flag.String("opcode", "QUERY", "message `opcode`: QUERY, NOTIFY to tell a secondary that its zone changed (the type defaults to SOA), STATUS or a number")
+	timeout := flag.Duration("timeout", 5*time.Second, "give up on the query after this `duration`")
+	jsonOut := flag.Bool("json", false, "print the full response as JSON, including the server used and the round trip time")
+	verbose := flag.Bool("verbose", false, "print the complete response like dig: header flags, EDNS, all sections, query time and size")
+	short := flag.Bool("short", false, "print only the data of the answer records, one per line, like dig +short")
+	format := flag.String("format", "", "print each answer record with this Go `template`, such as '{{.Name}},{{.TTL}},{{.Data}}', with the fields QName, QType, Name, Type, Class, TTL, Data, Rcode, RTT, RTTMillis, Server and Transport")
+	tlsDebug := flag.Bool("tls-debug", false, "also print the TLS version, cipher suite, ALPN, certificate chain and OCSP staple of tls, quic and https servers")
+	dnssec := flag.Bool("dnssec", false, "request signatures and validate the response from the root trust anchor, reporting Secure, Insecure or Bogus")
+	anchorFile := flag.String("anchor", "", "read DNSSEC trust anchors (DS or DNSKEY records) from `file` instead of the stored root anchors")
+	iterate := flag.Bool("trace", false, "resolve iteratively from the root servers (or the -server root hints), printing every delegation step")
+	qmin := flag.Bool("qmin", true, "with -trace, send each server only the labels it needs (RFC 9156 QNAME minimization), -qmin=false sends the full name")
+	pcapFile := flag.String("pcap", "", pcapUsage)
+	wireFormat := flag.String("wire", "", "print the exact wire bytes of every query and response in `format` hex or base64")
+	showDig := flag.Bool("show-dig", false, "print the equivalent dig command line before sending the query")
+	odohTarget := flag.String("odoh-target", defaultServers["odoh"], "Oblivious DoH target `URL`")
+	searchList := flag.String("search", "", "qualify names without a trailing dot with these search `domains`, comma separated, like the search line of resolv.conf (default those of the system with -system)")
+	ndots := flag.Int("ndots", 1, "with -search or -system, try names with at least `n` dots as they are before the search domains rather than after them (default the ndots of the system with -system)")
+	system := flag.Bool("system", false, "behave like the system resolver: query the servers of /etc/resolv.conf (the registry on Windows) unless -server is given, and qualify names without a trailing dot with its search domains and ndots")
+	punycode := flag.Bool("punycode", false, "print internationalized names in answers in their xn-- form instead of Unicode")
+	var opts options
+	opts.register(flag.CommandLine)
+	var logs logOptions
+	logs.register(flag.CommandLine)
+	var cfg configFile
+	cfg.register(flag.CommandLine)
+	var edns ednsFlags
+	edns.register(flag.CommandLine)
+	var watch watchOptions
+	watch.register(flag.CommandLine)
+	var ping pingOptions
+	ping.register(flag.CommandLine)
+	var craft craftOptions
+	flag.StringVar(&craft.rawHex, "raw", "", "expert: send this `message`, in hex or base64 wire format, verbatim over udp, tcp or tls")
+	flag.StringVar(&craft.rawFile, "raw-file", "", "expert: send the wire format message in this `file`, - for standard input, verbatim over udp, tcp or tls")
+	flag.Var(&craft.answers, "answer", "expert: add this `record` to the answer section of the query (repeatable)")
+	for i, section := range []string{"qd", "an", "ns", "ar"} {
+		flag.IntVar(&craft.counts[i], section+"count", -1, "expert: override the "+strings.ToUpper(section)+"COUNT header field with `n`")
+	}
+	flag.Usage = func() {
+		for i, line := range usageLines {
+			prefix := "       "
+			if i == 0 {
+				prefix = "Usage: "
+			}
+			fmt.Fprintf(flag.CommandLine.Output(), "%s%s %s\n", prefix, os.Args[0], line)
+		}
+		flag.PrintDefaults()
+	}
+	args := parseArgs(flag.CommandLine, os.Args[1:])
+	if err := cfg.apply(flag.CommandLine, "query"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if *reverse != "" {
+		arpa, err := dns.ReverseAddr(*reverse)
+		if err != nil {
+			fatal("invalid address for -x", "address", *reverse)
+		}
+		args = append([]string{arpa}, args...)
+		if !flagSet(flag.CommandLine, "type") {
+			*typeName = "PTR"
+		}
+	}
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	// Send the message
-	_, err = conn.Write(buf.Bytes())
+	domain, err := toASCII(args[0])
 	if err != nil {
-		return nil, fmt.Errorf("failed to send DNS query: %v", err)
+		fatal(err.Error())
 	}
-
-	// Read the response length
-	lengthBytes := make([]byte, 2)
-	_, err = conn.Read(lengthBytes)
+	method := "udp" // default method
+	if len(args) >= 2 {
+		method = args[1]
+	} else if *serverFlag == "" && *via == "" && !*iterate && isLocalName(domain) {
+		// .local names belong to multicast DNS (RFC 6762 section 3)
+		method = "mdns"
+	}
+	opcode, err := parseOpcode(*opcodeName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response length: %v", err)
+		fatal(err.Error())
 	}
-	respLength := int(lengthBytes[0])<<8 | int(lengthBytes[1])
-
-	// Read the DNS response
-	respBytes := make([]byte, respLength)
-	_, err = conn.Read(respBytes)
+	// The type may also be given dig style as the third argument
+	if len(args) >= 3 {
+		*typeName = args[2]
+	} else if opcode == dns.OpcodeNotify && !flagSet(flag.CommandLine, "type") {
+		*typeName = "SOA"
+	}
+	qtypes, err := parseTypes(*typeName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read DNS response: %v", err)
+		fatal(err.Error())
 	}
-
-	// Unpack the response
-	resp := new(dns.Msg)
-	err = resp.Unpack(respBytes)
+	qtype := qtypes[0]
+	qclass, err := parseClass(*className)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unpack DNS response: %v", err)
+		fatal(err.Error())
+	}
+	if (qclass != dns.ClassINET || opcode != dns.OpcodeQuery) && (craft.active() || *iterate || *dnssec || method == "json" || method == "mdns") {
+		fatal("-class and -opcode cannot be combined with crafted messages, -trace, -dnssec or the json and mdns methods")
+	}
+	if len(qtypes) > 1 && (craft.active() || watch.active() || ping.active() || *iterate || *dnssec || *fingerprints != "" || *tlsDebug) {
+		fatal("several types cannot be combined with crafted messages, -watch, -count, -trace, -dnssec, -fingerprints or -tls-debug")
+	}
+	if ping.active() && (craft.active() || watch.active() || *iterate || *verbose || *short || *format != "" || *fingerprints != "" || *tlsDebug) {
+		fatal("-count prints latency statistics and cannot be combined with crafted messages, -watch, -trace, -verbose, -short, -format, -fingerprints or -tls-debug")
+	}
+	if ping.active() && !flagSet(flag.CommandLine, "retries") {
+		// Like bench, count lost queries instead of hiding them behind retries
+		opts.retries = 0
+	}
+	outputs := 0
+	for _, set := range []bool{*jsonOut, *verbose, *short, *format != ""} {
+		if set {
+			outputs++
+		}
+	}
+	if outputs > 1 {
+		fatal("only one of -json, -verbose, -short and -format can be given")
+	}
+	if (*short || *format != "") && (craft.active() || watch.active() || *iterate || *tlsDebug) {
+		fatal("-short and -format print only record data and cannot be combined with crafted messages, -watch, -trace or -tls-debug")
+	}
+	var tmpl *template.Template
+	if *format != "" {
+		if tmpl, err = parseFormat(*format); err != nil {
+			fatal("invalid -format template", "err", err)
+		}
 	}
 
-	return resp, nil
-}
+	// sysConf holds the search list, from the system with -system and from
+	// -search and -ndots, which win over it
+	var sysConf *systemConfig
+	if *system {
+		if sysConf, err = loadSystemConfig(); err != nil {
+			fatal(err.Error())
+		}
+	}
+	if *searchList != "" || flagSet(flag.CommandLine, "ndots") {
+		if sysConf == nil {
+			sysConf = &systemConfig{Ndots: *ndots}
+		}
+		if *searchList != "" {
+			sysConf.Search = strings.Split(*searchList, ",")
+		}
+		if flagSet(flag.CommandLine, "ndots") {
+			sysConf.Ndots = *ndots
+		}
+	}
+	if sysConf != nil && (*iterate || craft.active()) {
+		fatal("-system and -search cannot be combined with -trace or crafted messages")
+	}
+	servers := *serverFlag
+	if servers == "" && *system {
+		servers = sysConf.servers()
+	}
+	if servers == "" && opts.ddr && method == "udp" && !*iterate {
+		// DDR upgrades the resolvers the network handed out
+		conf, err := loadSystemConfig()
+		if err != nil {
+			fatal(err.Error())
+		}
+		servers = conf.servers()
+	}
+	if servers == "" {
+		switch method {
+		case "http":
+			servers = *dohURL
+		case "odoh":
+			servers = *odohTarget
+		default:
+			servers = opts.defaultServer(method)
+		}
+		if *iterate {
+			servers = strings.Join(resolver.RootServers, ",")
+			if opts.ipv6 {
+				servers = strings.Join(resolver.RootServers6, ",")
+			}
+		}
+	}
+	var upstreams []upstream
+	if *via != "" {
+		if *serverFlag != "" || *iterate || len(args) >= 2 {
+			fatal("-via gives the servers and their transports, it cannot be combined with -server, -trace or a method argument")
+		}
+		if opts.balance != "round-robin" && opts.balance != "ordered" {
+			fatal("-via tries its links in order, it leaves nothing for -balance " + opts.balance + " to do")
+		}
+		opts.balance = "ordered"
+		upstreams, err = parseVia(*via, *port)
+	} else {
+		upstreams, err = parseUpstreams(method, servers, *port)
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
 
-// DNSOverHTTPS performs a DNS query over HTTPS (DoH)
-func DNSOverHTTPS(domain, dohURL string, qtype uint16) (*dns.Msg, error) {
-	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(domain), qtype)
-	m.RecursionDesired = true
+	if *showDig {
+		q := digQuery{Name: domain, Type: qtype, Method: upstreams[0].Method, DoHMethod: strings.ToUpper(opts.dohMethod), HTTPVersion: opts.dohVersion(), Timeout: *timeout, Crafted: craft.active(), DNSSEC: *dnssec, Reverse: *reverse, Trace: *iterate, Race: opts.race, Watch: watch.interval, Class: qclass, Opcode: opcode, Options: edns.digArgs()}
+		switch {
+		case *iterate:
+			// dig +trace starts from its own root hints, or asks @server for them
+			if *serverFlag != "" {
+				q.Server = upstreams[0].Addr
+			}
+		case q.Method == "http" || q.Method == "json" || q.Method == "odoh":
+			q.DoHURL = upstreams[0].Addr
+		default:
+			q.Server = upstreams[0].Addr
+		}
+		if opts.keepalive && (q.Method == "tcp" || q.Method == "tls") {
+			q.Options = append(q.Options, "+keepalive")
+		}
+		if sysConf != nil {
+			q.Options = append(q.Options, "+search")
+		}
+		if opts.tsig != "" {
+			q.Options = append(q.Options, "-y", shellQuote(opts.tsig))
+		} else if opts.tsigFile != "" {
+			q.Options = append(q.Options, "-k", shellQuote(opts.tsigFile))
+		}
+		if opts.tlsCA != "" {
+			q.Options = append(q.Options, "+tls-ca="+shellQuote(opts.tlsCA))
+		}
+		if opts.tlsName != "" {
+			q.Options = append(q.Options, "+tls-hostname="+opts.tlsName)
+		}
+		if !*iterate {
+			for _, u := range upstreams[1:] {
+				q.Fallbacks = append(q.Fallbacks, u.Addr)
+			}
+		}
+		for _, t := range qtypes {
+			q.Type = t
+			fmt.Println(digCommand(q))
+		}
+	}
 
-	msgBytes, err := m.Pack()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	if *iterate || ping.active() {
+		// Iteration and -count make many queries, so the timeout applies to
+		// each one
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	capture, err := openPcap(*pcapFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to pack DNS message: %v", err)
+		fatal("failed to create the pcap file", "err", err)
+	}
+	defer closePcap(capture)
+	ctx = capture.context(ctx)
+	if *wireFormat != "" {
+		dump, err := newWireDump(*wireFormat)
+		if err != nil {
+			fatal(err.Error())
+		}
+		ctx = resolver.WithWireTap(ctx, dump)
 	}
 
-	// Encode the DNS query in base64 URL without padding
-	encoded := base64.RawURLEncoding.EncodeToString(msgBytes)
-
-	// Construct the DoH GET request URL
-	fullURL := fmt.Sprintf("%s?dns=%s", dohURL, encoded)
+	if craft.active() {
+		// Crafted messages are a robustness testing aid and go to one server
+		// over a transport that sends them as they are
+		if len(upstreams) != 1 {
+			fatal("crafted messages can only be sent to a single server")
+		}
+		raw, err := opts.rawExchanger(upstreams[0])
+		if err != nil {
+			fatal(err.Error())
+		}
+		msgBytes, err := craftQuery(domain, qtype, &craft)
+		if err != nil {
+			fatal("failed to craft query", "err", err)
+		}
+		reply, err := raw.ExchangeRaw(ctx, msgBytes)
+		if err != nil {
+			closePcap(capture)
+			queryFailed(domain, qtype, err, false)
+		}
+		printRawReply(reply)
+		return
+	}
 
-	// Create HTTP request
-	req, err := http.NewRequest("GET", fullURL, nil)
+	var r resolver.Resolver
+	if *iterate {
+		r, err = newTraceIterator(upstreams, *port, *timeout, opts.family(), *qmin)
+	} else {
+		r, err = opts.buildResolver(upstreams)
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+	ednsOpts, err := edns.options()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
+		fatal(err.Error())
+	}
+	// askName sends the query for name to r as the flags describe it
+	askName := func(ctx context.Context, r resolver.Resolver, name string, qtype uint16) (*dns.Msg, error) {
+		if !*dnssec && !edns.active() && qclass == dns.ClassINET && opcode == dns.OpcodeQuery {
+			return r.Query(ctx, name, qtype)
+		}
+		query := resolver.NewQuery(name, qtype)
+		if *dnssec {
+			query = resolver.NewDNSSECQuery(name, qtype)
+		}
+		query.Question[0].Qclass = qclass
+		if opcode != dns.OpcodeQuery {
+			query.Opcode = opcode
+			query.RecursionDesired = false
+			// A NOTIFY comes from the primary of the zone (RFC 1996 section 3.7)
+			query.Authoritative = opcode == dns.OpcodeNotify
+		}
+		if err := ednsOpts.Apply(query); err != nil {
+			return nil, err
+		}
+		response, err := r.Exchange(ctx, query)
+		if err == nil {
+			if err := resolver.CheckCookie(query, response); err != nil {
+				slog.Warn("DNS cookie check failed", "err", err)
+			}
+		}
+		return response, err
+	}
+	// askSearch sends the query for domain, trying the names of the search
+	// list in turn with -system or -search and returning those it tried
+	askSearch := func(ctx context.Context, r resolver.Resolver, qtype uint16) (*dns.Msg, []searchTry, error) {
+		if sysConf == nil {
+			resp, err := askName(ctx, r, domain, qtype)
+			return resp, nil, err
+		}
+		var tries []searchTry
+		search := resolver.NewSearch(r, sysConf.Search, sysConf.Ndots)
+		search.OnTry = func(name string, resp *dns.Msg, err error) {
+			tries = append(tries, newSearchTry(name, resp, err))
+		}
+		resp, err := search.Lookup(ctx, domain, func(ctx context.Context, name string) (*dns.Msg, error) {
+			return askName(ctx, r, name, qtype)
+		})
+		return resp, tries, err
+	}
+	ask := func(ctx context.Context, qtype uint16) (*dns.Msg, error) {
+		resp, _, err := askSearch(ctx, r, qtype)
+		return resp, err
 	}
 
-	// Set appropriate headers
-	req.Header.Set("Accept", "application/dns-message")
+	if ping.active() {
+		targets := []pingTarget{{ask: func(ctx context.Context) (*dns.Msg, error) {
+			return ask(ctx, qtype)
+		}}}
+		if ping.each {
+			// A resolver per server, so that each one gets every query
+			targets = targets[:0]
+			for _, u := range upstreams {
+				ur, err := opts.buildResolver([]upstream{u})
+				if err != nil {
+					fatal(err.Error())
+				}
+				label := u.Addr
+				if !strings.Contains(label, "://") {
+					label = u.Method + "://" + label
+				}
+				targets = append(targets, pingTarget{label: label, ask: func(ctx context.Context) (*dns.Msg, error) {
+					resp, _, err := askSearch(ctx, ur, qtype)
+					return resp, err
+				}})
+			}
+		}
+		status := ping.run(ctx, domain, qtype, *timeout, targets, *jsonOut)
+		closePcap(capture)
+		os.Exit(status)
+	}
 
-	// Perform the HTTP request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %v", err)
+	if watch.active() {
+		if *jsonOut || *iterate || *dnssec || *fingerprints != "" {
+			fatal("-watch prints changes only and cannot be combined with -json, -trace, -dnssec or -fingerprints")
+		}
+		watch.run(domain, qtype, *timeout, *verbose, func(ctx context.Context) (*dns.Msg, error) {
+			return ask(ctx, qtype)
+		})
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("DoH server returned non-OK status: %s, body: %s", resp.Status, string(body))
+	if len(qtypes) > 1 {
+		results := queryTypes(ctx, qtypes, ask)
+		switch {
+		case *jsonOut:
+			printTypesJSON(domain, results)
+		case *verbose:
+			for i, res := range results {
+				if i > 0 {
+					fmt.Println()
+				}
+				if res.err != nil {
+					fmt.Printf(";; %s query failed: %v\n", typeString(res.qtype), res.err)
+					continue
+				}
+				printVerbose(os.Stdout, res.resp, res.trace, res.sent)
+			}
+		case *short, tmpl != nil:
+			for _, res := range results {
+				if res.err != nil {
+					slog.Error("DNS query failed", "name", domain, "type", typeString(res.qtype), "err", res.err)
+					continue
+				}
+				if tmpl == nil {
+					printShort(res.resp)
+				} else if err := printFormat(os.Stdout, tmpl, res.resp, res.trace); err != nil {
+					fatal("failed to execute the -format template", "err", err)
+				}
+			}
+		default:
+			printTypes(domain, results, *punycode)
+		}
+		closePcap(capture)
+		// The first type that failed, in the order given, sets the status
+		for _, res := range results {
+			if class := classify(res.resp, res.err); class != classNone {
+				os.Exit(class.exitCode())
+			}
+		}
+		return
 	}
 
-	// Read the DNS response
-	respBytes, err := ioutil.ReadAll(resp.Body)
+	var trace resolver.Trace
+	sent := time.Now()
+	response, tries, err := askSearch(resolver.WithTrace(ctx, &trace), r, qtype)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read DNS response: %v", err)
+		closePcap(capture)
+		queryFailed(domain, qtype, err, *jsonOut)
 	}
+	class := classify(response, nil)
 
-	// Unpack the DNS response
-	respMsg := new(dns.Msg)
-	err = respMsg.Unpack(respBytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unpack DNS response: %v", err)
+	var validation *dnssecResult
+	if *dnssec {
+		anchors, err := trustAnchors(ctx, r, *anchorFile)
+		if err != nil {
+			fatal("failed to read trust anchors", "err", err)
+		}
+		sec, err := resolver.NewValidator(r, anchors).Validate(ctx, response)
+		validation = &dnssecResult{Status: sec.String()}
+		if sec == resolver.Bogus {
+			class = classBogus
+		}
+		if err != nil {
+			validation.Reason = err.Error()
+		}
+		validation.Denial = newJSONDenial(resolver.ExplainDenial(response))
 	}
 
-	return respMsg, nil
-}
+	var status fingerprintStatus
+	var prev fingerprintEntry
+	if *fingerprints != "" {
+		status, prev, err = newFingerprintStore(*fingerprints).Record(domain, qtype, response)
+		if err != nil {
+			fatal("fingerprint store failed", "err", err)
+		}
+	}
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s <domain> [tcp|http]\n", os.Args[0])
-		os.Exit(1)
+	if *jsonOut {
+		out := newJSONResponse(response, trace)
+		out.DNSSEC = validation
+		out.Search = tries
+		out.ErrorClass = class.String()
+		if *tlsDebug && trace.TLS != nil {
+			out.TLS = newJSONTLS(trace.TLS)
+		}
+		if *fingerprints != "" {
+			out.Fingerprint = status.String()
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fatal(err.Error())
+		}
+		closePcap(capture)
+		os.Exit(class.exitCode())
 	}
 
-	domain := os.Args[1]
-	method := "tcp" // default method
-	if len(os.Args) >= 3 {
-		method = os.Args[2]
+	if *short || tmpl != nil {
+		if tmpl == nil {
+			printShort(response)
+		} else if err := printFormat(os.Stdout, tmpl, response, trace); err != nil {
+			fatal("failed to execute the -format template", "err", err)
+		}
+		closePcap(capture)
+		os.Exit(class.exitCode())
 	}
 
-	var response *dns.Msg
-	var err error
+	// Print the DNS response
+	if *verbose {
+		printVerbose(os.Stdout, response, trace, sent)
+	} else {
+		printHeading(domain, *punycode)
+		printAnswers(response, *punycode)
+	}
+	if len(tries) > 1 || len(tries) == 1 && tries[0].Name != dns.Fqdn(domain) {
+		fmt.Println(";; " + describeSearch(tries))
+	}
 
-	switch method {
-	case "tcp":
-		// Example DNS server: 8.8.8.8 (Google DNS)
-		response, err = DNSOverTCP(domain, "8.8.8.8", dns.TypeA)
-	case "http":
-		// Example DoH endpoint: Cloudflare
-		response, err = DNSOverHTTPS(domain, "https://cloudflare-dns.com/dns-query", dns.TypeA)
-	default:
-		log.Fatalf("Unknown method: %s. Use 'tcp' or 'http'.", method)
+	if *tlsDebug {
+		printTLS(os.Stdout, trace)
 	}
 
-	if err != nil {
-		log.Fatalf("DNS query failed: %v", err)
+	if validation != nil {
+		fmt.Println(validation)
+		if d := validation.Denial; d != nil {
+			fmt.Printf(";; %s proof using %s:\n", d.Kind, d.Type)
+			for _, step := range d.Proof {
+				fmt.Println(";;   " + step)
+			}
+			if d.Error != "" {
+				fmt.Println(";;   incomplete: " + d.Error)
+			}
+		}
 	}
 
-	// Print the DNS response
+	if *fingerprints != "" {
+		switch status {
+		case fingerprintChanged:
+			fmt.Printf("CHANGED since %s\n", prev.Checked.Format(time.RFC3339))
+		case fingerprintNew:
+			fmt.Println("First seen, fingerprint recorded")
+		}
+	}
+	closePcap(capture)
+	os.Exit(class.exitCode())
+}
+
+// printHeading introduces the answers for domain
+func printHeading(domain string, punycode bool) {
+	if !punycode {
+		domain = toUnicode(domain)
+	}
 	fmt.Printf("DNS Response for %s:\n", domain)
-	for _, ans := range response.Answer {
-		fmt.Println(ans)
+}
+
+// printShort prints only the data of each answer record, one per line, for
+// shell pipelines
+func printShort(resp *dns.Msg) {
+	for _, rr := range resp.Answer {
+		fmt.Println(strings.TrimSpace(rrData(rr)))
+	}
+}
+
+// printAnswers prints the answer section of resp, its rcode when it is an
+// error, and its EDNS options
+func printAnswers(resp *dns.Msg, punycode bool) {
+	for _, ans := range resp.Answer {
+		if punycode {
+			fmt.Println(ans)
+		} else {
+			fmt.Println(displayRR(ans))
+		}
+		for _, line := range describeRecord(ans) {
+			fmt.Println(";; " + line)
+		}
+	}
+	failed := resp.Rcode != dns.RcodeSuccess
+	if failed {
+		fmt.Println(";; " + explainRcode(resp))
+	} else if resp.Opcode != dns.OpcodeQuery {
+		fmt.Printf(";; %s acknowledged\n", dns.OpcodeToString[resp.Opcode])
+	}
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			// The extended errors of a failure went with its rcode
+			if o.Option() != dns.EDNS0PADDING && !(failed && o.Option() == dns.EDNS0EDE) {
+				fmt.Println(";; " + describeOption(o))
+			}
+		}
 	}
 }
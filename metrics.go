@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the query latency
+// histogram buckets
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// queryLabels identify one series of dns_queries_total
+type queryLabels struct {
+	qtype, rcode, transport string
+}
+
+// histogram counts observations per bucket, the last bucket being +Inf
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// metrics collects what serve and batch expose on /metrics, in the
+// Prometheus text format. A nil *metrics records nothing, so callers need
+// not check whether -metrics was given.
+type metrics struct {
+	mu              sync.Mutex
+	queries         map[queryLabels]uint64
+	latency         map[string]*histogram // by transport
+	upstreamQueries map[string]uint64
+	upstreamErrors  map[string]uint64
+	upstreamHealthy map[string]bool // with health probes only
+	ejections       map[string]uint64
+	refused         map[string]uint64 // queries not admitted, by reason
+	cache           *resolver.Cache
+	dedup           *resolver.Dedup
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		queries:         map[queryLabels]uint64{},
+		latency:         map[string]*histogram{},
+		upstreamQueries: map[string]uint64{},
+		upstreamErrors:  map[string]uint64{},
+		upstreamHealthy: map[string]bool{},
+		ejections:       map[string]uint64{},
+		refused:         map[string]uint64{},
+	}
+}
+
+// ServeDNS implements resolver.Handler, observing every query that the
+// handlers after it answer or fail, but not those they drop
+func (m *metrics) ServeDNS(ctx context.Context, req *resolver.Request, next resolver.Next) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := next(ctx, req)
+	if len(req.Msg.Question) > 0 && (resp != nil || err != nil) {
+		m.observeQuery(req.Msg.Question[0].Qtype, resp, err, req.Trace, time.Since(start))
+	}
+	return resp, err
+}
+
+// observeQuery records a query answered to a client. Answers from the cache
+// carry no trace and are counted under the transport "cache".
+func (m *metrics) observeQuery(qtype uint16, resp *dns.Msg, err error, trace resolver.Trace, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	labels := queryLabels{qtype: typeString(qtype), transport: trace.Transport}
+	switch {
+	case err != nil:
+		labels.rcode = "ERROR"
+	default:
+		labels.rcode = rcodeString(resp.Rcode)
+	}
+	if labels.transport == "" {
+		labels.transport = "none"
+		if err == nil {
+			labels.transport = "cache"
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries[labels]++
+	h := m.latency[labels.transport]
+	if h == nil {
+		h = &histogram{}
+		m.latency[labels.transport] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// observeUpstream records one exchange with an upstream server and whether
+// it failed
+func (m *metrics) observeUpstream(server string, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstreamQueries[server]++
+	if failed {
+		m.upstreamErrors[server]++
+	}
+}
+
+// observeRefused records a query from a client the ACLs or the rate limit
+// do not admit
+func (m *metrics) observeRefused(reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refused[reason]++
+}
+
+// setHealthy records whether the health probes keep server in rotation,
+// counting the times it is taken out
+func (m *metrics) setHealthy(server string, healthy bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if was, ok := m.upstreamHealthy[server]; ok && was && !healthy {
+		m.ejections[server]++
+	}
+	m.upstreamHealthy[server] = healthy
+}
+
+// write prints every series in the Prometheus text exposition format
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP dns_queries_total Queries answered, by query type, response code and upstream transport.")
+	fmt.Fprintln(w, "# TYPE dns_queries_total counter")
+	keys := make([]queryLabels, 0, len(m.queries))
+	for k := range m.queries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.qtype != b.qtype {
+			return a.qtype < b.qtype
+		}
+		if a.rcode != b.rcode {
+			return a.rcode < b.rcode
+		}
+		return a.transport < b.transport
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "dns_queries_total{qtype=%q,rcode=%q,transport=%q} %d\n", k.qtype, k.rcode, k.transport, m.queries[k])
+	}
+
+	fmt.Fprintln(w, "# HELP dns_query_duration_seconds Time taken to answer queries, by upstream transport.")
+	fmt.Fprintln(w, "# TYPE dns_query_duration_seconds histogram")
+	for _, transport := range sortedKeys(m.latency) {
+		h := m.latency[transport]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "dns_query_duration_seconds_bucket{transport=%q,le=\"%g\"} %d\n", transport, bound, cumulative)
+		}
+		fmt.Fprintf(w, "dns_query_duration_seconds_bucket{transport=%q,le=\"+Inf\"} %d\n", transport, h.count)
+		fmt.Fprintf(w, "dns_query_duration_seconds_sum{transport=%q} %g\n", transport, h.sum)
+		fmt.Fprintf(w, "dns_query_duration_seconds_count{transport=%q} %d\n", transport, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP dns_upstream_requests_total Exchanges with each upstream server.")
+	fmt.Fprintln(w, "# TYPE dns_upstream_requests_total counter")
+	for _, server := range sortedKeys(m.upstreamQueries) {
+		fmt.Fprintf(w, "dns_upstream_requests_total{upstream=%q} %d\n", server, m.upstreamQueries[server])
+	}
+	fmt.Fprintln(w, "# HELP dns_upstream_errors_total Exchanges with each upstream server that failed or got SERVFAIL or REFUSED.")
+	fmt.Fprintln(w, "# TYPE dns_upstream_errors_total counter")
+	for _, server := range sortedKeys(m.upstreamQueries) {
+		fmt.Fprintf(w, "dns_upstream_errors_total{upstream=%q} %d\n", server, m.upstreamErrors[server])
+	}
+
+	if len(m.refused) > 0 {
+		fmt.Fprintln(w, "# HELP dns_clients_refused_total Queries refused or dropped, by reason: acl, rate or rrl.")
+		fmt.Fprintln(w, "# TYPE dns_clients_refused_total counter")
+		for _, reason := range sortedKeys(m.refused) {
+			fmt.Fprintf(w, "dns_clients_refused_total{reason=%q} %d\n", reason, m.refused[reason])
+		}
+	}
+
+	if len(m.upstreamHealthy) > 0 {
+		fmt.Fprintln(w, "# HELP dns_upstream_healthy Whether each upstream server is in rotation, by the health probes.")
+		fmt.Fprintln(w, "# TYPE dns_upstream_healthy gauge")
+		for _, server := range sortedKeys(m.upstreamHealthy) {
+			healthy := 0
+			if m.upstreamHealthy[server] {
+				healthy = 1
+			}
+			fmt.Fprintf(w, "dns_upstream_healthy{upstream=%q} %d\n", server, healthy)
+		}
+		fmt.Fprintln(w, "# HELP dns_upstream_ejections_total Times each upstream server was taken out of rotation.")
+		fmt.Fprintln(w, "# TYPE dns_upstream_ejections_total counter")
+		for _, server := range sortedKeys(m.upstreamHealthy) {
+			fmt.Fprintf(w, "dns_upstream_ejections_total{upstream=%q} %d\n", server, m.ejections[server])
+		}
+	}
+
+	if m.dedup != nil {
+		fmt.Fprintln(w, "# HELP dns_dedup_shared_total Queries that waited for an identical one in flight instead of going upstream.")
+		fmt.Fprintln(w, "# TYPE dns_dedup_shared_total counter")
+		fmt.Fprintf(w, "dns_dedup_shared_total %d\n", m.dedup.Shared())
+	}
+
+	if m.cache == nil {
+		return
+	}
+	stats := m.cache.Stats()
+	fmt.Fprintln(w, "# HELP dns_cache_hits_total Queries answered from the cache.")
+	fmt.Fprintln(w, "# TYPE dns_cache_hits_total counter")
+	fmt.Fprintf(w, "dns_cache_hits_total %d\n", stats.Hits)
+	fmt.Fprintln(w, "# HELP dns_cache_misses_total Queries the cache passed upstream.")
+	fmt.Fprintln(w, "# TYPE dns_cache_misses_total counter")
+	fmt.Fprintf(w, "dns_cache_misses_total %d\n", stats.Misses)
+	fmt.Fprintln(w, "# HELP dns_cache_prefetches_total Popular entries refreshed before they expired.")
+	fmt.Fprintln(w, "# TYPE dns_cache_prefetches_total counter")
+	fmt.Fprintf(w, "dns_cache_prefetches_total %d\n", stats.Prefetches)
+	fmt.Fprintln(w, "# HELP dns_cache_stale_answers_total Queries answered from expired entries while the upstreams failed.")
+	fmt.Fprintln(w, "# TYPE dns_cache_stale_answers_total counter")
+	fmt.Fprintf(w, "dns_cache_stale_answers_total %d\n", stats.Stale)
+	fmt.Fprintln(w, "# HELP dns_cache_hit_ratio Share of queries answered from the cache since startup.")
+	fmt.Fprintln(w, "# TYPE dns_cache_hit_ratio gauge")
+	ratio := 0.0
+	if total := stats.Hits + stats.Misses; total > 0 {
+		ratio = float64(stats.Hits) / float64(total)
+	}
+	fmt.Fprintf(w, "dns_cache_hit_ratio %g\n", ratio)
+	fmt.Fprintln(w, "# HELP dns_cache_entries Responses held in the cache.")
+	fmt.Fprintln(w, "# TYPE dns_cache_entries gauge")
+	fmt.Fprintf(w, "dns_cache_entries %d\n", stats.Entries)
+}
+
+// sortedKeys returns the keys of a map in order, for stable output
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serveMetrics serves m on addr at /metrics in the background
+func serveMetrics(addr string, m *metrics) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.write(w)
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fatal("metrics server failed", "listen", addr, "err", err)
+		}
+	}()
+	slog.Info("serving metrics", "listen", addr, "path", "/metrics")
+}
+
+// meteredResolver counts the exchanges with one upstream and their failures
+type meteredResolver struct {
+	resolver.Resolver
+	server  string
+	metrics *metrics
+}
+
+// Query implements resolver.Resolver
+func (r *meteredResolver) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	resp, err := r.Resolver.Query(ctx, name, qtype)
+	r.observe(ctx, resp, err)
+	return resp, err
+}
+
+// Exchange implements resolver.Resolver
+func (r *meteredResolver) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	resp, err := r.Resolver.Exchange(ctx, m)
+	r.observe(ctx, resp, err)
+	return resp, err
+}
+
+func (r *meteredResolver) observe(ctx context.Context, resp *dns.Msg, err error) {
+	// Exchanges given up on, such as the losers of -race, are not the
+	// upstream's fault
+	if ctx.Err() == context.Canceled {
+		return
+	}
+	failed := err != nil || resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused
+	r.metrics.observeUpstream(r.server, failed)
+}
+
+// rcodeString names an rcode for metric labels
+func rcodeString(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// typeResult is the outcome of the query for one of several types
+type typeResult struct {
+	qtype uint16
+	resp  *dns.Msg
+	trace resolver.Trace
+	sent  time.Time
+	err   error
+}
+
+// queryTypes asks for every type in parallel and returns the results in
+// the order of types
+func queryTypes(ctx context.Context, types []uint16, ask func(context.Context, uint16) (*dns.Msg, error)) []typeResult {
+	results := make([]typeResult, len(types))
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		results[i].qtype = t
+		go func(res *typeResult) {
+			defer wg.Done()
+			res.sent = time.Now()
+			res.resp, res.err = ask(resolver.WithTrace(ctx, &res.trace), res.qtype)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// printTypes prints the answers grouped by type, with a line for the types
+// that have none
+func printTypes(domain string, results []typeResult, punycode bool) {
+	printHeading(domain, punycode)
+	for _, res := range results {
+		name := typeString(res.qtype)
+		switch {
+		case res.err != nil:
+			fmt.Printf(";; %s: query failed: %v\n", name, res.err)
+		case res.resp.Rcode != dns.RcodeSuccess:
+			fmt.Printf(";; %s: %s\n", name, explainRcode(res.resp))
+		case len(res.resp.Answer) == 0:
+			fmt.Printf(";; %s: no records\n", name)
+		default:
+			fmt.Printf(";; %s\n", name)
+			printAnswers(res.resp, punycode)
+		}
+	}
+}
+
+// printTypesJSON prints the results as a JSON array, an element per type
+// in the form of batch -json lines
+func printTypesJSON(domain string, results []typeResult) {
+	out := make([]batchJSON, 0, len(results))
+	for _, res := range results {
+		line := batchJSON{Name: dns.Fqdn(domain), Type: typeString(res.qtype), ErrorClass: classify(res.resp, res.err).String()}
+		if res.err != nil {
+			line.Error = res.err.Error()
+		} else {
+			resp := newJSONResponse(res.resp, res.trace)
+			line.jsonResponse = &resp
+		}
+		out = append(out, line)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		fatal(err.Error())
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+
+	"tmp-dns/pkg/resolver"
+)
+
+const (
+	// pcapLinkRaw is LINKTYPE_RAW, packets that start with their IPv4 or
+	// IPv6 header
+	pcapLinkRaw = 101
+	// pcapSnapLen is the largest packet the file declares, room for any
+	// DNS message with its headers
+	pcapSnapLen = 65535
+	// pcapUsage is the usage of -pcap, shared by the commands that take it
+	pcapUsage = "write every DNS message sent to and received from the servers to this pcap `file` for Wireshark, those of encrypted transports decrypted"
+)
+
+var (
+	// pcapUnknownServer and pcapUnknownClient stand in for the addresses of
+	// transports that do not expose their sockets, from the documentation
+	// ranges of RFC 5737
+	pcapUnknownServer = net.IPv4(192, 0, 2, 53).To4()
+	pcapUnknownClient = net.IPv4(192, 0, 2, 1).To4()
+)
+
+// pcapWriter writes the messages the wire tap sees to a pcap file, each as
+// a UDP datagram with synthesized IP and UDP headers, so that Wireshark
+// decodes them as DNS whatever the transport. Plain UDP and TCP messages
+// keep the addresses and ports of their socket. The encrypted transports
+// are written decrypted, from their socket addresses when known, with the
+// server on port 53. A nil *pcapWriter writes nothing.
+type pcapWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// openPcap creates the pcap file at path, or returns nil when path is empty
+func openPcap(path string) (*pcapWriter, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &pcapWriter{f: f, w: bufio.NewWriter(f)}
+	header := binary.LittleEndian.AppendUint32(nil, 0xa1b23c4d) // nanosecond timestamps
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint16(header, 4)
+	header = binary.LittleEndian.AppendUint32(header, 0) // GMT offset
+	header = binary.LittleEndian.AppendUint32(header, 0) // timestamp accuracy
+	header = binary.LittleEndian.AppendUint32(header, pcapSnapLen)
+	header = binary.LittleEndian.AppendUint32(header, pcapLinkRaw)
+	p.w.Write(header)
+	return p, nil
+}
+
+// context returns ctx with a wire tap writing to p
+func (p *pcapWriter) context(ctx context.Context) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return resolver.WithWireTap(ctx, p.write)
+}
+
+// write adds one message as a packet
+func (p *pcapWriter) write(m resolver.WireMessage) {
+	if len(m.Data) < 3 {
+		return
+	}
+	client, clientPort := pcapEndpoint(m.Local, pcapUnknownClient, 0)
+	server, serverPort := pcapEndpoint(m.Remote, pcapServerIP(m.Server), 53)
+	if m.Transport != "udp" && m.Transport != "tcp" {
+		serverPort = 53
+	}
+	if clientPort == 0 {
+		// A port made up from the message ID pairs queries with their
+		// responses
+		clientPort = 49152 + int(binary.BigEndian.Uint16(m.Data)%16384)
+	}
+	if (client.To4() == nil) != (server.To4() == nil) {
+		client = pcapUnknownClient
+		if server.To4() == nil {
+			client = net.IPv6loopback
+		}
+	}
+	src, dst, srcPort, dstPort := client, server, clientPort, serverPort
+	if m.Data[2]&0x80 != 0 { // QR, a response
+		src, dst, srcPort, dstPort = server, client, serverPort, clientPort
+	}
+	packet := ipUDPPacket(src, dst, srcPort, dstPort, m.Data)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f == nil {
+		return
+	}
+	record := binary.LittleEndian.AppendUint32(nil, uint32(m.Time.Unix()))
+	record = binary.LittleEndian.AppendUint32(record, uint32(m.Time.Nanosecond()))
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(packet)))
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(packet)))
+	p.w.Write(record)
+	p.w.Write(packet)
+	// serve runs until it is killed, so nothing waits in the buffer
+	p.w.Flush()
+}
+
+// close flushes and closes the file, after which messages are ignored
+func (p *pcapWriter) close() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f == nil {
+		return nil
+	}
+	f := p.f
+	p.f = nil
+	if err := p.w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pcapEndpoint returns the IP and port of addr, or ip and port when addr
+// is not an IP socket address
+func pcapEndpoint(addr net.Addr, ip net.IP, port int) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	}
+	return ip, port
+}
+
+// pcapServerIP returns the address in a host:port or URL server when it
+// is an IP literal, or pcapUnknownServer
+func pcapServerIP(server string) net.IP {
+	host := server
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	return pcapUnknownServer
+}
+
+// ipUDPPacket wraps payload in UDP and IPv4 or IPv6 headers
+func ipUDPPacket(src, dst net.IP, srcPort, dstPort int, payload []byte) []byte {
+	udpLen := 8 + len(payload)
+	udp := binary.BigEndian.AppendUint16(nil, uint16(srcPort))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(dstPort))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(udpLen))
+	udp = binary.BigEndian.AppendUint16(udp, 0)
+	udp = append(udp, payload...)
+
+	var packet, pseudo []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		packet = []byte{0x45, 0}
+		packet = binary.BigEndian.AppendUint16(packet, uint16(20+udpLen))
+		packet = append(packet, 0, 0, 0x40, 0, 64, 17, 0, 0) // ID, DF, TTL, UDP, checksum
+		packet = append(append(packet, src4...), dst4...)
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet, 0))
+		pseudo = append(append([]byte{}, src4...), dst4...)
+		pseudo = append(pseudo, 0, 17)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(udpLen))
+	} else {
+		packet = []byte{0x60, 0, 0, 0}
+		packet = binary.BigEndian.AppendUint16(packet, uint16(udpLen))
+		packet = append(packet, 17, 64) // UDP, hop limit
+		packet = append(append(packet, src.To16()...), dst.To16()...)
+		pseudo = append(append([]byte{}, src.To16()...), dst.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(udpLen))
+		pseudo = append(pseudo, 0, 0, 0, 17)
+	}
+	sum := checksum(udp, sumWords(pseudo))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(packet, udp...)
+}
+
+// sumWords adds up b as big endian 16 bit words, the last one padded
+func sumWords(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksum returns the Internet checksum of b on top of the partial sum
+func checksum(b []byte, sum uint32) uint16 {
+	sum += sumWords(b)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// closePcap closes p, warning when the file could not be written
+func closePcap(p *pcapWriter) {
+	if err := p.close(); err != nil {
+		slog.Warn("failed to write the pcap file", "err", err)
+	}
+}
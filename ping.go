@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// pingOptions are the flags of ping mode, which repeats the query and
+// reports latency and loss, for comparing resolvers
+type pingOptions struct {
+	count    int
+	interval time.Duration
+	each     bool
+}
+
+// register adds the ping flags to fs
+func (p *pingOptions) register(fs *flag.FlagSet) {
+	fs.IntVar(&p.count, "count", 0, "send the query `n` times, like ping, and print the min, avg, max and p95 latency and the loss")
+	fs.DurationVar(&p.interval, "interval", time.Second, "with -count, wait this `duration` between queries")
+	fs.BoolVar(&p.each, "each", false, "with -count, query each server of -server on its own and print statistics for each")
+}
+
+// active reports whether ping mode was asked for
+func (p *pingOptions) active() bool {
+	return p.count > 0
+}
+
+// pingTarget is where one series of queries goes
+type pingTarget struct {
+	label string // the server, empty for all of them through one resolver
+	ask   func(ctx context.Context) (*dns.Msg, error)
+}
+
+// pingStats sums up the queries of one target
+type pingStats struct {
+	Server      string         `json:"server,omitempty"`
+	Sent        int            `json:"sent"`
+	Received    int            `json:"received"`
+	LossPercent float64        `json:"loss_percent"`
+	MinMillis   float64        `json:"min_ms,omitempty"`
+	AvgMillis   float64        `json:"avg_ms,omitempty"`
+	MaxMillis   float64        `json:"max_ms,omitempty"`
+	P95Millis   float64        `json:"p95_ms,omitempty"`
+	Rcodes      map[string]int `json:"rcodes,omitempty"`
+
+	rtts    []time.Duration
+	lastErr error
+}
+
+// record adds the outcome of one query
+func (s *pingStats) record(resp *dns.Msg, err error, rtt time.Duration) {
+	s.Sent++
+	if err != nil {
+		s.lastErr = err
+		return
+	}
+	s.Received++
+	s.rtts = append(s.rtts, rtt)
+	if s.Rcodes == nil {
+		s.Rcodes = map[string]int{}
+	}
+	s.Rcodes[rcodeString(resp.Rcode)]++
+}
+
+// summarize works out the loss and the latency figures
+func (s *pingStats) summarize() {
+	if s.Sent > 0 {
+		s.LossPercent = 100 * float64(s.Sent-s.Received) / float64(s.Sent)
+	}
+	if len(s.rtts) == 0 {
+		return
+	}
+	sorted := append([]time.Duration(nil), s.rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, rtt := range sorted {
+		total += rtt
+	}
+	millis := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	s.MinMillis = millis(sorted[0])
+	s.MaxMillis = millis(sorted[len(sorted)-1])
+	s.AvgMillis = millis(total / time.Duration(len(sorted)))
+	// The nearest rank, so that p95 is a latency actually seen
+	s.P95Millis = millis(sorted[int(math.Ceil(0.95*float64(len(sorted))))-1])
+}
+
+// run sends the query count times to every target, interval apart, the
+// targets of a round at once, and prints a line per query followed by the
+// statistics of each target. Ctrl-C stops early and still prints them. It
+// returns the exit status: 0 when any query got a response, else that of
+// the last failure. Each query gets timeout on top of ctx.
+func (p *pingOptions) run(ctx context.Context, domain string, qtype uint16, timeout time.Duration, targets []pingTarget, jsonOut bool) int {
+	stats := make([]pingStats, len(targets))
+	for i, t := range targets {
+		stats[i].Server = t.label
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	if !jsonOut {
+		fmt.Printf("PING %s %s\n", domain, typeString(qtype))
+	}
+	var mu sync.Mutex
+rounds:
+	for seq := 1; seq <= p.count; seq++ {
+		if seq > 1 {
+			select {
+			case <-interrupt:
+				break rounds
+			case <-time.After(p.interval):
+			}
+		}
+		var wg sync.WaitGroup
+		for i, t := range targets {
+			wg.Add(1)
+			go func(i int, t pingTarget) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(ctx, timeout)
+				defer cancel()
+				var trace resolver.Trace
+				start := time.Now()
+				resp, err := t.ask(resolver.WithTrace(resolver.WithTraceID(ctx, resolver.NewTraceID()), &trace))
+				rtt := trace.RTT
+				if rtt == 0 {
+					rtt = time.Since(start)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				stats[i].record(resp, err, rtt)
+				if !jsonOut {
+					printPing(seq, t.label, resp, err, trace, rtt)
+				}
+			}(i, t)
+		}
+		wg.Wait()
+	}
+
+	status := 0
+	var failed error
+	received := 0
+	for i := range stats {
+		stats[i].summarize()
+		received += stats[i].Received
+		if stats[i].lastErr != nil {
+			failed = stats[i].lastErr
+		}
+	}
+	if received == 0 && failed != nil {
+		status = classify(nil, failed).exitCode()
+	}
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(stats); err != nil {
+			fatal(err.Error())
+		}
+		return status
+	}
+	for _, s := range stats {
+		fmt.Println()
+		printPingStats(domain, qtype, s)
+	}
+	return status
+}
+
+// printPing prints the outcome of query seq, naming the server that
+// answered
+func printPing(seq int, label string, resp *dns.Msg, err error, trace resolver.Trace, rtt time.Duration) {
+	if label != "" {
+		label = " " + label
+	}
+	if err != nil {
+		fmt.Printf("seq=%d%s: %s: %v\n", seq, label, classify(nil, err), err)
+		return
+	}
+	if trace.Server != "" {
+		label = fmt.Sprintf(" from %s (%s)", trace.Server, trace.Transport)
+	}
+	fmt.Printf("seq=%d%s: %s, %d answers, %.1f ms\n", seq, label, rcodeString(resp.Rcode), len(resp.Answer), float64(rtt.Microseconds())/1000)
+}
+
+// printPingStats prints the statistics of one target the way ping does
+func printPingStats(domain string, qtype uint16, s pingStats) {
+	via := ""
+	if s.Server != "" {
+		via = " via " + s.Server
+	}
+	fmt.Printf("--- %s %s statistics%s ---\n", domain, typeString(qtype), via)
+	fmt.Printf("%d queries sent, %d responses, %.1f%% loss\n", s.Sent, s.Received, s.LossPercent)
+	if s.Received == 0 {
+		return
+	}
+	fmt.Printf("rtt min/avg/max/p95 = %.1f/%.1f/%.1f/%.1f ms\n", s.MinMillis, s.AvgMillis, s.MaxMillis, s.P95Millis)
+	rcodes := make([]string, 0, len(s.Rcodes))
+	for rcode, n := range s.Rcodes {
+		rcodes = append(rcodes, fmt.Sprintf("%s %d", rcode, n))
+	}
+	sort.Strings(rcodes)
+	fmt.Printf("rcodes: %s\n", strings.Join(rcodes, ", "))
+}
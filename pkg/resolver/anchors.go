@@ -0,0 +1,396 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RootAnchorsURL is where IANA publishes the root trust anchors in the XML
+// format of RFC 7958
+const RootAnchorsURL = "https://data.iana.org/root-anchors/root-anchors.xml"
+
+// AddHoldDown is how long a new key must be seen before it is trusted, and
+// how long a revoked key is remembered (RFC 5011 section 2.4.1)
+const AddHoldDown = 30 * 24 * time.Hour
+
+// KeyState is the RFC 5011 section 4 state of a tracked key
+type KeyState string
+
+const (
+	// KeyAddPend is a new key waiting out the hold-down time
+	KeyAddPend KeyState = "AddPend"
+	// KeyValid is a trusted key
+	KeyValid KeyState = "Valid"
+	// KeyMissing is a trusted key that has left the DNSKEY set without being
+	// revoked, it stays trusted
+	KeyMissing KeyState = "Missing"
+	// KeyRevoked is a key that signed its own revocation
+	KeyRevoked KeyState = "Revoked"
+)
+
+// TrackedKey is a trust anchor as an AnchorStore remembers it
+type TrackedKey struct {
+	Zone      string    `json:"zone"`
+	KeyTag    uint16    `json:"key_tag"`
+	State     KeyState  `json:"state"`
+	DS        string    `json:"ds,omitempty"`     // the digest the key was first trusted by
+	DNSKEY    string    `json:"dnskey,omitempty"` // the key itself, once seen
+	FirstSeen time.Time `json:"first_seen"`
+	Changed   time.Time `json:"changed"` // when State last changed
+}
+
+// AnchorStore keeps trust anchors in a JSON file and follows key rollovers
+// of their zones with the automated updates of RFC 5011, so that validation
+// keeps working after a KSK rollover without new anchors being configured
+type AnchorStore struct {
+	Path    string        `json:"-"`
+	Checked time.Time     `json:"checked"` // the last successful Refresh
+	Keys    []*TrackedKey `json:"keys"`
+}
+
+// LoadAnchorStore reads the store at path, which need not exist yet
+func LoadAnchorStore(path string) (*AnchorStore, error) {
+	s := &AnchorStore{Path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust anchor store: %w", err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse trust anchor store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Save writes the store to a temporary file and renames it into place
+func (s *AnchorStore) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode trust anchor store: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
+		return fmt.Errorf("failed to write trust anchor store: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write trust anchor store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write trust anchor store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write trust anchor store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("failed to replace trust anchor store: %w", err)
+	}
+	return nil
+}
+
+// Anchors returns DS records for the trusted keys: those in the Valid and
+// Missing states
+func (s *AnchorStore) Anchors() []*dns.DS {
+	var out []*dns.DS
+	for _, k := range s.Keys {
+		if k.State != KeyValid && k.State != KeyMissing {
+			continue
+		}
+		if ds := k.ds(); ds != nil {
+			out = append(out, ds)
+		}
+	}
+	return out
+}
+
+// HasZone reports whether the store tracks keys for zone
+func (s *AnchorStore) HasZone(zone string) bool {
+	zone = dns.CanonicalName(zone)
+	for _, k := range s.Keys {
+		if k.Zone == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// Add trusts anchors, such as those of a TLD or a private root, from now on
+// and tracks their zones' rollovers from the next Refresh
+func (s *AnchorStore) Add(anchors []*dns.DS) {
+	now := time.Now().UTC()
+	for _, ds := range anchors {
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		if s.find(zone, ds.KeyTag) != nil {
+			continue
+		}
+		s.Keys = append(s.Keys, &TrackedKey{Zone: zone, KeyTag: ds.KeyTag, State: KeyValid, DS: ds.String(), FirstSeen: now, Changed: now})
+	}
+}
+
+// Bootstrap fetches the root anchors from url, normally RootAnchorsURL, and
+// adds those currently valid. The detached signature IANA publishes next to
+// the file is not checked: the HTTPS connection vouches for it, and Refresh
+// fails unless an anchor matches a key that signs the root DNSKEY set.
+func (s *AnchorStore) Bootstrap(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch root anchors: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch root anchors: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to fetch root anchors: %w", err)
+	}
+	anchors, err := ParseRootAnchors(data, time.Now())
+	if err != nil {
+		return err
+	}
+	s.Add(anchors)
+	return nil
+}
+
+// rootAnchorsXML is the TrustAnchor document of RFC 7958 section 2
+type rootAnchorsXML struct {
+	Zone       string `xml:"Zone"`
+	KeyDigests []struct {
+		ID         string `xml:"id,attr"`
+		ValidFrom  string `xml:"validFrom,attr"`
+		ValidUntil string `xml:"validUntil,attr"`
+		KeyTag     uint16 `xml:"KeyTag"`
+		Algorithm  uint8  `xml:"Algorithm"`
+		DigestType uint8  `xml:"DigestType"`
+		Digest     string `xml:"Digest"`
+	} `xml:"KeyDigest"`
+}
+
+// ParseRootAnchors returns the DS records in an RFC 7958 document that are
+// valid at now
+func ParseRootAnchors(data []byte, now time.Time) ([]*dns.DS, error) {
+	var doc rootAnchorsXML
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse root anchors: %w", err)
+	}
+	zone := dns.CanonicalName(strings.TrimSpace(doc.Zone))
+	var anchors []*dns.DS
+	for _, kd := range doc.KeyDigests {
+		from, err := time.Parse(time.RFC3339, kd.ValidFrom)
+		if err != nil {
+			return nil, fmt.Errorf("root anchor %s: invalid validFrom: %w", kd.ID, err)
+		}
+		if now.Before(from) {
+			continue
+		}
+		if kd.ValidUntil != "" {
+			until, err := time.Parse(time.RFC3339, kd.ValidUntil)
+			if err != nil {
+				return nil, fmt.Errorf("root anchor %s: invalid validUntil: %w", kd.ID, err)
+			}
+			if !now.Before(until) {
+				continue
+			}
+		}
+		anchors = append(anchors, &dns.DS{
+			Hdr:        dns.RR_Header{Name: zone, Rrtype: dns.TypeDS, Class: dns.ClassINET},
+			KeyTag:     kd.KeyTag,
+			Algorithm:  kd.Algorithm,
+			DigestType: kd.DigestType,
+			Digest:     strings.ToUpper(strings.TrimSpace(kd.Digest)),
+		})
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no currently valid root anchors for %s", zone)
+	}
+	return anchors, nil
+}
+
+// Refresh fetches the DNSKEY set of every tracked zone and moves its keys
+// through the states of RFC 5011 section 4. A zone whose set is not signed
+// by a trusted key is left as it was and reported in the error.
+func (s *AnchorStore) Refresh(ctx context.Context, r Resolver) error {
+	var zones []string
+	for _, k := range s.Keys {
+		if !containsName(zones, k.Zone) {
+			zones = append(zones, k.Zone)
+		}
+	}
+	var errs []string
+	for _, zone := range zones {
+		if err := s.refreshZone(ctx, r, zone); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	s.Checked = time.Now().UTC()
+	return nil
+}
+
+func (s *AnchorStore) refreshZone(ctx context.Context, r Resolver, zone string) error {
+	resp, err := r.Exchange(ctx, NewDNSSECQuery(zone, dns.TypeDNSKEY))
+	if err != nil {
+		return fmt.Errorf("%s DNSKEY lookup: %w", zone, err)
+	}
+	sets, sigs := splitRRsets(resp.Answer)
+	var keySet []dns.RR
+	for _, set := range sets {
+		if set[0].Header().Rrtype == dns.TypeDNSKEY && dns.CanonicalName(set[0].Header().Name) == zone {
+			keySet = set
+		}
+	}
+	if keySet == nil {
+		return fmt.Errorf("no DNSKEY records for %s", zone)
+	}
+	setSigs := sigs[rrsetKey(zone, dns.TypeDNSKEY)]
+
+	// Only a set signed by a key trusted already may change anything
+	var trusted []*dns.DNSKEY
+	for _, rr := range keySet {
+		key := rr.(*dns.DNSKEY)
+		if k := s.find(zone, key.KeyTag()); k != nil && (k.State == KeyValid || k.State == KeyMissing) && k.matches(key) {
+			trusted = append(trusted, key)
+		}
+	}
+	if len(trusted) == 0 {
+		return fmt.Errorf("no trusted key for %s is in its DNSKEY set", zone)
+	}
+	if err := verifySigned(keySet, setSigs, trusted); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	seen := map[*TrackedKey]bool{}
+	for _, rr := range keySet {
+		key := rr.(*dns.DNSKEY)
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+		if key.Flags&dns.REVOKE != 0 {
+			// A revoked key is known by the tag it had before the bit was set,
+			// and counts only when it signed the set itself
+			orig := *key
+			orig.Flags &^= dns.REVOKE
+			k := s.find(zone, orig.KeyTag())
+			if k == nil || !k.matches(&orig) {
+				continue
+			}
+			seen[k] = true
+			if k.State != KeyRevoked && verifySigned(keySet, setSigs, []*dns.DNSKEY{key}) == nil {
+				k.State, k.Changed = KeyRevoked, now
+			}
+			continue
+		}
+		k := s.find(zone, key.KeyTag())
+		if k == nil {
+			k = &TrackedKey{Zone: zone, KeyTag: key.KeyTag(), State: KeyAddPend, FirstSeen: now, Changed: now}
+			s.Keys = append(s.Keys, k)
+		} else if !k.matches(key) {
+			continue
+		}
+		seen[k] = true
+		k.DNSKEY = key.String()
+		switch {
+		case k.State == KeyAddPend && now.Sub(k.FirstSeen) >= AddHoldDown:
+			k.State, k.Changed = KeyValid, now
+		case k.State == KeyMissing:
+			k.State, k.Changed = KeyValid, now
+		}
+	}
+
+	kept := s.Keys[:0]
+	for _, k := range s.Keys {
+		if k.Zone == zone && !seen[k] {
+			switch k.State {
+			case KeyAddPend:
+				// A pending key that disappears starts over if it comes back
+				continue
+			case KeyValid:
+				k.State, k.Changed = KeyMissing, now
+			case KeyRevoked:
+				if now.Sub(k.Changed) >= AddHoldDown {
+					continue
+				}
+			}
+		}
+		kept = append(kept, k)
+	}
+	s.Keys = kept
+	return nil
+}
+
+func (s *AnchorStore) find(zone string, tag uint16) *TrackedKey {
+	for _, k := range s.Keys {
+		if k.Zone == zone && k.KeyTag == tag {
+			return k
+		}
+	}
+	return nil
+}
+
+// ds returns the DS the key is trusted by, a digest of the DNSKEY once it
+// has been seen
+func (k *TrackedKey) ds() *dns.DS {
+	if key := k.key(); key != nil {
+		return key.ToDS(dns.SHA256)
+	}
+	rr, err := dns.NewRR(k.DS)
+	if err != nil {
+		return nil
+	}
+	ds, _ := rr.(*dns.DS)
+	return ds
+}
+
+func (k *TrackedKey) key() *dns.DNSKEY {
+	if k.DNSKEY == "" {
+		return nil
+	}
+	rr, err := dns.NewRR(k.DNSKEY)
+	if err != nil {
+		return nil
+	}
+	key, _ := rr.(*dns.DNSKEY)
+	return key
+}
+
+// matches reports whether key is the tracked key and not merely one with
+// the same tag
+func (k *TrackedKey) matches(key *dns.DNSKEY) bool {
+	if known := k.key(); known != nil {
+		return known.Algorithm == key.Algorithm && known.PublicKey == key.PublicKey
+	}
+	if ds := k.ds(); ds != nil {
+		return matchesDS(key, []*dns.DS{ds})
+	}
+	return false
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package resolver
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// latencyWeight is how much a new RTT sample moves the average
+	latencyWeight = 0.3
+	// latencyPenalty is the RTT a failed attempt counts as
+	latencyPenalty = 5 * time.Second
+)
+
+// Balancer decides which upstream of a Retry a query tries first and where
+// it moves on to after a failure
+type Balancer interface {
+	// Order returns the indexes of n upstreams in the order to try them
+	Order(ctx context.Context, n int) []int
+	// Observe reports how an attempt with upstream i went
+	Observe(i int, rtt time.Duration, ok bool)
+}
+
+// rotation returns the n indexes starting at start and wrapping around
+func rotation(start, n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = (start + i) % n
+	}
+	return order
+}
+
+// RoundRobin starts each query at the next upstream in turn
+type RoundRobin struct {
+	next atomic.Uint32
+}
+
+// Order implements Balancer
+func (b *RoundRobin) Order(ctx context.Context, n int) []int {
+	return rotation(int(b.next.Add(1)-1)%n, n)
+}
+
+// Observe implements Balancer
+func (b *RoundRobin) Observe(int, time.Duration, bool) {}
+
+// Ordered starts every query at the first upstream and falls back to the
+// others in the order given, for a preferred server with backups or a
+// chain of transports from the most private to the most likely to get
+// through
+type Ordered struct{}
+
+// Order implements Balancer
+func (Ordered) Order(ctx context.Context, n int) []int {
+	return rotation(0, n)
+}
+
+// Observe implements Balancer
+func (Ordered) Observe(int, time.Duration, bool) {}
+
+// Weighted starts queries at the upstreams in proportion to their weights,
+// spread evenly with the smooth weighted round robin of nginx, and falls
+// back to the others from the heaviest down
+type Weighted struct {
+	Weights []int // one per upstream, those below 1 count as 1
+
+	mu      sync.Mutex
+	current []int
+}
+
+// NewWeighted returns a Weighted with the given weights
+func NewWeighted(weights []int) *Weighted {
+	return &Weighted{Weights: weights}
+}
+
+func (b *Weighted) weight(i int) int {
+	if i < len(b.Weights) && b.Weights[i] > 1 {
+		return b.Weights[i]
+	}
+	return 1
+}
+
+// Order implements Balancer
+func (b *Weighted) Order(ctx context.Context, n int) []int {
+	b.mu.Lock()
+	if len(b.current) != n {
+		b.current = make([]int, n)
+	}
+	first, total := 0, 0
+	for i := range b.current {
+		b.current[i] += b.weight(i)
+		total += b.weight(i)
+		if b.current[i] > b.current[first] {
+			first = i
+		}
+	}
+	b.current[first] -= total
+	b.mu.Unlock()
+
+	order := []int{first}
+	for _, i := range rotation(0, n) {
+		if i != first {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order[1:], func(x, y int) bool {
+		return b.weight(order[1+x]) > b.weight(order[1+y])
+	})
+	return order
+}
+
+// Observe implements Balancer
+func (b *Weighted) Observe(int, time.Duration, bool) {}
+
+// Latency tries the upstream with the lowest smoothed RTT first. Failures
+// count as latencyPenalty, and upstreams not heard from yet go first so
+// that every one gets measured. Probe keeps the figures fresh for the
+// upstreams queries rarely reach.
+type Latency struct {
+	mu  sync.Mutex
+	rtt []time.Duration // exponentially weighted moving averages, 0 when unmeasured
+}
+
+// NewLatency returns a Latency with no measurements
+func NewLatency() *Latency {
+	return &Latency{}
+}
+
+// Order implements Balancer
+func (b *Latency) Order(ctx context.Context, n int) []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.grow(n)
+	order := rotation(0, n)
+	sort.SliceStable(order, func(x, y int) bool {
+		return b.rtt[order[x]] < b.rtt[order[y]]
+	})
+	return order
+}
+
+// Observe implements Balancer
+func (b *Latency) Observe(i int, rtt time.Duration, ok bool) {
+	if !ok && rtt < latencyPenalty {
+		rtt = latencyPenalty
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.grow(i + 1)
+	if b.rtt[i] == 0 {
+		b.rtt[i] = rtt
+	} else {
+		b.rtt[i] += time.Duration(latencyWeight * float64(rtt-b.rtt[i]))
+	}
+}
+
+// RTT returns the smoothed RTT of upstream i, 0 when unmeasured
+func (b *Latency) RTT(i int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i >= len(b.rtt) {
+		return 0
+	}
+	return b.rtt[i]
+}
+
+func (b *Latency) grow(n int) {
+	for len(b.rtt) < n {
+		b.rtt = append(b.rtt, 0)
+	}
+}
+
+// Probe asks every upstream for the root NS records each interval until
+// ctx is done, observing how they do. The upstreams must be in the order
+// the Retry using b has them.
+func (b *Latency) Probe(ctx context.Context, upstreams []Resolver, interval time.Duration) {
+	probeLoop(ctx, upstreams, interval, b.Observe)
+}
+
+// probeLoop asks every upstream for the root NS records at once, then
+// again each interval until ctx is done, and passes on how they did
+func probeLoop(ctx context.Context, upstreams []Resolver, interval time.Duration, observe func(i int, rtt time.Duration, ok bool)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for i, upstream := range upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pctx, cancel := context.WithTimeout(WithTraceID(ctx, NewTraceID()), latencyPenalty)
+				defer cancel()
+				start := time.Now()
+				resp, err := upstream.Query(pctx, ".", dns.TypeNS)
+				if err == nil || ctx.Err() == nil {
+					observe(i, time.Since(start), err == nil && !retryableRcode(resp.Rcode))
+				}
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type clientKey struct{}
+
+// WithClient returns a context naming the client a query is made for,
+// such as its IP address, for Sticky
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// Sticky sends the queries of each client named by WithClient to the same
+// upstream, so that the client sees one consistent view, moving on to the
+// next ones only on failure. Queries without a client go round robin.
+type Sticky struct {
+	RoundRobin
+}
+
+// NewSticky returns a Sticky balancer
+func NewSticky() *Sticky {
+	return &Sticky{}
+}
+
+// Order implements Balancer
+func (b *Sticky) Order(ctx context.Context, n int) []int {
+	client, _ := ctx.Value(clientKey{}).(string)
+	if client == "" {
+		return b.RoundRobin.Order(ctx, n)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(client))
+	return rotation(int(h.Sum32()%uint32(n)), n)
+}
@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// bootstrapMinTTL keeps a looked up address for at least this long, so
+// servers with tiny TTLs do not cost a lookup per connection
+const bootstrapMinTTL = 30 * time.Second
+
+// Bootstrap looks up the addresses of encrypted servers given by name
+// through plain DNS servers given by address, so that reaching them does
+// not depend on the system resolver, which may itself be configured to use
+// them. Addresses are cached for their TTL and kept past it when a later
+// lookup fails.
+type Bootstrap struct {
+	Servers []string // host:port of the plain DNS servers, tried in order
+	Dialer  *Dialer  // opens the sockets to Servers, a plain net.Dialer when nil
+
+	mu    sync.Mutex
+	cache map[bootstrapKey]bootstrapEntry
+}
+
+type bootstrapKey struct {
+	host   string
+	family int
+}
+
+type bootstrapEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// NewBootstrap returns a Bootstrap asking the host:port servers
+func NewBootstrap(servers []string) *Bootstrap {
+	return &Bootstrap{Servers: servers}
+}
+
+// LookupIP returns the addresses of host in family, 4 or 6, or of both
+// with the IPv4 ones first when family is 0
+func (b *Bootstrap) LookupIP(ctx context.Context, host string, family int) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	key := bootstrapKey{dns.CanonicalName(host), family}
+	b.mu.Lock()
+	entry, ok := b.cache[key]
+	b.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	ips, ttl, err := b.lookup(ctx, key.host, family)
+	if err != nil {
+		if ok {
+			return entry.ips, nil
+		}
+		return nil, err
+	}
+	if ttl < bootstrapMinTTL {
+		ttl = bootstrapMinTTL
+	}
+	b.mu.Lock()
+	if b.cache == nil {
+		b.cache = make(map[bootstrapKey]bootstrapEntry)
+	}
+	b.cache[key] = bootstrapEntry{ips: ips, expires: time.Now().Add(ttl)}
+	b.mu.Unlock()
+	return ips, nil
+}
+
+// lookup asks the servers in turn for the address records of name,
+// returning them with the smallest TTL among them
+func (b *Bootstrap) lookup(ctx context.Context, name string, family int) ([]net.IP, time.Duration, error) {
+	if len(b.Servers) == 0 {
+		return nil, 0, fmt.Errorf("no bootstrap servers to look up %s with", name)
+	}
+	var lastErr error
+	for _, server := range b.Servers {
+		r := NewUDP(server)
+		r.Dialer = b.Dialer
+		var ips []net.IP
+		var ttl uint32
+		for _, qtype := range familyTypes(family) {
+			resp, err := r.Query(ctx, name, qtype)
+			if err == nil {
+				err = checkReply(&dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}, dns.OpcodeQuery, resp)
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for _, rr := range resp.Answer {
+				var ip net.IP
+				switch rr := rr.(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				default:
+					continue
+				}
+				if len(ips) == 0 || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) > 0 {
+			return ips, time.Duration(ttl) * time.Second, nil
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("%s has no addresses", name)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, fmt.Errorf("failed to look up %s through the bootstrap servers: %w", name, lastErr)
+}
@@ -0,0 +1,443 @@
+package resolver
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultCacheSize is the number of responses NewCache keeps when given no size
+const DefaultCacheSize = 10000
+
+// DefaultMaxNegativeTTL bounds how long NewCache keeps negative answers,
+// the upper end of the one to three hours RFC 2308 section 5 suggests
+const DefaultMaxNegativeTTL = 3 * time.Hour
+
+// DefaultStaleTTL is the TTL of stale answers, the 30 seconds RFC 8767
+// section 4 recommends
+const DefaultStaleTTL = 30 * time.Second
+
+const (
+	// prefetchShare is the part of its TTL, one in prefetchShare, an entry
+	// has left when a hit makes Prefetch refresh it
+	prefetchShare = 10
+	// prefetchTimeout bounds a refresh in the background
+	prefetchTimeout = 5 * time.Second
+)
+
+// Cache answers repeated questions from memory. Positive responses live for
+// their smallest TTL, negative ones (NXDOMAIN and NODATA) for the SOA
+// minimum as RFC 2308 describes, and cached TTLs count down as entries age.
+// Failures, SERVFAIL answers and upstream errors alike, are kept for
+// ServfailTTL only. Truncated responses and other rcodes are never cached.
+// Neither are the answers to other opcodes than QUERY and to queries with
+// an EDNS client subnet, which depend on more than the question: those go
+// upstream every time.
+//
+// With MaxStale set the cache serves stale data as RFC 8767 describes:
+// expired entries are kept that much longer, and when the upstream fails,
+// answers SERVFAIL or takes longer than StaleTimeout to answer a question
+// of one, the expired entry answers instead, with its TTLs clamped to
+// StaleTTL and a Stale Answer or Stale NXDOMAIN Answer extended error
+// (RFC 8914) when the query has EDNS. After a failure the entry answers
+// stale for StaleTTL without asking the upstream again.
+type Cache struct {
+	Upstream   Resolver
+	MaxEntries int
+	// MaxNegativeTTL bounds how long negative answers are kept, 0 keeps
+	// none of them
+	MaxNegativeTTL time.Duration
+	// ServfailTTL is how long a failure is answered from the cache with
+	// SERVFAIL instead of being retried upstream, 0 retries every time.
+	// It spares the upstreams the full load while they are down.
+	ServfailTTL time.Duration
+	// Prefetch, when positive, is the number of hits that make an entry
+	// popular. A hit in the last tenth of a popular entry's TTL refreshes
+	// it in the background, so that its clients never wait for the
+	// upstream.
+	Prefetch int
+	// MaxStale is how long past their expiry entries may answer while the
+	// upstream is failing, 0 serves nothing stale
+	MaxStale time.Duration
+	// StaleTTL is the most TTL of stale answers, DefaultStaleTTL when 0:
+	// records cached with a shorter one keep it
+	StaleTTL time.Duration
+	// StaleTimeout, when positive, is how long a query with an expired
+	// entry waits for the upstream before it is answered stale; the
+	// upstream's answer, once it comes, still refreshes the entry
+	StaleTimeout time.Duration
+
+	mu         sync.Mutex
+	entries    map[cacheKey]cacheEntry
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	prefetches atomic.Uint64
+	stale      atomic.Uint64
+}
+
+// CacheStats reports cache activity
+type CacheStats struct {
+	Hits       uint64
+	Misses     uint64
+	Prefetches uint64 // refreshes of popular entries before they expired
+	Stale      uint64 // answers from expired entries, with MaxStale
+	Entries    int
+}
+
+type cacheKey struct {
+	name          string
+	qtype, qclass uint16
+	do, cd        bool
+}
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+
+	query      *dns.Msg // what to send again on prefetch, nil for Query
+	hits       int
+	refreshing bool
+	failedAt   time.Time // when the upstream last failed to refresh it, for MaxStale
+}
+
+// NewCache returns a Cache in front of upstream holding at most maxEntries
+// responses, or DefaultCacheSize when maxEntries is zero, with negative
+// answers kept up to DefaultMaxNegativeTTL and failures not at all
+func NewCache(upstream Resolver, maxEntries int) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheSize
+	}
+	return &Cache{Upstream: upstream, MaxEntries: maxEntries, MaxNegativeTTL: DefaultMaxNegativeTTL, entries: map[cacheKey]cacheEntry{}}
+}
+
+// Query implements Resolver
+func (c *Cache) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	key := cacheKey{name: dns.CanonicalName(name), qtype: qtype, qclass: dns.ClassINET}
+	return c.resolve(ctx, key, nil, 0, func(ctx context.Context) (*dns.Msg, error) {
+		return c.Upstream.Query(ctx, name, qtype)
+	})
+}
+
+// Exchange implements Resolver
+func (c *Cache) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) != 1 || m.Opcode != dns.OpcodeQuery || hasSubnet(m) {
+		return c.Upstream.Exchange(ctx, m)
+	}
+	q := m.Question[0]
+	key := cacheKey{name: dns.CanonicalName(q.Name), qtype: q.Qtype, qclass: q.Qclass, cd: m.CheckingDisabled}
+	if opt := m.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return c.resolve(ctx, key, m, m.Id, func(ctx context.Context) (*dns.Msg, error) {
+		return c.Upstream.Exchange(ctx, m)
+	})
+}
+
+// hasSubnet reports whether m carries an EDNS client subnet option
+func hasSubnet(m *dns.Msg) bool {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0SUBNET {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolve answers the question of key from the cache, or through ask and
+// stores the answer. query is the message asked with Exchange, nil for
+// Query, and id the ID of cached answers.
+func (c *Cache) resolve(ctx context.Context, key cacheKey, query *dns.Msg, id uint16, ask func(context.Context) (*dns.Msg, error)) (*dns.Msg, error) {
+	resp, stale := c.lookup(ctx, key, id)
+	if resp != nil {
+		return resp, nil
+	}
+	if stale == nil {
+		resp, err := ask(ctx)
+		if err != nil {
+			if query == nil {
+				query = NewQuery(key.name, key.qtype)
+			}
+			c.storeFailure(ctx, key, query)
+			return nil, err
+		}
+		c.store(key, query, resp)
+		return resp, nil
+	}
+
+	type answer struct {
+		resp *dns.Msg
+		err  error
+	}
+	answers := make(chan answer, 1)
+	askCtx, cancel := ctx, func() {}
+	if c.StaleTimeout > 0 {
+		// Keep asking for the entry's sake once the client got the stale answer
+		askCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), prefetchTimeout)
+	}
+	go func() {
+		defer cancel()
+		resp, err := ask(askCtx)
+		if err == nil && resp.Rcode != dns.RcodeServerFailure {
+			c.store(key, query, resp)
+		} else if askCtx.Err() == nil || c.StaleTimeout > 0 {
+			c.failed(key)
+		}
+		answers <- answer{resp, err}
+	}()
+	var timeout <-chan time.Time
+	if c.StaleTimeout > 0 {
+		t := time.NewTimer(c.StaleTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case a := <-answers:
+		if a.err == nil && a.resp.Rcode != dns.RcodeServerFailure || ctx.Err() != nil {
+			return a.resp, a.err
+		}
+		slog.DebugContext(ctx, "answering stale", "name", key.name, "type", dns.Type(key.qtype).String(), "err", a.err)
+	case <-timeout:
+		slog.DebugContext(ctx, "answering stale, the upstream is slow", "name", key.name, "type", dns.Type(key.qtype).String())
+	}
+	return c.staleAnswer(ctx, stale, query, id), nil
+}
+
+// Stats returns the hit and miss counts and the current number of entries
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Prefetches: c.prefetches.Load(), Stale: c.stale.Load(), Entries: len(c.entries)}
+}
+
+// Flush empties the cache
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	c.entries = map[cacheKey]cacheEntry{}
+	c.mu.Unlock()
+}
+
+// lookup returns a copy of a live entry with its TTLs reduced by its age.
+// With MaxStale it returns the response of an expired entry as stale
+// instead, or answers with it stale right away when the upstream failed to
+// refresh it less than StaleTTL ago.
+func (c *Cache) lookup(ctx context.Context, key cacheKey, id uint16) (*dns.Msg, *dns.Msg) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expires) {
+		if now.Before(c.staleUntil(e)) {
+			c.mu.Unlock()
+			c.misses.Add(1)
+			if now.Sub(e.failedAt) < c.staleTTL() {
+				return c.staleAnswer(ctx, e.msg, e.query, id), nil
+			}
+			return nil, e.msg
+		}
+		delete(c.entries, key)
+		ok = false
+	}
+	prefetch := false
+	if ok {
+		e.hits++
+		if c.Prefetch > 0 && e.hits >= c.Prefetch && !e.refreshing && e.msg.Rcode != dns.RcodeServerFailure && e.expires.Sub(now)*prefetchShare < e.expires.Sub(e.stored) {
+			e.refreshing, prefetch = true, true
+		}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, nil
+	}
+	c.hits.Add(1)
+	if prefetch {
+		go c.refresh(key, e.query)
+	}
+
+	resp := e.msg.Copy()
+	resp.Id = id
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl -= min(h.Ttl, age)
+			}
+		}
+	}
+	recordTrace(ctx, "cache", "", now, 0, resp.Len())
+	return resp, nil
+}
+
+// staleUntil is when e, once expired, can no longer answer stale. Cached
+// failures never do.
+func (c *Cache) staleUntil(e cacheEntry) time.Time {
+	if c.MaxStale <= 0 || e.msg.Rcode == dns.RcodeServerFailure {
+		return e.expires
+	}
+	return e.expires.Add(c.MaxStale)
+}
+
+func (c *Cache) staleTTL() time.Duration {
+	if c.StaleTTL > 0 {
+		return c.StaleTTL
+	}
+	return DefaultStaleTTL
+}
+
+// failed notes that the upstream failed to refresh the expired entry of
+// key, which then answers stale for StaleTTL without asking again
+func (c *Cache) failed(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.failedAt = time.Now()
+		c.entries[key] = e
+	}
+}
+
+// staleAnswer returns a copy of msg with its TTLs clamped to StaleTTL and,
+// when query has EDNS or is nil, the extended error saying it is stale
+func (c *Cache) staleAnswer(ctx context.Context, msg, query *dns.Msg, id uint16) *dns.Msg {
+	c.stale.Add(1)
+	resp := msg.Copy()
+	resp.Id = id
+	ttl := uint32(c.staleTTL() / time.Second)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl = min(h.Ttl, ttl)
+			}
+		}
+	}
+	if opt := resp.IsEdns0(); opt != nil && (query == nil || query.IsEdns0() != nil) {
+		code := dns.ExtendedErrorCodeStaleAnswer
+		if resp.Rcode == dns.RcodeNameError {
+			code = dns.ExtendedErrorCodeStaleNXDOMAINAnswer
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code})
+	}
+	recordTrace(ctx, "cache", "", time.Now(), 0, resp.Len())
+	return resp
+}
+
+// refresh asks the upstream for the entry of key again and stores the
+// answer, or lets the entry expire when that fails
+func (c *Cache) refresh(key cacheKey, query *dns.Msg) {
+	ctx, cancel := context.WithTimeout(WithTraceID(context.Background(), NewTraceID()), prefetchTimeout)
+	defer cancel()
+	if query == nil && (key.do || key.cd || key.qclass != dns.ClassINET) {
+		// loaded from a cache file, rebuild what the key asks for
+		query = NewQuery(key.name, key.qtype)
+		query.Question[0].Qclass = key.qclass
+		query.CheckingDisabled = key.cd
+		query.SetEdns0(UDPBufferSize, key.do)
+	}
+	var resp *dns.Msg
+	var err error
+	if query != nil {
+		resp, err = c.Upstream.Exchange(ctx, query)
+	} else {
+		resp, err = c.Upstream.Query(ctx, key.name, key.qtype)
+	}
+	if err != nil {
+		slog.DebugContext(ctx, "prefetch failed", "name", key.name, "type", dns.Type(key.qtype).String(), "err", err)
+		return
+	}
+	c.prefetches.Add(1)
+	c.store(key, query, resp)
+}
+
+// store caches resp as the answer for key, with query as the message that
+// got it when it came from Exchange
+func (c *Cache) store(key cacheKey, query, resp *dns.Msg) {
+	ttl, ok := c.ttl(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.MaxEntries {
+		c.evict(now)
+	}
+	e := cacheEntry{msg: resp.Copy(), stored: now, expires: now.Add(ttl)}
+	if c.Prefetch > 0 && query != nil {
+		e.query = query.Copy()
+	}
+	c.entries[key] = e
+}
+
+// storeFailure caches a SERVFAIL answer to query after the upstream failed
+// to give one, unless it was the caller that gave up
+func (c *Cache) storeFailure(ctx context.Context, key cacheKey, query *dns.Msg) {
+	if c.ServfailTTL <= 0 || ctx.Err() != nil {
+		return
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(query, dns.RcodeServerFailure)
+	c.store(key, query, resp)
+}
+
+// evict drops expired entries past MaxStale, or failing that the one
+// closest to expiry, stale ones first. The caller holds c.mu.
+func (c *Cache) evict(now time.Time) {
+	var soonest cacheKey
+	var soonestAt time.Time
+	for k, e := range c.entries {
+		if !now.Before(c.staleUntil(e)) {
+			delete(c.entries, k)
+			continue
+		}
+		if soonestAt.IsZero() || e.expires.Before(soonestAt) {
+			soonest, soonestAt = k, e.expires
+		}
+	}
+	if len(c.entries) >= c.MaxEntries {
+		delete(c.entries, soonest)
+	}
+}
+
+// ttl returns how long resp may be cached and whether it may be cached at
+// all
+func (c *Cache) ttl(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+	if resp.Rcode == dns.RcodeServerFailure {
+		return c.ServfailTTL, c.ServfailTTL > 0
+	}
+	negative := resp.Rcode == dns.RcodeNameError || (resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0)
+	if resp.Rcode != dns.RcodeSuccess && !negative {
+		return 0, false
+	}
+
+	if negative {
+		if c.MaxNegativeTTL <= 0 {
+			return 0, false
+		}
+		// RFC 2308 section 5: the lesser of the SOA TTL and its MINIMUM field
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return min(time.Duration(min(soa.Hdr.Ttl, soa.Minttl))*time.Second, c.MaxNegativeTTL), true
+			}
+		}
+		return 0, false
+	}
+
+	ttl, found := uint32(0), false
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT && (!found || h.Ttl < ttl) {
+				ttl, found = h.Ttl, true
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second, found
+}
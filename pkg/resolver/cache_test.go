@@ -0,0 +1,200 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stubResolver answers every query with the function it is
+type stubResolver func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+
+func (s stubResolver) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return s(ctx, NewQuery(name, qtype))
+}
+
+func (s stubResolver) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return s(ctx, m)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// expireAll makes every entry of c expired a second ago
+func expireAll(c *Cache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		e.expires = time.Now().Add(-time.Second)
+		c.entries[key] = e
+	}
+}
+
+func hasEDE(m *dns.Msg, code uint16) bool {
+	opt := m.IsEdns0()
+	return opt != nil && slices.ContainsFunc(opt.Option, func(o dns.EDNS0) bool {
+		ede, ok := o.(*dns.EDNS0_EDE)
+		return ok && ede.InfoCode == code
+	})
+}
+
+func TestCacheStaleTTL(t *testing.T) {
+	var fail bool
+	up := stubResolver(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		if fail {
+			return nil, errors.New("upstream down")
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		switch m.Question[0].Name {
+		case "example.com.":
+			resp.Answer = append(resp.Answer, mustRR(t, "example.com. 300 IN A 192.0.2.1"))
+			resp.Ns = append(resp.Ns, mustRR(t, "example.com. 3600 IN NS ns.example.com."))
+			resp.Extra = append(resp.Extra, mustRR(t, "ns.example.com. 3600 IN A 192.0.2.53"), mustRR(t, "ns.example.com. 5 IN AAAA 2001:db8::53"))
+		default:
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = append(resp.Ns, mustRR(t, "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 86400 600"))
+		}
+		if opt := m.IsEdns0(); opt != nil {
+			resp.SetEdns0(opt.UDPSize(), false)
+		}
+		return resp, nil
+	})
+	c := NewCache(up, 0)
+	c.MaxStale = time.Hour
+	c.StaleTTL = 7 * time.Second
+
+	for _, tt := range []struct {
+		name string
+		ede  uint16
+	}{
+		{"example.com.", dns.ExtendedErrorCodeStaleAnswer},
+		{"missing.example.com.", dns.ExtendedErrorCodeStaleNXDOMAINAnswer},
+	} {
+		fail = false
+		q := NewQuery(tt.name, dns.TypeA)
+		q.SetEdns0(UDPBufferSize, false)
+		fresh, err := c.Exchange(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expireAll(c)
+		fail = true
+		stale, err := c.Exchange(context.Background(), q)
+		if err != nil {
+			t.Fatalf("%s: %v, want the stale answer", tt.name, err)
+		}
+		if stale.Rcode != fresh.Rcode || len(stale.Answer) != len(fresh.Answer) || len(stale.Ns) != len(fresh.Ns) {
+			t.Fatalf("%s: stale answer %v differs from the cached %v", tt.name, stale, fresh)
+		}
+		for _, section := range [][]dns.RR{stale.Answer, stale.Ns, stale.Extra} {
+			for _, rr := range section {
+				want := uint32(7)
+				if rr.Header().Rrtype == dns.TypeAAAA {
+					want = 5 // shorter than the stale TTL to begin with
+				}
+				if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl != want {
+					t.Errorf("%s: stale record %v, want the TTL %d", tt.name, rr, want)
+				}
+			}
+		}
+		if !hasEDE(stale, tt.ede) {
+			t.Errorf("%s: stale answer without extended error %d", tt.name, tt.ede)
+		}
+	}
+	if got := c.Stats().Stale; got != 2 {
+		t.Errorf("counted %d stale answers, want 2", got)
+	}
+}
+
+func TestCacheStaleDisabled(t *testing.T) {
+	var fail bool
+	up := stubResolver(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		if fail {
+			return nil, errors.New("upstream down")
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR(t, "example.com. 300 IN A 192.0.2.1"))
+		return resp, nil
+	})
+	c := NewCache(up, 0)
+	if _, err := c.Query(context.Background(), "example.com", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	expireAll(c)
+	fail = true
+	if resp, err := c.Query(context.Background(), "example.com", dns.TypeA); err == nil {
+		t.Errorf("answered %v without MaxStale, want the upstream error", resp)
+	}
+}
+
+func TestCacheSubnetAndOpcode(t *testing.T) {
+	calls := 0
+	c := NewCache(stubResolver(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		calls++
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		// An answer for the client's subnet, as a CDN gives
+		addr := "192.0.2.1"
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+					addr = ecs.Address.To4().String()
+				}
+			}
+		}
+		resp.Answer = append(resp.Answer, mustRR(t, "example.com. 300 IN A "+addr))
+		return resp, nil
+	}), 0)
+	query := func(subnet string, opcode int) *dns.Msg {
+		m := NewQuery("example.com", dns.TypeA)
+		m.Opcode = opcode
+		m.SetEdns0(UDPBufferSize, false)
+		if subnet != "" {
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet).To4()})
+		}
+		return m
+	}
+
+	for i, tt := range []struct {
+		query *dns.Msg
+		want  string // the address answered
+		calls int    // upstream after it
+	}{
+		{query("", dns.OpcodeQuery), "192.0.2.1", 1},
+		{query("", dns.OpcodeQuery), "192.0.2.1", 1},
+		{query("198.51.100.0", dns.OpcodeQuery), "198.51.100.0", 2},
+		{query("203.0.113.0", dns.OpcodeQuery), "203.0.113.0", 3},
+		{query("203.0.113.0", dns.OpcodeQuery), "203.0.113.0", 4},
+		{query("", dns.OpcodeNotify), "192.0.2.1", 5},
+		{query("", dns.OpcodeQuery), "192.0.2.1", 5},
+	} {
+		resp, err := c.Exchange(context.Background(), tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != tt.want || resp.Opcode != tt.query.Opcode {
+			t.Errorf("query %d: got %v, want the answer %s", i, resp, tt.want)
+		}
+		if calls != tt.calls {
+			t.Errorf("query %d: %d queries upstream, want %d", i, calls, tt.calls)
+		}
+	}
+	if got := c.Stats().Entries; got != 1 {
+		t.Errorf("%d entries cached, want only the plain query's", got)
+	}
+}
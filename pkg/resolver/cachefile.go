@@ -0,0 +1,180 @@
+package resolver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheFileMagic starts a cache file and names the version of its format.
+// Every entry after it is the question name, type, class and DO and CD
+// flags, the times the response was stored and expires in Unix
+// nanoseconds, and the response in wire format, each field length-prefixed
+// or fixed size in network byte order.
+const cacheFileMagic = "tmp-dns cache 1\n"
+
+// Save writes the live entries, and with MaxStale those that may still
+// answer stale, to path, those that stay valid longest first, leaving out
+// the rest once the file would grow past maxBytes when that is positive.
+// The file is written aside and renamed into place. It returns the number
+// of entries written.
+func (c *Cache) Save(path string, maxBytes int64) (int, error) {
+	now := time.Now()
+	type saved struct {
+		key cacheKey
+		cacheEntry
+	}
+	c.mu.Lock()
+	entries := make([]saved, 0, len(c.entries))
+	for k, e := range c.entries {
+		if now.Before(c.staleUntil(e)) {
+			entries = append(entries, saved{k, e})
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].expires.After(entries[j].expires) })
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, fmt.Errorf("failed to write cache file: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to write cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	w.WriteString(cacheFileMagic)
+	size := int64(len(cacheFileMagic))
+	written := 0
+	for _, e := range entries {
+		record, err := encodeCacheEntry(e.key, e.cacheEntry)
+		if err != nil {
+			continue
+		}
+		if maxBytes > 0 && size+int64(len(record)) > maxBytes {
+			break
+		}
+		w.Write(record)
+		size += int64(len(record))
+		written++
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to replace cache file: %w", err)
+	}
+	return written, nil
+}
+
+// Load adds the entries of a file written by Save that have not expired
+// since, or only by less than MaxStale, up to MaxEntries, and returns how
+// many it added. A missing file is not an error, it is what the first
+// start finds.
+func (c *Cache) Load(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cache file: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(cacheFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != cacheFileMagic {
+		return 0, fmt.Errorf("%s is not a cache file of this version", path)
+	}
+
+	now := time.Now()
+	loaded := 0
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.entries) < c.MaxEntries {
+		key, e, err := decodeCacheEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("invalid cache file %s: %w", path, err)
+		}
+		if !now.Before(c.staleUntil(e)) {
+			continue
+		}
+		if _, ok := c.entries[key]; !ok {
+			c.entries[key] = e
+			loaded++
+		}
+	}
+	return loaded, nil
+}
+
+func encodeCacheEntry(key cacheKey, e cacheEntry) ([]byte, error) {
+	msg, err := e.msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, 2+len(key.name)+5+16+4+len(msg))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(key.name)))
+	b = append(b, key.name...)
+	b = binary.BigEndian.AppendUint16(b, key.qtype)
+	b = binary.BigEndian.AppendUint16(b, key.qclass)
+	var flags byte
+	if key.do {
+		flags |= 1
+	}
+	if key.cd {
+		flags |= 2
+	}
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint64(b, uint64(e.stored.UnixNano()))
+	b = binary.BigEndian.AppendUint64(b, uint64(e.expires.UnixNano()))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+	return append(b, msg...), nil
+}
+
+// decodeCacheEntry reads one entry, returning io.EOF only at a clean end
+func decodeCacheEntry(r io.Reader) (cacheKey, cacheEntry, error) {
+	var key cacheKey
+	var e cacheEntry
+	var nameLen uint16
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return key, e, err
+	}
+	name := make([]byte, nameLen)
+	var fixed struct {
+		Qtype, Qclass   uint16
+		Flags           byte
+		Stored, Expires int64
+		MsgLen          uint32
+	}
+	if _, err := io.ReadFull(r, name); err != nil {
+		return key, e, io.ErrUnexpectedEOF
+	}
+	if err := binary.Read(r, binary.BigEndian, &fixed); err != nil {
+		return key, e, io.ErrUnexpectedEOF
+	}
+	wire := make([]byte, fixed.MsgLen)
+	if _, err := io.ReadFull(r, wire); err != nil {
+		return key, e, io.ErrUnexpectedEOF
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(wire); err != nil {
+		return key, e, err
+	}
+	key = cacheKey{name: string(name), qtype: fixed.Qtype, qclass: fixed.Qclass, do: fixed.Flags&1 != 0, cd: fixed.Flags&2 != 0}
+	e = cacheEntry{msg: msg, stored: time.Unix(0, fixed.Stored), expires: time.Unix(0, fixed.Expires)}
+	return key, e, nil
+}
@@ -0,0 +1,155 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime/debug"
+
+	"github.com/miekg/dns"
+)
+
+// Request is a query a server received, as it passes along a Chain
+type Request struct {
+	Msg *dns.Msg
+	// Client is the address the query came from, Local the one it
+	// arrived at
+	Client, Local net.Addr
+	// Trace records where the response came from. Handlers that answer
+	// themselves set its Transport, such as "local", and Forward fills
+	// it in from the upstream exchange.
+	Trace Trace
+}
+
+// ClientIP returns the IP address of the client, or nil
+func (r *Request) ClientIP() net.IP {
+	switch addr := r.Client.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(r.Client.String())
+	return net.ParseIP(host)
+}
+
+// UDP reports whether the query came over UDP, where the response has to
+// fit the size the client advertised
+func (r *Request) UDP() bool {
+	_, ok := r.Client.(*net.UDPAddr)
+	return ok
+}
+
+// Next hands a request on to the rest of a Chain
+type Next func(ctx context.Context, req *Request) (*dns.Msg, error)
+
+// Handler is a link of a Chain, in the manner of a CoreDNS plugin. It
+// answers the request itself or returns what next answers, and may change
+// the request on the way in and the response on the way out. A nil
+// response without an error means the query is dropped.
+type Handler interface {
+	ServeDNS(ctx context.Context, req *Request, next Next) (*dns.Msg, error)
+}
+
+// HandlerFunc lets an ordinary function be a Handler
+type HandlerFunc func(ctx context.Context, req *Request, next Next) (*dns.Msg, error)
+
+// ServeDNS implements Handler
+func (f HandlerFunc) ServeDNS(ctx context.Context, req *Request, next Next) (*dns.Msg, error) {
+	return f(ctx, req, next)
+}
+
+// Chain passes each query through its handlers in order. It is a
+// dns.Handler, so that a dns.Server can serve it.
+type Chain struct {
+	handlers []Handler
+}
+
+// NewChain returns a Chain of handlers, the first one seeing each query
+// first
+func NewChain(handlers ...Handler) *Chain {
+	return &Chain{handlers: handlers}
+}
+
+// Use adds handlers to the end of the chain. It must not be called while
+// the chain serves queries.
+func (c *Chain) Use(handlers ...Handler) {
+	c.handlers = append(c.handlers, handlers...)
+}
+
+// Serve passes req through the chain and returns the response. A query
+// that no handler answers fails, and so does one whose handling panics,
+// say on a malformed upstream response, rather than the whole server.
+func (c *Chain) Serve(ctx context.Context, req *Request) (resp *dns.Msg, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.ErrorContext(ctx, "handling a query panicked", "panic", p, "stack", string(debug.Stack()))
+			resp, err = nil, fmt.Errorf("handling the query panicked: %v", p)
+		}
+	}()
+	return c.next(0)(ctx, req)
+}
+
+func (c *Chain) next(i int) Next {
+	if i == len(c.handlers) {
+		return func(ctx context.Context, req *Request) (*dns.Msg, error) {
+			return nil, fmt.Errorf("no handler answered the query")
+		}
+	}
+	return func(ctx context.Context, req *Request) (*dns.Msg, error) {
+		return c.handlers[i].ServeDNS(ctx, req, c.next(i+1))
+	}
+}
+
+// ServeDNS implements dns.Handler. It answers SERVFAIL when the chain
+// fails, nothing when the query is dropped, and cuts responses over UDP
+// down to the size the client advertised. Responses carry the ID and the
+// question of the query, in the letter case the client sent it.
+func (c *Chain) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
+	req := &Request{Msg: m, Client: w.RemoteAddr(), Local: w.LocalAddr()}
+	resp, err := c.Serve(context.Background(), req)
+	if err != nil {
+		resp = new(dns.Msg)
+		resp.SetRcode(m, dns.RcodeServerFailure)
+	}
+	if resp == nil {
+		return
+	}
+	resp.Id = m.Id
+	resp.Question = append([]dns.Question(nil), m.Question...)
+	if req.UDP() {
+		size := dns.MinMsgSize
+		if opt := m.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	w.WriteMsg(resp)
+}
+
+// Forward returns the Handler that ends a forwarding chain: it sends every
+// query it gets to r, which may be a Cache or any other Resolver, naming
+// the client for Sticky
+func Forward(r Resolver) Handler {
+	return HandlerFunc(func(ctx context.Context, req *Request, next Next) (*dns.Msg, error) {
+		if ip := req.ClientIP(); ip != nil {
+			ctx = WithClient(ctx, ip.String())
+		}
+		resp, err := r.Exchange(WithTrace(ctx, &req.Trace), req.Msg)
+		if err != nil {
+			return nil, err
+		}
+		// A cached or shared response answered the first client to ask,
+		// whose question may differ in case, by 0x20 randomization
+		resp.Id = req.Msg.Id
+		resp.Question = append([]dns.Question(nil), req.Msg.Question...)
+		// A signature made for the upstream query means nothing to the client
+		if resp.IsTsig() != nil {
+			resp.Extra = resp.Extra[:len(resp.Extra)-1]
+		}
+		return resp, nil
+	})
+}
@@ -0,0 +1,74 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// recorder is a dns.ResponseWriter keeping the message written to it
+type recorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (r *recorder) LocalAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (r *recorder) RemoteAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353} }
+
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+	r.msg = m
+	return nil
+}
+
+func TestChainEchoesQuestion(t *testing.T) {
+	calls := 0
+	cache := NewCache(stubResolver(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		calls++
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR(t, m.Question[0].Name+" 300 IN A 192.0.2.1"))
+		return resp, nil
+	}), 0)
+	chain := NewChain(Forward(cache))
+
+	for i, name := range []string{"eXaMpLe.CoM.", "ExAmPlE.cOm.", "example.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Id = uint16(i + 100)
+		resp, err := chain.Serve(context.Background(), &Request{Msg: m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Id != m.Id || len(resp.Question) != 1 || resp.Question[0].Name != name {
+			t.Errorf("%s: answered %v, want the ID %d and the question as asked", name, resp, m.Id)
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("%s: got %v, want the cached answer", name, resp)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("%d queries upstream, want the later ones answered from the cache", calls)
+	}
+
+	// A handler answering for another case of the name
+	answered := new(dns.Msg)
+	answered.SetQuestion("example.com.", dns.TypeA)
+	chain = NewChain(HandlerFunc(func(ctx context.Context, req *Request, next Next) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(answered)
+		return resp, nil
+	}))
+	m := new(dns.Msg)
+	m.SetQuestion("EXAMPLE.com.", dns.TypeA)
+	w := &recorder{}
+	chain.ServeDNS(w, m)
+	if w.msg == nil || w.msg.Id != m.Id || w.msg.Question[0].Name != "EXAMPLE.com." {
+		t.Errorf("wrote %v, want the ID %d and the question as asked", w.msg, m.Id)
+	}
+	w.msg.Question[0].Name = "changed."
+	if m.Question[0].Name != "EXAMPLE.com." {
+		t.Errorf("the response shares its question with the query")
+	}
+}
@@ -0,0 +1,167 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CheckResponse reports why resp is not a plausible reply to m: the ID or
+// opcode differ, the QR bit is clear, the question is not echoed, or the
+// answer section holds records that are neither for the question name nor
+// for a name its CNAME and DNAME chain leads to. Off-path attackers and
+// broken middleboxes produce such responses, and answers out of bailiwick
+// are the classic way to poison a cache.
+func CheckResponse(m, resp *dns.Msg) error {
+	if resp.Id != m.Id {
+		return fmt.Errorf("response ID %d does not match query ID %d", resp.Id, m.Id)
+	}
+	if len(m.Question) != 1 {
+		return checkReply(nil, m.Opcode, resp)
+	}
+	return checkReply(&m.Question[0], m.Opcode, resp)
+}
+
+// checkReply is CheckResponse without the ID, for callers that never saw
+// the query message. A nil q skips the question and answer checks.
+func checkReply(q *dns.Question, opcode int, resp *dns.Msg) error {
+	if !resp.Response {
+		return fmt.Errorf("the response does not have the QR bit set")
+	}
+	if resp.Opcode != opcode {
+		return fmt.Errorf("response opcode %s does not match query opcode %s", dns.OpcodeToString[resp.Opcode], dns.OpcodeToString[opcode])
+	}
+	if q == nil {
+		return nil
+	}
+	// Servers may leave the question out of errors such as FORMERR
+	if len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil
+	}
+	if len(resp.Question) != 1 {
+		return fmt.Errorf("the response has %d questions, want the one asked", len(resp.Question))
+	}
+	got := resp.Question[0]
+	if dns.CanonicalName(got.Name) != dns.CanonicalName(q.Name) || got.Qtype != q.Qtype || got.Qclass != q.Qclass {
+		return fmt.Errorf("the response is for %s %s %s, not %s %s %s", got.Name, dns.Class(got.Qclass), dns.Type(got.Qtype), q.Name, dns.Class(q.Qclass), dns.Type(q.Qtype))
+	}
+	if opcode != dns.OpcodeQuery {
+		return nil
+	}
+	if stray := outOfBailiwick(q.Name, resp.Answer); len(stray) > 0 {
+		return fmt.Errorf("the answer has records for %s, which %s does not lead to", strings.Join(stray, ", "), q.Name)
+	}
+	return nil
+}
+
+// outOfBailiwick returns the owner names of the records in answer that are
+// off the alias chain starting at name. DNAME records count when their
+// owner is an ancestor of a name on the chain.
+func outOfBailiwick(name string, answer []dns.RR) []string {
+	chain := map[string]bool{dns.CanonicalName(name): true}
+	// Each pass follows one more alias. A DNAME may rewrite into its own
+	// subtree, so the chain is cut at one name more than there are records.
+	for grown := true; grown && len(chain) <= len(answer); {
+		grown = false
+		for _, rr := range answer {
+			var next string
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				if chain[dns.CanonicalName(rr.Hdr.Name)] {
+					next = dns.CanonicalName(rr.Target)
+				}
+			case *dns.DNAME:
+				owner := dns.CanonicalName(rr.Hdr.Name)
+				for n := range chain {
+					if n != owner && dns.IsSubDomain(owner, n) && !chain[dnameTarget(n, owner, rr.Target)] {
+						next = dnameTarget(n, owner, rr.Target)
+						break
+					}
+				}
+			}
+			if next != "" && !chain[next] {
+				chain[next] = true
+				grown = true
+			}
+		}
+	}
+
+	var stray []string
+	seen := map[string]bool{}
+	for _, rr := range answer {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if chain[owner] || seen[owner] || isDNAMEOwner(owner, answer, chain) {
+			continue
+		}
+		seen[owner] = true
+		stray = append(stray, owner)
+	}
+	return stray
+}
+
+// dnameTarget substitutes the DNAME owner suffix of name with target
+func dnameTarget(name, owner, target string) string {
+	return dns.CanonicalName(strings.TrimSuffix(name, owner) + dns.Fqdn(target))
+}
+
+// isDNAMEOwner reports whether owner carries a DNAME of answer that
+// rewrites a name on the chain, which makes the DNAME and its signatures
+// belong to the answer
+func isDNAMEOwner(owner string, answer []dns.RR, chain map[string]bool) bool {
+	for _, rr := range answer {
+		if d, ok := rr.(*dns.DNAME); ok && dns.CanonicalName(d.Hdr.Name) == owner {
+			for n := range chain {
+				if n != owner && dns.IsSubDomain(owner, n) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Checked runs CheckResponse on every response of Upstream, failing the
+// query when a response does not pass or, with Warn, only logging it
+type Checked struct {
+	Upstream Resolver
+	Warn     bool
+}
+
+// NewChecked returns a Checked in front of upstream
+func NewChecked(upstream Resolver, warn bool) *Checked {
+	return &Checked{Upstream: upstream, Warn: warn}
+}
+
+// Query implements Resolver, leaving the query to Upstream so transport
+// defaults such as EDNS0 on UDP still apply
+func (c *Checked) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	resp, err := c.Upstream.Query(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	q := dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+	return c.verdict(ctx, resp, checkReply(&q, dns.OpcodeQuery, resp))
+}
+
+// Exchange implements Resolver
+func (c *Checked) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	resp, err := c.Upstream.Exchange(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	return c.verdict(ctx, resp, CheckResponse(m, resp))
+}
+
+func (c *Checked) verdict(ctx context.Context, resp *dns.Msg, err error) (*dns.Msg, error) {
+	if err == nil {
+		return resp, nil
+	}
+	if c.Warn {
+		slog.WarnContext(ctx, "accepted a suspicious response", "err", err)
+		return resp, nil
+	}
+	return nil, withKind(fmt.Errorf("rejected the response: %w", err), ErrMismatch)
+}
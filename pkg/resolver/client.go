@@ -0,0 +1,423 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultClientServer is the server of a Client given no transport,
+	// over UDP with TCP for truncated answers
+	DefaultClientServer = "8.8.8.8:53"
+	// DefaultClientTimeout bounds each query of a Client, retries included
+	DefaultClientTimeout = 5 * time.Second
+)
+
+// ClientOption configures a Client
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	timeout    time.Duration
+	transports []Resolver
+	dnssec     bool
+	anchors    []*dns.DS
+	cacheSize  int
+	retry      RetryPolicy
+}
+
+// WithTimeout bounds each query, retries included, 0 leaves it to the
+// context
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.timeout = d
+	}
+}
+
+// WithTransport sends the queries to upstreams, any of the resolvers of
+// this package, in the order the retry policy goes through them
+func WithTransport(upstreams ...Resolver) ClientOption {
+	return func(c *clientConfig) {
+		c.transports = upstreams
+	}
+}
+
+// WithDNSSEC validates every answer from anchors, the root trust anchors
+// when none are given. Answers that turn out Bogus fail with ErrBogus and
+// Secure ones come back with the AD bit set.
+func WithDNSSEC(anchors ...*dns.DS) ClientOption {
+	return func(c *clientConfig) {
+		c.dnssec = true
+		c.anchors = anchors
+	}
+}
+
+// WithCache keeps up to entries responses, DefaultCacheSize when 0, in a
+// Cache in front of the transports
+func WithCache(entries int) ClientOption {
+	return func(c *clientConfig) {
+		c.cacheSize = entries
+		if entries <= 0 {
+			c.cacheSize = DefaultCacheSize
+		}
+	}
+}
+
+// WithRetry replaces DefaultRetryPolicy, Attempts 1 turns retries off
+func WithRetry(policy RetryPolicy) ClientOption {
+	return func(c *clientConfig) {
+		c.retry = policy
+	}
+}
+
+// Client is a stub resolver for Go programs. It has the lookups of
+// net.Resolver, returning *net.DNSError the same way, over any transport,
+// and implements Resolver for raw queries. Without options it asks
+// DefaultClientServer over UDP, retries with DefaultRetryPolicy and gives
+// up after DefaultClientTimeout. It is safe for concurrent use.
+type Client struct {
+	resolver Resolver
+	timeout  time.Duration
+	dnssec   bool
+	anchors  []*dns.DS
+}
+
+// NewClient returns a Client configured by opts
+func NewClient(opts ...ClientOption) *Client {
+	cfg := clientConfig{timeout: DefaultClientTimeout, retry: DefaultRetryPolicy}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if len(cfg.transports) == 0 {
+		cfg.transports = []Resolver{NewUDP(DefaultClientServer)}
+	}
+	var r Resolver = NewRetry(cfg.transports, cfg.retry)
+	if len(cfg.transports) == 1 && cfg.retry.Attempts <= 1 {
+		r = cfg.transports[0]
+	}
+	if cfg.cacheSize > 0 {
+		r = NewCache(r, cfg.cacheSize)
+	}
+	return &Client{resolver: r, timeout: cfg.timeout, dnssec: cfg.dnssec, anchors: cfg.anchors}
+}
+
+// Query implements Resolver
+func (c *Client) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	if c.dnssec {
+		return c.Exchange(ctx, NewQuery(name, qtype))
+	}
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	return c.resolver.Query(ctx, name, qtype)
+}
+
+// Exchange implements Resolver. With WithDNSSEC the query goes out with
+// the DO and CD bits set and the response is validated.
+func (c *Client) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	if !c.dnssec {
+		return c.resolver.Exchange(ctx, m)
+	}
+	query := m.Copy()
+	query.CheckingDisabled = true
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		query.SetEdns0(UDPBufferSize, true)
+	}
+	resp, err := c.resolver.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return resp, nil
+	}
+	sec, err := NewValidator(c.resolver, c.anchors).Validate(ctx, resp)
+	switch sec {
+	case Secure, Insecure:
+	case Bogus:
+		return nil, withKind(fmt.Errorf("DNSSEC validation of %s failed: %w", questionString(m), err), ErrBogus)
+	default:
+		return nil, fmt.Errorf("could not validate %s: %w", questionString(m), err)
+	}
+	resp.AuthenticatedData = sec == Secure
+	return resp, nil
+}
+
+func (c *Client) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+func questionString(m *dns.Msg) string {
+	if len(m.Question) != 1 {
+		return "the query"
+	}
+	q := m.Question[0]
+	return q.Name + " " + dns.Type(q.Qtype).String()
+}
+
+// lookup returns the records of qtype answering name, following the CNAME
+// chain, or the *net.DNSError net.Resolver would return
+func (c *Client) lookup(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	resp, err := c.Query(ctx, name, qtype)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", name, err)
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: "server answered " + rcodeString(resp.Rcode), Name: name, IsTemporary: resp.Rcode == dns.RcodeServerFailure}
+	}
+	var out []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype {
+			out = append(out, rr)
+		}
+	}
+	if len(out) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return out, nil
+}
+
+// LookupA returns the IPv4 addresses of host
+func (c *Client) LookupA(ctx context.Context, host string) ([]net.IP, error) {
+	return c.lookupIPs(ctx, host, dns.TypeA)
+}
+
+// LookupAAAA returns the IPv6 addresses of host
+func (c *Client) LookupAAAA(ctx context.Context, host string) ([]net.IP, error) {
+	return c.lookupIPs(ctx, host, dns.TypeAAAA)
+}
+
+func (c *Client) lookupIPs(ctx context.Context, host string, qtype uint16) ([]net.IP, error) {
+	rrs, err := c.lookup(ctx, host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(rrs))
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	return ips, nil
+}
+
+// LookupIP returns the addresses of host for network "ip", "ip4" or "ip6",
+// asking for A and AAAA records at once for "ip". An IP address is
+// returned as it is.
+func (c *Client) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	var qtypes []uint16
+	switch network {
+	case "ip":
+		qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	case "ip4":
+		qtypes = []uint16{dns.TypeA}
+	case "ip6":
+		qtypes = []uint16{dns.TypeAAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	results := make([][]net.IP, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = c.lookupIPs(ctx, host, qtype)
+		}()
+	}
+	wg.Wait()
+	var ips []net.IP
+	for _, r := range results {
+		ips = append(ips, r...)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	// The error that says more than not found wins
+	for _, err := range errs {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+	return nil, errs[0]
+}
+
+// LookupHost returns the addresses of host as strings
+func (c *Client) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ips, err := c.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	return addrs, nil
+}
+
+// LookupAddr returns the names the PTR records of addr give
+func (c *Client) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	arpa, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	rrs, err := c.lookup(ctx, arpa, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(rrs))
+	for i, rr := range rrs {
+		names[i] = rr.(*dns.PTR).Ptr
+	}
+	return names, nil
+}
+
+// LookupCNAME returns the canonical name of host, the end of its CNAME
+// chain, or host itself as a fully qualified name when it has none
+func (c *Client) LookupCNAME(ctx context.Context, host string) (string, error) {
+	resp, err := c.Query(ctx, host, dns.TypeA)
+	if err != nil {
+		return "", fmt.Errorf("lookup %s: %w", host, err)
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	name := dns.Fqdn(host)
+	for seen := 0; seen < len(resp.Answer); seen++ {
+		next := ""
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return name, nil
+}
+
+// LookupMX returns the MX records of name sorted by preference
+func (c *Client) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	rrs, err := c.lookup(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	mxs := make([]*net.MX, len(rrs))
+	for i, rr := range rrs {
+		mx := rr.(*dns.MX)
+		mxs[i] = &net.MX{Host: mx.Mx, Pref: mx.Preference}
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, nil
+}
+
+// LookupNS returns the NS records of name
+func (c *Client) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	rrs, err := c.lookup(ctx, name, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	nss := make([]*net.NS, len(rrs))
+	for i, rr := range rrs {
+		nss[i] = &net.NS{Host: rr.(*dns.NS).Ns}
+	}
+	return nss, nil
+}
+
+// LookupTXT returns the TXT records of name, the character strings of each
+// one joined
+func (c *Client) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	rrs, err := c.lookup(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	txts := make([]string, len(rrs))
+	for i, rr := range rrs {
+		var b strings.Builder
+		for _, s := range rr.(*dns.TXT).Txt {
+			b.WriteString(unescapeString(s))
+		}
+		txts[i] = b.String()
+	}
+	return txts, nil
+}
+
+// LookupSRV returns the SRV records of _service._proto.name, or of name
+// when service and proto are empty, sorted by priority and weight, and
+// the name it looked up
+func (c *Client) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	target = dns.Fqdn(target)
+	rrs, err := c.lookup(ctx, target, dns.TypeSRV)
+	if err != nil {
+		return "", nil, err
+	}
+	srvs := make([]*net.SRV, len(rrs))
+	for i, rr := range rrs {
+		srv := rr.(*dns.SRV)
+		srvs[i] = &net.SRV{Target: srv.Target, Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight}
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	return target, srvs, nil
+}
+
+// unescapeString undoes the \X and \DDD escapes the dns package keeps in
+// character strings
+func unescapeString(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			b.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		i++
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
@@ -0,0 +1,212 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordServer returns the address of a UDP server answering from records,
+// following CNAMEs, with NXDOMAIN for the names it has nothing for and
+// SERVFAIL for those under broken.example.
+func recordServer(t *testing.T, records ...string) string {
+	t.Helper()
+	byName := map[string][]dns.RR{}
+	for _, s := range records {
+		rr := mustRR(t, s)
+		name := strings.ToLower(rr.Header().Name)
+		byName[name] = append(byName[name], rr)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		q := m.Question[0]
+		name := strings.ToLower(q.Name)
+		if dns.IsSubDomain("broken.example.", name) {
+			resp.Rcode = dns.RcodeServerFailure
+			w.WriteMsg(resp)
+			return
+		}
+		if _, ok := byName[name]; !ok {
+			resp.Rcode = dns.RcodeNameError
+		}
+		for i := 0; i < 8; i++ {
+			var next string
+			for _, rr := range byName[name] {
+				switch {
+				case rr.Header().Rrtype == q.Qtype:
+					resp.Answer = append(resp.Answer, rr)
+				case rr.Header().Rrtype == dns.TypeCNAME:
+					resp.Answer = append(resp.Answer, rr)
+					next = strings.ToLower(rr.(*dns.CNAME).Target)
+				}
+			}
+			if next == "" {
+				break
+			}
+			name = next
+		}
+		w.WriteMsg(resp)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestNewClientOptions(t *testing.T) {
+	c := NewClient()
+	retry, ok := c.resolver.(*Retry)
+	if !ok || len(retry.Upstreams) != 1 || retry.Policy != DefaultRetryPolicy {
+		t.Fatalf("default resolver %#v, want a Retry with DefaultRetryPolicy", c.resolver)
+	}
+	if udp, ok := retry.Upstreams[0].(*UDP); !ok || udp.Addr != DefaultClientServer {
+		t.Errorf("default transport %#v, want UDP to %s", retry.Upstreams[0], DefaultClientServer)
+	}
+	if c.timeout != DefaultClientTimeout || c.dnssec {
+		t.Errorf("default timeout %v and DNSSEC %v, want %v without DNSSEC", c.timeout, c.dnssec, DefaultClientTimeout)
+	}
+
+	upstream := NewTCP("192.0.2.53:53")
+	c = NewClient(WithTransport(upstream), WithRetry(RetryPolicy{Attempts: 1}), WithTimeout(0))
+	if c.resolver != Resolver(upstream) || c.timeout != 0 {
+		t.Errorf("got %#v with timeout %v, want the single transport without retries or a timeout", c.resolver, c.timeout)
+	}
+
+	c = NewClient(WithTransport(upstream, NewUDP("192.0.2.54:53")), WithCache(0), WithTimeout(time.Second))
+	cache, ok := c.resolver.(*Cache)
+	if !ok || cache.MaxEntries != DefaultCacheSize || c.timeout != time.Second {
+		t.Fatalf("got %#v, want a Cache of DefaultCacheSize", c.resolver)
+	}
+	if retry, ok := cache.Upstream.(*Retry); !ok || len(retry.Upstreams) != 2 || retry.Policy != DefaultRetryPolicy {
+		t.Errorf("cache upstream %#v, want a Retry over both transports", cache.Upstream)
+	}
+	if c := NewClient(WithCache(10)); c.resolver.(*Cache).MaxEntries != 10 {
+		t.Errorf("WithCache(10) keeps %d entries", c.resolver.(*Cache).MaxEntries)
+	}
+
+	anchor := &dns.DS{KeyTag: 20326, Algorithm: dns.RSASHA256, DigestType: dns.SHA256}
+	if c := NewClient(WithDNSSEC(anchor)); !c.dnssec || len(c.anchors) != 1 || c.anchors[0] != anchor {
+		t.Errorf("WithDNSSEC gave %v with anchors %v", c.dnssec, c.anchors)
+	}
+}
+
+func TestClientLookups(t *testing.T) {
+	addr := recordServer(t,
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 300 IN A 192.0.2.2",
+		"example.com. 300 IN AAAA 2001:db8::1",
+		`example.com. 300 IN TXT "v=spf1 " "-all"`,
+		`example.com. 300 IN TXT "semi\;colon"`,
+		"example.com. 300 IN MX 20 mx2.example.com.",
+		"example.com. 300 IN MX 10 mx1.example.com.",
+		"example.com. 300 IN NS ns1.example.com.",
+		"www.example.com. 300 IN CNAME web.example.net.",
+		"web.example.net. 300 IN CNAME example.com.",
+		"_sip._udp.example.com. 300 IN SRV 20 10 5060 sip2.example.com.",
+		"_sip._udp.example.com. 300 IN SRV 10 5 5060 sip1.example.com.",
+		"_sip._udp.example.com. 300 IN SRV 10 50 5060 sip0.example.com.",
+		"1.2.0.192.in-addr.arpa. 300 IN PTR example.com.",
+		"v4only.example.com. 300 IN A 192.0.2.3",
+	)
+	c := NewClient(WithTransport(NewUDP(addr)), WithTimeout(2*time.Second))
+	ctx := context.Background()
+
+	ips, err := c.LookupA(ctx, "example.com")
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("LookupA: %v, %v", ips, err)
+	}
+	hosts, err := c.LookupHost(ctx, "www.example.com")
+	slices.Sort(hosts)
+	if err != nil || !slices.Equal(hosts, []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}) {
+		t.Errorf("LookupHost through the CNAME chain: %v, %v", hosts, err)
+	}
+	if ips, err := c.LookupIP(ctx, "ip", "v4only.example.com"); err != nil || len(ips) != 1 {
+		t.Errorf("LookupIP with A records only: %v, %v", ips, err)
+	}
+	if ips, err := c.LookupIP(ctx, "ip6", "192.0.2.9"); err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 9)) {
+		t.Errorf("LookupIP of an address: %v, %v", ips, err)
+	}
+	if cname, err := c.LookupCNAME(ctx, "www.example.com"); err != nil || cname != "example.com." {
+		t.Errorf("LookupCNAME: %q, %v", cname, err)
+	}
+	if cname, err := c.LookupCNAME(ctx, "example.com"); err != nil || cname != "example.com." {
+		t.Errorf("LookupCNAME without one: %q, %v", cname, err)
+	}
+	txts, err := c.LookupTXT(ctx, "example.com")
+	slices.Sort(txts)
+	if err != nil || !slices.Equal(txts, []string{"semi;colon", "v=spf1 -all"}) {
+		t.Errorf("LookupTXT: %q, %v", txts, err)
+	}
+	mxs, err := c.LookupMX(ctx, "example.com")
+	if err != nil || len(mxs) != 2 || mxs[0].Host != "mx1.example.com." || mxs[1].Pref != 20 {
+		t.Errorf("LookupMX: %v, %v", mxs, err)
+	}
+	if nss, err := c.LookupNS(ctx, "example.com"); err != nil || len(nss) != 1 || nss[0].Host != "ns1.example.com." {
+		t.Errorf("LookupNS: %v, %v", nss, err)
+	}
+	target, srvs, err := c.LookupSRV(ctx, "sip", "udp", "example.com")
+	if err != nil || target != "_sip._udp.example.com." || len(srvs) != 3 {
+		t.Fatalf("LookupSRV: %s %v, %v", target, srvs, err)
+	}
+	if srvs[0].Target != "sip0.example.com." || srvs[1].Target != "sip1.example.com." || srvs[2].Priority != 20 {
+		t.Errorf("LookupSRV order %s, %s, %s, want by priority then weight", srvs[0].Target, srvs[1].Target, srvs[2].Target)
+	}
+	if names, err := c.LookupAddr(ctx, "192.0.2.1"); err != nil || !slices.Equal(names, []string{"example.com."}) {
+		t.Errorf("LookupAddr: %v, %v", names, err)
+	}
+
+	resp, err := c.Exchange(ctx, NewQuery("example.com", dns.TypeMX))
+	if err != nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+		t.Errorf("Exchange: %v, %v", resp, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	c := NewClient(WithTransport(NewUDP(recordServer(t, "example.com. 300 IN A 192.0.2.1"))), WithTimeout(2*time.Second))
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name                string
+		lookup              func() error
+		notFound, temporary bool
+	}{
+		{"NXDOMAIN", func() error { _, err := c.LookupA(ctx, "missing.example.com"); return err }, true, false},
+		{"NODATA", func() error { _, err := c.LookupMX(ctx, "example.com"); return err }, true, false},
+		{"neither address type", func() error { _, err := c.LookupIP(ctx, "ip", "missing.example.com"); return err }, true, false},
+		{"SERVFAIL", func() error { _, err := c.LookupA(ctx, "host.broken.example"); return err }, false, true},
+		{"SERVFAIL for one address type", func() error { _, err := c.LookupHost(ctx, "host.broken.example"); return err }, false, true},
+	} {
+		var dnsErr *net.DNSError
+		if err := tt.lookup(); !errors.As(err, &dnsErr) || dnsErr.IsNotFound != tt.notFound || dnsErr.IsTemporary != tt.temporary {
+			t.Errorf("%s: got %#v, want a DNSError with IsNotFound %v and IsTemporary %v", tt.name, err, tt.notFound, tt.temporary)
+		}
+	}
+	if _, err := c.LookupIP(ctx, "tcp", "example.com"); !errors.As(err, new(net.UnknownNetworkError)) {
+		t.Errorf("LookupIP of network tcp: %v, want an UnknownNetworkError", err)
+	}
+	if _, err := c.LookupAddr(ctx, "not an address"); err == nil {
+		t.Errorf("LookupAddr of a bad address succeeded")
+	}
+
+	c = NewClient(WithTransport(NewUDP(blackhole(t))), WithRetry(RetryPolicy{Attempts: 1}), WithTimeout(200*time.Millisecond))
+	start := time.Now()
+	_, err := c.LookupA(ctx, "example.com")
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v, past the 200ms timeout", elapsed)
+	}
+}
@@ -0,0 +1,209 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DDRName is the special-use name that unencrypted resolvers answer SVCB
+// queries for with the encrypted resolvers they designate (RFC 9462)
+const DDRName = "_dns.resolver.arpa."
+
+// ddrProtocols maps the ALPN protocol IDs of designations onto protocols
+var ddrProtocols = map[string]string{
+	"dot": "dot",
+	"doq": "doq",
+	"h2":  "doh",
+	"h3":  "doh",
+}
+
+// Designation is an encrypted resolver that an unencrypted one designates
+// as its equivalent
+type Designation struct {
+	Protocol string   // dot, doq or doh
+	Priority uint16   // lower first
+	Target   string   // the server name, without the trailing dot
+	Port     int      // 853 for dot and doq and 443 for doh unless given
+	Path     string   // the dohpath template of doh, such as /dns-query{?dns}
+	ALPN     []string // the protocol IDs offered, h2 and h3 for doh
+	Addrs    []net.IP // from the address hints, or looked up
+}
+
+// URL returns the DoH endpoint of a doh designation
+func (d *Designation) URL() string {
+	path, _, _ := strings.Cut(d.Path, "{")
+	return "https://" + net.JoinHostPort(d.Target, strconv.Itoa(d.Port)) + path
+}
+
+// Discover asks r, an unencrypted resolver, for the resolvers it designates
+// (RFC 9462 section 4), sorted by priority. The names of those without
+// address hints are looked up through r. Discover does not verify them.
+func Discover(ctx context.Context, r Resolver) ([]Designation, error) {
+	resp, err := r.Query(ctx, DDRName, dns.TypeSVCB)
+	if err != nil {
+		return nil, fmt.Errorf("DDR query failed: %w", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, withKind(fmt.Errorf("DDR query answered %s", rcodeString(resp.Rcode)), &RcodeError{Rcode: resp.Rcode})
+	}
+	var designations []Designation
+	for _, rr := range resp.Answer {
+		svcb, ok := rr.(*dns.SVCB)
+		if !ok || svcb.Priority == 0 || svcb.Target == "." {
+			continue
+		}
+		designations = append(designations, designationsOf(svcb)...)
+	}
+	sort.SliceStable(designations, func(i, j int) bool {
+		return designations[i].Priority < designations[j].Priority
+	})
+	for i := range designations {
+		d := &designations[i]
+		if len(d.Addrs) > 0 {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			resp, err := r.Query(ctx, d.Target, qtype)
+			if err != nil {
+				continue
+			}
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					d.Addrs = append(d.Addrs, rr.A)
+				case *dns.AAAA:
+					d.Addrs = append(d.Addrs, rr.AAAA)
+				}
+			}
+		}
+	}
+	return designations, nil
+}
+
+// designationsOf returns a designation for each protocol an SVCB record
+// offers, none when it makes a key mandatory that is not understood
+func designationsOf(svcb *dns.SVCB) []Designation {
+	base := Designation{Priority: svcb.Priority, Target: strings.TrimSuffix(svcb.Target, ".")}
+	var alpn []string
+	for _, kv := range svcb.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBMandatory:
+			for _, key := range kv.Code {
+				switch key {
+				case dns.SVCB_ALPN, dns.SVCB_PORT, dns.SVCB_IPV4HINT, dns.SVCB_IPV6HINT, dns.SVCB_DOHPATH:
+				default:
+					return nil
+				}
+			}
+		case *dns.SVCBAlpn:
+			alpn = kv.Alpn
+		case *dns.SVCBPort:
+			base.Port = int(kv.Port)
+		case *dns.SVCBIPv4Hint:
+			base.Addrs = append(base.Addrs, kv.Hint...)
+		case *dns.SVCBIPv6Hint:
+			base.Addrs = append(base.Addrs, kv.Hint...)
+		case *dns.SVCBDoHPath:
+			base.Path = kv.Template
+		}
+	}
+	var out []Designation
+	doh := -1
+	for _, id := range alpn {
+		protocol, ok := ddrProtocols[id]
+		if !ok {
+			continue
+		}
+		if protocol == "doh" {
+			// h2 and h3 are two ways to the same endpoint
+			if base.Path == "" {
+				continue
+			}
+			if doh < 0 {
+				doh = len(out)
+				d := base
+				d.Protocol = "doh"
+				d.Addrs = append([]net.IP(nil), base.Addrs...)
+				out = append(out, d)
+			}
+			out[doh].ALPN = append(out[doh].ALPN, id)
+			continue
+		}
+		d := base
+		d.Protocol, d.ALPN = protocol, []string{id}
+		d.Addrs = append([]net.IP(nil), base.Addrs...)
+		out = append(out, d)
+	}
+	for i := range out {
+		if out[i].Port == 0 {
+			out[i].Port = 853
+			if out[i].Protocol == "doh" {
+				out[i].Port = 443
+			}
+		}
+	}
+	return out
+}
+
+// Verify connects to the designated resolver at its addresses in turn and
+// checks, as RFC 9462 section 4.2 has clients do, that its certificate is
+// valid for Target and also carries designator, the IP address of the
+// unencrypted resolver, so that no one on the path could have designated a
+// resolver of their own. base holds the TLS settings and dialer, when not
+// nil, opens the TCP connections. It returns the address that verified.
+func (d *Designation) Verify(ctx context.Context, designator net.IP, base *tls.Config, dialer *Dialer) (string, error) {
+	if len(d.Addrs) == 0 {
+		return "", fmt.Errorf("no address found for %s", d.Target)
+	}
+	var errs []error
+	for _, ip := range d.Addrs {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(d.Port))
+		state, err := d.handshake(ctx, addr, base, dialer)
+		if err != nil {
+			errs = append(errs, typedError(fmt.Errorf("%s: %w", addr, err)))
+			continue
+		}
+		if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].VerifyHostname(designator.String()) != nil {
+			return "", withKind(fmt.Errorf("the certificate of %s (%s) does not carry the address %s of the resolver designating it", d.Target, addr, designator), ErrTLSVerify)
+		}
+		return addr, nil
+	}
+	return "", fmt.Errorf("failed to verify %s: %w", d.Target, errors.Join(errs...))
+}
+
+// handshake runs a TLS handshake with addr, over QUIC for doq and for doh
+// through HTTP/3 only, and returns its state
+func (d *Designation) handshake(ctx context.Context, addr string, base *tls.Config, dialer *Dialer) (tls.ConnectionState, error) {
+	if d.Protocol == "doq" || d.Protocol == "doh" && !slices.Contains(d.ALPN, "h2") {
+		conn, err := quic.DialAddr(ctx, addr, clientTLSConfig(base, d.Target, d.ALPN[0]), nil)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.CloseWithError(0, "")
+		return conn.ConnectionState().TLS, nil
+	}
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	proto := d.ALPN[0]
+	if d.Protocol == "doh" {
+		proto = "h2"
+	}
+	conn := tls.Client(raw, clientTLSConfig(base, d.Target, proto))
+	defer conn.Close()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return conn.ConnectionState(), nil
+}
@@ -0,0 +1,129 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Dedup sends identical queries that are in flight at once upstream only
+// once: those asked while the first is unanswered wait for its response,
+// and each gets a copy with its own ID. Queries are identical when they
+// have the same name, type, class, opcode, DO and CD bits and client
+// subnet option, which the upstream may answer differently. A waiter that
+// gives up returns without cancelling the upstream query the others wait
+// for, with an error matching ErrTimeout when its deadline passed.
+type Dedup struct {
+	Upstream Resolver
+
+	mu     sync.Mutex
+	calls  map[dedupKey]*dedupCall
+	shared atomic.Uint64
+}
+
+// dedupKey is what makes queries identical for Dedup: what makes them so for
+// the cache, and the opcode and client subnet sent along
+type dedupKey struct {
+	cacheKey
+	opcode     int
+	ecsFamily  uint16
+	ecsPrefix  uint8
+	ecsAddress string
+}
+
+// dedupCall is a query in flight and, once done is closed, its outcome
+type dedupCall struct {
+	done  chan struct{}
+	resp  *dns.Msg
+	err   error
+	trace Trace
+}
+
+// NewDedup returns a Dedup in front of upstream
+func NewDedup(upstream Resolver) *Dedup {
+	return &Dedup{Upstream: upstream, calls: map[dedupKey]*dedupCall{}}
+}
+
+// Query implements Resolver
+func (d *Dedup) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	key := dedupKey{cacheKey: cacheKey{name: dns.CanonicalName(name), qtype: qtype, qclass: dns.ClassINET}}
+	return d.resolve(ctx, key, nil, func(ctx context.Context) (*dns.Msg, error) {
+		return d.Upstream.Query(ctx, name, qtype)
+	})
+}
+
+// Exchange implements Resolver
+func (d *Dedup) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return d.Upstream.Exchange(ctx, m)
+	}
+	q := m.Question[0]
+	key := dedupKey{
+		cacheKey: cacheKey{name: dns.CanonicalName(q.Name), qtype: q.Qtype, qclass: q.Qclass, cd: m.CheckingDisabled},
+		opcode:   m.Opcode,
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				key.ecsFamily, key.ecsPrefix, key.ecsAddress = ecs.Family, ecs.SourceNetmask, ecs.Address.String()
+			}
+		}
+	}
+	return d.resolve(ctx, key, m, func(ctx context.Context) (*dns.Msg, error) {
+		return d.Upstream.Exchange(ctx, m)
+	})
+}
+
+// Shared returns the number of queries that waited for an identical one in
+// flight instead of going upstream
+func (d *Dedup) Shared() uint64 {
+	return d.shared.Load()
+}
+
+// resolve joins the call in flight for key, or starts one through ask, and
+// waits for its outcome. query is the message asked with Exchange, whose ID
+// the copy returned gets, nil for Query.
+func (d *Dedup) resolve(ctx context.Context, key dedupKey, query *dns.Msg, ask func(context.Context) (*dns.Msg, error)) (*dns.Msg, error) {
+	d.mu.Lock()
+	call, ok := d.calls[key]
+	if ok {
+		d.shared.Add(1)
+	} else {
+		call = &dedupCall{done: make(chan struct{})}
+		d.calls[key] = call
+		// The call outlives the query that started it when that one gives
+		// up first, but no longer than its deadline
+		callCtx, cancel := context.WithoutCancel(ctx), context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			callCtx, cancel = context.WithDeadline(callCtx, deadline)
+		}
+		go func() {
+			defer cancel()
+			call.resp, call.err = ask(WithTrace(callCtx, &call.trace))
+			d.mu.Lock()
+			delete(d.calls, key)
+			d.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, typedError(fmt.Errorf("%s %s: waiting for the same query in flight: %w", key.name, dns.TypeToString[key.qtype], ctx.Err()))
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	copyTrace(ctx, call.trace)
+	resp := call.resp.Copy()
+	if query != nil {
+		resp.Id = query.Id
+	}
+	return resp, nil
+}
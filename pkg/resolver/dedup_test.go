@@ -0,0 +1,121 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dedupQuery returns an EDNS query for name and qtype
+func dedupQuery(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(UDPBufferSize, false)
+	return m
+}
+
+// waitInFlight waits until d has n distinct queries in flight
+func waitInFlight(d *Dedup, n int) {
+	for {
+		d.mu.Lock()
+		calls := len(d.calls)
+		d.mu.Unlock()
+		if calls >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDedupWaiterGivesUp(t *testing.T) {
+	release := make(chan struct{})
+	d := NewDedup(stubResolver(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		<-release
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		return resp, nil
+	}))
+	defer close(release)
+
+	go d.Exchange(context.Background(), dedupQuery("example.com.", dns.TypeA))
+	waitInFlight(d, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := d.Exchange(ctx, dedupQuery("example.com.", dns.TypeA))
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if d.Shared() != 1 {
+		t.Errorf("%d queries shared, want the second waiting for the first", d.Shared())
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.Exchange(ctx, dedupQuery("example.com.", dns.TypeA)); !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want it cancelled", err)
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	withECS := func(address string, prefix uint8) *dns.Msg {
+		m := dedupQuery("example.com.", dns.TypeA)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: prefix, Address: net.ParseIP(address).To4()})
+		return m
+	}
+	notify := dedupQuery("example.com.", dns.TypeA)
+	notify.Opcode = dns.OpcodeNotify
+	for _, tt := range []struct {
+		name    string
+		queries []*dns.Msg
+		calls   int32
+	}{
+		{"identical", []*dns.Msg{dedupQuery("example.com.", dns.TypeA), dedupQuery("EXAMPLE.com.", dns.TypeA), dedupQuery("example.com.", dns.TypeA)}, 1},
+		{"same subnet", []*dns.Msg{withECS("192.0.2.0", 24), withECS("192.0.2.0", 24)}, 1},
+		{"other subnet", []*dns.Msg{withECS("192.0.2.0", 24), withECS("198.51.100.0", 24), dedupQuery("example.com.", dns.TypeA)}, 3},
+		{"other prefix", []*dns.Msg{withECS("192.0.2.0", 24), withECS("192.0.2.0", 16)}, 2},
+		{"other opcode", []*dns.Msg{dedupQuery("example.com.", dns.TypeA), notify}, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			release := make(chan struct{})
+			d := NewDedup(stubResolver(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+				calls.Add(1)
+				<-release
+				resp := new(dns.Msg)
+				resp.SetReply(m)
+				return resp, nil
+			}))
+
+			var wg sync.WaitGroup
+			for i, q := range tt.queries {
+				q.Id = uint16(i + 1)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := d.Exchange(context.Background(), q)
+					if err != nil || resp.Id != q.Id || resp.Opcode != q.Opcode {
+						t.Errorf("query %d: got %v, %v", q.Id, resp, err)
+					}
+				}()
+				// Let each query join or start its call before the next
+				waitInFlight(d, 1)
+				for int(d.Shared())+int(calls.Load()) <= i {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			close(release)
+			wg.Wait()
+			if got := calls.Load(); got != tt.calls {
+				t.Errorf("%d queries upstream, want %d", got, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Dialer opens the connections to DNS servers, optionally from a given local
+// address or network interface, for multihomed hosts and VRF setups, and
+// optionally through a proxy. A nil *Dialer dials like a plain net.Dialer.
+type Dialer struct {
+	Source    net.IP // local address to send from, chosen by the system when nil
+	Interface string // network interface to send through, when not empty
+	// Proxy, when set, is a SOCKS5 or HTTP CONNECT proxy as ParseProxy
+	// accepts it, which TCP connections go through. Source and Interface
+	// then apply to the connection to the proxy.
+	Proxy *url.URL
+	// Family is 4 or 6 to connect over IPv4 or IPv6 only, looking up only
+	// the addresses of that family, or 0 for either
+	Family int
+	// Bootstrap, when set, looks up the server names instead of the system
+	// resolver, for connections that do not go through Proxy
+	Bootstrap *Bootstrap
+}
+
+// DialContext connects to addr on the named network like net.Dialer does
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d != nil && d.Proxy != nil {
+		return d.dialProxy(ctx, network, addr)
+	}
+	if d != nil && d.Bootstrap != nil {
+		return d.dialBootstrapped(ctx, network, addr)
+	}
+	return d.dialDirect(ctx, network, addr)
+}
+
+// dialBootstrapped connects to the addresses Bootstrap gives for the host
+// of addr in turn, until one of them answers
+func (d *Dialer) dialBootstrapped(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.Bootstrap.LookupIP(ctx, host, d.Family)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.dialDirect(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// network narrows udp and tcp to the family of d
+func (d *Dialer) network(network string) string {
+	if d == nil || d.Family == 0 || (network != "udp" && network != "tcp") {
+		return network
+	}
+	return network + strconv.Itoa(d.Family)
+}
+
+// resolveUDP returns addr with its host looked up through Bootstrap or in
+// the family of d, for the QUIC transports, which open their own sockets.
+// Without either addr is returned as it is.
+func (d *Dialer) resolveUDP(ctx context.Context, addr string) (string, error) {
+	network := d.network("udp")
+	if network == "udp" && (d == nil || d.Bootstrap == nil) {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	var ips []net.IP
+	if d.Bootstrap != nil {
+		ips, err = d.Bootstrap.LookupIP(ctx, host, d.Family)
+	} else if ips, err = net.DefaultResolver.LookupIP(ctx, "ip"+network[3:], host); err != nil {
+		err = fmt.Errorf("failed to look up %s: %w", host, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// dialDirect connects without the proxy
+func (d *Dialer) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	var nd net.Dialer
+	network = d.network(network)
+	if d != nil {
+		if d.Interface != "" {
+			if err := bindInterface(&nd, d.Interface, network, addr); err != nil {
+				return nil, err
+			}
+		}
+		if d.Source != nil {
+			if strings.HasPrefix(network, "udp") {
+				nd.LocalAddr = &net.UDPAddr{IP: d.Source}
+			} else {
+				nd.LocalAddr = &net.TCPAddr{IP: d.Source}
+			}
+		}
+	}
+	return nd.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,29 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// bindInterface makes nd send through the interface with SO_BINDTODEVICE,
+// which also works for interfaces enslaved to a VRF
+func bindInterface(nd *net.Dialer, name, _, _ string) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		return fmt.Errorf("invalid interface %q: %w", name, err)
+	}
+	nd.Control = func(_, _ string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("failed to bind to interface %s: %v", name, sockErr)
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build !linux
+
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// bindInterface makes nd send from an address of the interface, as there is
+// no portable way to bind a socket to the interface itself
+func bindInterface(nd *net.Dialer, name, network, addr string) error {
+	ip, err := interfaceAddr(name, network, addr)
+	if err != nil {
+		return fmt.Errorf("invalid interface %q: %w", name, err)
+	}
+	if network == "udp" || network == "udp4" || network == "udp6" {
+		nd.LocalAddr = &net.UDPAddr{IP: ip}
+	} else {
+		nd.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return nil
+}
+
+// interfaceAddr returns an address of the interface in the family of the
+// network or of the host of addr, IPv4 unless either says IPv6
+func interfaceAddr(name, network, addr string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	want6 := strings.HasSuffix(network, "6") || strings.Contains(host, ":")
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ipnet.IP.To4() == nil) == want6 {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, &net.AddrError{Err: "no usable address on interface " + name, Addr: host}
+}
@@ -0,0 +1,134 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// WellKnownNAT64Prefix is the NAT64 prefix of RFC 6052
+const WellKnownNAT64Prefix = "64:ff9b::/96"
+
+// DNS64 synthesizes AAAA records from A records (RFC 6147) for IPv6-only
+// clients behind NAT64: when a name has no AAAA records, its IPv4
+// addresses are embedded in the NAT64 prefix as RFC 6052 describes.
+// AAAA records that merely map IPv4 addresses (::ffff:0:0/96) count as
+// absent. Queries with the CD bit come from validators that would reject
+// synthesized records, so they are passed on untouched.
+type DNS64 struct {
+	Upstream Resolver
+	Prefix   *net.IPNet
+}
+
+// NewDNS64 returns a DNS64 in front of upstream for the NAT64 prefix, which
+// must be a /32, /40, /48, /56, /64 or /96
+func NewDNS64(upstream Resolver, prefix string) (*DNS64, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NAT64 prefix: %w", err)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits != 128 {
+		return nil, fmt.Errorf("NAT64 prefix %s is not an IPv6 prefix", prefix)
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("NAT64 prefix %s must be a /32, /40, /48, /56, /64 or /96", prefix)
+	}
+	if ones < 96 && ipnet.IP[8] != 0 {
+		return nil, fmt.Errorf("NAT64 prefix %s sets bits 64 to 71, which RFC 6052 reserves", prefix)
+	}
+	return &DNS64{Upstream: upstream, Prefix: ipnet}, nil
+}
+
+// Query implements Resolver
+func (d *DNS64) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return d.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver
+func (d *DNS64) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	resp, err := d.Upstream.Exchange(ctx, m)
+	if err != nil || len(m.Question) != 1 || m.Question[0].Qtype != dns.TypeAAAA || m.Question[0].Qclass != dns.ClassINET || m.CheckingDisabled {
+		return resp, err
+	}
+	// A name that does not exist has no IPv4 addresses either
+	if resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess && hasUsableAAAA(resp) {
+		return resp, nil
+	}
+
+	aQuery := m.Copy()
+	aQuery.Question[0].Qtype = dns.TypeA
+	aResp, err := d.Upstream.Exchange(ctx, aQuery)
+	if err != nil || aResp.Rcode != dns.RcodeSuccess {
+		return resp, nil
+	}
+	// Synthesized records live no longer than the negative AAAA answer would
+	ttlCap := ^uint32(0)
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttlCap = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	var answer []dns.RR
+	synthesized := false
+	for _, rr := range aResp.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME, *dns.DNAME:
+			answer = append(answer, rr)
+		case *dns.A:
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			hdr.Ttl = min(hdr.Ttl, ttlCap)
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: d.synthesize(rr.A)})
+			synthesized = true
+		}
+	}
+	if !synthesized {
+		return resp, nil
+	}
+	out := new(dns.Msg)
+	out.SetReply(m)
+	out.RecursionAvailable = aResp.RecursionAvailable
+	out.Answer = answer
+	if opt := aResp.IsEdns0(); opt != nil {
+		out.Extra = append(out.Extra, opt)
+	}
+	return out, nil
+}
+
+// mappedIPv4 is ::ffff:0:0/96, whose AAAA records do not make a name
+// reachable over IPv6
+var mappedIPv4 = &net.IPNet{IP: net.ParseIP("::ffff:0:0"), Mask: net.CIDRMask(96, 128)}
+
+// hasUsableAAAA reports whether resp answers with an AAAA record outside
+// the excluded range
+func hasUsableAAAA(resp *dns.Msg) bool {
+	for _, rr := range resp.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !mappedIPv4.Contains(aaaa.AAAA) {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesize embeds an IPv4 address in the prefix, skipping bits 64 to 71
+// as RFC 6052 section 2.2 requires
+func (d *DNS64) synthesize(v4 net.IP) net.IP {
+	ones, _ := d.Prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.Prefix.IP.To16())
+	pos := ones / 8
+	for _, b := range v4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
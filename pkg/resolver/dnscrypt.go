@@ -0,0 +1,394 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/poly1305"
+)
+
+// DNSCrypt v2 (https://dnscrypt.info/protocol): the resolver publishes
+// short-lived certificates, signed with the provider key from its stamp,
+// as TXT records at the provider name. A certificate carries the
+// resolver's X25519 key, with which every query is encrypted under a fresh
+// client key, and the encrypted response comes back on the same socket.
+
+const (
+	dnscryptCertMagic     = "DNSC"
+	dnscryptResponseMagic = "r6fnvWj8"
+	dnscryptCertSize      = 124
+
+	// The es-version of a certificate names its construction
+	dnscryptXSalsa20Poly1305  = 1
+	dnscryptXChaCha20Poly1305 = 2
+
+	// dnscryptMinQuerySize is the padded size of UDP queries, so that a
+	// response is never much larger than the query it answers
+	dnscryptMinQuerySize = 256
+	dnscryptHalfNonce    = 12
+)
+
+// dnscryptCert is a verified resolver certificate
+type dnscryptCert struct {
+	esVersion   uint16
+	resolverKey [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+}
+
+// parseDNSCryptCert decodes a certificate and checks its signature against
+// the provider key
+func parseDNSCryptCert(b []byte, providerKey ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(b) < dnscryptCertSize || string(b[:4]) != dnscryptCertMagic {
+		return nil, fmt.Errorf("not a DNSCrypt certificate")
+	}
+	cert := &dnscryptCert{esVersion: binary.BigEndian.Uint16(b[4:])}
+	if cert.esVersion != dnscryptXSalsa20Poly1305 && cert.esVersion != dnscryptXChaCha20Poly1305 {
+		return nil, fmt.Errorf("unsupported DNSCrypt es-version %d", cert.esVersion)
+	}
+	// The signature covers everything from the resolver key on, extensions included
+	if !ed25519.Verify(providerKey, b[72:], b[8:72]) {
+		return nil, fmt.Errorf("DNSCrypt certificate signature does not verify")
+	}
+	copy(cert.resolverKey[:], b[72:104])
+	copy(cert.clientMagic[:], b[104:112])
+	cert.serial = binary.BigEndian.Uint32(b[112:])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(b[116:])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:])), 0)
+	return cert, nil
+}
+
+// DNSCrypt resolves over DNSCrypt v2, over UDP and over TCP when the
+// response is truncated
+type DNSCrypt struct {
+	Addr         string // host:port
+	ProviderName string // such as 2.dnscrypt-cert.example.com
+	ProviderKey  ed25519.PublicKey
+	Dialer       *Dialer // opens the sockets, a plain net.Dialer when nil
+
+	mu   sync.Mutex
+	cert *dnscryptCert
+}
+
+// NewDNSCrypt returns a DNSCrypt resolver for the server at addr, whose
+// certificates are published at providerName and signed with providerKey.
+// ParseStamp gives all three from an sdns:// stamp.
+func NewDNSCrypt(addr, providerName string, providerKey ed25519.PublicKey) *DNSCrypt {
+	return &DNSCrypt{Addr: addr, ProviderName: dns.Fqdn(providerName), ProviderKey: providerKey}
+}
+
+// Query implements Resolver, advertising UDPBufferSize with EDNS0
+func (r *DNSCrypt) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := NewQuery(name, qtype)
+	m.SetEdns0(UDPBufferSize, false)
+	return r.Exchange(ctx, m)
+}
+
+// Exchange implements Resolver
+func (r *DNSCrypt) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	msgBytes, err := packQuery(m, false)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := r.certificate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logWire(ctx, "sending query", "dnscrypt", r.Addr, nil, msgBytes)
+	start := time.Now()
+	respBytes, size, err := r.exchange(ctx, "udp", cert, msgBytes)
+	// The TC flag is bit 1 of the third header byte
+	if err == nil && len(respBytes) >= 3 && respBytes[2]&0x02 != 0 {
+		start = time.Now()
+		respBytes, size, err = r.exchange(ctx, "tcp", cert, msgBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logWire(ctx, "received response", "dnscrypt", r.Addr, nil, respBytes)
+
+	resp, err := unpackResponse(respBytes)
+	if err != nil {
+		return nil, err
+	}
+	recordTrace(ctx, "dnscrypt", r.Addr, start, size, len(respBytes))
+	return resp, nil
+}
+
+// certificate returns the resolver's current certificate, fetching a new
+// one when none is cached or the cached one has expired
+func (r *DNSCrypt) certificate(ctx context.Context) (*dnscryptCert, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && time.Now().Before(r.cert.notAfter) {
+		return r.cert, nil
+	}
+	cert, err := r.fetchCertificate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.cert = cert
+	return cert, nil
+}
+
+// fetchCertificate queries the provider name for certificates in the clear
+// and picks the valid one with the highest serial, preferring XChaCha20
+func (r *DNSCrypt) fetchCertificate(ctx context.Context) (*dnscryptCert, error) {
+	// Keep the certificate lookup out of the trace of the query itself
+	resp, err := NewUDP(r.Addr).Query(WithTrace(ctx, &Trace{}), r.ProviderName, dns.TypeTXT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch DNSCrypt certificate: %w", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("DNSCrypt certificate lookup for %s returned %w", r.ProviderName, &RcodeError{Rcode: resp.Rcode})
+	}
+
+	var best *dnscryptCert
+	var lastErr error
+	now := time.Now()
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		b, err := txtBytes(txt)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		cert, err := parseDNSCryptCert(b, r.ProviderKey)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if now.Before(cert.notBefore) || !now.Before(cert.notAfter) {
+			lastErr = fmt.Errorf("DNSCrypt certificate %d is valid from %s to %s", cert.serial, cert.notBefore.UTC().Format(time.RFC3339), cert.notAfter.UTC().Format(time.RFC3339))
+			continue
+		}
+		if best == nil || cert.serial > best.serial || cert.serial == best.serial && cert.esVersion > best.esVersion {
+			best = cert
+		}
+	}
+	if best == nil {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no TXT records")
+		}
+		return nil, fmt.Errorf("no valid DNSCrypt certificate at %s: %w", r.ProviderName, lastErr)
+	}
+	return best, nil
+}
+
+// txtBytes returns the TXT strings of rr joined as raw bytes. The strings
+// of a dns.TXT are in presentation format, so packing the record is the
+// simplest way to undo the escaping of binary data.
+func txtBytes(rr *dns.TXT) ([]byte, error) {
+	buf := make([]byte, dns.Len(rr))
+	end, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	nameLen, err := dns.PackDomainName(rr.Hdr.Name, make([]byte, 256), 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	rdata := buf[nameLen+10 : end]
+	var out []byte
+	for len(rdata) > 0 {
+		n := int(rdata[0])
+		if len(rdata) < 1+n {
+			return nil, fmt.Errorf("malformed TXT record")
+		}
+		out = append(out, rdata[1:1+n]...)
+		rdata = rdata[1+n:]
+	}
+	return out, nil
+}
+
+// exchange encrypts one query to cert, sends it over network and returns
+// the decrypted response and the size of the encrypted query
+func (r *DNSCrypt) exchange(ctx context.Context, network string, cert *dnscryptCert, msgBytes []byte) ([]byte, int, error) {
+	query, key, nonce, err := encryptDNSCryptQuery(cert, msgBytes, network == "udp")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encrypt DNSCrypt query: %w", err)
+	}
+
+	conn, err := r.Dialer.DialContext(ctx, network, r.Addr)
+	if err != nil {
+		return nil, 0, contextError(ctx, fmt.Errorf("failed to connect to DNS server: %w", err))
+	}
+	defer conn.Close()
+	if _, ok := ctx.Deadline(); !ok {
+		conn.SetDeadline(time.Now().Add(udpTimeout))
+	}
+	defer bindContext(ctx, conn)()
+
+	var respBytes []byte
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, 0, contextError(ctx, fmt.Errorf("failed to send DNS query: %w", err))
+		}
+		respBytes = make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(respBytes)
+		if err != nil {
+			return nil, 0, contextError(ctx, fmt.Errorf("failed to read DNS response: %w", err))
+		}
+		respBytes = respBytes[:n]
+	} else if respBytes, err = exchangeStream(conn, query); err != nil {
+		return nil, 0, contextError(ctx, err)
+	}
+
+	plain, err := decryptDNSCryptResponse(cert, key, nonce, respBytes)
+	if err != nil {
+		return nil, 0, err
+	}
+	return plain, len(query), nil
+}
+
+// encryptDNSCryptQuery pads and encrypts a packed query under a fresh
+// client key. It returns the query packet with the shared key and client
+// nonce needed to open the response.
+func encryptDNSCryptQuery(cert *dnscryptCert, msgBytes []byte, udp bool) ([]byte, *[32]byte, []byte, error) {
+	clientKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	resolverKey, err := ecdh.X25519().NewPublicKey(cert.resolverKey[:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := dnscryptSharedKey(cert.esVersion, clientKey, resolverKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	clientNonce := make([]byte, dnscryptHalfNonce)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, nil, nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], clientNonce)
+
+	// ISO/IEC 7816-4 padding: 0x80, then zeros to a multiple of 64 bytes
+	size := (len(msgBytes) + 1 + 63) &^ 63
+	if udp {
+		size = max(size, dnscryptMinQuerySize)
+	}
+	padded := make([]byte, size)
+	copy(padded, msgBytes)
+	padded[len(msgBytes)] = 0x80
+
+	var packet bytes.Buffer
+	packet.Write(cert.clientMagic[:])
+	packet.Write(clientKey.PublicKey().Bytes())
+	packet.Write(clientNonce)
+	packet.Write(dnscryptSeal(cert.esVersion, padded, &nonce, key))
+	return packet.Bytes(), key, clientNonce, nil
+}
+
+// decryptDNSCryptResponse opens a response packet and strips its padding
+func decryptDNSCryptResponse(cert *dnscryptCert, key *[32]byte, clientNonce, b []byte) ([]byte, error) {
+	headerLen := len(dnscryptResponseMagic) + 24
+	if len(b) < headerLen+poly1305.TagSize || string(b[:len(dnscryptResponseMagic)]) != dnscryptResponseMagic {
+		return nil, fmt.Errorf("not a DNSCrypt response")
+	}
+	var nonce [24]byte
+	copy(nonce[:], b[len(dnscryptResponseMagic):headerLen])
+	if subtle.ConstantTimeCompare(nonce[:dnscryptHalfNonce], clientNonce) != 1 {
+		return nil, fmt.Errorf("DNSCrypt response nonce does not match the query")
+	}
+	padded, ok := dnscryptOpen(cert.esVersion, b[headerLen:], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt DNSCrypt response")
+	}
+	end := bytes.LastIndexByte(padded, 0x80)
+	if end < 0 || len(bytes.TrimLeft(padded[end+1:], "\x00")) != 0 {
+		return nil, fmt.Errorf("malformed DNSCrypt response padding")
+	}
+	return padded[:end], nil
+}
+
+// dnscryptSharedKey derives the key both sides compute from the client
+// and resolver keys: the NaCl box key for XSalsa20, and HChaCha20 of the
+// X25519 result for XChaCha20
+func dnscryptSharedKey(esVersion uint16, clientKey *ecdh.PrivateKey, resolverKey *ecdh.PublicKey) (*[32]byte, error) {
+	var key [32]byte
+	if esVersion == dnscryptXSalsa20Poly1305 {
+		var priv, pub [32]byte
+		copy(priv[:], clientKey.Bytes())
+		copy(pub[:], resolverKey.Bytes())
+		box.Precompute(&key, &pub, &priv)
+		return &key, nil
+	}
+	shared, err := clientKey.ECDH(resolverKey)
+	if err != nil {
+		return nil, err
+	}
+	subKey, err := chacha20.HChaCha20(shared, make([]byte, 16))
+	if err != nil {
+		return nil, err
+	}
+	copy(key[:], subKey)
+	return &key, nil
+}
+
+// dnscryptSeal encrypts and authenticates msg, returning tag || ciphertext
+func dnscryptSeal(esVersion uint16, msg []byte, nonce *[24]byte, key *[32]byte) []byte {
+	if esVersion == dnscryptXSalsa20Poly1305 {
+		return box.SealAfterPrecomputation(nil, msg, nonce, key)
+	}
+	// XChaCha20 in the secretbox construction: the first 32 bytes of key
+	// stream are the Poly1305 key and the message is encrypted after them
+	stream := xchachaStream(msg, nonce, key)
+	var polyKey [32]byte
+	copy(polyKey[:], stream[:32])
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, stream[32:], &polyKey)
+	return append(tag[:], stream[32:]...)
+}
+
+// dnscryptOpen reverses dnscryptSeal
+func dnscryptOpen(esVersion uint16, sealed []byte, nonce *[24]byte, key *[32]byte) ([]byte, bool) {
+	if esVersion == dnscryptXSalsa20Poly1305 {
+		return box.OpenAfterPrecomputation(nil, sealed, nonce, key)
+	}
+	if len(sealed) < poly1305.TagSize {
+		return nil, false
+	}
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], sealed)
+	ciphertext := sealed[poly1305.TagSize:]
+
+	var polyKey [32]byte
+	copy(polyKey[:], xchachaStream(nil, nonce, key))
+	if !poly1305.Verify(&tag, ciphertext, &polyKey) {
+		return nil, false
+	}
+	return xchachaStream(ciphertext, nonce, key)[32:], true
+}
+
+// xchachaStream XORs data with the XChaCha20 key stream from byte 32 on and
+// returns the first 32 bytes of key stream followed by the result
+func xchachaStream(data []byte, nonce *[24]byte, key *[32]byte) []byte {
+	c, err := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	if err != nil {
+		panic(err) // key and nonce sizes are fixed
+	}
+	out := make([]byte, 32+len(data))
+	copy(out[32:], data)
+	c.XORKeyStream(out, out)
+	return out
+}
@@ -0,0 +1,465 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Security is the DNSSEC validation status of a response (RFC 4035 section 4.3)
+type Security int
+
+const (
+	// Indeterminate means validation could not be carried out
+	Indeterminate Security = iota
+	// Insecure means the data sits below a provably unsigned delegation
+	Insecure
+	// Secure means every RRset chains up to a trust anchor
+	Secure
+	// Bogus means signatures are missing, expired or do not verify
+	Bogus
+)
+
+func (s Security) String() string {
+	switch s {
+	case Insecure:
+		return "Insecure"
+	case Secure:
+		return "Secure"
+	case Bogus:
+		return "Bogus"
+	default:
+		return "Indeterminate"
+	}
+}
+
+// RootAnchors returns the root zone trust anchors published by IANA, the
+// 2017 KSK and its 2024 successor
+func RootAnchors() []*dns.DS {
+	return []*dns.DS{
+		{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET}, KeyTag: 20326, Algorithm: dns.RSASHA256, DigestType: dns.SHA256, Digest: "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"},
+		{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET}, KeyTag: 38696, Algorithm: dns.RSASHA256, DigestType: dns.SHA256, Digest: "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16"},
+	}
+}
+
+// ReadTrustAnchors reads DS or DNSKEY records in zone file format, such as
+// the output of "dig . DNSKEY", and returns them as DS records
+func ReadTrustAnchors(path string) ([]*dns.DS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var anchors []*dns.DS
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			anchors = append(anchors, rr)
+		case *dns.DNSKEY:
+			if rr.Flags&dns.SEP != 0 {
+				anchors = append(anchors, rr.ToDS(dns.SHA256))
+			}
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse trust anchors: %w", err)
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no DS or DNSKEY records in %s", path)
+	}
+	return anchors, nil
+}
+
+// NewDNSSECQuery returns a query with the DO bit set so the upstream returns
+// signatures, and CD set so it hands over data it considers bogus rather
+// than failing with SERVFAIL
+func NewDNSSECQuery(name string, qtype uint16) *dns.Msg {
+	m := NewQuery(name, qtype)
+	m.CheckingDisabled = true
+	m.SetEdns0(UDPBufferSize, true)
+	return m
+}
+
+// Validator checks responses against a chain of trust that it builds from
+// the trust anchors down, fetching DS and DNSKEY records through Resolver
+type Validator struct {
+	Resolver Resolver
+	Anchors  []*dns.DS
+
+	mu    sync.Mutex
+	zones map[string]zoneResult
+}
+
+// zoneResult caches what is known about a zone's keys
+type zoneResult struct {
+	keys []*dns.DNSKEY
+	sec  Security
+	err  error
+}
+
+// NewValidator returns a Validator that trusts anchors, or the root anchors
+// when anchors is empty
+func NewValidator(r Resolver, anchors []*dns.DS) *Validator {
+	if len(anchors) == 0 {
+		anchors = RootAnchors()
+	}
+	return &Validator{Resolver: r, Anchors: anchors, zones: map[string]zoneResult{}}
+}
+
+// Validate determines the security status of resp, which should have been
+// obtained with a query from NewDNSSECQuery. For Bogus and Indeterminate
+// results the error explains why.
+func (v *Validator) Validate(ctx context.Context, resp *dns.Msg) (Security, error) {
+	if len(resp.Question) != 1 {
+		return Indeterminate, fmt.Errorf("response has %d questions", len(resp.Question))
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return Indeterminate, fmt.Errorf("%s responses cannot be validated", dns.RcodeToString[resp.Rcode])
+	}
+	q := resp.Question[0]
+
+	section := resp.Answer
+	negative := len(resp.Answer) == 0
+	if negative {
+		section = resp.Ns
+	}
+	sets, sigs := splitRRsets(section)
+	if len(sets) == 0 {
+		return v.unsignedStatus(ctx, q.Name)
+	}
+
+	if sec, err := v.verifySets(ctx, sets, sigs); sec != Secure {
+		return sec, err
+	}
+
+	if negative {
+		if err := checkDenial(q, resp.Rcode, section); err != nil {
+			return Bogus, err
+		}
+		return Secure, nil
+	}
+
+	// Answers expanded from a wildcard must prove the name itself is absent
+	for _, sigList := range sigs {
+		sig := sigList[0]
+		if labels := dns.CountLabel(sig.Hdr.Name); int(sig.Labels) < labels {
+			ce := dns.Fqdn(strings.Join(dns.SplitDomainName(sig.Hdr.Name)[labels-int(sig.Labels):], "."))
+			if sig.Labels == 0 {
+				ce = "."
+			}
+			authSets, authSigs := splitRRsets(resp.Ns)
+			if sec, err := v.verifySets(ctx, authSets, authSigs); sec != Secure {
+				return Bogus, fmt.Errorf("wildcard proof for %s: %w", sig.Hdr.Name, err)
+			}
+			if err := checkWildcardProof(sig.Hdr.Name, ce, resp.Ns); err != nil {
+				return Bogus, err
+			}
+		}
+	}
+	return Secure, nil
+}
+
+// verifySets validates every RRset, returning Insecure if any of them is
+// insecure and the first failure if one is bogus
+func (v *Validator) verifySets(ctx context.Context, sets [][]dns.RR, sigs map[string][]*dns.RRSIG) (Security, error) {
+	status := Secure
+	for _, set := range sets {
+		h := set[0].Header()
+		sec, err := v.verifyRRset(ctx, set, sigs[rrsetKey(h.Name, h.Rrtype)])
+		switch sec {
+		case Bogus, Indeterminate:
+			return sec, err
+		case Insecure:
+			status = Insecure
+		}
+	}
+	return status, nil
+}
+
+// verifyRRset validates one RRset with its signatures. Unsigned RRsets are
+// Insecure when they sit below an unsigned delegation and Bogus otherwise.
+func (v *Validator) verifyRRset(ctx context.Context, set []dns.RR, sigs []*dns.RRSIG) (Security, error) {
+	h := set[0].Header()
+	if len(sigs) == 0 {
+		sec, err := v.unsignedStatus(ctx, h.Name)
+		if sec == Secure {
+			return Bogus, fmt.Errorf("%s %s is unsigned in a signed zone", h.Name, dns.TypeToString[h.Rrtype])
+		}
+		return sec, err
+	}
+
+	signer := sigs[0].SignerName
+	if !dns.IsSubDomain(signer, h.Name) {
+		return Bogus, fmt.Errorf("%s is signed by %s, which is not an enclosing zone", h.Name, signer)
+	}
+	keys, sec, err := v.zoneKeys(ctx, signer)
+	if sec != Secure {
+		return sec, err
+	}
+	if err := verifySigned(set, sigs, keys); err != nil {
+		return Bogus, err
+	}
+	return Secure, nil
+}
+
+// zoneKeys returns the validated DNSKEYs of zone. The result is Insecure
+// when the zone, or one of its ancestors, is delegated without a DS.
+func (v *Validator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, Security, error) {
+	zone = dns.CanonicalName(zone)
+	v.mu.Lock()
+	res, ok := v.zones[zone]
+	v.mu.Unlock()
+	if ok {
+		return res.keys, res.sec, res.err
+	}
+
+	keys, sec, err := v.lookupZoneKeys(ctx, zone)
+	if ctx.Err() == nil {
+		v.mu.Lock()
+		v.zones[zone] = zoneResult{keys, sec, err}
+		v.mu.Unlock()
+	}
+	return keys, sec, err
+}
+
+func (v *Validator) lookupZoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, Security, error) {
+	var dsSet []*dns.DS
+	if anchors := v.anchorsFor(zone); len(anchors) > 0 {
+		dsSet = anchors
+	} else if zone == "." {
+		return nil, Bogus, fmt.Errorf("no trust anchor for the root zone")
+	} else {
+		ds, sec, err := v.delegation(ctx, zone)
+		if sec != Secure {
+			return nil, sec, err
+		}
+		dsSet = ds
+	}
+
+	resp, err := v.fetch(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, Indeterminate, err
+	}
+	sets, sigs := splitRRsets(resp.Answer)
+	var keySet []dns.RR
+	for _, set := range sets {
+		if set[0].Header().Rrtype == dns.TypeDNSKEY && dns.CanonicalName(set[0].Header().Name) == zone {
+			keySet = set
+		}
+	}
+	if keySet == nil {
+		return nil, Bogus, fmt.Errorf("no DNSKEY records for %s", zone)
+	}
+
+	// The DNSKEY RRset must be signed by a key that a DS points at
+	var entry, all []*dns.DNSKEY
+	for _, rr := range keySet {
+		key := rr.(*dns.DNSKEY)
+		all = append(all, key)
+		if key.Flags&dns.ZONE != 0 && matchesDS(key, dsSet) {
+			entry = append(entry, key)
+		}
+	}
+	if len(entry) == 0 {
+		return nil, Bogus, fmt.Errorf("no DNSKEY for %s matches its DS records", zone)
+	}
+	if err := verifySigned(keySet, sigs[rrsetKey(zone, dns.TypeDNSKEY)], entry); err != nil {
+		return nil, Bogus, err
+	}
+	return all, Secure, nil
+}
+
+// delegation returns the validated DS RRset for zone from its parent, or
+// Insecure if the parent proves that no DS exists
+func (v *Validator) delegation(ctx context.Context, zone string) ([]*dns.DS, Security, error) {
+	resp, err := v.fetch(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, Indeterminate, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, Indeterminate, fmt.Errorf("DS query for %s failed with %w", zone, &RcodeError{Rcode: resp.Rcode})
+	}
+
+	sets, sigs := splitRRsets(resp.Answer)
+	for _, set := range sets {
+		if set[0].Header().Rrtype != dns.TypeDS || dns.CanonicalName(set[0].Header().Name) != zone {
+			continue
+		}
+		sec, err := v.verifyRRset(ctx, set, sigs[rrsetKey(zone, dns.TypeDS)])
+		if sec != Secure {
+			return nil, sec, err
+		}
+		ds := make([]*dns.DS, len(set))
+		for i, rr := range set {
+			ds[i] = rr.(*dns.DS)
+		}
+		return ds, Secure, nil
+	}
+
+	// No DS: the parent's signed denial makes the delegation insecure
+	sets, sigs = splitRRsets(resp.Ns)
+	if len(sigs) == 0 {
+		sec, err := v.unsignedStatus(ctx, parentName(zone))
+		if sec == Secure {
+			return nil, Bogus, fmt.Errorf("no DS for %s and no signed proof of its absence", zone)
+		}
+		return nil, sec, err
+	}
+	if sec, err := v.verifySets(ctx, sets, sigs); sec != Secure {
+		return nil, sec, err
+	}
+	q := dns.Question{Name: zone, Qtype: dns.TypeDS, Qclass: dns.ClassINET}
+	if err := checkDenial(q, dns.RcodeSuccess, resp.Ns); err != nil {
+		return nil, Bogus, err
+	}
+	return nil, Insecure, nil
+}
+
+// unsignedStatus finds out whether unsigned data for name is expected,
+// which is the case when name is covered by an insecure delegation. It
+// walks down from the root looking for the zone cut without a DS.
+func (v *Validator) unsignedStatus(ctx context.Context, name string) (Security, error) {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		resp, err := v.fetch(ctx, candidate, dns.TypeDS)
+		if err != nil {
+			return Indeterminate, err
+		}
+
+		if hasRRset(resp.Answer, candidate, dns.TypeDS) {
+			// A signed delegation, carry on below it
+			_, sec, err := v.zoneKeys(ctx, candidate)
+			if sec != Secure {
+				return sec, err
+			}
+			continue
+		}
+		if !isZoneCut(resp.Ns, candidate) {
+			continue
+		}
+		if _, sec, err := v.delegation(ctx, candidate); sec != Secure {
+			return sec, err
+		}
+	}
+	if _, sec, err := v.zoneKeys(ctx, "."); sec != Secure {
+		return sec, err
+	}
+	return Secure, nil
+}
+
+// anchorsFor returns the configured trust anchors for zone
+func (v *Validator) anchorsFor(zone string) []*dns.DS {
+	var out []*dns.DS
+	for _, ds := range v.Anchors {
+		if dns.CanonicalName(ds.Hdr.Name) == zone {
+			out = append(out, ds)
+		}
+	}
+	return out
+}
+
+// fetch queries the upstream for DNSSEC material
+func (v *Validator) fetch(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	resp, err := v.Resolver.Exchange(ctx, NewDNSSECQuery(name, qtype))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s lookup: %w", name, dns.TypeToString[qtype], err)
+	}
+	return resp, nil
+}
+
+// verifySigned checks that at least one currently valid signature over set
+// verifies with one of keys
+func verifySigned(set []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	h := set[0].Header()
+	desc := fmt.Sprintf("%s %s", h.Name, dns.TypeToString[h.Rrtype])
+	if len(sigs) == 0 {
+		return fmt.Errorf("%s has no signatures", desc)
+	}
+	now := time.Now()
+	lastErr := fmt.Errorf("no DNSKEY matches the signatures over %s", desc)
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm || dns.CanonicalName(key.Hdr.Name) != dns.CanonicalName(sig.SignerName) {
+				continue
+			}
+			if err := sig.Verify(key, set); err != nil {
+				lastErr = fmt.Errorf("signature over %s by key %d does not verify: %w", desc, sig.KeyTag, err)
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				lastErr = fmt.Errorf("signature over %s by key %d is outside its validity period", desc, sig.KeyTag)
+				continue
+			}
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// matchesDS reports whether one of the DS records is a digest of key
+func matchesDS(key *dns.DNSKEY, dsSet []*dns.DS) bool {
+	for _, ds := range dsSet {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		if d := key.ToDS(ds.DigestType); d != nil && strings.EqualFold(d.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRRsets groups a section into RRsets and the signatures covering them,
+// keyed by owner and type. OPT records are skipped.
+func splitRRsets(rrs []dns.RR) ([][]dns.RR, map[string][]*dns.RRSIG) {
+	var sets [][]dns.RR
+	index := map[string]int{}
+	sigs := map[string][]*dns.RRSIG{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.OPT:
+			continue
+		case *dns.RRSIG:
+			key := rrsetKey(h.Name, rr.TypeCovered)
+			sigs[key] = append(sigs[key], rr)
+			continue
+		}
+		key := rrsetKey(h.Name, h.Rrtype)
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+		} else {
+			index[key] = len(sets)
+			sets = append(sets, []dns.RR{rr})
+		}
+	}
+	return sets, sigs
+}
+
+func rrsetKey(name string, rrtype uint16) string {
+	return dns.CanonicalName(name) + "/" + dns.TypeToString[rrtype]
+}
+
+func hasRRset(rrs []dns.RR, name string, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype && dns.CanonicalName(rr.Header().Name) == dns.CanonicalName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
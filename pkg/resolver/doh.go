@@ -0,0 +1,269 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// dohContentType is the RFC 8484 media type for wire format DNS messages
+const dohContentType = "application/dns-message"
+
+// DoHOption configures a DoH resolver
+type DoHOption func(*dohConfig)
+
+type dohConfig struct {
+	version string
+	method  string
+	tls     *tls.Config
+	addr    string
+	dialer  *Dialer
+}
+
+// WithHTTP1Only disables HTTP/2 for endpoints behind proxies that only
+// speak HTTP/1.1
+func WithHTTP1Only() DoHOption {
+	return WithHTTPVersion("1.1")
+}
+
+// WithHTTPVersion requires the given HTTP version, "1.1", "2" or "3" (over
+// QUIC), instead of negotiating HTTP/2 or HTTP/1.1 with the server
+func WithHTTPVersion(version string) DoHOption {
+	return func(c *dohConfig) {
+		c.version = version
+	}
+}
+
+// WithDoHMethod selects the HTTP method tried first, GET or POST. POST is
+// the default as it keeps the query out of URL logs; either way the other
+// method is tried when the server rejects the first one.
+func WithDoHMethod(method string) DoHOption {
+	return func(c *dohConfig) {
+		c.method = strings.ToUpper(method)
+	}
+}
+
+// WithTLSConfig sets the TLS settings for connections to the server, such
+// as the root CAs to trust. The ALPN protocols are still chosen by the
+// resolver.
+func WithTLSConfig(cfg *tls.Config) DoHOption {
+	return func(c *dohConfig) {
+		c.tls = cfg
+	}
+}
+
+// WithServerAddr connects to the host:port addr instead of an address the
+// URL's host resolves to. The host still names the server to TLS and HTTP.
+func WithServerAddr(addr string) DoHOption {
+	return func(c *dohConfig) {
+		c.addr = addr
+	}
+}
+
+// WithDialer opens the connections to the server with d. Over HTTP/3 only
+// its address family applies. The proxy of d replaces the one HTTPS_PROXY
+// would pick.
+func WithDialer(d *Dialer) DoHOption {
+	return func(c *dohConfig) {
+		c.dialer = d
+	}
+}
+
+// DoH resolves over DNS over HTTPS (RFC 8484)
+type DoH struct {
+	URL string
+
+	cfg    dohConfig
+	client *http.Client
+}
+
+// NewDoH returns a DoH resolver for the endpoint URL
+func NewDoH(url string, opts ...DoHOption) *DoH {
+	cfg := dohConfig{method: http.MethodPost}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &DoH{URL: url, cfg: cfg, client: newDoHClient(cfg)}
+}
+
+// dohMaxIdleConns is the number of idle connections kept to a DoH server.
+// Over HTTP/2 queries share one multiplexed connection, the spare ones let
+// concurrent HTTP/1.1 queries avoid a new handshake each.
+const dohMaxIdleConns = 16
+
+// newDoHClient returns the HTTP client for the given DoH configuration, which
+// prefers HTTP/2 unless told otherwise. Connections are kept alive between
+// queries, so a resolver used for many queries pays the handshake once.
+func newDoHClient(cfg dohConfig) *http.Client {
+	if cfg.version == "3" {
+		h3 := &http3.Transport{TLSClientConfig: clientTLSConfig(cfg.tls, "")}
+		if cfg.addr != "" || cfg.dialer != nil {
+			h3.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, quicCfg *quic.Config) (quic.EarlyConnection, error) {
+				if cfg.addr != "" {
+					addr = cfg.addr
+				}
+				addr, err := cfg.dialer.resolveUDP(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+				return quic.DialAddrEarly(ctx, addr, tlsCfg, quicCfg)
+			}
+		}
+		return &http.Client{Transport: h3}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = dohMaxIdleConns
+	if cfg.addr != "" || cfg.dialer != nil {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if cfg.addr != "" {
+				addr = cfg.addr
+			}
+			return cfg.dialer.DialContext(ctx, network, addr)
+		}
+		if cfg.dialer != nil {
+			transport.Proxy = nil
+		}
+	}
+	if cfg.tls != nil {
+		transport.TLSClientConfig = clientTLSConfig(cfg.tls, "")
+	}
+	switch cfg.version {
+	case "1.1":
+		transport.ForceAttemptHTTP2 = false
+		// A non-nil, empty TLSNextProto keeps net/http from offering h2 via ALPN.
+		// Offer http/1.1 explicitly, some servers assume h2 when ALPN is absent.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		transport.TLSClientConfig = clientTLSConfig(cfg.tls, "", "http/1.1")
+	case "2":
+		transport.TLSClientConfig = clientTLSConfig(cfg.tls, "", "h2")
+	}
+	return &http.Client{Transport: transport}
+}
+
+// Query implements Resolver
+func (r *DoH) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver
+func (r *DoH) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	method := r.cfg.method
+	if method != http.MethodGet && method != http.MethodPost {
+		return nil, fmt.Errorf("unsupported DoH method %q, use GET or POST", method)
+	}
+	switch r.cfg.version {
+	case "", "1.1", "2", "3":
+	default:
+		return nil, fmt.Errorf("unsupported HTTP version %q, use 1.1, 2 or 3", r.cfg.version)
+	}
+
+	// RFC 8484 section 4.1: a zero ID makes GET responses cache friendly
+	msgBytes, err := packQuery(m, true)
+	if err != nil {
+		return nil, err
+	}
+
+	logWire(ctx, "sending query", "https", r.URL, nil, msgBytes)
+	// Perform the HTTP request, switching methods if the server refuses ours
+	start := time.Now()
+	httpResp, err := r.request(ctx, method, msgBytes)
+	if err == nil && dohMethodRejected(httpResp.StatusCode) {
+		drainBody(httpResp.Body)
+		other := http.MethodGet
+		if method == http.MethodGet {
+			other = http.MethodPost
+		}
+		httpResp, err = r.request(ctx, other, msgBytes)
+	}
+	if err != nil {
+		return nil, typedError(fmt.Errorf("HTTP request failed: %w", err))
+	}
+	defer drainBody(httpResp.Body)
+
+	// A server without h2 support answers over HTTP/1.1 despite the ALPN offer
+	if r.cfg.version == "2" && httpResp.ProtoMajor != 2 {
+		return nil, fmt.Errorf("DoH server negotiated %s, not HTTP/2", httpResp.Proto)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(httpResp.Body, 512))
+		return nil, fmt.Errorf("DoH server returned non-OK status: %s, body: %s", httpResp.Status, string(body))
+	}
+	if mediaType, _, _ := mime.ParseMediaType(httpResp.Header.Get("Content-Type")); mediaType != dohContentType {
+		return nil, fmt.Errorf("DoH server returned unexpected content type %q", httpResp.Header.Get("Content-Type"))
+	}
+
+	// Read the DNS response, a byte more than a message holds so that
+	// unpackResponse rejects longer bodies
+	respBytes, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize+1))
+	if err != nil {
+		return nil, typedError(fmt.Errorf("failed to read DNS response: %w", err))
+	}
+	logWire(ctx, "received response", "https", r.URL, nil, respBytes)
+
+	resp, err := unpackResponse(respBytes)
+	if err != nil {
+		return nil, err
+	}
+	// Restore the ID the caller used so responses can be matched as usual
+	resp.Id = m.Id
+	recordTrace(ctx, "https", r.URL, start, len(msgBytes), len(respBytes))
+	recordProtocol(ctx, httpResp.Proto)
+	recordTLS(ctx, httpResp.TLS)
+	return resp, nil
+}
+
+// request sends the query with GET (base64url in the dns parameter) or POST
+// (the message as the request body)
+func (r *DoH) request(ctx context.Context, method string, msgBytes []byte) (*http.Response, error) {
+	var req *http.Request
+	var err error
+	if method == http.MethodPost {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(msgBytes))
+		if err == nil {
+			req.Header.Set("Content-Type", dohContentType)
+		}
+	} else {
+		// Encode the DNS query in base64 URL without padding
+		encoded := base64.RawURLEncoding.EncodeToString(msgBytes)
+		separator := "?"
+		if strings.Contains(r.URL, "?") {
+			separator = "&"
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, r.URL+separator+"dns="+encoded, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohContentType)
+	return r.client.Do(req)
+}
+
+// dohMethodRejected reports whether a status means the server does not accept
+// the HTTP method or its encoding, rather than failing to resolve
+func dohMethodRejected(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// drainBody reads what is left of a response body before closing it, which
+// lets net/http put the connection back into its pool
+func drainBody(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, dns.MaxMsgSize))
+	body.Close()
+}
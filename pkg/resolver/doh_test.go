@@ -0,0 +1,100 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newDoHServer starts a TLS DoH server offering h2 and HTTP/1.1 that
+// answers every query with an A record, and reports the protocol of each
+// request it served
+func newDoHServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var protos []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		protos = append(protos, req.Proto)
+		mu.Unlock()
+		body, _ := io.ReadAll(req.Body)
+		query := new(dns.Msg)
+		if err := query.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		rr, _ := dns.NewRR(query.Question[0].Name + " 300 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, rr)
+		packed, _ := resp.Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(packed)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, protos...)
+	}
+}
+
+func TestDoHHTTPVersion(t *testing.T) {
+	srv, protos := newDoHServer(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	for _, tt := range []struct {
+		name string
+		opts []DoHOption
+		want string
+	}{
+		{"auto", nil, "HTTP/2.0"},
+		{"http-version 1.1", []DoHOption{WithHTTPVersion("1.1")}, "HTTP/1.1"},
+		{"WithHTTP1Only", []DoHOption{WithHTTP1Only()}, "HTTP/1.1"},
+		{"http-version 2", []DoHOption{WithHTTPVersion("2")}, "HTTP/2.0"},
+	} {
+		before := len(protos())
+		r := NewDoH(srv.URL+"/dns-query", append([]DoHOption{WithTLSConfig(tlsConfig)}, tt.opts...)...)
+		var trace Trace
+		resp, err := r.Query(WithTrace(context.Background(), &trace), "example.com", dns.TypeA)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("%s: got %v", tt.name, resp)
+		}
+		got := protos()
+		if len(got) != before+1 || got[before] != tt.want {
+			t.Errorf("%s: server saw %v, want one request over %s", tt.name, got[before:], tt.want)
+		}
+		if trace.Protocol != tt.want {
+			t.Errorf("%s: trace says %s, want %s", tt.name, trace.Protocol, tt.want)
+		}
+	}
+}
+
+func TestDoHHTTP2Required(t *testing.T) {
+	// A server without h2 answers over HTTP/1.1, which fails a query that
+	// requires HTTP/2
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	r := NewDoH(srv.URL+"/dns-query", WithTLSConfig(&tls.Config{RootCAs: roots}), WithHTTPVersion("2"))
+	if _, err := r.Query(context.Background(), "example.com", dns.TypeA); err == nil {
+		t.Error("HTTP/2 query succeeded against an HTTP/1.1 only server")
+	} else if !strings.Contains(err.Error(), "not HTTP/2") {
+		t.Errorf("got %v, want the negotiated version refused", err)
+	}
+}
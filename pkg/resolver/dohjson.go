@@ -0,0 +1,161 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohJSONContentType is the media type of the JSON DoH APIs
+const dohJSONContentType = "application/dns-json"
+
+// DoHJSON resolves over the JSON DoH APIs of Google (https://dns.google/resolve)
+// and Cloudflare (https://cloudflare-dns.com/dns-query), for networks that
+// only let those through. The JSON is mapped back into a dns.Msg, so
+// responses look like those of the other transports, but EDNS options other
+// than the client subnet cannot be sent and the OPT record is not returned.
+type DoHJSON struct {
+	URL string
+
+	client *http.Client
+}
+
+// NewDoHJSON returns a DoHJSON resolver for the endpoint URL. Of the DoH
+// options only the HTTP version and TLS settings apply, the API is GET only.
+func NewDoHJSON(url string, opts ...DoHOption) *DoHJSON {
+	var cfg dohConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &DoHJSON{URL: url, client: newDoHClient(cfg)}
+}
+
+// dohJSONResponse is the response body of the JSON APIs
+type dohJSONResponse struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Answer     []dohJSONRecord
+	Authority  []dohJSONRecord
+	Additional []dohJSONRecord
+}
+
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// Query implements Resolver
+func (r *DoHJSON) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver. Only the question, the CD bit, the DO bit
+// and an EDNS client subnet option of m are sent.
+func (r *DoHJSON) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return nil, fmt.Errorf("the DoH JSON API takes exactly one question")
+	}
+	q := m.Question[0]
+	params := url.Values{}
+	params.Set("name", q.Name)
+	params.Set("type", strconv.Itoa(int(q.Qtype)))
+	if m.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		if opt.Do() {
+			params.Set("do", "1")
+		}
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				params.Set("edns_client_subnet", fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask))
+			}
+		}
+	}
+	separator := "?"
+	if strings.Contains(r.URL, "?") {
+		separator = "&"
+	}
+	reqURL := r.URL + separator + params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohJSONContentType)
+	slog.DebugContext(ctx, "sending query", "transport", "https-json", "url", reqURL)
+	start := time.Now()
+	httpResp, err := r.client.Do(req)
+	if err != nil {
+		return nil, typedError(fmt.Errorf("HTTP request failed: %w", err))
+	}
+	defer drainBody(httpResp.Body)
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize*4))
+	if err != nil {
+		return nil, typedError(fmt.Errorf("failed to read DNS response: %w", err))
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned non-OK status: %s, body: %s", httpResp.Status, string(body))
+	}
+	if mediaType, _, _ := mime.ParseMediaType(httpResp.Header.Get("Content-Type")); !strings.Contains(mediaType, "json") {
+		return nil, fmt.Errorf("DoH server returned unexpected content type %q", httpResp.Header.Get("Content-Type"))
+	}
+	slog.DebugContext(ctx, "received response", "transport", "https-json", "url", r.URL, "body", string(body))
+
+	var jr dohJSONResponse
+	if err := json.Unmarshal(body, &jr); err != nil {
+		return nil, fmt.Errorf("failed to parse DoH JSON response: %w", err)
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	resp.Rcode = jr.Status
+	resp.Truncated = jr.TC
+	resp.RecursionDesired = jr.RD
+	resp.RecursionAvailable = jr.RA
+	resp.AuthenticatedData = jr.AD
+	resp.CheckingDisabled = jr.CD
+	resp.Answer = jsonRecords(ctx, jr.Answer)
+	resp.Ns = jsonRecords(ctx, jr.Authority)
+	resp.Extra = jsonRecords(ctx, jr.Additional)
+	recordTrace(ctx, "https-json", r.URL, start, len(reqURL), len(body))
+	recordProtocol(ctx, httpResp.Proto)
+	recordTLS(ctx, httpResp.TLS)
+	return resp, nil
+}
+
+// jsonRecords converts the records of a JSON response, whose data is in
+// master file format. The APIs differ on quoting TXT data, Google leaves
+// the quotes out. Records that do not parse are logged and skipped.
+func jsonRecords(ctx context.Context, records []dohJSONRecord) []dns.RR {
+	var rrs []dns.RR
+	for _, rec := range records {
+		data := rec.Data
+		if (rec.Type == dns.TypeTXT || rec.Type == dns.TypeSPF) && !strings.HasPrefix(data, `"`) {
+			data = strconv.Quote(data)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rec.Name), rec.TTL, dns.Type(rec.Type), data))
+		if err != nil || rr == nil {
+			slog.WarnContext(ctx, "skipped unparseable record in DoH JSON response", "name", rec.Name, "type", dns.Type(rec.Type).String(), "data", rec.Data, "err", err)
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
@@ -0,0 +1,90 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ resolves over DNS over QUIC (RFC 9250). Every query uses its own
+// bidirectional stream carrying a length-prefixed message.
+type DoQ struct {
+	Addr string // host:port
+
+	// TLSConfig, when set, is the base for the TLS settings, as for DoT
+	TLSConfig *tls.Config
+	// Dialer, when set, picks the address family. QUIC opens its own
+	// sockets, so the source address, interface and proxy do not apply.
+	Dialer *Dialer
+}
+
+// NewDoQ returns a DoQ resolver for the host:port address
+func NewDoQ(addr string) *DoQ {
+	return &DoQ{Addr: addr}
+}
+
+// Query implements Resolver
+func (r *DoQ) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver
+func (r *DoQ) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 9250 section 4.2.1: the message ID must be zero on DoQ
+	msgBytes, err := packQuery(m, true)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(r.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS server address: %w", err)
+	}
+
+	start := time.Now()
+	addr, err := r.Dialer.resolveUDP(ctx, r.Addr)
+	if err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to establish QUIC connection: %w", err))
+	}
+	conn, err := quic.DialAddr(ctx, addr, clientTLSConfig(r.TLSConfig, host, "doq"), nil)
+	if err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to establish QUIC connection: %w", err))
+	}
+	defer conn.CloseWithError(0, "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to open QUIC stream: %w", err))
+	}
+	defer bindContext(ctx, stream)()
+
+	logWire(ctx, "sending query", "quic", r.Addr, conn, msgBytes)
+	// Send the length-prefixed query and signal the end of it with a FIN
+	if _, err := stream.Write(append(u16(uint16(len(msgBytes))), msgBytes...)); err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to send DNS query: %w", err))
+	}
+	if err := stream.Close(); err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to send DNS query: %w", err))
+	}
+
+	respBytes, err := readStreamMessage(stream)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	logWire(ctx, "received response", "quic", r.Addr, conn, respBytes)
+
+	resp, err := unpackResponse(respBytes)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = m.Id
+	recordTrace(ctx, "quic", r.Addr, start, len(msgBytes), len(respBytes))
+	state := conn.ConnectionState().TLS
+	recordTLS(ctx, &state)
+	return resp, nil
+}
@@ -0,0 +1,318 @@
+package resolver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// unpackResponse unpacks a DNS response and deals with broken EDNS0 data.
+// Responses that fail checkResponse are rejected, options in the OPT record
+// that fail to parse are dropped (and reported) instead of failing the
+// whole message, and an OPT record carrying a nonzero EDNS version is
+// reported as BADVERS rather than a normal answer.
+func unpackResponse(respBytes []byte) (*dns.Msg, error) {
+	if err := checkResponse(respBytes); err != nil {
+		return nil, withKind(fmt.Errorf("malformed DNS response: %w", err), ErrMalformed)
+	}
+	resp := new(dns.Msg)
+	err := resp.Unpack(respBytes)
+	if err != nil {
+		cleaned, skipped, ok := dropMalformedOptions(respBytes)
+		if !ok || len(skipped) == 0 {
+			return nil, withKind(fmt.Errorf("failed to unpack DNS response: %w", err), ErrMalformed)
+		}
+		resp = new(dns.Msg)
+		if err := resp.Unpack(cleaned); err != nil {
+			return nil, withKind(fmt.Errorf("failed to unpack DNS response: %w", err), ErrMalformed)
+		}
+		slog.Warn("skipped unparseable EDNS0 options in response", "options", strings.Join(skipped, ", "))
+	}
+
+	if opt := resp.IsEdns0(); opt != nil && (opt.Version() != 0 || resp.Rcode == dns.RcodeBadVers) {
+		return nil, fmt.Errorf("server responded with BADVERS (EDNS version %d, rcode %w)",
+			opt.Version(), &RcodeError{Rcode: resp.Rcode})
+	}
+	return resp, nil
+}
+
+// dropMalformedOptions walks the wire format of a message, finds the OPT
+// records and rewrites them without the options the dns package cannot
+// parse. It returns false when the message itself cannot be walked.
+func dropMalformedOptions(msg []byte) ([]byte, []string, bool) {
+	if len(msg) < 12 {
+		return nil, nil, false
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	var ok bool
+	for i := 0; i < qdcount; i++ {
+		if off, ok = skipName(msg, off); !ok || off+4 > len(msg) {
+			return nil, nil, false
+		}
+		off += 4
+	}
+
+	out := append([]byte{}, msg[:off]...)
+	var skipped []string
+	for i := 0; i < rrcount; i++ {
+		start := off
+		if off, ok = skipName(msg, off); !ok || off+10 > len(msg) {
+			return nil, nil, false
+		}
+		rrtype := binary.BigEndian.Uint16(msg[off:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		rdata := off + 10
+		if rdata+rdlen > len(msg) {
+			return nil, nil, false
+		}
+		if rrtype != dns.TypeOPT {
+			out = append(out, msg[start:rdata+rdlen]...)
+			off = rdata + rdlen
+			continue
+		}
+
+		kept, bad := filterOptions(msg[rdata : rdata+rdlen])
+		skipped = append(skipped, bad...)
+		out = append(out, msg[start:off+8]...)
+		out = append(out, u16(uint16(len(kept)))...)
+		out = append(out, kept...)
+		off = rdata + rdlen
+	}
+	return append(out, msg[off:]...), skipped, true
+}
+
+// filterOptions returns the OPT RDATA with only the options that parse
+func filterOptions(rdata []byte) ([]byte, []string) {
+	var kept []byte
+	var bad []string
+	for off := 0; off < len(rdata); {
+		if off+4 > len(rdata) {
+			bad = append(bad, fmt.Sprintf("%d trailing bytes", len(rdata)-off))
+			break
+		}
+		code := binary.BigEndian.Uint16(rdata[off:])
+		length := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		if off+4+length > len(rdata) {
+			bad = append(bad, fmt.Sprintf("%s (truncated, length %d)", OptionName(code), length))
+			break
+		}
+		option := rdata[off : off+4+length]
+		if optionParses(option) {
+			kept = append(kept, option...)
+		} else {
+			bad = append(bad, fmt.Sprintf("%s (length %d)", OptionName(code), length))
+		}
+		off += 4 + length
+	}
+	return kept, bad
+}
+
+// OptionName names an EDNS0 option code, as in SUBNET, or OPT65001 for those
+// without a name
+func OptionName(code uint16) string {
+	names := map[uint16]string{
+		dns.EDNS0LLQ: "LLQ", dns.EDNS0UL: "UL", dns.EDNS0NSID: "NSID", dns.EDNS0DAU: "DAU",
+		dns.EDNS0DHU: "DHU", dns.EDNS0N3U: "N3U", dns.EDNS0SUBNET: "SUBNET", dns.EDNS0EXPIRE: "EXPIRE",
+		dns.EDNS0COOKIE: "COOKIE", dns.EDNS0TCPKEEPALIVE: "KEEPALIVE", dns.EDNS0PADDING: "PADDING",
+		dns.EDNS0EDE: "EDE",
+	}
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("OPT%d", code)
+}
+
+// optionParses checks a single option by unpacking a minimal message that
+// carries nothing but an OPT record with that option
+func optionParses(option []byte) bool {
+	probe := make([]byte, 12, 12+11+len(option))
+	binary.BigEndian.PutUint16(probe[10:], 1) // ARCOUNT
+	probe = append(probe, 0)                  // root owner name
+	probe = append(probe, u16(dns.TypeOPT)...)
+	probe = append(probe, u16(dns.DefaultMsgSize)...)
+	probe = append(probe, 0, 0, 0, 0)
+	probe = append(probe, u16(uint16(len(option)))...)
+	probe = append(probe, option...)
+	return new(dns.Msg).Unpack(probe) == nil
+}
+
+// skipName returns the offset just past the (possibly compressed) name at off
+func skipName(msg []byte, off int) (int, bool) {
+	for {
+		if off >= len(msg) {
+			return 0, false
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, true
+		case l&0xC0 == 0xC0:
+			if off+2 > len(msg) {
+				return 0, false
+			}
+			return off + 2, true
+		case l&0xC0 != 0:
+			return 0, false
+		}
+		off += 1 + l
+	}
+}
+
+// paddingBlockSize is the query padding block recommended by RFC 8467
+const paddingBlockSize = 128
+
+// EDNSOptions selects the EDNS0 settings of a query
+type EDNSOptions struct {
+	UDPSize uint16 // advertised payload size, UDPBufferSize when zero
+	DO      bool   // ask for DNSSEC records
+	NSID    bool   // ask the server to identify itself (RFC 5001)
+	Padding bool   // pad the query to a multiple of 128 bytes (RFC 7830, RFC 8467)
+	// Cookie is the client cookie (8 bytes), optionally followed by a
+	// server cookie from an earlier response (RFC 7873)
+	Cookie []byte
+	// Subnet is sent as EDNS Client Subnet (RFC 7871); a /0 prefix asks
+	// the resolver not to use the client's address at all
+	Subnet *net.IPNet
+}
+
+// ParseSubnet reads an ECS prefix such as 192.0.2.0/24 or 2001:db8::/56. A
+// bare address gets the prefix lengths RFC 7871 recommends for privacy,
+// /24 for IPv4 and /56 for IPv6.
+func ParseSubnet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid client subnet %q", s)
+		}
+		if ip.To4() != nil {
+			s += "/24"
+		} else {
+			s += "/56"
+		}
+	}
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client subnet %q", s)
+	}
+	return subnet, nil
+}
+
+// NewClientCookie returns a random 8 byte client cookie
+func NewClientCookie() []byte {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	return cookie
+}
+
+// Apply adds the options to the OPT record of m, creating it if needed.
+// Padding is computed last, so apply any other options before calling it.
+func (o EDNSOptions) Apply(m *dns.Msg) error {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(UDPBufferSize, false)
+		opt = m.IsEdns0()
+	}
+	if o.UDPSize != 0 {
+		opt.SetUDPSize(o.UDPSize)
+	}
+	if o.DO {
+		opt.SetDo()
+	}
+	if o.NSID {
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	}
+	if o.Cookie != nil {
+		if n := len(o.Cookie); n != 8 && (n < 16 || n > 40) {
+			return fmt.Errorf("DNS cookie must be 8 bytes, or 16 to 40 with a server cookie, got %d", n)
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(o.Cookie)})
+	}
+	if o.Subnet != nil {
+		ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, Address: o.Subnet.IP.To4()}
+		if ecs.Address == nil {
+			ecs.Family, ecs.Address = 2, o.Subnet.IP
+		}
+		ones, _ := o.Subnet.Mask.Size()
+		ecs.SourceNetmask = uint8(ones)
+		opt.Option = append(opt.Option, ecs)
+	}
+	if o.Padding {
+		pad := &dns.EDNS0_PADDING{}
+		opt.Option = append(opt.Option, pad)
+		if n := m.Len() % paddingBlockSize; n != 0 {
+			pad.Padding = make([]byte, paddingBlockSize-n)
+		}
+	}
+	return nil
+}
+
+// CheckCookie verifies that a response carrying a cookie echoes the client
+// cookie of the query, as RFC 7873 section 5.3 requires
+func CheckCookie(query, resp *dns.Msg) error {
+	sent, got := findCookie(query), findCookie(resp)
+	if sent == "" || got == "" {
+		return nil
+	}
+	if len(got) < 16 || !strings.EqualFold(got[:16], sent[:16]) {
+		return fmt.Errorf("response cookie %s does not echo the client cookie %s", got, sent[:16])
+	}
+	return nil
+}
+
+func findCookie(m *dns.Msg) string {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				return c.Cookie
+			}
+		}
+	}
+	return ""
+}
+
+// ExtendedError is an Extended DNS Error of a response (RFC 8914), which
+// says why a resolver failed or answered the way it did
+type ExtendedError struct {
+	Code      uint16
+	ExtraText string // what the server adds in its own words, may be empty
+}
+
+// Name returns the name the IANA registry gives the code, such as
+// "DNSSEC Bogus", "Stale Answer" or "Blocked"
+func (e ExtendedError) Name() string {
+	if name, ok := dns.ExtendedErrorCodeToString[e.Code]; ok {
+		return name
+	}
+	return "Unassigned"
+}
+
+// String renders e as its name and code, followed by the extra text quoted
+func (e ExtendedError) String() string {
+	if e.ExtraText == "" {
+		return fmt.Sprintf("%s (%d)", e.Name(), e.Code)
+	}
+	return fmt.Sprintf("%s (%d): %q", e.Name(), e.Code, e.ExtraText)
+}
+
+// ExtendedErrors returns the Extended DNS Errors of m in the order the
+// server sent them
+func ExtendedErrors(m *dns.Msg) []ExtendedError {
+	var errs []ExtendedError
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				errs = append(errs, ExtendedError{Code: ede.InfoCode, ExtraText: ede.ExtraText})
+			}
+		}
+	}
+	return errs
+}
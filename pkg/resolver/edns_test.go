@@ -0,0 +1,156 @@
+package resolver
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// ednsResponse packs a response to an A query for example.com with an OPT
+// record carrying an NSID and the given options, after edit
+func ednsResponse(t *testing.T, edit func(m *dns.Msg, opt *dns.OPT), options ...dns.EDNS0) []byte {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m = m.SetReply(m)
+	m.Answer = append(m.Answer, mustRR(t, "example.com. 300 IN A 192.0.2.1"))
+	m.SetEdns0(UDPBufferSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append([]dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e7331"}}, options...)
+	if edit != nil {
+		edit(m, opt)
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// patchOption rewrites the code and length of the option with the given
+// code in msg, which the dns package would refuse to pack itself
+func patchOption(t *testing.T, msg []byte, code, newCode, newLength uint16) []byte {
+	t.Helper()
+	i := bytes.Index(msg, u16(code))
+	if i < 0 {
+		t.Fatalf("option %d not in the message", code)
+	}
+	out := append([]byte{}, msg...)
+	copy(out[i:], u16(newCode))
+	copy(out[i+2:], u16(newLength))
+	return out
+}
+
+func TestUnpackResponse(t *testing.T) {
+	local := func(code uint16) dns.EDNS0 {
+		return &dns.EDNS0_LOCAL{Code: code, Data: []byte{0x00, 0x63, 0x18, 0x00}}
+	}
+	clean := ednsResponse(t, nil)
+	tests := []struct {
+		name        string
+		msg         []byte
+		wantRcode   int      // the RcodeError the response fails with, -1 for none
+		wantKind    error    // the kind of failure when not an rcode
+		wantOptions []uint16 // the options left when it succeeds
+		wantSkipped []string // from dropMalformedOptions
+	}{
+		{
+			name:        "clean",
+			msg:         clean,
+			wantRcode:   -1,
+			wantOptions: []uint16{dns.EDNS0NSID},
+		},
+		{
+			name: "BADVERS extended rcode",
+			msg: ednsResponse(t, func(m *dns.Msg, opt *dns.OPT) {
+				// The upper eight bits of the rcode go in the OPT record
+				m.Rcode = dns.RcodeBadVers
+			}),
+			wantRcode: dns.RcodeBadVers,
+		},
+		{
+			name: "EDNS version 1",
+			msg: ednsResponse(t, func(m *dns.Msg, opt *dns.OPT) {
+				opt.SetVersion(1)
+			}),
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:        "malformed SUBNET option",
+			msg:         patchOption(t, ednsResponse(t, nil, local(65001)), 65001, dns.EDNS0SUBNET, 4),
+			wantRcode:   -1,
+			wantOptions: []uint16{dns.EDNS0NSID},
+			wantSkipped: []string{"SUBNET (length 4)"},
+		},
+		{
+			name:        "option running past the OPT record",
+			msg:         patchOption(t, ednsResponse(t, nil, local(65001)), 65001, dns.EDNS0COOKIE, 20),
+			wantRcode:   -1,
+			wantOptions: []uint16{dns.EDNS0NSID},
+			wantSkipped: []string{"COOKIE (truncated, length 20)"},
+		},
+		{
+			name:      "short of a header",
+			msg:       clean[:11],
+			wantRcode: -1,
+			wantKind:  ErrMalformed,
+		},
+		{
+			name:      "truncated record",
+			msg:       clean[:len(clean)-20],
+			wantRcode: -1,
+			wantKind:  ErrMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := unpackResponse(tt.msg)
+			var rcodeErr *RcodeError
+			switch {
+			case tt.wantRcode >= 0:
+				if !errors.As(err, &rcodeErr) || rcodeErr.Rcode != tt.wantRcode || !strings.Contains(err.Error(), "BADVERS") {
+					t.Fatalf("got %v, %v, want BADVERS with rcode %s", resp, err, rcodeString(tt.wantRcode))
+				}
+				return
+			case tt.wantKind != nil:
+				if !errors.Is(err, tt.wantKind) {
+					t.Fatalf("got %v, %v, want %v", resp, err, tt.wantKind)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			var options []uint16
+			for _, o := range resp.IsEdns0().Option {
+				options = append(options, o.Option())
+			}
+			if !slices.Equal(options, tt.wantOptions) {
+				t.Errorf("options %v left, want %v", options, tt.wantOptions)
+			}
+			if len(resp.Answer) != 1 || resp.Rcode != dns.RcodeSuccess {
+				t.Errorf("got %v, want the answer kept", resp)
+			}
+
+			cleaned, skipped, ok := dropMalformedOptions(tt.msg)
+			if !ok || !slices.Equal(skipped, tt.wantSkipped) {
+				t.Errorf("dropMalformedOptions skipped %q (%v), want %q", skipped, ok, tt.wantSkipped)
+			}
+			if tt.wantSkipped == nil && !bytes.Equal(cleaned, tt.msg) {
+				t.Errorf("a clean message was rewritten")
+			}
+		})
+	}
+}
+
+func TestOptionName(t *testing.T) {
+	for code, want := range map[uint16]string{dns.EDNS0SUBNET: "SUBNET", dns.EDNS0COOKIE: "COOKIE", 65001: "OPT65001"} {
+		if got := OptionName(code); got != want {
+			t.Errorf("OptionName(%d) = %s, want %s", code, got, want)
+		}
+	}
+}
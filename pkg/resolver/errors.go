@@ -0,0 +1,96 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+)
+
+// The kinds of failure the resolvers report. The errors they return keep
+// their own text, naming the server and the step that failed, and match
+// one of these with errors.Is; the errors of the network, TLS and HTTP
+// packages underneath stay reachable with errors.As.
+var (
+	// ErrTimeout is a query that got no response in time, from the
+	// context's deadline or the transport's own
+	ErrTimeout = errors.New("timed out")
+	// ErrTruncated is a message cut short: a stream that ended inside a
+	// response, or records running past the end of one
+	ErrTruncated = errors.New("truncated message")
+	// ErrMalformed is a response that could not be parsed
+	ErrMalformed = errors.New("malformed response")
+	// ErrTLSVerify is a server certificate that did not verify, or matched
+	// none of the pins or stamp hashes
+	ErrTLSVerify = errors.New("TLS certificate verification failed")
+	// ErrMismatch is a response Checked rejected for not answering the
+	// query
+	ErrMismatch = errors.New("response does not match the query")
+	// ErrBogus is an answer that failed DNSSEC validation, from a Client
+	// made WithDNSSEC
+	ErrBogus = errors.New("DNSSEC validation failed")
+	// ErrBadRcode is an operation that failed on an error rcode, which
+	// every *RcodeError matches
+	ErrBadRcode = errors.New("error rcode")
+)
+
+// RcodeError is an operation that failed because the server answered with
+// an error rcode, such as a refused zone transfer or a BADVERS response.
+// Queries that get an error rcode are not failures: the response carries it.
+type RcodeError struct {
+	Rcode int // extended rcodes included
+}
+
+func (e *RcodeError) Error() string {
+	return rcodeString(e.Rcode)
+}
+
+// Is makes every RcodeError match ErrBadRcode, and another RcodeError with
+// the same rcode
+func (e *RcodeError) Is(target error) bool {
+	if t, ok := target.(*RcodeError); ok {
+		return t.Rcode == e.Rcode
+	}
+	return target == ErrBadRcode
+}
+
+// kindError adds a kind of failure to err, keeping its text
+type kindError struct {
+	err  error
+	kind error
+}
+
+func (e *kindError) Error() string { return e.err.Error() }
+
+func (e *kindError) Unwrap() []error { return []error{e.err, e.kind} }
+
+// withKind returns err matching kind for errors.Is as well, nil for nil
+func withKind(err, kind error) error {
+	if err == nil || errors.Is(err, kind) {
+		return err
+	}
+	return &kindError{err: err, kind: kind}
+}
+
+// typedError adds the kind of an I/O or TLS failure to err: ErrTimeout for
+// deadlines and timeouts, ErrTruncated for streams that ended early and
+// ErrTLSVerify for certificates that did not verify
+func typedError(err error) error {
+	var ne net.Error
+	var verify *tls.CertificateVerificationError
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &ne) && ne.Timeout():
+		return withKind(err, ErrTimeout)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return withKind(err, ErrTruncated)
+	case errors.As(err, &verify), errors.As(err, &unknown), errors.As(err, &hostname), errors.As(err, &invalid):
+		return withKind(err, ErrTLSVerify)
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestErrorKinds(t *testing.T) {
+	refused := fmt.Errorf("transfer of example.com. refused: %w", &RcodeError{Rcode: dns.RcodeRefused})
+	timeout := &net.OpError{Op: "read", Net: "udp", Err: context.DeadlineExceeded}
+	for _, tt := range []struct {
+		name string
+		err  error
+		is   []error
+		not  []error
+	}{
+		{"rcode", refused, []error{ErrBadRcode, &RcodeError{Rcode: dns.RcodeRefused}}, []error{ErrTimeout, &RcodeError{Rcode: dns.RcodeNameError}}},
+		{"rcode as a kind", withKind(errors.New("DDR query answered SERVFAIL"), &RcodeError{Rcode: dns.RcodeServerFailure}), []error{ErrBadRcode}, []error{ErrMalformed}},
+		{"timeout", typedError(timeout), []error{ErrTimeout, context.DeadlineExceeded}, []error{ErrBadRcode, ErrTruncated}},
+		{"truncated", typedError(fmt.Errorf("reading the response: %w", io.ErrUnexpectedEOF)), []error{ErrTruncated}, []error{ErrTimeout}},
+		{"other", typedError(errors.New("connection refused")), nil, []error{ErrTimeout, ErrBadRcode, ErrTLSVerify}},
+	} {
+		for _, kind := range tt.is {
+			if !errors.Is(tt.err, kind) {
+				t.Errorf("%s: %v does not match %v", tt.name, tt.err, kind)
+			}
+		}
+		for _, kind := range tt.not {
+			if errors.Is(tt.err, kind) {
+				t.Errorf("%s: %v matches %v", tt.name, tt.err, kind)
+			}
+		}
+	}
+
+	var rcodeErr *RcodeError
+	if !errors.As(refused, &rcodeErr) || rcodeErr.Rcode != dns.RcodeRefused || refused.Error() != "transfer of example.com. refused: REFUSED" {
+		t.Errorf("got %v, want the REFUSED rcode with the error's own text", refused)
+	}
+}
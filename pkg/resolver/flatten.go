@@ -0,0 +1,133 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxFlattenHops bounds the CNAME chains Flatten follows
+const maxFlattenHops = 8
+
+// Flatten answers A and AAAA queries without CNAME records, for clients
+// that mishandle chains: it follows the chain upstream, asking for the
+// target when the response stops short of it, and answers with the
+// addresses of the last name as records of the name asked for, living no
+// longer than any link of the chain. A chain that ends in NXDOMAIN or
+// NODATA gives that answer. Other types, and queries with the CD bit whose
+// validators need the signed chain, pass through untouched.
+type Flatten struct {
+	Upstream Resolver
+}
+
+// NewFlatten returns a Flatten in front of upstream
+func NewFlatten(upstream Resolver) *Flatten {
+	return &Flatten{Upstream: upstream}
+}
+
+// Query implements Resolver
+func (f *Flatten) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return f.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver
+func (f *Flatten) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	resp, err := f.Upstream.Exchange(ctx, m)
+	if err != nil || len(m.Question) != 1 || m.CheckingDisabled || resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return resp, err
+	}
+	q := m.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA || q.Qclass != dns.ClassINET || !hasCNAME(resp) {
+		return resp, nil
+	}
+
+	name := strings.ToLower(q.Name)
+	ttl := ^uint32(0)
+	seen := map[string]bool{}
+	last := resp
+	for {
+		// Follow the chain as far as this response goes
+		progressed := false
+		for {
+			target, cnameTTL, ok := cnameOf(last, name)
+			if !ok {
+				break
+			}
+			if seen[name] || len(seen) == maxFlattenHops {
+				// A loop, or a chain too long: answer as the upstream did
+				return resp, nil
+			}
+			seen[name] = true
+			name, ttl, progressed = target, min(ttl, cnameTTL), true
+		}
+		if !progressed && last == resp {
+			// The CNAME records are not those of the name asked for
+			return resp, nil
+		}
+		var addrs []dns.RR
+		for _, rr := range last.Answer {
+			h := rr.Header()
+			if h.Rrtype == q.Qtype && strings.EqualFold(h.Name, name) {
+				addrs = append(addrs, rr)
+			}
+		}
+		if len(addrs) > 0 || last.Rcode != dns.RcodeSuccess || !progressed {
+			return flattened(m, last, addrs, ttl), nil
+		}
+		// The response stops at a CNAME, ask for its target
+		next := m.Copy()
+		next.Id = dns.Id()
+		next.Question[0].Name = dns.Fqdn(name)
+		if last, err = f.Upstream.Exchange(ctx, next); err != nil {
+			return resp, nil
+		}
+	}
+}
+
+// flattened answers m with the addresses of the end of the chain renamed
+// to the name asked for, or with the rcode and authority section of last
+// when there are none
+func flattened(m, last *dns.Msg, addrs []dns.RR, ttl uint32) *dns.Msg {
+	out := new(dns.Msg)
+	out.SetReply(m)
+	out.Rcode = last.Rcode
+	out.RecursionAvailable = last.RecursionAvailable
+	for _, rr := range addrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = m.Question[0].Name
+		rr.Header().Ttl = min(rr.Header().Ttl, ttl)
+		out.Answer = append(out.Answer, rr)
+	}
+	if len(addrs) == 0 {
+		for _, rr := range last.Ns {
+			if rr.Header().Rrtype != dns.TypeRRSIG && rr.Header().Rrtype != dns.TypeNSEC && rr.Header().Rrtype != dns.TypeNSEC3 {
+				out.Ns = append(out.Ns, rr)
+			}
+		}
+	}
+	if opt := last.IsEdns0(); opt != nil {
+		out.Extra = append(out.Extra, opt)
+	}
+	return out
+}
+
+// hasCNAME reports whether resp answers with a CNAME record
+func hasCNAME(resp *dns.Msg) bool {
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			return true
+		}
+	}
+	return false
+}
+
+// cnameOf returns the target and TTL of the CNAME record of name in resp
+func cnameOf(resp *dns.Msg, name string) (string, uint32, bool) {
+	for _, rr := range resp.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return strings.ToLower(cname.Target), cname.Hdr.Ttl, true
+		}
+	}
+	return "", 0, false
+}
@@ -0,0 +1,115 @@
+package resolver
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fuzzSeeds are the seed corpus of FuzzUnpack: valid responses of the
+// kinds a forwarder handles, then the same cut short
+func fuzzSeeds(f *testing.F) [][]byte {
+	var seeds [][]byte
+	add := func(edit func(m *dns.Msg)) {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m = m.SetReply(m)
+		edit(m)
+		b, err := m.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, b)
+	}
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			f.Fatal(err)
+		}
+		return rr
+	}
+	add(func(m *dns.Msg) {
+		m.Answer = append(m.Answer, rr("example.com. 300 IN A 192.0.2.1"))
+	})
+	add(func(m *dns.Msg) {
+		m.Answer = append(m.Answer, rr("example.com. 60 IN CNAME www.example.net."), rr("www.example.net. 30 IN A 192.0.2.2"))
+	})
+	add(func(m *dns.Msg) {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, rr("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 86400 600"))
+	})
+	add(func(m *dns.Msg) {
+		m.Answer = append(m.Answer, rr("example.com. 300 IN A 192.0.2.1"))
+		m.SetEdns0(UDPBufferSize, true)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e7331"}, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	})
+	add(func(m *dns.Msg) {
+		m.Question[0].Qtype = dns.TypeAAAA
+		m.Answer = append(m.Answer, rr("example.com. 300 IN AAAA 2001:db8::1"))
+		m.Compress = true
+	})
+	for _, b := range seeds[:len(seeds):len(seeds)] {
+		seeds = append(seeds, b[:len(b)-3], b[:12])
+	}
+	return append(seeds, nil)
+}
+
+// FuzzUnpack runs the response handling of a forwarder on data: it is
+// unpacked as an upstream response to a query for its own question, then
+// passes the checks, CNAME flattening, DNS64, the TTL policy and the cache
+// before being packed and truncated for a client as Chain.ServeDNS does
+func FuzzUnpack(f *testing.F) {
+	// The checks warn about most inputs, which only slows the fuzzer down
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	f.Cleanup(func() { slog.SetDefault(logger) })
+
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resp, err := unpackResponse(data)
+		if err != nil {
+			return
+		}
+		query := new(dns.Msg)
+		query.Id = resp.Id
+		if len(resp.Question) > 0 {
+			query.Question = []dns.Question{resp.Question[0]}
+		} else {
+			query.SetQuestion("example.com.", dns.TypeA)
+		}
+		query.SetEdns0(UDPBufferSize, true)
+
+		var r Resolver = NewChecked(stubResolver(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+			out := resp.Copy()
+			out.Id = m.Id
+			return out, nil
+		}), true)
+		r = NewFlatten(r)
+		if dns64, err := NewDNS64(r, WellKnownNAT64Prefix); err == nil {
+			r = dns64
+		}
+		policy := NewTTLPolicy(r, time.Second, time.Hour)
+		policy.Override("example.com", time.Minute)
+		cache := NewCache(policy, 16)
+		cache.Prefetch = 0
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		out, err := cache.Exchange(ctx, query)
+		if err != nil {
+			return
+		}
+		if _, err := cache.Exchange(ctx, query); err != nil {
+			t.Fatalf("a cached response failed: %v", err)
+		}
+		out.Truncate(dns.MinMsgSize)
+		out.Pack()
+	})
+}
@@ -0,0 +1,99 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHealthFailures is how many failures in a row eject an upstream
+	DefaultHealthFailures = 3
+	// DefaultHealthRecoveries is how many successes in a row re-admit one
+	DefaultHealthRecoveries = 2
+)
+
+// Health tracks which upstreams of a Retry are answering. An upstream is
+// ejected after Failures failed attempts in a row, queries or probes, and
+// only tried once the healthy ones have failed too, until Recoveries
+// attempts in a row succeed again. Probe keeps checking the ejected ones,
+// which queries hardly reach.
+type Health struct {
+	Failures   int
+	Recoveries int
+	// OnChange, if set, is called when upstream i is ejected or re-admitted
+	OnChange func(i int, healthy bool)
+
+	mu    sync.Mutex
+	state []healthState
+}
+
+type healthState struct {
+	ejected   bool
+	failures  int // in a row
+	successes int // in a row
+}
+
+// NewHealth returns a Health with the default thresholds
+func NewHealth() *Health {
+	return &Health{Failures: DefaultHealthFailures, Recoveries: DefaultHealthRecoveries}
+}
+
+// Observe records how an attempt with upstream i went
+func (h *Health) Observe(i int, ok bool) {
+	h.mu.Lock()
+	for len(h.state) <= i {
+		h.state = append(h.state, healthState{})
+	}
+	st := &h.state[i]
+	changed := false
+	if ok {
+		st.failures = 0
+		st.successes++
+		if st.ejected && st.successes >= max(h.Recoveries, 1) {
+			st.ejected, changed = false, true
+		}
+	} else {
+		st.successes = 0
+		st.failures++
+		if !st.ejected && st.failures >= max(h.Failures, 1) {
+			st.ejected, changed = true, true
+		}
+	}
+	healthy := !st.ejected
+	h.mu.Unlock()
+	if changed && h.OnChange != nil {
+		h.OnChange(i, healthy)
+	}
+}
+
+// Healthy reports whether upstream i is in rotation
+func (h *Health) Healthy(i int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return i >= len(h.state) || !h.state[i].ejected
+}
+
+// sort moves the ejected upstreams of order to the end, keeping the order
+// within both groups
+func (h *Health) sort(order []int) []int {
+	sorted := make([]int, 0, len(order))
+	var ejected []int
+	for _, i := range order {
+		if h.Healthy(i) {
+			sorted = append(sorted, i)
+		} else {
+			ejected = append(ejected, i)
+		}
+	}
+	return append(sorted, ejected...)
+}
+
+// Probe asks every upstream for the root NS records each interval until
+// ctx is done, observing whether they answer. The upstreams must be in the
+// order the Retry using h has them.
+func (h *Health) Probe(ctx context.Context, upstreams []Resolver, interval time.Duration) {
+	probeLoop(ctx, upstreams, interval, func(i int, _ time.Duration, ok bool) {
+		h.Observe(i, ok)
+	})
+}
@@ -0,0 +1,189 @@
+package resolver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// This file implements the sender side of HPKE base mode (RFC 9180) for the
+// DHKEM(X25519, HKDF-SHA256) KEM, which is all ODoH needs.
+
+const (
+	hpkeKEMX25519     uint16 = 0x0020
+	hpkeKDFSHA256     uint16 = 0x0001
+	hpkeAEADAES128GCM uint16 = 0x0001
+	hpkeAEADAES256GCM uint16 = 0x0002
+
+	hpkeHashLen = sha256.Size
+)
+
+// hpkeContext is an established sender context
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	suiteID        []byte
+	seq            uint64
+}
+
+// hpkeKeySize returns Nk for the supported AEADs
+func hpkeKeySize(aeadID uint16) (int, error) {
+	switch aeadID {
+	case hpkeAEADAES128GCM:
+		return 16, nil
+	case hpkeAEADAES256GCM:
+		return 32, nil
+	default:
+		return 0, fmt.Errorf("unsupported HPKE AEAD 0x%04x", aeadID)
+	}
+}
+
+// hpkeSetupBaseS encapsulates a fresh shared secret to the recipient key and
+// returns the encapsulated key together with the sender context
+func hpkeSetupBaseS(kemID, kdfID, aeadID uint16, publicKey, info []byte) ([]byte, *hpkeContext, error) {
+	if kemID != hpkeKEMX25519 {
+		return nil, nil, fmt.Errorf("unsupported HPKE KEM 0x%04x", kemID)
+	}
+	if kdfID != hpkeKDFSHA256 {
+		return nil, nil, fmt.Errorf("unsupported HPKE KDF 0x%04x", kdfID)
+	}
+	if _, err := hpkeKeySize(aeadID); err != nil {
+		return nil, nil, err
+	}
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	return hpkeSetupBase(kemID, kdfID, aeadID, skE, publicKey, info)
+}
+
+// hpkeSetupBase is hpkeSetupBaseS with the ephemeral key skE given, which
+// the test vectors fix
+func hpkeSetupBase(kemID, kdfID, aeadID uint16, skE *ecdh.PrivateKey, publicKey, info []byte) ([]byte, *hpkeContext, error) {
+	pkR, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid HPKE public key: %w", err)
+	}
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("HPKE key agreement failed: %w", err)
+	}
+	enc := skE.PublicKey().Bytes()
+	ctx, err := hpkeKeySchedule(kemID, kdfID, aeadID, dh, enc, publicKey, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+// hpkeKeySchedule derives the context of either side from the result dh of
+// the key agreement, the encapsulated key and the recipient's public key
+func hpkeKeySchedule(kemID, kdfID, aeadID uint16, dh, enc, publicKey, info []byte) (*hpkeContext, error) {
+	keySize, err := hpkeKeySize(aeadID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encap: ExtractAndExpand(dh, enc || pkRm) with the KEM suite id
+	kemSuite := append([]byte("KEM"), u16(kemID)...)
+	kemContext := append(append([]byte{}, enc...), publicKey...)
+	eaePRK := labeledExtract(kemSuite, nil, "eae_prk", dh)
+	sharedSecret := labeledExpand(kemSuite, eaePRK, "shared_secret", kemContext, hpkeHashLen)
+
+	// KeySchedule in base mode, i.e. with an empty PSK and PSK id
+	suite := append([]byte("HPKE"), u16(kemID)...)
+	suite = append(suite, u16(kdfID)...)
+	suite = append(suite, u16(aeadID)...)
+	pskIDHash := labeledExtract(suite, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(suite, nil, "info_hash", info)
+	scheduleContext := append([]byte{0x00}, pskIDHash...)
+	scheduleContext = append(scheduleContext, infoHash...)
+	secret := labeledExtract(suite, sharedSecret, "secret", nil)
+
+	key := labeledExpand(suite, secret, "key", scheduleContext, keySize)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      labeledExpand(suite, secret, "base_nonce", scheduleContext, aead.NonceSize()),
+		exporterSecret: labeledExpand(suite, secret, "exp", scheduleContext, hpkeHashLen),
+		suiteID:        suite,
+	}, nil
+}
+
+// Seal encrypts the next message of the context
+func (c *hpkeContext) Seal(aad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.nextNonce(), plaintext, aad)
+}
+
+// nextNonce computes the nonce of the next message and advances the
+// sequence number
+func (c *hpkeContext) nextNonce() []byte {
+	nonce := make([]byte, len(c.baseNonce))
+	copy(nonce, c.baseNonce)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i := range seq {
+		nonce[len(nonce)-8+i] ^= seq[i]
+	}
+	c.seq++
+	return nonce
+}
+
+// Export derives a secret of the given length bound to the context
+func (c *hpkeContext) Export(exporterContext []byte, length int) []byte {
+	return labeledExpand(c.suiteID, c.exporterSecret, "sec", exporterContext, length)
+}
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, ikm...)
+	return hkdfExtract(salt, labeled)
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, length int) []byte {
+	labeled := u16(uint16(length))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, info...)
+	return hkdfExpand(prk, labeled, length)
+}
+
+// hkdfExtract is HKDF-Extract from RFC 5869 with SHA-256
+func hkdfExtract(salt, ikm []byte) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, hpkeHashLen)
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand is HKDF-Expand from RFC 5869 with SHA-256
+func hkdfExpand(prk, info []byte, length int) []byte {
+	var out, prev []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
@@ -0,0 +1,138 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// hpkeVectors are the base mode DHKEM(X25519, HKDF-SHA256), HKDF-SHA256
+// vectors of RFC 9180 appendix A.1 and A.2 for the AEADs ODoH may use. The
+// full lists of encryptions and exports are checked through digests of 1000
+// seals and exports of inputs drawn from SHAKE128, as the Go standard
+// library's crypto/hpke testdata does.
+var hpkeVectors = []struct {
+	name           string
+	aeadID         uint16
+	info           string
+	ikmE, ikmR     string
+	pkRm           string
+	enc            string
+	accEncryptions string
+	accExports     string
+}{
+	{
+		name:           "AES-128-GCM",
+		aeadID:         hpkeAEADAES128GCM,
+		info:           "4f6465206f6e2061204772656369616e2055726e",
+		ikmE:           "7268600d403fce431561aef583ee1613527cff655c1343f29812e66706df3234",
+		ikmR:           "6db9df30aa07dd42ee5e8181afdb977e538f5e1fec8a06223f33f7013e525037",
+		pkRm:           "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d",
+		enc:            "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431",
+		accEncryptions: "dcabb32ad8e8acea785275323395abd0",
+		accExports:     "45db490fc51c86ba46cca1217f66a75e",
+	},
+	{
+		name:           "AES-256-GCM",
+		aeadID:         hpkeAEADAES256GCM,
+		info:           "4f6465206f6e2061204772656369616e2055726e",
+		ikmE:           "2cd7c601cefb3d42a62b04b7a9041494c06c7843818e0ce28a8f704ae7ab20f9",
+		ikmR:           "dac33b0e9db1b59dbbea58d59a14e7b5896e9bdf98fad6891e99d1686492b9ee",
+		pkRm:           "430f4b9859665145a6b1ba274024487bd66f03a2dd577d7753c68d7d7d00c00c",
+		enc:            "6c93e09869df3402d7bf231bf540fadd35cd56be14f97178f0954db94b7fc256",
+		accEncryptions: "1702e73e1e71705faa8241022af1deea",
+		accExports:     "5cb678bf1c52afbd9afb58b8f7c1ced3",
+	},
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// deriveX25519 is DeriveKeyPair of DHKEM(X25519, HKDF-SHA256) (RFC 9180
+// section 7.1.3)
+func deriveX25519(t *testing.T, ikm []byte) *ecdh.PrivateKey {
+	t.Helper()
+	suite := append([]byte("KEM"), u16(hpkeKEMX25519)...)
+	prk := labeledExtract(suite, nil, "dkp_prk", ikm)
+	sk, err := ecdh.X25519().NewPrivateKey(labeledExpand(suite, prk, "sk", nil, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk
+}
+
+// drawInput reads a length byte and that many bytes from r
+func drawInput(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	var n [1]byte
+	if _, err := r.Read(n[:]); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, n[0])
+	if _, err := r.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHPKEVectors(t *testing.T) {
+	for _, v := range hpkeVectors {
+		t.Run(v.name, func(t *testing.T) {
+			pkR := mustHex(t, v.pkRm)
+			if got := deriveX25519(t, mustHex(t, v.ikmR)).PublicKey().Bytes(); !bytes.Equal(got, pkR) {
+				t.Fatalf("recipient key derived from ikmR is %x, want %x", got, pkR)
+			}
+
+			enc, ctx, err := hpkeSetupBase(hpkeKEMX25519, hpkeKDFSHA256, v.aeadID, deriveX25519(t, mustHex(t, v.ikmE)), pkR, mustHex(t, v.info))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mustHex(t, v.enc); !bytes.Equal(enc, want) {
+				t.Errorf("enc = %x, want %x", enc, want)
+			}
+
+			source, sink := sha3.NewShake128(), sha3.NewShake128()
+			for range 1000 {
+				aad, plaintext := drawInput(t, source), drawInput(t, source)
+				sink.Write(ctx.Seal(aad, plaintext))
+			}
+			got := make([]byte, 16)
+			sink.Read(got)
+			if want := mustHex(t, v.accEncryptions); !bytes.Equal(got, want) {
+				t.Errorf("accumulated encryptions = %x, want %x", got, want)
+			}
+
+			source, sink = sha3.NewShake128(), sha3.NewShake128()
+			for length := range 1000 {
+				sink.Write(ctx.Export(drawInput(t, source), length))
+			}
+			sink.Read(got)
+			if want := mustHex(t, v.accExports); !bytes.Equal(got, want) {
+				t.Errorf("accumulated exports = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestHPKEUnsupportedSuites(t *testing.T) {
+	pkR := deriveX25519(t, mustHex(t, hpkeVectors[0].ikmR)).PublicKey().Bytes()
+	for _, suite := range []struct{ kem, kdf, aead uint16 }{
+		{0x0010, hpkeKDFSHA256, hpkeAEADAES128GCM}, // DHKEM(P-256)
+		{hpkeKEMX25519, 0x0002, hpkeAEADAES128GCM}, // HKDF-SHA384
+		{hpkeKEMX25519, hpkeKDFSHA256, 0x0003},     // ChaCha20Poly1305
+	} {
+		if _, _, err := hpkeSetupBaseS(suite.kem, suite.kdf, suite.aead, pkR, nil); err == nil {
+			t.Errorf("suite %04x/%04x/%04x accepted, want an error", suite.kem, suite.kdf, suite.aead)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RootServers lists the IPv4 addresses of a.root-servers.net through
+// m.root-servers.net
+var RootServers = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+// RootServers6 lists the IPv6 addresses of the same root servers
+var RootServers6 = []string{
+	"2001:503:ba3e::2:30", "2801:1b8:10::b", "2001:500:2::c", "2001:500:2d::d",
+	"2001:500:a8::e", "2001:500:2f::f", "2001:500:12::d0d", "2001:500:1::53",
+	"2001:7fe::53", "2001:503:c27::2:30", "2001:7fd::1", "2001:500:9f::42",
+	"2001:dc3::35",
+}
+
+const (
+	// maxReferrals bounds the delegations followed for one name
+	maxReferrals = 32
+	// maxCNAMEs bounds the aliases followed for one query
+	maxCNAMEs = 8
+	// maxGlueDepth bounds nested lookups of nameserver addresses
+	maxGlueDepth = 4
+	// maxMinimized bounds the minimized queries for one name, after which
+	// the rest of it is sent whole, as MAX_MINIMISE_COUNT of RFC 9156 does
+	maxMinimized = 10
+)
+
+// Step describes one query made while iterating
+type Step struct {
+	Zone     string // zone the server was asked as an authority for
+	Name     string // name being resolved at this step
+	Server   string // host:port of the server queried
+	RTT      time.Duration
+	Response *dns.Msg // nil when the query failed
+	Err      error
+}
+
+// Iterator resolves names itself, starting at the root servers and
+// following referrals like a recursive resolver does, without relying on
+// any upstream recursion
+type Iterator struct {
+	// Roots are the root hints, addresses with or without a port
+	Roots []string
+	// Port is used for servers learnt from referrals
+	Port string
+	// Transport returns the resolver used to reach one server
+	Transport func(addr string) Resolver
+	// Timeout bounds each query to a single server, when nonzero
+	Timeout time.Duration
+	// OnStep, if set, is called after every query
+	OnStep func(Step)
+	// Family is 4 or 6 to only talk to servers over IPv4 or IPv6, 0 for
+	// either
+	Family int
+	// Minimize sends each server only one label more than the zone it is
+	// an authority for, with type A, until the last step, so that the
+	// servers above the one holding the name never see all of it (RFC 9156)
+	Minimize bool
+}
+
+// NewIterator returns an Iterator that starts at the root servers, over
+// IPv4 first, and uses UDP with TCP fallback on port 53 and QNAME
+// minimization
+func NewIterator() *Iterator {
+	return &Iterator{
+		Roots:     append(append([]string(nil), RootServers...), RootServers6...),
+		Port:      "53",
+		Transport: func(addr string) Resolver { return NewUDP(addr) },
+		Minimize:  true,
+	}
+}
+
+// Query implements Resolver
+func (it *Iterator) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return it.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver, resolving the question of m. The returned
+// message carries the whole CNAME chain in its answer section.
+func (it *Iterator) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return nil, fmt.Errorf("iterative resolution needs exactly one question, got %d", len(m.Question))
+	}
+	q := m.Question[0]
+	do := false
+	if opt := m.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	var chain []dns.RR
+	name := q.Name
+	for i := 0; i <= maxCNAMEs; i++ {
+		resp, err := it.resolve(ctx, name, q.Qtype, do, 0)
+		if err != nil {
+			return nil, err
+		}
+		resp.Id = m.Id
+		resp.Question = m.Question
+		resp.RecursionDesired = m.RecursionDesired
+		resp.Answer = append(chain, resp.Answer...)
+
+		target := cnameTarget(resp.Answer, name, q.Qtype)
+		if target == "" || hasRRset(resp.Answer, target, q.Qtype) {
+			return resp, nil
+		}
+		chain = resp.Answer
+		name = target
+	}
+	return nil, fmt.Errorf("more than %d CNAMEs while resolving %s", maxCNAMEs, q.Name)
+}
+
+// resolve follows referrals from the root down to the authority for name
+func (it *Iterator) resolve(ctx context.Context, name string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	zone := "."
+	servers := it.rootAddrs()
+	labels := dns.CountLabel(name)
+	// known is how many labels of name were found to exist inside zone,
+	// minimized how many minimized queries were sent
+	known, minimized := 0, 0
+	for referrals := 0; referrals < maxReferrals; {
+		qname, qt := name, qtype
+		next := max(known, dns.CountLabel(zone)) + 1
+		if it.Minimize && minimized < maxMinimized && next < labels {
+			qname, qt = lastLabels(name, next), dns.TypeA
+			minimized++
+		}
+		resp, err := it.ask(ctx, zone, servers, qname, qt, do)
+		if qname != name {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			var child string
+			if err == nil {
+				child, _ = referral(resp, zone, qname)
+			}
+			if child == "" {
+				if err == nil && resp.Rcode == dns.RcodeSuccess && cnameTarget(resp.Answer, qname, qt) == "" {
+					// qname exists without a zone cut, go one label further
+					known = next
+					continue
+				}
+				// Denials, aliases and errors are left to the full
+				// question, some servers get minimized queries wrong
+				minimized = maxMinimized
+				continue
+			}
+		} else {
+			if err != nil {
+				return nil, err
+			}
+			// An answer, an authoritative denial or an alias ends the walk
+			if len(resp.Answer) > 0 || resp.Rcode != dns.RcodeSuccess || resp.Authoritative {
+				return resp, nil
+			}
+		}
+
+		child, nsNames := referral(resp, zone, qname)
+		if child == "" {
+			return nil, fmt.Errorf("%s: servers for %s gave neither an answer nor a referral", name, zone)
+		}
+		servers = it.glueAddrs(resp, nsNames)
+		if len(servers) == 0 {
+			servers = it.lookupNameservers(ctx, nsNames, depth)
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("%s: no address for any nameserver of %s", name, child)
+		}
+		zone = child
+		referrals++
+	}
+	return nil, fmt.Errorf("%s: more than %d referrals", name, maxReferrals)
+}
+
+// lastLabels returns the name made of the last n labels of name
+func lastLabels(name string, n int) string {
+	offsets := dns.Split(name)
+	return name[offsets[len(offsets)-n]:]
+}
+
+// ask queries the servers in turn until one responds usefully
+func (it *Iterator) ask(ctx context.Context, zone string, servers []string, name string, qtype uint16, do bool) (*dns.Msg, error) {
+	m := NewQuery(name, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(UDPBufferSize, do)
+
+	var lastErr error
+	for _, addr := range servers {
+		qctx, cancel := ctx, context.CancelFunc(func() {})
+		if it.Timeout > 0 {
+			qctx, cancel = context.WithTimeout(ctx, it.Timeout)
+		}
+		start := time.Now()
+		resp, err := it.Transport(addr).Exchange(qctx, m)
+		cancel()
+		if err == nil {
+			if err = CheckResponse(m, resp); err != nil {
+				resp, err = nil, fmt.Errorf("%s: %w", addr, err)
+			} else {
+				// An authority for zone has no say over names outside it, such
+				// as the target of a CNAME into another zone
+				resp.Answer = inBailiwick(resp.Answer, zone)
+			}
+		}
+		step := Step{Zone: zone, Name: name, Server: addr, RTT: time.Since(start), Response: resp, Err: err}
+		if it.OnStep != nil {
+			it.OnStep(step)
+		}
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			lastErr = fmt.Errorf("%s answered %w", addr, &RcodeError{Rcode: resp.Rcode})
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("%s: no server for %s responded: %w", name, zone, lastErr)
+}
+
+// inBailiwick returns the records of rrs at or below zone
+func inBailiwick(rrs []dns.RR, zone string) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// referral returns the delegated zone and its nameserver names when resp
+// delegates a zone below the current one towards name
+func referral(resp *dns.Msg, zone, name string) (string, []string) {
+	var child string
+	var nsNames []string
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		// Only accept delegations that make progress, anything else is lame
+		if owner == dns.CanonicalName(zone) || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if child == "" {
+			child = owner
+		}
+		if owner == child {
+			nsNames = append(nsNames, dns.CanonicalName(ns.Ns))
+		}
+	}
+	return child, nsNames
+}
+
+// glueAddrs collects the glue addresses for nsNames from the additional section
+func (it *Iterator) glueAddrs(resp *dns.Msg, nsNames []string) []string {
+	var addrs []string
+	for _, rr := range resp.Extra {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if !it.inFamily(ip) {
+			continue
+		}
+		owner := dns.CanonicalName(rr.Header().Name)
+		for _, ns := range nsNames {
+			if ns == owner {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), it.Port))
+			}
+		}
+	}
+	return addrs
+}
+
+// lookupNameservers resolves the addresses of glueless nameservers
+func (it *Iterator) lookupNameservers(ctx context.Context, nsNames []string, depth int) []string {
+	if depth >= maxGlueDepth {
+		return nil
+	}
+	qtype := dns.TypeA
+	if it.Family == 6 {
+		qtype = dns.TypeAAAA
+	}
+	for _, ns := range nsNames {
+		resp, err := it.resolve(ctx, ns, qtype, false, depth+1)
+		if err != nil {
+			continue
+		}
+		var addrs []string
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.JoinHostPort(rr.A.String(), it.Port))
+			case *dns.AAAA:
+				addrs = append(addrs, net.JoinHostPort(rr.AAAA.String(), it.Port))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// rootAddrs returns the roots as host:port, leaving out addresses of the
+// other family
+func (it *Iterator) rootAddrs() []string {
+	var addrs []string
+	for _, root := range it.Roots {
+		addr := root
+		if _, _, err := net.SplitHostPort(root); err != nil {
+			addr = net.JoinHostPort(strings.Trim(root, "[]"), it.Port)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); ip == nil || it.inFamily(ip) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// inFamily reports whether ip is of the family the iterator is held to
+func (it *Iterator) inFamily(ip net.IP) bool {
+	switch it.Family {
+	case 4:
+		return ip.To4() != nil
+	case 6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// cnameTarget returns where name is aliased to in answer, following a chain
+// of CNAMEs, or "" when there is no alias or the query was for CNAME itself
+func cnameTarget(answer []dns.RR, name string, qtype uint16) string {
+	if qtype == dns.TypeCNAME {
+		return ""
+	}
+	target := ""
+	for i := 0; i <= len(answer); i++ {
+		found := false
+		for _, rr := range answer {
+			if c, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(c.Hdr.Name) == dns.CanonicalName(name) {
+				name, target, found = c.Target, c.Target, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return target
+}
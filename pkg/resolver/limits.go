@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxResponseQuestions bounds the question section of a response,
+	// which in practice always holds one question
+	maxResponseQuestions = 4
+	// maxResponseRecords bounds the records of a response, about what a
+	// 64 KiB message of address records holds
+	maxResponseRecords = 4096
+)
+
+// checkResponse walks the wire format of a response before it is unpacked
+// and rejects what no sane server sends: messages over 64 KiB, section
+// counts beyond the limits, records running past the end, and names with
+// labels over 63 bytes, over 255 bytes in all or compression pointers that
+// do not point back at an earlier name. A message may end before the
+// records its header counts, as truncated ones do.
+func checkResponse(msg []byte) error {
+	if len(msg) > dns.MaxMsgSize {
+		return fmt.Errorf("response of %d bytes is over the %d bytes of a DNS message", len(msg), dns.MaxMsgSize)
+	}
+	if len(msg) < 12 {
+		return fmt.Errorf("response of %d bytes is shorter than a DNS header", len(msg))
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	if qdcount > maxResponseQuestions {
+		return fmt.Errorf("response has %d questions", qdcount)
+	}
+	if rrcount > maxResponseRecords {
+		return fmt.Errorf("response of %d bytes claims %d records", len(msg), rrcount)
+	}
+
+	off := 12
+	var err error
+	for i := 0; i < qdcount && off < len(msg); i++ {
+		if off, err = checkName(msg, off); err != nil {
+			return fmt.Errorf("question %d: %w", i+1, err)
+		}
+		if off += 4; off > len(msg) {
+			return withKind(fmt.Errorf("question %d is truncated", i+1), ErrTruncated)
+		}
+	}
+	for i := 0; i < rrcount && off < len(msg); i++ {
+		if off, err = checkName(msg, off); err != nil {
+			return fmt.Errorf("record %d: %w", i+1, err)
+		}
+		if off+10 > len(msg) {
+			return withKind(fmt.Errorf("record %d is truncated", i+1), ErrTruncated)
+		}
+		if off += 10 + int(binary.BigEndian.Uint16(msg[off+8:])); off > len(msg) {
+			return withKind(fmt.Errorf("record %d has data past the end of the message", i+1), ErrTruncated)
+		}
+	}
+	return nil
+}
+
+// checkName checks the name at off, following its compression pointers,
+// and returns the offset just past it
+func checkName(msg []byte, off int) (int, error) {
+	end := -1 // where the name ends in place, once a pointer was followed
+	length := 1
+	for {
+		if off >= len(msg) {
+			return 0, fmt.Errorf("name runs past the end of the message")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return end, nil
+		case l&0xC0 == 0xC0:
+			if off+2 > len(msg) {
+				return 0, fmt.Errorf("name runs past the end of the message")
+			}
+			target := int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			if target >= off {
+				return 0, fmt.Errorf("compression pointer at %d does not point back", off)
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = target
+			continue
+		case l > 63:
+			return 0, fmt.Errorf("label of length byte %#x at %d", l, off)
+		}
+		if length += 1 + l; length > 255 {
+			return 0, fmt.Errorf("name longer than 255 bytes")
+		}
+		off += 1 + l
+	}
+}
@@ -0,0 +1,65 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+type traceIDKey struct{}
+
+// WithTraceID returns a context whose log records carry id, so that the
+// records of one query can be followed among many concurrent ones
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// TraceID returns the trace ID attached to ctx, or ""
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// NewTraceID returns a random 16 hex digit trace ID
+func NewTraceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewLogHandler wraps h so that records logged with a context holding a
+// trace ID get a trace_id attribute
+func NewLogHandler(h slog.Handler) slog.Handler {
+	return traceHandler{h}
+}
+
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := TraceID(ctx); id != "" {
+		r.AddAttrs(slog.String("trace_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
+
+// logWire logs a message as it goes over conn, nil when the transport does
+// not expose it, in hex when debug logging is enabled, and hands it to the
+// wire tap of ctx
+func logWire(ctx context.Context, msg, transport, server string, conn endpoints, b []byte) {
+	tapWire(ctx, transport, server, conn, b)
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	slog.DebugContext(ctx, msg, "transport", transport, "server", server, "size", len(b), "hex", hex.EncodeToString(b))
+}
@@ -0,0 +1,236 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// MDNSAddr and MDNSAddr6 are the multicast DNS groups of RFC 6762
+	MDNSAddr  = "224.0.0.251:5353"
+	MDNSAddr6 = "[ff02::fb]:5353"
+	// DefaultMDNSWindow is how long MDNS collects responses by default.
+	// Responders delay shared answers by up to 120 ms, and a busy link
+	// needs more than that.
+	DefaultMDNSWindow = time.Second
+
+	// qclassUnicast is the top bit of the question class, which asks for a
+	// unicast response (QU), and cacheFlush the same bit in the class of a
+	// record, which marks the record set as complete
+	qclassUnicast = 1 << 15
+	cacheFlush    = 1 << 15
+)
+
+// MDNS queries .local names by multicast DNS (RFC 6762), for discovering
+// the devices on the local link. Every device that has an answer responds,
+// so Exchange collects responses for Window and merges them into one.
+// Queries leave from a port of their own rather than 5353, as one-shot
+// queries that responders answer only to the querier.
+type MDNS struct {
+	Addr string // host:port, MDNSAddr or MDNSAddr6 for the link
+	// Dialer picks the link: its Interface sends the queries out of that
+	// interface, which IPv6 needs unless Addr carries a zone, and Source
+	// the address they leave from. Its Proxy and Bootstrap do not apply.
+	Dialer *Dialer
+	Window time.Duration // how long to wait for responses, DefaultMDNSWindow when 0
+	// Unicast sets the unicast-response bit (QU) in the question, asking
+	// responders that would answer to the group to answer the querier
+	Unicast bool
+}
+
+// NewMDNS returns an MDNS resolver for the group at the host:port address
+func NewMDNS(addr string) *MDNS {
+	return &MDNS{Addr: addr}
+}
+
+// Query implements Resolver. mDNS queries ask for no recursion.
+func (r *MDNS) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := NewQuery(name, qtype)
+	m.RecursionDesired = false
+	return r.Exchange(ctx, m)
+}
+
+// Exchange implements Resolver. The response is authoritative and carries
+// the records of every responder that answered within Window, with the
+// cache-flush bit cleared from their class. When none answered, the query
+// fails like one that timed out.
+func (r *MDNS) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	sent := m.Copy()
+	sent.Id = dns.Id()
+	if r.Unicast {
+		for i := range sent.Question {
+			sent.Question[i].Qclass |= qclassUnicast
+		}
+	}
+	msgBytes, err := packQuery(sent, false)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	group, err := r.groupAddr()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := r.listen(group)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	window := r.Window
+	if window == 0 {
+		window = DefaultMDNSWindow
+	}
+	deadline := time.Now().Add(window)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	defer bindContext(ctx, conn)()
+	conn.SetDeadline(deadline)
+
+	logWire(ctx, "sending query", "mdns", r.Addr, packetEndpoints{conn.LocalAddr(), group}, msgBytes)
+	if _, err := conn.WriteTo(msgBytes, group); err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to send mDNS query: %w", err))
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	resp.RecursionDesired = m.RecursionDesired
+	resp.Authoritative = true
+	responders, received := 0, 0
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, contextError(ctx, fmt.Errorf("failed to read mDNS response: %w", err))
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				return nil, fmt.Errorf("failed to read mDNS response: %w", err)
+			}
+			break
+		}
+		logWire(ctx, "received response", "mdns", from.String(), packetEndpoints{conn.LocalAddr(), from}, buf[:n])
+		part := new(dns.Msg)
+		if err := checkResponse(buf[:n]); err != nil {
+			slog.WarnContext(ctx, "ignored a malformed mDNS response", "responder", from, "err", err)
+			continue
+		}
+		if err := part.Unpack(buf[:n]); err != nil {
+			slog.WarnContext(ctx, "ignored an invalid mDNS response", "responder", from, "err", err)
+			continue
+		}
+		// Responders zero the ID of multicast answers (RFC 6762 section 18.1)
+		if !part.Response || part.Opcode != dns.OpcodeQuery || (part.Id != sent.Id && part.Id != 0) {
+			continue
+		}
+		responders++
+		received += n
+		slog.DebugContext(ctx, "mDNS response", "responder", from, "answers", len(part.Answer))
+		resp.Answer = mergeMDNS(resp.Answer, part.Answer)
+		resp.Ns = mergeMDNS(resp.Ns, part.Ns)
+		resp.Extra = mergeMDNS(resp.Extra, part.Extra)
+	}
+	if responders == 0 {
+		return nil, withKind(fmt.Errorf("no mDNS responder answered within %v: %w", window, context.DeadlineExceeded), ErrTimeout)
+	}
+	recordTrace(ctx, "mdns", r.Addr, start, len(msgBytes), received)
+	return resp, nil
+}
+
+// groupAddr resolves Addr, giving a link-local group the zone of the
+// interface of Dialer when it has none
+func (r *MDNS) groupAddr() (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp", r.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mDNS address %q: %w", r.Addr, err)
+	}
+	if addr.Zone == "" && addr.IP.To4() == nil && addr.IP.IsLinkLocalMulticast() && r.Dialer != nil {
+		addr.Zone = r.Dialer.Interface
+	}
+	return addr, nil
+}
+
+// listen opens the socket that sends the query to group and receives the
+// responses, which come from the address of each responder, sending out of
+// the interface of Dialer with the TTL of 255 that RFC 6762 asks for
+func (r *MDNS) listen(group *net.UDPAddr) (*net.UDPConn, error) {
+	local := &net.UDPAddr{}
+	var ifi *net.Interface
+	if r.Dialer != nil {
+		local.IP = r.Dialer.Source
+		if r.Dialer.Interface != "" {
+			var err error
+			if ifi, err = net.InterfaceByName(r.Dialer.Interface); err != nil {
+				return nil, fmt.Errorf("invalid interface %q: %w", r.Dialer.Interface, err)
+			}
+		}
+	}
+	network := "udp4"
+	if group.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, local)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the mDNS socket: %w", err)
+	}
+	if !group.IP.IsMulticast() {
+		return conn, nil
+	}
+	if network == "udp4" {
+		pc := ipv4.NewPacketConn(conn)
+		err = pc.SetMulticastTTL(255)
+		if err == nil && ifi != nil {
+			err = pc.SetMulticastInterface(ifi)
+		}
+	} else {
+		pc := ipv6.NewPacketConn(conn)
+		err = pc.SetMulticastHopLimit(255)
+		if err == nil && ifi != nil {
+			err = pc.SetMulticastInterface(ifi)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set up the mDNS socket: %w", err)
+	}
+	return conn, nil
+}
+
+// mergeMDNS adds the records of rrs missing from section, clearing the
+// cache-flush bit of their class on the way
+func mergeMDNS(section, rrs []dns.RR) []dns.RR {
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.OPT); ok {
+			continue
+		}
+		rr.Header().Class &^= cacheFlush
+		duplicate := false
+		for _, have := range section {
+			if dns.IsDuplicate(have, rr) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			section = append(section, rr)
+		}
+	}
+	return section
+}
+
+// packetEndpoints names the ends of one datagram of an unconnected socket
+// for the wire tap
+type packetEndpoints struct {
+	local, remote net.Addr
+}
+
+func (e packetEndpoints) LocalAddr() net.Addr  { return e.local }
+func (e packetEndpoints) RemoteAddr() net.Addr { return e.remote }
@@ -0,0 +1,321 @@
+package resolver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Denial explains how the NSEC or NSEC3 records of a negative response
+// prove it
+type Denial struct {
+	Kind   string   // NXDOMAIN or NODATA
+	Type   string   // NSEC or NSEC3, empty when there are neither
+	Steps  []string // what each record proves, in the order of the proof
+	OptOut bool     // an NSEC3 opt-out span covers the name, unsigned delegations may hide in it
+	Err    error    // the missing part of the proof, nil when it is complete
+}
+
+// ExplainDenial describes the denial of existence in resp, or returns nil
+// when resp is not a negative answer. It checks the logic of the proof but
+// not the signatures, which Validate does.
+func ExplainDenial(resp *dns.Msg) *Denial {
+	if len(resp.Question) != 1 || len(resp.Answer) > 0 || resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil
+	}
+	return explainDenial(resp.Question[0], resp.Rcode, resp.Ns)
+}
+
+// checkDenial verifies that the NSEC or NSEC3 records in section prove the
+// negative answer for q: NODATA when rcode is NOERROR, otherwise NXDOMAIN.
+// The records' signatures must already have been verified.
+func checkDenial(q dns.Question, rcode int, section []dns.RR) error {
+	return explainDenial(q, rcode, section).Err
+}
+
+func explainDenial(q dns.Question, rcode int, section []dns.RR) *Denial {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range section {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	name := dns.CanonicalName(q.Name)
+	d := &Denial{Kind: "NXDOMAIN"}
+	if rcode == dns.RcodeSuccess {
+		d.Kind = "NODATA"
+	}
+	step := func(format string, args ...any) {
+		d.Steps = append(d.Steps, fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case len(nsecs) > 0:
+		d.Type = "NSEC"
+		if rcode == dns.RcodeSuccess {
+			for _, n := range nsecs {
+				if dns.CanonicalName(n.Hdr.Name) == name {
+					step("the NSEC at %s lists %s, not %s", n.Hdr.Name, typeList(n.TypeBitMap), typeName(q.Qtype))
+					d.Err = checkTypeAbsent(n.TypeBitMap, q.Qtype, "NSEC at "+n.Hdr.Name)
+					return d
+				}
+			}
+			d.Err = fmt.Errorf("no NSEC record proves %s for %s", d.Kind, q.Name)
+			return d
+		}
+		cover := nsecCovering(nsecs, name)
+		if cover == nil {
+			d.Err = fmt.Errorf("no NSEC record proves %s for %s", d.Kind, q.Name)
+			return d
+		}
+		step("the NSEC from %s to %s spans %s, so it does not exist", cover.Hdr.Name, cover.NextDomain, q.Name)
+		ce := nsecClosestEncloser(name, cover)
+		step("%s is the closest existing ancestor", ce)
+		wild := nsecCovering(nsecs, "*."+ce)
+		if wild == nil {
+			d.Err = fmt.Errorf("no NSEC record proves that *.%s does not exist", ce)
+			return d
+		}
+		step("the NSEC from %s to %s spans *.%s, so no wildcard answers either", wild.Hdr.Name, wild.NextDomain, ce)
+		return d
+
+	case len(nsec3s) > 0:
+		d.Type = "NSEC3"
+		p := nsec3s[0]
+		salt := p.Salt
+		if salt == "" {
+			salt = "-"
+		}
+		step("names are hashed with %s, %d extra iterations and salt %s", nsec3HashName(p.Hash), p.Iterations, salt)
+		if rcode == dns.RcodeSuccess {
+			for _, n := range nsec3s {
+				if n.Match(name) {
+					step("the NSEC3 %s matches %s and lists %s, not %s", nsec3Owner(n), q.Name, typeList(n.TypeBitMap), typeName(q.Qtype))
+					d.Err = checkTypeAbsent(n.TypeBitMap, q.Qtype, "NSEC3 for "+q.Name)
+					return d
+				}
+			}
+			// Only DS queries may be answered by an opt-out span (RFC 5155 section 8.6)
+			if q.Qtype == dns.TypeDS {
+				if ce, next, err := nsec3ClosestEncloser(nsec3s, name); err == nil && next.Flags&1 == 1 {
+					step("%s is the closest existing ancestor", ce)
+					step("the opt-out NSEC3 from %s to %s covers %s, which may be an unsigned delegation", nsec3Owner(next), strings.ToLower(next.NextDomain), nextCloser(name, ce))
+					d.OptOut = true
+					return d
+				}
+			}
+			d.Err = fmt.Errorf("no NSEC3 record proves %s for %s", d.Kind, q.Name)
+			return d
+		}
+		ce, cover, err := nsec3ClosestEncloser(nsec3s, name)
+		if err != nil {
+			d.Err = err
+			return d
+		}
+		for _, n := range nsec3s {
+			if n.Match(ce) {
+				step("the NSEC3 %s matches %s, the closest existing ancestor", nsec3Owner(n), ce)
+				break
+			}
+		}
+		next := nextCloser(name, ce)
+		step("the NSEC3 from %s to %s covers %s, the next closer name hashing to %s, so it does not exist", nsec3Owner(cover), strings.ToLower(cover.NextDomain), next, strings.ToLower(dns.HashName(next, cover.Hash, cover.Iterations, cover.Salt)))
+		if cover.Flags&1 == 1 {
+			step("that NSEC3 has opt-out set, unsigned delegations may exist in its span")
+			d.OptOut = true
+		}
+		wild := nsec3Covering(nsec3s, "*."+ce)
+		if wild == nil {
+			d.Err = fmt.Errorf("no NSEC3 record proves that *.%s does not exist", ce)
+			return d
+		}
+		step("the NSEC3 from %s to %s covers *.%s, so no wildcard answers either", nsec3Owner(wild), strings.ToLower(wild.NextDomain), ce)
+		return d
+	}
+	d.Err = fmt.Errorf("no NSEC or NSEC3 records prove %s for %s", d.Kind, q.Name)
+	return d
+}
+
+// nsec3Owner returns the hash an NSEC3 record is owned by
+func nsec3Owner(n *dns.NSEC3) string {
+	return strings.ToLower(dns.SplitDomainName(n.Hdr.Name)[0])
+}
+
+func nsec3HashName(alg uint8) string {
+	if alg == dns.SHA1 {
+		return "SHA-1"
+	}
+	return fmt.Sprintf("hash algorithm %d", alg)
+}
+
+func typeList(types []uint16) string {
+	if len(types) == 0 {
+		return "no types"
+	}
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = typeName(t)
+	}
+	return strings.Join(names, " ")
+}
+
+func typeName(t uint16) string {
+	if name, ok := dns.TypeToString[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// checkWildcardProof verifies that an answer synthesised from the wildcard
+// at closest encloser ce comes with proof that name itself does not exist
+func checkWildcardProof(name, ce string, section []dns.RR) error {
+	name = dns.CanonicalName(name)
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range section {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	if nsecCovering(nsecs, name) != nil {
+		return nil
+	}
+	if next := nextCloser(name, ce); next != "" && nsec3Covering(nsec3s, next) != nil {
+		return nil
+	}
+	return fmt.Errorf("wildcard answer for %s lacks proof that the name does not exist", name)
+}
+
+// isZoneCut reports whether the denial in section shows an unsigned
+// delegation at name: a matching NSEC or NSEC3 with NS but without SOA and
+// DS, or an NSEC3 opt-out span covering it
+func isZoneCut(section []dns.RR, name string) bool {
+	name = dns.CanonicalName(name)
+	var nsec3s []*dns.NSEC3
+	for _, rr := range section {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(rr.Hdr.Name) == name {
+				return delegationBitmap(rr.TypeBitMap)
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				return delegationBitmap(rr.TypeBitMap)
+			}
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	if len(nsec3s) > 0 {
+		if _, next, err := nsec3ClosestEncloser(nsec3s, name); err == nil && next.Flags&1 == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func delegationBitmap(types []uint16) bool {
+	return hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA) && !hasType(types, dns.TypeDS)
+}
+
+// checkTypeAbsent passes when neither qtype nor a CNAME is in the bitmap
+func checkTypeAbsent(types []uint16, qtype uint16, desc string) error {
+	if hasType(types, qtype) {
+		return fmt.Errorf("%s lists %s, so it cannot prove NODATA", desc, dns.TypeToString[qtype])
+	}
+	if qtype != dns.TypeCNAME && hasType(types, dns.TypeCNAME) {
+		return fmt.Errorf("%s lists CNAME, so it cannot prove NODATA", desc)
+	}
+	return nil
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovering returns the NSEC whose span contains name, if any
+func nsecCovering(nsecs []*dns.NSEC, name string) *dns.NSEC {
+	for _, n := range nsecs {
+		owner, next := dns.CanonicalName(n.Hdr.Name), dns.CanonicalName(n.NextDomain)
+		if canonicalLess(owner, name) && (canonicalLess(name, next) || !canonicalLess(owner, next)) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsecClosestEncloser returns the longest ancestor of name that the NSEC
+// covering it proves to exist
+func nsecClosestEncloser(name string, cover *dns.NSEC) string {
+	owner, next := dns.CanonicalName(cover.Hdr.Name), dns.CanonicalName(cover.NextDomain)
+	for ce := parentName(name); ; ce = parentName(ce) {
+		if dns.IsSubDomain(ce, owner) || dns.IsSubDomain(ce, next) || ce == "." {
+			return ce
+		}
+	}
+}
+
+// nsec3ClosestEncloser finds the closest encloser proof of RFC 5155 section
+// 7.2.1: a matching NSEC3 for an ancestor and a covering one for the next
+// closer name. The covering record is returned for opt-out checks.
+func nsec3ClosestEncloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3, error) {
+	for ce := parentName(name); ; ce = parentName(ce) {
+		for _, n := range nsec3s {
+			if !n.Match(ce) {
+				continue
+			}
+			next := nextCloser(name, ce)
+			if cover := nsec3Covering(nsec3s, next); cover != nil {
+				return ce, cover, nil
+			}
+			return "", nil, fmt.Errorf("no NSEC3 record covers %s, the next closer name to %s", next, name)
+		}
+		if ce == "." {
+			return "", nil, fmt.Errorf("no NSEC3 closest encloser proof for %s", name)
+		}
+	}
+}
+
+func nsec3Covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, n := range nsec3s {
+		if n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nextCloser returns the ancestor of name one label longer than ce
+func nextCloser(name, ce string) string {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(ce) + 1
+	if n > len(labels) {
+		return ""
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// canonicalLess orders names as in RFC 4034 section 6.1, comparing labels
+// from the right
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
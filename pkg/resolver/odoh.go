@@ -0,0 +1,368 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Oblivious DoH (RFC 9230): the query is encrypted to the target's HPKE key
+// and sent through a relay, so the relay sees the client but not the query
+// while the target sees the query but not the client.
+
+const (
+	odohContentType  = "application/oblivious-dns-message"
+	odohConfigPath   = "/.well-known/odohconfigs"
+	odohVersion      = 0x0001
+	odohQueryType    = 0x01
+	odohResponseType = 0x02
+
+	// odohConfigLifetime is how long a target config is reused when the
+	// target does not set a Cache-Control max-age
+	odohConfigLifetime = time.Hour
+)
+
+// odohConfig is a single ObliviousDoHConfigContents entry published by a target
+type odohConfig struct {
+	KEMID     uint16
+	KDFID     uint16
+	AEADID    uint16
+	PublicKey []byte
+
+	contents []byte // serialized contents, the input for the key id
+}
+
+// keyID identifies the config to the target:
+// Expand(Extract("", config), "odoh key id", Nh)
+func (c odohConfig) keyID() []byte {
+	return hkdfExpand(hkdfExtract(nil, c.contents), []byte("odoh key id"), hpkeHashLen)
+}
+
+// parseODoHConfigs decodes an ObliviousDoHConfigs structure, skipping
+// configs with unknown versions as the RFC requires
+func parseODoHConfigs(b []byte) ([]odohConfig, error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return nil, fmt.Errorf("malformed ODoH config list")
+	}
+	b = b[2:]
+
+	var configs []odohConfig
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated ODoH config")
+		}
+		version := binary.BigEndian.Uint16(b)
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+length {
+			return nil, fmt.Errorf("truncated ODoH config")
+		}
+		contents := b[4 : 4+length]
+		b = b[4+length:]
+		if version != odohVersion {
+			continue
+		}
+		if len(contents) < 8 {
+			return nil, fmt.Errorf("truncated ODoH config contents")
+		}
+		keyLen := int(binary.BigEndian.Uint16(contents[6:]))
+		if len(contents) != 8+keyLen {
+			return nil, fmt.Errorf("malformed ODoH config public key")
+		}
+		configs = append(configs, odohConfig{
+			KEMID:     binary.BigEndian.Uint16(contents),
+			KDFID:     binary.BigEndian.Uint16(contents[2:]),
+			AEADID:    binary.BigEndian.Uint16(contents[4:]),
+			PublicKey: contents[8:],
+			contents:  contents,
+		})
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no supported ODoH config version")
+	}
+	return configs, nil
+}
+
+// targetConfig returns the target's config, fetching it when there is no
+// cached one, it has expired or refresh is set. Reusing it keeps the target
+// from seeing a config request from the client's own address right before
+// each relayed query.
+func (r *ODoH) targetConfig(ctx context.Context, refresh bool) (odohConfig, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.config != nil && !refresh && time.Now().Before(r.configExpires) {
+		return *r.config, nil
+	}
+	config, lifetime, err := r.fetchConfig(ctx)
+	if err != nil {
+		return odohConfig{}, err
+	}
+	r.config, r.configExpires = &config, time.Now().Add(lifetime)
+	return config, nil
+}
+
+// fetchConfig retrieves the target's configs from its well-known endpoint
+// and returns the first one we can use, with how long it may be cached
+func (r *ODoH) fetchConfig(ctx context.Context) (odohConfig, time.Duration, error) {
+	target, err := url.Parse(r.TargetURL)
+	if err != nil {
+		return odohConfig{}, 0, fmt.Errorf("invalid ODoH target URL: %w", err)
+	}
+	configURL := url.URL{Scheme: target.Scheme, Host: target.Host, Path: odohConfigPath}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL.String(), nil)
+	if err != nil {
+		return odohConfig{}, 0, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return odohConfig{}, 0, typedError(fmt.Errorf("failed to fetch ODoH config: %w", err))
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return odohConfig{}, 0, typedError(fmt.Errorf("failed to read ODoH config: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return odohConfig{}, 0, fmt.Errorf("ODoH config endpoint returned non-OK status: %s", resp.Status)
+	}
+
+	configs, err := parseODoHConfigs(body)
+	if err != nil {
+		return odohConfig{}, 0, err
+	}
+	for _, c := range configs {
+		if _, err := hpkeKeySize(c.AEADID); err == nil && c.KEMID == hpkeKEMX25519 && c.KDFID == hpkeKDFSHA256 {
+			return c, configMaxAge(resp.Header.Get("Cache-Control")), nil
+		}
+	}
+	return odohConfig{}, 0, fmt.Errorf("target offers no supported HPKE suite")
+}
+
+// configMaxAge returns the max-age of a Cache-Control header, or
+// odohConfigLifetime when there is none
+func configMaxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return odohConfigLifetime
+}
+
+// odohQuery holds the state needed to decrypt the answer to one query
+type odohQuery struct {
+	config    odohConfig
+	context   *hpkeContext
+	plaintext []byte
+}
+
+// encryptODoHQuery builds the ObliviousDoHMessage for a packed DNS query
+func encryptODoHQuery(config odohConfig, msgBytes []byte) ([]byte, *odohQuery, error) {
+	// ObliviousDoHMessagePlaintext: dns_message<1..2^16-1>, padding<0..2^16-1>
+	plaintext := append(u16(uint16(len(msgBytes))), msgBytes...)
+	plaintext = append(plaintext, 0, 0)
+
+	enc, ctx, err := hpkeSetupBaseS(config.KEMID, config.KDFID, config.AEADID, config.PublicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID := config.keyID()
+	aad := append([]byte{odohQueryType}, u16(uint16(len(keyID)))...)
+	aad = append(aad, keyID...)
+	encrypted := append(enc, ctx.Seal(aad, plaintext)...)
+
+	var buf bytes.Buffer
+	buf.Write(aad)
+	buf.Write(u16(uint16(len(encrypted))))
+	buf.Write(encrypted)
+	return buf.Bytes(), &odohQuery{config: config, context: ctx, plaintext: plaintext}, nil
+}
+
+// decrypt opens an ObliviousDoHMessage response and returns the DNS message
+func (q *odohQuery) decrypt(b []byte) ([]byte, error) {
+	if len(b) < 3 || b[0] != odohResponseType {
+		return nil, fmt.Errorf("not an ODoH response message")
+	}
+	nonceLen := int(binary.BigEndian.Uint16(b[1:]))
+	if len(b) < 3+nonceLen+2 {
+		return nil, withKind(fmt.Errorf("truncated ODoH response"), ErrTruncated)
+	}
+	respNonce := b[3 : 3+nonceLen]
+	ctLen := int(binary.BigEndian.Uint16(b[3+nonceLen:]))
+	ct := b[3+nonceLen+2:]
+	if len(ct) != ctLen {
+		return nil, withKind(fmt.Errorf("truncated ODoH response"), ErrTruncated)
+	}
+
+	keySize, err := hpkeKeySize(q.config.AEADID)
+	if err != nil {
+		return nil, err
+	}
+	secret := q.context.Export([]byte("odoh response"), keySize)
+	salt := append(append([]byte{}, q.plaintext...), u16(uint16(nonceLen))...)
+	salt = append(salt, respNonce...)
+	prk := hkdfExtract(salt, secret)
+	key := hkdfExpand(prk, []byte("odoh key"), keySize)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := hkdfExpand(prk, []byte("odoh nonce"), aead.NonceSize())
+	aad := append([]byte{odohResponseType}, u16(uint16(nonceLen))...)
+	aad = append(aad, respNonce...)
+
+	plaintext, err := aead.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt ODoH response: %w", err)
+	}
+	if len(plaintext) < 2 || len(plaintext) < 2+int(binary.BigEndian.Uint16(plaintext)) {
+		return nil, fmt.Errorf("malformed ODoH response plaintext")
+	}
+	return plaintext[2 : 2+int(binary.BigEndian.Uint16(plaintext))], nil
+}
+
+// ODoH resolves over Oblivious DoH. Queries are sent through the relay when
+// one is configured, otherwise directly to the target, which is useful for
+// testing but offers no privacy benefit over plain DoH.
+type ODoH struct {
+	TargetURL string
+	RelayURL  string
+	// Dialer, when set, opens the connections to the relay or target
+	Dialer *Dialer
+
+	client        *http.Client
+	mu            sync.Mutex
+	config        *odohConfig
+	configExpires time.Time
+}
+
+// NewODoH returns an ODoH resolver for the target, relayed by relayURL when
+// it is non-empty
+func NewODoH(targetURL, relayURL string) *ODoH {
+	r := &ODoH{TargetURL: targetURL, RelayURL: relayURL}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return r.Dialer.DialContext(ctx, network, addr)
+	}
+	r.client = &http.Client{Transport: transport}
+	return r
+}
+
+// Query implements Resolver
+func (r *ODoH) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver
+func (r *ODoH) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// The ID is covered by the encryption but RFC 9230 still asks for zero
+	msgBytes, err := packQuery(m, true)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := r.targetConfig(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	logWire(ctx, "sending query", "odoh", r.TargetURL, nil, msgBytes)
+	start := time.Now()
+	plain, err := r.send(ctx, config, msgBytes)
+	if err == errODoHKeyRejected {
+		// The target rotated its key since we fetched the config
+		if config, err = r.targetConfig(ctx, true); err != nil {
+			return nil, err
+		}
+		start = time.Now()
+		plain, err = r.send(ctx, config, msgBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logWire(ctx, "received response", "odoh", r.TargetURL, nil, plain)
+
+	resp, err := unpackResponse(plain)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = m.Id
+	recordTrace(ctx, "odoh", r.TargetURL, start, len(msgBytes), len(plain))
+	return resp, nil
+}
+
+// errODoHKeyRejected is returned by send when the target does not know the
+// key the query was encrypted to
+var errODoHKeyRejected = fmt.Errorf("ODoH target rejected the key")
+
+// send encrypts the packed query to config, posts it through the relay, if
+// any, and returns the decrypted response
+func (r *ODoH) send(ctx context.Context, config odohConfig, msgBytes []byte) ([]byte, error) {
+	body, query, err := encryptODoHQuery(config, msgBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt ODoH query: %w", err)
+	}
+
+	postURL := r.TargetURL
+	if r.RelayURL != "" {
+		target, err := url.Parse(r.TargetURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ODoH target URL: %w", err)
+		}
+		relay, err := url.Parse(r.RelayURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ODoH relay URL: %w", err)
+		}
+		params := relay.Query()
+		params.Set("targethost", target.Host)
+		params.Set("targetpath", target.Path)
+		relay.RawQuery = params.Encode()
+		postURL = relay.String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, postURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", odohContentType)
+	req.Header.Set("Accept", odohContentType)
+
+	httpResp, err := r.client.Do(req)
+	if err != nil {
+		return nil, typedError(fmt.Errorf("HTTP request failed: %w", err))
+	}
+	defer httpResp.Body.Close()
+
+	respBytes, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize*4))
+	if err != nil {
+		return nil, typedError(fmt.Errorf("failed to read ODoH response: %w", err))
+	}
+	// RFC 9230 section 4.3: 401 when the key ID is not the target's
+	if httpResp.StatusCode == http.StatusUnauthorized {
+		return nil, errODoHKeyRejected
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ODoH server returned non-OK status: %s, body: %s", httpResp.Status, string(respBytes))
+	}
+	return query.decrypt(respBytes)
+}
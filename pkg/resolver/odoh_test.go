@@ -0,0 +1,282 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/hkdf"
+)
+
+// odohTarget is an ODoH target (RFC 9230 section 6) written against the
+// RFC with an independent HKDF, to check the client side against
+type odohTarget struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	key      *ecdh.PrivateKey
+	contents []byte // ObliviousDoHConfigContents of key
+	queries  int
+	relayed  int
+}
+
+func newODoHTarget(t *testing.T) *odohTarget {
+	target := &odohTarget{t: t}
+	target.rotate()
+	return target
+}
+
+// rotate gives the target a new key, which the clients' configs no longer
+// match
+func (o *odohTarget) rotate() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	o.key = key
+	pk := key.PublicKey().Bytes()
+	o.contents = append(u16(hpkeKEMX25519), u16(hpkeKDFSHA256)...)
+	o.contents = append(o.contents, u16(hpkeAEADAES128GCM)...)
+	o.contents = append(o.contents, u16(uint16(len(pk)))...)
+	o.contents = append(o.contents, pk...)
+}
+
+// configs is the ObliviousDoHConfigs of the target, after a config of an
+// unknown version that clients must skip
+func (o *odohTarget) configs() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	unknown := []byte{0xff, 0x00, 0x00, 0x02, 0xaa, 0xbb}
+	config := append(u16(odohVersion), u16(uint16(len(o.contents)))...)
+	config = append(config, o.contents...)
+	list := append(unknown, config...)
+	return append(u16(uint16(len(list))), list...)
+}
+
+// keyID is Expand(Extract("", contents), "odoh key id", Nh)
+func (o *odohTarget) keyID() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return rfcExpand(o.t, hkdf.Extract(sha256.New, o.contents, nil), "odoh key id", sha256.Size)
+}
+
+func rfcExpand(t *testing.T, prk []byte, info string, length int) []byte {
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(info)), out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func (o *odohTarget) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	t := o.t
+	switch req.URL.Path {
+	case odohConfigPath:
+		w.Write(o.configs())
+		return
+	case "/proxy":
+		if req.URL.Query().Get("targetpath") != "/dns-query" || req.URL.Query().Get("targethost") != req.Host {
+			t.Errorf("relayed with %s, want the target host and path", req.URL.RawQuery)
+		}
+		o.mu.Lock()
+		o.relayed++
+		o.mu.Unlock()
+	case "/dns-query":
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != odohContentType {
+		t.Errorf("query sent as %s %s", req.Method, req.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(req.Body)
+
+	// ObliviousDoHMessage: type, key_id<0..2^16-1>, encrypted_message<1..2^16-1>
+	if len(body) < 3 || body[0] != odohQueryType {
+		t.Fatalf("not an ODoH query: %x", body)
+	}
+	idLen := int(binary.BigEndian.Uint16(body[1:]))
+	keyID := body[3 : 3+idLen]
+	if !bytes.Equal(keyID, o.keyID()) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rest := body[3+idLen:]
+	encrypted := rest[2:]
+	if int(binary.BigEndian.Uint16(rest)) != len(encrypted) {
+		t.Fatalf("encrypted_message length %d, have %d bytes", binary.BigEndian.Uint16(rest), len(encrypted))
+	}
+
+	// SetupBaseR and Open
+	o.mu.Lock()
+	key := o.key
+	o.mu.Unlock()
+	enc, ct := encrypted[:32], encrypted[32:]
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh, err := key.ECDH(pkE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hctx, err := hpkeKeySchedule(hpkeKEMX25519, hpkeKDFSHA256, hpkeAEADAES128GCM, dh, enc, key.PublicKey().Bytes(), []byte("odoh query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryPlain, err := hctx.aead.Open(nil, hctx.nextNonce(), ct, body[:3+idLen])
+	if err != nil {
+		t.Fatalf("failed to open the query: %v", err)
+	}
+	msgLen := int(binary.BigEndian.Uint16(queryPlain))
+	query := new(dns.Msg)
+	if err := query.Unpack(queryPlain[2 : 2+msgLen]); err != nil {
+		t.Fatal(err)
+	}
+	if query.Id != 0 {
+		t.Errorf("query ID is %d, RFC 9230 asks for 0", query.Id)
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	rr, _ := dns.NewRR(query.Question[0].Name + " 300 IN A 192.0.2.1")
+	reply.Answer = append(reply.Answer, rr)
+	packed, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	respPlain := append(u16(uint16(len(packed))), packed...)
+	respPlain = append(respPlain, 0, 0)
+
+	// Section 6.4: the response key and nonce come from the exported
+	// secret, salted with the query plaintext and a fresh nonce
+	secret := hctx.Export([]byte("odoh response"), 16)
+	respNonce := make([]byte, 16)
+	rand.Read(respNonce)
+	salt := append(append([]byte{}, queryPlain...), u16(uint16(len(respNonce)))...)
+	salt = append(salt, respNonce...)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+	block, err := aes.NewCipher(rfcExpand(t, prk, "odoh key", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aad := append([]byte{odohResponseType}, u16(uint16(len(respNonce)))...)
+	aad = append(aad, respNonce...)
+	sealed := aead.Seal(nil, rfcExpand(t, prk, "odoh nonce", aead.NonceSize()), respPlain, aad)
+
+	o.mu.Lock()
+	o.queries++
+	o.mu.Unlock()
+	w.Header().Set("Content-Type", odohContentType)
+	w.Write(aad)
+	w.Write(u16(uint16(len(sealed))))
+	w.Write(sealed)
+}
+
+func TestParseODoHConfigs(t *testing.T) {
+	target := newODoHTarget(t)
+	configs, err := parseODoHConfigs(target.configs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 {
+		t.Fatalf("parsed %d configs, want the one of version 1", len(configs))
+	}
+	c := configs[0]
+	if c.KEMID != hpkeKEMX25519 || c.KDFID != hpkeKDFSHA256 || c.AEADID != hpkeAEADAES128GCM || !bytes.Equal(c.PublicKey, target.key.PublicKey().Bytes()) {
+		t.Errorf("parsed config %+v", c)
+	}
+	if !bytes.Equal(c.keyID(), target.keyID()) {
+		t.Errorf("key ID %x, want %x", c.keyID(), target.keyID())
+	}
+
+	for _, tt := range []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"list length", []byte{0x00, 0x05, 0x00, 0x01}},
+		{"config length", []byte{0x00, 0x04, 0x00, 0x01, 0x00, 0x10}},
+		{"short contents", []byte{0x00, 0x06, 0x00, 0x01, 0x00, 0x02, 0x00, 0x20}},
+		{"key length", []byte{0x00, 0x0d, 0x00, 0x01, 0x00, 0x09, 0x00, 0x20, 0x00, 0x01, 0x00, 0x01, 0x00, 0x02, 0xaa}},
+		{"no known version", []byte{0x00, 0x06, 0xff, 0x00, 0x00, 0x02, 0xaa, 0xbb}},
+	} {
+		if _, err := parseODoHConfigs(tt.in); err == nil {
+			t.Errorf("%s: parsed %x, want an error", tt.name, tt.in)
+		}
+	}
+}
+
+func TestODoHExchange(t *testing.T) {
+	target := newODoHTarget(t)
+	srv := httptest.NewServer(target)
+	defer srv.Close()
+
+	for _, relay := range []string{"", srv.URL + "/proxy"} {
+		r := NewODoH(srv.URL+"/dns-query", relay)
+		q := NewQuery("example.com", dns.TypeA)
+		q.Id = 4711
+		resp, err := r.Exchange(context.Background(), q)
+		if err != nil {
+			t.Fatalf("relay %q: %v", relay, err)
+		}
+		if resp.Id != 4711 || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Errorf("relay %q: got %v", relay, resp)
+		}
+
+		// After a key rotation the target answers 401, and the client
+		// fetches the new config and asks again
+		target.rotate()
+		if _, err := r.Exchange(context.Background(), q); err != nil {
+			t.Errorf("relay %q, after the key rotated: %v", relay, err)
+		}
+	}
+	if target.queries != 4 || target.relayed != 3 {
+		t.Errorf("target answered %d queries, %d relayed, want 4 and 3", target.queries, target.relayed)
+	}
+}
+
+func TestODoHResponseTampered(t *testing.T) {
+	target := newODoHTarget(t)
+	configs, err := parseODoHConfigs(target.configs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, query, err := encryptODoHQuery(configs[0], []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(body))
+	req.Header.Set("Content-Type", odohContentType)
+	target.ServeHTTP(rec, req)
+	resp := rec.Body.Bytes()
+	if _, err := query.decrypt(resp); err != nil {
+		t.Fatalf("failed to decrypt the response: %v", err)
+	}
+
+	flipped := append([]byte{}, resp...)
+	flipped[len(flipped)-1] ^= 1
+	if _, err := query.decrypt(flipped); err == nil {
+		t.Error("decrypted a tampered response")
+	}
+	if _, err := query.decrypt(resp[:len(resp)-1]); err == nil {
+		t.Error("decrypted a truncated response")
+	}
+}
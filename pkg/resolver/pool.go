@@ -0,0 +1,165 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultIdleTimeout is how long an idle connection is kept when the
+	// server does not state a keepalive timeout of its own
+	defaultIdleTimeout = 10 * time.Second
+	// maxIdleConns bounds the idle connections kept per server
+	maxIdleConns = 8
+)
+
+// StreamOption configures the TCP and DoT resolvers
+type StreamOption func(*streamConfig)
+
+type streamConfig struct {
+	reuse bool
+}
+
+// WithConnReuse keeps connections open between queries instead of dialing
+// one per query. Queries then carry the edns-tcp-keepalive option (RFC 7828)
+// and idle connections are closed when the server's timeout runs out.
+func WithConnReuse() StreamOption {
+	return func(c *streamConfig) {
+		c.reuse = true
+	}
+}
+
+func newStreamConfig(opts []StreamOption) streamConfig {
+	var cfg streamConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// connPool holds idle stream connections to a single server. Each
+// connection carries one query at a time.
+type connPool struct {
+	transport, server string // for logging and traces
+	dial              func(ctx context.Context) (net.Conn, error)
+
+	mu   sync.Mutex
+	idle []idleConn
+}
+
+type idleConn struct {
+	conn    net.Conn
+	expires time.Time
+}
+
+func newConnPool(transport, server string, dial func(ctx context.Context) (net.Conn, error)) *connPool {
+	return &connPool{transport: transport, server: server, dial: dial}
+}
+
+// get returns an idle connection that has not expired, or nil
+func (p *connPool) get() net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if now.Before(c.expires) {
+			return c.conn
+		}
+		c.conn.Close()
+	}
+	return nil
+}
+
+// put returns a connection to the pool for at most idle, closing it when
+// idle is zero or the pool is full
+func (p *connPool) put(conn net.Conn, idle time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if idle <= 0 || len(p.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, expires: time.Now().Add(idle)})
+}
+
+// exchange sends m over a reused or new connection. A reused connection
+// the server has closed in the meantime is replaced once by a fresh one.
+func (p *connPool) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	m = m.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	msgBytes, err := packQuery(m, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		conn := p.get()
+		reused := conn != nil
+		if !reused {
+			if conn, err = p.dial(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		stop := bindContext(ctx, conn)
+		logWire(ctx, "sending query", p.transport, p.server, conn, msgBytes)
+		respBytes, err := exchangeStream(conn, msgBytes)
+		released := stop()
+		if err != nil {
+			conn.Close()
+			if reused && ctx.Err() == nil {
+				continue
+			}
+			return nil, contextError(ctx, err)
+		}
+
+		logWire(ctx, "received response", p.transport, p.server, conn, respBytes)
+		resp, err := unpackResponse(respBytes)
+		if err == nil && resp.Id != m.Id {
+			err = withKind(fmt.Errorf("response ID %d does not match query ID %d", resp.Id, m.Id), ErrMismatch)
+		}
+		if err != nil || !released {
+			// The context watcher may have poisoned the deadline
+			conn.Close()
+		} else {
+			conn.SetDeadline(time.Time{})
+			p.put(conn, keepaliveTimeout(resp))
+		}
+		if err != nil {
+			return nil, err
+		}
+		recordTrace(ctx, p.transport, p.server, start, len(msgBytes), len(respBytes))
+		if tc, ok := conn.(*tls.Conn); ok {
+			state := tc.ConnectionState()
+			recordTLS(ctx, &state)
+		}
+		return resp, nil
+	}
+}
+
+// keepaliveTimeout returns the idle timeout the server asked for, in units
+// of 100ms, or the default when it did not say
+func keepaliveTimeout(resp *dns.Msg) time.Duration {
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if k, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok && k.Length == 2 {
+				return time.Duration(k.Timeout) * 100 * time.Millisecond
+			}
+		}
+	}
+	return defaultIdleTimeout
+}
@@ -0,0 +1,147 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ParseProxy reads a proxy URL: socks5://host:port (socks5h is the same, the
+// proxy always resolves names) or http:// and https:// for HTTP CONNECT
+// proxies, with user:password@ for proxies that want authentication
+func ParseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", s, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, fmt.Errorf("invalid proxy %q: the scheme must be socks5, socks5h, http or https", s)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %q: no host", s)
+	}
+	return u, nil
+}
+
+// proxyAddr is the host:port of the proxy, with the default port of its
+// scheme when the URL has none
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "1080"
+	switch u.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// dialProxy connects to addr through d.Proxy, which only carries TCP
+func (d *Dialer) dialProxy(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("a proxy carries TCP only, not %s", network)
+	}
+	if d.Proxy.Scheme == "http" || d.Proxy.Scheme == "https" {
+		return d.dialConnect(ctx, addr)
+	}
+	var auth *proxy.Auth
+	if user := d.Proxy.User; user != nil {
+		password, _ := user.Password()
+		auth = &proxy.Auth{User: user.Username(), Password: password}
+	}
+	socks, err := proxy.SOCKS5("tcp", proxyAddr(d.Proxy), auth, directDialer{d})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := socks.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", proxyAddr(d.Proxy), err)
+	}
+	return conn, nil
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request
+func (d *Dialer) dialConnect(ctx context.Context, addr string) (net.Conn, error) {
+	paddr := proxyAddr(d.Proxy)
+	conn, err := d.dialDirect(ctx, "tcp", paddr)
+	if err != nil {
+		return nil, err
+	}
+	if d.Proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.Proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("HTTPS proxy %s: %w", paddr, err)
+		}
+		conn = tlsConn
+	}
+
+	stop := bindContext(ctx, conn)
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if user := d.Proxy.User; user != nil {
+		password, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	br := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(br, req)
+	}
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, contextError(ctx, fmt.Errorf("HTTP proxy %s: %w", paddr, err))
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s refused the tunnel to %s: %s", paddr, addr, resp.Status)
+	}
+	// The tunnel outlives the dial, so the dial's deadline must not stay on it
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn hands out what the reader took in past the CONNECT response
+// before reading from the connection again
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// directDialer reaches the proxy itself with the dialer's source address
+// and interface
+type directDialer struct {
+	d *Dialer
+}
+
+func (x directDialer) Dial(network, addr string) (net.Conn, error) {
+	return x.d.dialDirect(context.Background(), network, addr)
+}
+
+func (x directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return x.d.dialDirect(ctx, network, addr)
+}
@@ -0,0 +1,85 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Race sends each query to all upstreams at once and returns the first
+// usable response, cancelling the others. It suits networks where some
+// transports are blocked or slow, at the price of one query per upstream.
+// Responses with SERVFAIL or REFUSED only win when no upstream does better.
+type Race struct {
+	Upstreams []Resolver
+}
+
+// NewRace returns a Race over upstreams
+func NewRace(upstreams []Resolver) *Race {
+	return &Race{Upstreams: upstreams}
+}
+
+// Query implements Resolver
+func (r *Race) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.do(ctx, func(ctx context.Context, upstream Resolver) (*dns.Msg, error) {
+		return upstream.Query(ctx, name, qtype)
+	})
+}
+
+// Exchange implements Resolver
+func (r *Race) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return r.do(ctx, func(ctx context.Context, upstream Resolver) (*dns.Msg, error) {
+		// Packing may touch the message, so every racer gets its own
+		return upstream.Exchange(ctx, m.Copy())
+	})
+}
+
+type raceResult struct {
+	resp  *dns.Msg
+	err   error
+	trace Trace
+}
+
+func (r *Race) do(ctx context.Context, attempt func(context.Context, Resolver) (*dns.Msg, error)) (*dns.Msg, error) {
+	if len(r.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream resolvers configured")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered so the losers can finish after the winner has returned
+	results := make(chan raceResult, len(r.Upstreams))
+	for _, upstream := range r.Upstreams {
+		go func() {
+			// Every racer records its own trace, the winner's is kept
+			var res raceResult
+			res.resp, res.err = attempt(WithTrace(ctx, &res.trace), upstream)
+			results <- res
+		}()
+	}
+
+	var fallback *raceResult
+	var lastErr error
+	for range r.Upstreams {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		if retryableRcode(res.resp.Rcode) {
+			if fallback == nil {
+				fallback = &res
+			}
+			continue
+		}
+		copyTrace(ctx, res.trace)
+		return res.resp, nil
+	}
+
+	if fallback != nil {
+		copyTrace(ctx, fallback.trace)
+		return fallback.resp, nil
+	}
+	return nil, fmt.Errorf("all %d upstreams failed: %w", len(r.Upstreams), lastErr)
+}
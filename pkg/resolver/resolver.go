@@ -0,0 +1,72 @@
+// Package resolver sends DNS queries over the common transports: plain UDP
+// and TCP, DNS over TLS, QUIC and HTTPS, and Oblivious DoH. Every transport
+// implements the Resolver interface so callers can swap them freely.
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver sends DNS queries to an upstream server
+type Resolver interface {
+	// Query resolves a single name and type with recursion desired
+	Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+	// Exchange sends a prepared message and returns the response
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+// NewQuery returns a recursive query for name and qtype in class IN
+func NewQuery(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+	return m
+}
+
+// packQuery packs m, optionally with the ID cleared as DoH and DoQ require.
+// The caller's message is left untouched.
+func packQuery(m *dns.Msg, zeroID bool) ([]byte, error) {
+	if zeroID && m.Id != 0 {
+		m = m.Copy()
+		m.Id = 0
+	}
+	msgBytes, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS message: %w", err)
+	}
+	return msgBytes, nil
+}
+
+// deadliner is implemented by connections and QUIC streams
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// bindContext applies the context deadline to conn and unblocks pending
+// reads and writes as soon as the context is cancelled. Call the returned
+// function once the exchange is over to release the watcher.
+func bindContext(ctx context.Context, conn deadliner) func() bool {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+// contextError prefers the context's error over the I/O error it caused, so
+// callers see context.DeadlineExceeded rather than a bare i/o timeout
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = fmt.Errorf("%w: %w", err, ctxErr)
+	}
+	return typedError(err)
+}
+
+func u16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
@@ -0,0 +1,176 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RetryPolicy controls how Retry handles failures
+type RetryPolicy struct {
+	// Attempts is the total number of tries per query across all upstreams
+	Attempts int
+	// BaseDelay is the backoff before the second attempt, doubling after that
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff
+	MaxDelay time.Duration
+	// AttemptTimeout bounds each attempt, so that an upstream that does not
+	// answer leaves time for the next. When 0, each attempt gets an equal
+	// share of what is left of the context's deadline, if it has one.
+	AttemptTimeout time.Duration
+}
+
+// DefaultRetryPolicy tries three times, backing off from 100ms
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 2 * time.Second}
+
+// Retry spreads queries over several upstreams. Each query starts at the
+// upstream the Balancer picks, the next one in rotation by default, and
+// moves on to the following one after a network error, SERVFAIL or
+// REFUSED, sleeping with exponential backoff and full jitter between
+// attempts.
+type Retry struct {
+	Upstreams []Resolver
+	Policy    RetryPolicy
+	// Balancer orders the upstreams for each query, RoundRobin when nil
+	Balancer Balancer
+	// Health, when set, puts the ejected upstreams last
+	Health *Health
+
+	roundRobin RoundRobin
+}
+
+// NewRetry returns a Retry over upstreams with the given policy
+func NewRetry(upstreams []Resolver, policy RetryPolicy) *Retry {
+	return &Retry{Upstreams: upstreams, Policy: policy}
+}
+
+func (r *Retry) balancer() Balancer {
+	if r.Balancer == nil {
+		return &r.roundRobin
+	}
+	return r.Balancer
+}
+
+// Query implements Resolver, using each upstream's own Query so transport
+// defaults such as EDNS0 on UDP still apply
+func (r *Retry) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.do(ctx, func(ctx context.Context, upstream Resolver) (*dns.Msg, error) {
+		return upstream.Query(ctx, name, qtype)
+	})
+}
+
+// Exchange implements Resolver
+func (r *Retry) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return r.do(ctx, func(ctx context.Context, upstream Resolver) (*dns.Msg, error) {
+		return upstream.Exchange(ctx, m)
+	})
+}
+
+// do runs the attempts. When every attempt fails, the last SERVFAIL or
+// REFUSED response is returned if there was one, otherwise the last error.
+// Only the end of ctx stops the attempts early; one that times out on its
+// own moves on to the next upstream.
+func (r *Retry) do(ctx context.Context, attempt func(context.Context, Resolver) (*dns.Msg, error)) (*dns.Msg, error) {
+	if len(r.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream resolvers configured")
+	}
+	attempts := r.Policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	balancer := r.balancer()
+	order := balancer.Order(ctx, len(r.Upstreams))
+	if r.Health != nil {
+		order = r.Health.sort(order)
+	}
+	var lastResp *dns.Msg
+	var lastErr error
+	tried := 0
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if err := sleepContext(ctx, r.backoff(i)); err != nil {
+				break
+			}
+		}
+
+		upstream := order[i%len(order)]
+		start := time.Now()
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout := r.attemptTimeout(ctx, attempts-i); timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		resp, err := attempt(attemptCtx, r.Upstreams[upstream])
+		cancel()
+		tried++
+		// An attempt cut short by the caller says nothing about the upstream
+		if err == nil || ctx.Err() == nil {
+			ok := err == nil && !retryableRcode(resp.Rcode)
+			balancer.Observe(upstream, time.Since(start), ok)
+			if r.Health != nil {
+				r.Health.Observe(upstream, ok)
+			}
+		}
+		if err == nil && !retryableRcode(resp.Rcode) {
+			return resp, nil
+		}
+		if err != nil {
+			lastErr = err
+		} else {
+			lastResp = resp
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, fmt.Errorf("query failed after %d attempt(s): %w", tried, lastErr)
+}
+
+// attemptTimeout returns how long the next attempt may take with left
+// attempts to go, 0 for as long as ctx allows
+func (r *Retry) attemptTimeout(ctx context.Context, left int) time.Duration {
+	if r.Policy.AttemptTimeout > 0 {
+		return r.Policy.AttemptTimeout
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || left <= 1 {
+		return 0
+	}
+	return time.Until(deadline) / time.Duration(left)
+}
+
+// backoff returns the full-jitter delay before attempt number i (from 1)
+func (r *Retry) backoff(i int) time.Duration {
+	if r.Policy.BaseDelay <= 0 {
+		return 0
+	}
+	delay := r.Policy.BaseDelay << (i - 1)
+	if r.Policy.MaxDelay > 0 && (delay > r.Policy.MaxDelay || delay <= 0) {
+		delay = r.Policy.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// retryableRcode reports whether another upstream may well do better
+func retryableRcode(rcode int) bool {
+	return rcode == dns.RcodeServerFailure || rcode == dns.RcodeRefused
+}
+
+// sleepContext sleeps for d or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
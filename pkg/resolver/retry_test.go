@@ -0,0 +1,116 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// blackhole returns the address of a UDP socket that reads queries and
+// never answers
+func blackhole(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// liveServer returns the address of a UDP server answering every A query
+// with 192.0.2.1
+func liveServer(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		rr, _ := dns.NewRR(m.Question[0].Name + " 300 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestRetryFailsOverOnTimeout(t *testing.T) {
+	dead, live := blackhole(t), liveServer(t)
+	for _, tt := range []struct {
+		name   string
+		policy RetryPolicy
+	}{
+		{"share of the deadline", RetryPolicy{Attempts: 2}},
+		{"attempt timeout", RetryPolicy{Attempts: 2, AttemptTimeout: 300 * time.Millisecond}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRetry([]Resolver{NewUDP(dead), NewUDP(live)}, tt.policy)
+			r.Balancer = Ordered{}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			start := time.Now()
+			resp, err := r.Query(ctx, "example.com", dns.TypeA)
+			if err != nil {
+				t.Fatalf("no failover to the live server: %v", err)
+			}
+			if len(resp.Answer) != 1 {
+				t.Errorf("got %v", resp)
+			}
+			if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+				t.Errorf("took %v, the dead server used up more than its share", elapsed)
+			}
+		})
+	}
+}
+
+func TestRetryStopsAtDeadline(t *testing.T) {
+	r := NewRetry([]Resolver{NewUDP(blackhole(t)), NewUDP(blackhole(t))}, RetryPolicy{Attempts: 4})
+	r.Balancer = Ordered{}
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := r.Query(ctx, "example.com", dns.TypeA)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v, past the 400ms deadline", elapsed)
+	}
+}
+
+func TestRetryServfail(t *testing.T) {
+	calls := 0
+	answer := func(rcode int) Resolver {
+		return stubResolver(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+			calls++
+			resp := new(dns.Msg)
+			resp.SetRcode(m, rcode)
+			return resp, nil
+		})
+	}
+	r := NewRetry([]Resolver{answer(dns.RcodeServerFailure), answer(dns.RcodeSuccess)}, RetryPolicy{Attempts: 3})
+	r.Balancer = Ordered{}
+	resp, err := r.Query(context.Background(), "example.com", dns.TypeA)
+	if err != nil || resp.Rcode != dns.RcodeSuccess || calls != 2 {
+		t.Errorf("got %v, %v after %d calls, want NOERROR from the second upstream", resp, err, calls)
+	}
+}
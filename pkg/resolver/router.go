@@ -0,0 +1,100 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Router sends the queries for names at or under a zone of its routes to
+// that zone's resolver, the longest zone winning, and the others to
+// Default: conditional forwarding for split horizon setups, such as a
+// corporate domain or a service mesh answered by servers of their own. DS
+// queries for a zone go where its parent's queries go, the DS record
+// living on the parent side of the cut. The routes can be replaced while
+// queries are served.
+type Router struct {
+	Default Resolver
+
+	mu     sync.RWMutex
+	routes map[string]Resolver
+}
+
+// NewRouter returns a Router without routes, asking def for everything
+func NewRouter(def Resolver) *Router {
+	return &Router{Default: def, routes: map[string]Resolver{}}
+}
+
+// Route sends the queries under zone to r
+func (rt *Router) Route(zone string, r Resolver) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes[dns.Fqdn(strings.ToLower(zone))] = r
+}
+
+// SetRoutes replaces every route with those of routes, which map zones to
+// their resolvers
+func (rt *Router) SetRoutes(routes map[string]Resolver) {
+	m := make(map[string]Resolver, len(routes))
+	for zone, r := range routes {
+		m[dns.Fqdn(strings.ToLower(zone))] = r
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes = m
+}
+
+// Resolver returns the resolver that the queries for name of type qtype
+// go to
+func (rt *Router) Resolver(name string, qtype uint16) Resolver {
+	name = dns.Fqdn(strings.ToLower(name))
+	if qtype == dns.TypeDS && name != "." {
+		name = parentZone(name)
+	}
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if r, ok := longestZone(rt.routes, name); ok {
+		return r
+	}
+	return rt.Default
+}
+
+// Query implements Resolver
+func (rt *Router) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return rt.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver
+func (rt *Router) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return rt.Default.Exchange(ctx, m)
+	}
+	return rt.Resolver(m.Question[0].Name, m.Question[0].Qtype).Exchange(ctx, m)
+}
+
+// longestZone returns the value of the longest zone of zones, lowercased
+// and fully qualified, that name is at or under
+func longestZone[V any](zones map[string]V, name string) (V, bool) {
+	name = dns.Fqdn(strings.ToLower(name))
+	for {
+		if v, ok := zones[name]; ok {
+			return v, true
+		}
+		if name == "." {
+			var zero V
+			return zero, false
+		}
+		name = parentZone(name)
+	}
+}
+
+// parentZone returns the zone name is directly under, the root for a top
+// level domain
+func parentZone(name string) string {
+	if name = name[strings.IndexByte(name, '.')+1:]; name == "" {
+		return "."
+	}
+	return name
+}
@@ -0,0 +1,101 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Search qualifies names the way the stub resolver of the system does with
+// the search and ndots options of resolv.conf. Query takes the name as a
+// user typed it: without a trailing dot it is tried as it is and under each
+// search domain, in the order ndots gives, until a response has answers.
+// Exchange sends its message unchanged, its question being qualified
+// already.
+type Search struct {
+	Resolver Resolver
+	Domains  []string // the search list, such as corp.example.com
+	// Ndots is the number of dots from which a name is tried as it is
+	// before the search domains rather than after them, 1 in resolv.conf
+	// unless its options say otherwise
+	Ndots int
+	// OnTry, when set, is called with each name tried and its response or
+	// error, so that callers can report which one answered
+	OnTry func(name string, resp *dns.Msg, err error)
+}
+
+// NewSearch returns a Search over r with the search domains and ndots
+func NewSearch(r Resolver, domains []string, ndots int) *Search {
+	return &Search{Resolver: r, Domains: domains, Ndots: ndots}
+}
+
+// Names returns the fully qualified names to try for name, in order
+func (s *Search) Names(name string) []string {
+	if dns.IsFqdn(name) || name == "" {
+		return []string{dns.Fqdn(name)}
+	}
+	asIs := dns.Fqdn(name)
+	var names []string
+	early := strings.Count(name, ".") >= s.Ndots
+	if early {
+		names = append(names, asIs)
+	}
+	for _, domain := range s.Domains {
+		if domain = strings.Trim(domain, "."); domain != "" {
+			names = append(names, asIs+domain+".")
+		}
+	}
+	if !early {
+		names = append(names, asIs)
+	}
+	return names
+}
+
+// Query implements Resolver, searching for name
+func (s *Search) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return s.Lookup(ctx, name, func(ctx context.Context, name string) (*dns.Msg, error) {
+		return s.Resolver.Query(ctx, name, qtype)
+	})
+}
+
+// Exchange implements Resolver, sending m as it is
+func (s *Search) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return s.Resolver.Exchange(ctx, m)
+}
+
+// Lookup asks query about each name of Names(name) in turn and returns the
+// first response with answers. A name that does not exist or has no
+// records of the type moves on to the next one, as any other error rcode
+// does, and an exchange that fails ends the search. When no name has
+// answers the first NODATA response is returned, else that of the name as
+// it was typed.
+func (s *Search) Lookup(ctx context.Context, name string, query func(ctx context.Context, name string) (*dns.Msg, error)) (*dns.Msg, error) {
+	var nodata, asIs, last *dns.Msg
+	for _, candidate := range s.Names(name) {
+		resp, err := query(ctx, candidate)
+		if s.OnTry != nil {
+			s.OnTry(candidate, resp, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0 {
+			return resp, nil
+		}
+		if resp.Rcode == dns.RcodeSuccess && nodata == nil {
+			nodata = resp
+		}
+		if candidate == dns.Fqdn(name) {
+			asIs = resp
+		}
+		last = resp
+	}
+	switch {
+	case nodata != nil:
+		return nodata, nil
+	case asIs != nil:
+		return asIs, nil
+	}
+	return last, nil
+}
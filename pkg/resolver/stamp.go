@@ -0,0 +1,285 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// StampProtocol is the protocol a server stamp describes
+type StampProtocol byte
+
+// The stamp protocols of https://dnscrypt.info/stamps-specifications
+const (
+	StampPlain      StampProtocol = 0x00
+	StampDNSCrypt   StampProtocol = 0x01
+	StampDoH        StampProtocol = 0x02
+	StampDoT        StampProtocol = 0x03
+	StampDoQ        StampProtocol = 0x04
+	StampODoHTarget StampProtocol = 0x05
+)
+
+// stampDefaultPorts are the ports used when a stamp's address has none
+var stampDefaultPorts = map[StampProtocol]int{
+	StampPlain:    53,
+	StampDNSCrypt: 443,
+	StampDoH:      443,
+	StampDoT:      853,
+	StampDoQ:      853,
+}
+
+// Stamp is a decoded sdns:// server stamp, the form public resolver lists
+// publish their servers in
+type Stamp struct {
+	Protocol StampProtocol
+	Props    uint64 // informational flags: 1 DNSSEC, 2 no logs, 4 no filter
+
+	// Addr is the server's host:port, from the stamp's address with the
+	// protocol's default port. It is empty for stamps that leave the
+	// address to be resolved from Hostname, see LookupAddr.
+	Addr string
+
+	ProviderKey  []byte   // DNSCrypt: the provider's Ed25519 public key
+	ProviderName string   // DNSCrypt: the name certificates are queried at
+	Hostname     string   // DoH, DoT, DoQ and ODoH: the server name
+	Path         string   // DoH and ODoH: the endpoint path
+	Hashes       [][]byte // DoH, DoT and DoQ: SHA-256 hashes of certificates in the chain
+	Bootstrap    []string // DoH, DoT and DoQ: resolvers to look up Hostname with
+}
+
+// ParseStamp decodes an sdns:// server stamp
+func ParseStamp(s string) (*Stamp, error) {
+	encoded, ok := strings.CutPrefix(s, "sdns://")
+	if !ok {
+		return nil, fmt.Errorf("server stamp %q does not start with sdns://", s)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server stamp: %w", err)
+	}
+	if len(b) < 1 {
+		return nil, fmt.Errorf("empty server stamp")
+	}
+	st := &Stamp{Protocol: StampProtocol(b[0])}
+	p := stampParser{b: b[1:]}
+	st.Props = p.props()
+
+	var addr string
+	switch st.Protocol {
+	case StampPlain:
+		addr = p.lp()
+	case StampDNSCrypt:
+		addr = p.lp()
+		st.ProviderKey = []byte(p.lp())
+		st.ProviderName = p.lp()
+		if p.err == nil && len(st.ProviderKey) != 32 {
+			return nil, fmt.Errorf("DNSCrypt stamp has a %d byte provider key, want 32", len(st.ProviderKey))
+		}
+	case StampDoH:
+		addr = p.lp()
+		st.Hashes = p.vlp()
+		st.Hostname = p.lp()
+		st.Path = p.lp()
+		st.Bootstrap = p.optionalStrings()
+	case StampDoT, StampDoQ:
+		addr = p.lp()
+		st.Hashes = p.vlp()
+		st.Hostname = p.lp()
+		st.Bootstrap = p.optionalStrings()
+	case StampODoHTarget:
+		st.Hostname = p.lp()
+		st.Path = p.lp()
+	default:
+		return nil, fmt.Errorf("unsupported server stamp protocol 0x%02x", byte(st.Protocol))
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("invalid server stamp: %w", p.err)
+	}
+	if addr != "" {
+		if st.Addr, err = stampAddr(addr, stampDefaultPorts[st.Protocol]); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// LookupAddr sets Addr, when the stamp gives none, to an address of
+// Hostname found through the stamp's bootstrap resolvers, so that reaching
+// the server does not depend on the system resolver. Stamps with an address
+// or without bootstrap resolvers are left alone. A family of 4 or 6 asks
+// for and through addresses of that family only, 0 tries IPv4 first.
+func (s *Stamp) LookupAddr(ctx context.Context, family int) error {
+	if s.Addr != "" || len(s.Bootstrap) == 0 {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(s.Hostname)
+	if err != nil {
+		host, port = s.Hostname, strconv.Itoa(stampDefaultPorts[s.Protocol])
+	}
+	var lastErr error
+	for _, server := range s.Bootstrap {
+		addr, err := stampAddr(server, 53)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, qtype := range familyTypes(family) {
+			bootstrap := NewUDP(addr)
+			bootstrap.Dialer = &Dialer{Family: family}
+			resp, err := bootstrap.Query(ctx, host, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					s.Addr = net.JoinHostPort(rr.A.String(), port)
+				case *dns.AAAA:
+					s.Addr = net.JoinHostPort(rr.AAAA.String(), port)
+				}
+				if s.Addr != "" {
+					return nil
+				}
+			}
+			lastErr = fmt.Errorf("%s has no %s records", host, dns.TypeToString[qtype])
+		}
+	}
+	return fmt.Errorf("failed to look up %s through the bootstrap resolvers: %w", host, lastErr)
+}
+
+// familyTypes returns the address record types to look up for family
+func familyTypes(family int) []uint16 {
+	switch family {
+	case 4:
+		return []uint16{dns.TypeA}
+	case 6:
+		return []uint16{dns.TypeAAAA}
+	}
+	return []uint16{dns.TypeA, dns.TypeAAAA}
+}
+
+// TLSConfig returns a copy of base, or a new config, that names Hostname to
+// the server. When the stamp has certificate hashes, one of them must also
+// match the SHA-256 hash of the to-be-signed part of a certificate the
+// server sends, on top of the usual verification.
+func (s *Stamp) TLSConfig(base *tls.Config) *tls.Config {
+	host, _, err := net.SplitHostPort(s.Hostname)
+	if err != nil {
+		host = s.Hostname
+	}
+	cfg := clientTLSConfig(base, host)
+	if len(s.Hashes) == 0 {
+		return cfg
+	}
+	verify := cfg.VerifyConnection
+	hashes := s.Hashes
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawTBSCertificate)
+			for _, h := range hashes {
+				if bytes.Equal(sum[:], h) {
+					return nil
+				}
+			}
+		}
+		return withKind(fmt.Errorf("no certificate of %s matches the hashes of its stamp", host), ErrTLSVerify)
+	}
+	return cfg
+}
+
+// stampAddr adds the default port to a stamp address given without one,
+// an IPv6 address then being in brackets
+func stampAddr(addr string, port int) (string, error) {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr, nil
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if host == "" {
+		return "", fmt.Errorf("invalid server stamp address %q", addr)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// stampParser reads the fields of a stamp, remembering the first error
+type stampParser struct {
+	b   []byte
+	err error
+}
+
+func (p *stampParser) props() uint64 {
+	if len(p.b) < 8 {
+		p.err = fmt.Errorf("truncated properties")
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(p.b)
+	p.b = p.b[8:]
+	return v
+}
+
+// lp reads a length-prefixed string
+func (p *stampParser) lp() string {
+	if p.err != nil {
+		return ""
+	}
+	if len(p.b) < 1 || len(p.b) < 1+int(p.b[0]) {
+		p.err = fmt.Errorf("truncated field")
+		return ""
+	}
+	s := string(p.b[1 : 1+int(p.b[0])])
+	p.b = p.b[1+int(p.b[0]):]
+	return s
+}
+
+// optionalStrings reads a trailing set of length-prefixed strings, which
+// older stamps leave out
+func (p *stampParser) optionalStrings() []string {
+	if p.err != nil || len(p.b) == 0 {
+		return nil
+	}
+	var out []string
+	for _, item := range p.vlp() {
+		out = append(out, string(item))
+	}
+	return out
+}
+
+// vlp reads a set of length-prefixed strings, the high bit of each length
+// saying whether another follows
+func (p *stampParser) vlp() [][]byte {
+	var items [][]byte
+	for p.err == nil {
+		if len(p.b) < 1 {
+			p.err = fmt.Errorf("truncated field")
+			return nil
+		}
+		more := p.b[0]&0x80 != 0
+		n := int(p.b[0] &^ 0x80)
+		if len(p.b) < 1+n {
+			p.err = fmt.Errorf("truncated field")
+			return nil
+		}
+		if n > 0 {
+			items = append(items, p.b[1:1+n])
+		}
+		p.b = p.b[1+n:]
+		if !more {
+			break
+		}
+	}
+	return items
+}
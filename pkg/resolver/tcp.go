@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TCP resolves over plain TCP, one connection per query unless created
+// with WithConnReuse
+type TCP struct {
+	Addr   string  // host:port
+	Dialer *Dialer // opens the connections, a plain net.Dialer when nil
+
+	pool *connPool
+}
+
+// NewTCP returns a TCP resolver for the host:port address
+func NewTCP(addr string, opts ...StreamOption) *TCP {
+	r := &TCP{Addr: addr}
+	if newStreamConfig(opts).reuse {
+		r.pool = newConnPool("tcp", addr, r.dial)
+	}
+	return r
+}
+
+// Query implements Resolver
+func (r *TCP) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver
+func (r *TCP) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if r.pool != nil {
+		return r.pool.exchange(ctx, m)
+	}
+
+	msgBytes, err := packQuery(m, false)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := r.ExchangeRaw(ctx, msgBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return unpackResponse(respBytes)
+}
+
+// ExchangeRaw sends already packed message bytes and returns the raw reply.
+// Neither side has to be a well-formed DNS message, which makes it usable
+// for robustness testing with crafted queries.
+func (r *TCP) ExchangeRaw(ctx context.Context, msgBytes []byte) ([]byte, error) {
+	start := time.Now()
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer bindContext(ctx, conn)()
+
+	logWire(ctx, "sending query", "tcp", r.Addr, conn, msgBytes)
+	respBytes, err := exchangeStream(conn, msgBytes)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	logWire(ctx, "received response", "tcp", r.Addr, conn, respBytes)
+	recordTrace(ctx, "tcp", r.Addr, start, len(msgBytes), len(respBytes))
+	return respBytes, nil
+}
+
+func (r *TCP) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := r.Dialer.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to connect to DNS server: %w", err))
+	}
+	return conn, nil
+}
+
+// exchangeStream sends a message with the two-byte length prefix used by
+// DNS over TCP and DoT and reads back the reply. Both the prefix and the
+// message are read in full, since a large response (DNSSEC answers easily
+// exceed a single segment) may arrive split across several reads.
+func exchangeStream(conn io.ReadWriter, msgBytes []byte) ([]byte, error) {
+	if err := writeStreamMessage(conn, msgBytes); err != nil {
+		return nil, err
+	}
+	return readStreamMessage(conn)
+}
+
+// writeStreamMessage sends one message with its two-byte length prefix
+func writeStreamMessage(w io.Writer, msgBytes []byte) error {
+	if len(msgBytes) > dns.MaxMsgSize {
+		return fmt.Errorf("DNS message too large for TCP framing: %d bytes", len(msgBytes))
+	}
+
+	// Prefix with two-byte length and send it in a single write
+	buf := make([]byte, 2, 2+len(msgBytes))
+	binary.BigEndian.PutUint16(buf, uint16(len(msgBytes)))
+	buf = append(buf, msgBytes...)
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("failed to send DNS query: %w", err)
+	}
+	return nil
+}
+
+// readStreamMessage reads one length-prefixed DNS message
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	lengthBytes := make([]byte, 2)
+	if _, err := io.ReadFull(r, lengthBytes); err != nil {
+		return nil, fmt.Errorf("failed to read response length: %w", err)
+	}
+
+	respBytes := make([]byte, binary.BigEndian.Uint16(lengthBytes))
+	if _, err := io.ReadFull(r, respBytes); err != nil {
+		return nil, fmt.Errorf("failed to read DNS response: %w", err)
+	}
+	return respBytes, nil
+}
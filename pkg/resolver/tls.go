@@ -0,0 +1,169 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DoT resolves over DNS over TLS (RFC 7858). The host part of the address is
+// used for SNI and certificate verification, so it may be a hostname or an IP
+// address covered by the server's certificate. Each query gets its own
+// connection unless the resolver is created with WithConnReuse.
+type DoT struct {
+	Addr string // host:port
+
+	// TLSConfig, when set, is the base for the TLS settings, such as the
+	// root CAs to trust. ServerName defaults to the host of Addr.
+	TLSConfig *tls.Config
+	// Dialer opens the TCP connections, a plain net.Dialer when nil
+	Dialer *Dialer
+
+	pool *connPool
+}
+
+// NewDoT returns a DoT resolver for the host:port address
+func NewDoT(addr string, opts ...StreamOption) *DoT {
+	r := &DoT{Addr: addr}
+	if newStreamConfig(opts).reuse {
+		r.pool = newConnPool("tls", addr, r.dial)
+	}
+	return r
+}
+
+// Query implements Resolver
+func (r *DoT) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver
+func (r *DoT) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if r.pool != nil {
+		return r.pool.exchange(ctx, m)
+	}
+
+	msgBytes, err := packQuery(m, false)
+	if err != nil {
+		return nil, err
+	}
+	respBytes, err := r.ExchangeRaw(ctx, msgBytes)
+	if err != nil {
+		return nil, err
+	}
+	return unpackResponse(respBytes)
+}
+
+// ExchangeRaw sends already packed message bytes over a new connection and
+// returns the raw reply
+func (r *DoT) ExchangeRaw(ctx context.Context, msgBytes []byte) ([]byte, error) {
+	start := time.Now()
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer bindContext(ctx, conn)()
+
+	logWire(ctx, "sending query", "tls", r.Addr, conn, msgBytes)
+	respBytes, err := exchangeStream(conn, msgBytes)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	logWire(ctx, "received response", "tls", r.Addr, conn, respBytes)
+	recordTrace(ctx, "tls", r.Addr, start, len(msgBytes), len(respBytes))
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		recordTLS(ctx, &state)
+	}
+	return respBytes, nil
+}
+
+func (r *DoT) dial(ctx context.Context) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(r.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS server address: %w", err)
+	}
+	raw, err := r.Dialer.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to establish TLS connection: %w", err))
+	}
+	conn := tls.Client(raw, clientTLSConfig(r.TLSConfig, host))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, contextError(ctx, fmt.Errorf("failed to establish TLS connection: %w", err))
+	}
+	return conn, nil
+}
+
+// clientTLSConfig returns a copy of base, or an empty config, with the
+// server name defaulting to host and the ALPN protocols set when given
+func clientTLSConfig(base *tls.Config, host string, protos ...string) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if len(protos) > 0 {
+		cfg.NextProtos = protos
+	}
+	return cfg
+}
+
+// ParseSPKIPin reads an SPKI pin, the base64 SHA-256 hash of a certificate's
+// SubjectPublicKeyInfo as RFC 7469 and RFC 7858 section 4.2 use it, given
+// bare or as sha256/<hash> or pin-sha256="<hash>"
+func ParseSPKIPin(s string) ([]byte, error) {
+	pin := strings.TrimPrefix(s, "sha256/")
+	pin = strings.TrimPrefix(pin, "pin-sha256=")
+	pin = strings.Trim(pin, `"`)
+	sum, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid SPKI pin %q, want the base64 SHA-256 hash of a public key", s)
+	}
+	return sum, nil
+}
+
+// SPKIPin returns the pin of a DER encoded SubjectPublicKeyInfo, as
+// ParseSPKIPin reads it
+func SPKIPin(spki []byte) string {
+	sum := sha256.Sum256(spki)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// PinSPKI returns a copy of base that also requires a certificate the server
+// sends to have one of the pinned public keys. The usual verification still
+// applies unless base skips it, in which case the pins alone vouch for the
+// server, as for resolvers with self-signed certificates.
+func PinSPKI(base *tls.Config, pins [][]byte) *tls.Config {
+	cfg := clientTLSConfig(base, "")
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		var got []string
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+			got = append(got, SPKIPin(cert.RawSubjectPublicKeyInfo))
+		}
+		return withKind(fmt.Errorf("no certificate the server sent matches the SPKI pins, its keys are %s", strings.Join(got, ", ")), ErrTLSVerify)
+	}
+	return cfg
+}
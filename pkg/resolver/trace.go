@@ -0,0 +1,66 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+)
+
+// Trace records how the last successful exchange of a query went. Attach
+// one to a context with WithTrace; transports fill it in as responses
+// arrive, so after a retry or a TCP fallback it describes the exchange that
+// produced the returned response.
+type Trace struct {
+	Transport    string        // udp, tcp, tls, quic, https, https-json, odoh or dnscrypt
+	Server       string        // host:port or URL that answered
+	RTT          time.Duration // time from sending the query to reading the reply
+	QuerySize    int           // wire size of the query in bytes
+	ResponseSize int           // wire size of the response in bytes
+	Protocol     string        // HTTP version DoH negotiated, such as HTTP/2.0
+	// TLS is the state of the connection over tls, quic and https, with the
+	// negotiated version, cipher suite, ALPN, certificates and OCSP staple
+	TLS *tls.ConnectionState
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context that makes transports record into t
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// recordTrace fills in the context's trace, if any, for one exchange
+func recordTrace(ctx context.Context, transport, server string, start time.Time, querySize, responseSize int) {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	if t == nil {
+		return
+	}
+	*t = Trace{
+		Transport:    transport,
+		Server:       server,
+		RTT:          time.Since(start),
+		QuerySize:    querySize,
+		ResponseSize: responseSize,
+	}
+}
+
+// recordProtocol adds the negotiated HTTP version to the context's trace
+func recordProtocol(ctx context.Context, proto string) {
+	if t, _ := ctx.Value(traceKey{}).(*Trace); t != nil {
+		t.Protocol = proto
+	}
+}
+
+// recordTLS adds the TLS state of the connection to the context's trace
+func recordTLS(ctx context.Context, state *tls.ConnectionState) {
+	if t, _ := ctx.Value(traceKey{}).(*Trace); t != nil && state != nil {
+		t.TLS = state
+	}
+}
+
+// copyTrace stores t as the context's trace, if it has one
+func copyTrace(ctx context.Context, t Trace) {
+	if dst, _ := ctx.Value(traceKey{}).(*Trace); dst != nil {
+		*dst = t
+	}
+}
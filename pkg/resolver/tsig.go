@@ -0,0 +1,232 @@
+package resolver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigFudge is the clock skew allowed between us and the server, in seconds
+const tsigFudge = 300
+
+// tsigAlgorithms maps the algorithm names used by dig and BIND to the dns
+// package names
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// TSIGKey is a secret shared with a server for TSIG (RFC 8945)
+type TSIGKey struct {
+	Name      string // key name, fully qualified
+	Algorithm string // algorithm name such as dns.HmacSHA256
+	Secret    string // base64 encoded secret
+}
+
+// ParseTSIGKey parses a key written as [algorithm:]name:secret, the form dig
+// takes with -y. The algorithm defaults to hmac-sha256.
+func ParseTSIGKey(s string) (*TSIGKey, error) {
+	parts := strings.Split(s, ":")
+	algorithm := "hmac-sha256"
+	switch len(parts) {
+	case 2:
+	case 3:
+		algorithm, parts = parts[0], parts[1:]
+	default:
+		return nil, fmt.Errorf("invalid TSIG key %q, want [algorithm:]name:secret", s)
+	}
+	return NewTSIGKey(parts[0], algorithm, parts[1])
+}
+
+// NewTSIGKey checks the parts of a key and returns it with the name made
+// fully qualified and the algorithm in canonical form
+func NewTSIGKey(name, algorithm, secret string) (*TSIGKey, error) {
+	if name == "" {
+		return nil, fmt.Errorf("TSIG key has no name")
+	}
+	alg, ok := tsigAlgorithms[strings.ToLower(strings.TrimSuffix(algorithm, "."))]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", algorithm)
+	}
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+		return nil, fmt.Errorf("TSIG secret for %s is not valid base64: %w", name, err)
+	}
+	return &TSIGKey{Name: dns.Fqdn(strings.ToLower(name)), Algorithm: alg, Secret: secret}, nil
+}
+
+// ReadTSIGKey reads the first key from a file in the BIND format that
+// tsig-keygen and ddns-confgen write:
+//
+//	key "name" {
+//		algorithm hmac-sha256;
+//		secret "base64";
+//	};
+func ReadTSIGKey(path string) (*TSIGKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := keyFileTokens(string(data))
+	for i := 0; i+2 < len(tokens); i++ {
+		if tokens[i] != "key" || tokens[i+2] != "{" {
+			continue
+		}
+		name, algorithm, secret := tokens[i+1], "", ""
+		for j := i + 3; j+1 < len(tokens) && tokens[j] != "}"; j++ {
+			switch tokens[j] {
+			case "algorithm":
+				algorithm = tokens[j+1]
+			case "secret":
+				secret = tokens[j+1]
+			}
+		}
+		if algorithm == "" || secret == "" {
+			return nil, fmt.Errorf("%s: key %s needs an algorithm and a secret", path, name)
+		}
+		return NewTSIGKey(name, algorithm, secret)
+	}
+	return nil, fmt.Errorf("%s: no key statement found", path)
+}
+
+// keyFileTokens splits a BIND style configuration into words, quoted
+// strings without their quotes, and the punctuation { } ;, leaving out
+// comments
+func keyFileTokens(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || strings.HasPrefix(s[i:], "//"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				end = len(s) - i - 1
+			}
+			tokens = append(tokens, s[i+1:i+1+end])
+			i += end + 2
+		default:
+			start := i
+			for i < len(s) && !strings.ContainsRune(" \t\n\r{};\"#", rune(s[i])) {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+		}
+	}
+	return tokens
+}
+
+// RawExchanger is implemented by transports that can send packed messages
+// as they are, which signing needs: UDP, TCP and DoT
+type RawExchanger interface {
+	Resolver
+	ExchangeRaw(ctx context.Context, msgBytes []byte) ([]byte, error)
+}
+
+// Signed signs every query with a TSIG key and only accepts responses that
+// carry a valid signature made with the same key
+type Signed struct {
+	Upstream RawExchanger
+	Key      *TSIGKey
+}
+
+// NewSigned returns a Signed that sends its queries through upstream
+func NewSigned(upstream RawExchanger, key *TSIGKey) *Signed {
+	return &Signed{Upstream: upstream, Key: key}
+}
+
+// Query implements Resolver, advertising UDPBufferSize with EDNS0 as the
+// plain UDP resolver does
+func (r *Signed) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := NewQuery(name, qtype)
+	m.SetEdns0(UDPBufferSize, false)
+	return r.Exchange(ctx, m)
+}
+
+// Exchange implements Resolver. The returned response still holds its TSIG
+// record.
+func (r *Signed) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	msgBytes, mac, err := r.Key.sign(m)
+	if err != nil {
+		return nil, err
+	}
+	respBytes, err := r.Upstream.ExchangeRaw(ctx, msgBytes)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := unpackResponse(respBytes)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Key.verify(respBytes, resp, mac, false); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// sign packs m with a TSIG record made with k and returns the packed message
+// and its MAC, needed to verify the response
+func (k *TSIGKey) sign(m *dns.Msg) ([]byte, string, error) {
+	m = m.Copy()
+	m.SetTsig(k.Name, k.Algorithm, tsigFudge, time.Now().Unix())
+	msgBytes, mac, err := dns.TsigGenerate(m, k.Secret, "", false)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to sign DNS message: %w", err)
+	}
+	return msgBytes, mac, nil
+}
+
+// verify checks the TSIG record of a response, with msgBytes as it was
+// received, against the MAC of the request. For the later messages of a
+// zone transfer, requestMAC is the MAC of the previous message and only the
+// timers are covered again. It returns the response's MAC.
+func (k *TSIGKey) verify(msgBytes []byte, resp *dns.Msg, requestMAC string, timersOnly bool) (string, error) {
+	t := resp.IsTsig()
+	if t == nil {
+		return "", fmt.Errorf("response is not TSIG signed")
+	}
+	if err := tsigError(resp); err != nil {
+		return "", err
+	}
+	if dns.CanonicalName(t.Hdr.Name) != k.Name {
+		return "", fmt.Errorf("response is signed with key %s, not %s", t.Hdr.Name, k.Name)
+	}
+	if err := dns.TsigVerify(msgBytes, k.Secret, requestMAC, timersOnly); err != nil {
+		return "", fmt.Errorf("TSIG verification failed: %w", err)
+	}
+	return t.MAC, nil
+}
+
+// tsigError reports the error a server signalled in the TSIG record of its
+// response, such as BADKEY or BADSIG when it did not accept our key
+func tsigError(resp *dns.Msg) error {
+	t := resp.IsTsig()
+	if t == nil || t.Error == dns.RcodeSuccess {
+		return nil
+	}
+	return fmt.Errorf("server rejected the TSIG key: %w", &RcodeError{Rcode: int(t.Error)})
+}
+
+// rcodeString names an rcode, including the extended TSIG ones
+func rcodeString(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
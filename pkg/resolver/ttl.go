@@ -0,0 +1,86 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TTLPolicy rewrites the TTLs of the responses of Upstream: every record
+// gets at least Min and at most Max, and the answers to questions at or
+// under a zone of Overrides get that zone's TTL instead, the longest zone
+// winning. In front of a Cache it sets how long answers are kept as well as
+// what clients see, so that a low Max makes failover faster and a high Min
+// spares the upstreams. Negative answers are only ever shortened: Max and
+// the overrides also lower the SOA minimum, Min leaves them alone.
+type TTLPolicy struct {
+	Upstream Resolver
+	Min      time.Duration // 0 for no minimum
+	Max      time.Duration // 0 for no maximum
+	// Overrides maps lowercased zones, fully qualified, to the TTL of the
+	// answers under them
+	Overrides map[string]time.Duration
+}
+
+// NewTTLPolicy returns a TTLPolicy in front of upstream clamping TTLs
+// between min and max, either 0 for no bound
+func NewTTLPolicy(upstream Resolver, min, max time.Duration) *TTLPolicy {
+	return &TTLPolicy{Upstream: upstream, Min: min, Max: max, Overrides: map[string]time.Duration{}}
+}
+
+// Override gives the answers under zone the TTL ttl
+func (p *TTLPolicy) Override(zone string, ttl time.Duration) {
+	p.Overrides[dns.Fqdn(strings.ToLower(zone))] = ttl
+}
+
+// Query implements Resolver
+func (p *TTLPolicy) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return p.Exchange(ctx, NewQuery(name, qtype))
+}
+
+// Exchange implements Resolver
+func (p *TTLPolicy) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	resp, err := p.Upstream.Exchange(ctx, m)
+	if err != nil || len(m.Question) != 1 {
+		return resp, err
+	}
+	resp = resp.Copy()
+	negative := resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0
+	override, fixed := p.override(m.Question[0].Name)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			soa, _ := rr.(*dns.SOA)
+			switch {
+			case fixed && negative && soa != nil:
+				// The SOA of a negative answer says how long it is negative
+				h.Ttl = min(h.Ttl, uint32(override/time.Second))
+				soa.Minttl = min(soa.Minttl, uint32(override/time.Second))
+			case fixed:
+				h.Ttl = uint32(override / time.Second)
+			default:
+				if p.Min > 0 && !negative {
+					h.Ttl = max(h.Ttl, uint32(p.Min/time.Second))
+				}
+				if p.Max > 0 {
+					h.Ttl = min(h.Ttl, uint32(p.Max/time.Second))
+					if soa != nil {
+						soa.Minttl = min(soa.Minttl, uint32(p.Max/time.Second))
+					}
+				}
+			}
+		}
+	}
+	return resp, nil
+}
+
+// override returns the TTL of the longest zone of Overrides that name is
+// at or under
+func (p *TTLPolicy) override(name string) (time.Duration, bool) {
+	return longestZone(p.Overrides, name)
+}
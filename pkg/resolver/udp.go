@@ -0,0 +1,175 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// UDPBufferSize is the EDNS0 payload size advertised over UDP, the value
+	// recommended by DNS flag day 2020 to avoid IP fragmentation
+	UDPBufferSize = 1232
+	// udpTimeout bounds the wait for a UDP reply, which may never arrive,
+	// when the context carries no deadline of its own
+	udpTimeout = 5 * time.Second
+)
+
+// UDP resolves over plain UDP and repeats the query over TCP when the
+// response comes back truncated, like a regular stub resolver. Every
+// exchange opens a socket of its own, so each query leaves from a fresh
+// port picked at random by the system, and Exchange gives each query a
+// fresh random ID, so an off-path attacker has to guess both.
+type UDP struct {
+	Addr   string  // host:port
+	Dialer *Dialer // opens the sockets, a plain net.Dialer when nil
+	// Mix0x20 randomizes the case of the query name in Exchange and drops
+	// responses that do not echo it exactly, which makes spoofing harder
+	// still (DNS 0x20). Servers that do not keep the case end up ignored.
+	Mix0x20 bool
+}
+
+// NewUDP returns a UDP resolver for the host:port address
+func NewUDP(addr string) *UDP {
+	return &UDP{Addr: addr}
+}
+
+// Query implements Resolver, advertising UDPBufferSize with EDNS0
+func (r *UDP) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := NewQuery(name, qtype)
+	m.SetEdns0(UDPBufferSize, false)
+	return r.Exchange(ctx, m)
+}
+
+// Exchange implements Resolver. The response carries the ID and question
+// of m whatever was sent on the wire.
+func (r *UDP) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	sent := m.Copy()
+	sent.Id = dns.Id()
+	mix := r.Mix0x20 && len(sent.Question) == 1
+	if mix {
+		sent.Question[0].Name = mixCase(sent.Question[0].Name)
+	}
+	msgBytes, err := packQuery(sent, false)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := r.exchange(ctx, msgBytes, mix)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := unpackResponse(respBytes)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = m.Id
+	if mix {
+		restoreCase(resp, sent.Question[0].Name, m.Question[0].Name)
+	}
+	return resp, nil
+}
+
+// ExchangeRaw sends already packed message bytes and returns the raw reply,
+// repeating the exchange over TCP when the reply has the TC bit set
+func (r *UDP) ExchangeRaw(ctx context.Context, msgBytes []byte) ([]byte, error) {
+	return r.exchange(ctx, msgBytes, false)
+}
+
+// exchange is ExchangeRaw, also dropping datagrams whose question differs
+// from the query byte for byte when exactQuestion is set
+func (r *UDP) exchange(ctx context.Context, msgBytes []byte, exactQuestion bool) ([]byte, error) {
+	start := time.Now()
+	conn, err := r.Dialer.DialContext(ctx, "udp", r.Addr)
+	if err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to connect to DNS server: %w", err))
+	}
+	defer conn.Close()
+	if _, ok := ctx.Deadline(); !ok {
+		conn.SetDeadline(time.Now().Add(udpTimeout))
+	}
+	defer bindContext(ctx, conn)()
+
+	logWire(ctx, "sending query", "udp", r.Addr, conn, msgBytes)
+	if _, err := conn.Write(msgBytes); err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to send DNS query: %w", err))
+	}
+
+	// Servers may ignore the advertised size, so accept any datagram.
+	// Datagrams with another ID are dropped like a stub resolver does, so
+	// a spoofed reply cannot take the place of the real one.
+	respBytes := make([]byte, dns.MaxMsgSize)
+	var n int
+	for {
+		n, err = conn.Read(respBytes)
+		if err != nil {
+			return nil, contextError(ctx, fmt.Errorf("failed to read DNS response: %w", err))
+		}
+		logWire(ctx, "received response", "udp", r.Addr, conn, respBytes[:n])
+		if n >= 2 && len(msgBytes) >= 2 && (respBytes[0] != msgBytes[0] || respBytes[1] != msgBytes[1]) {
+			slog.WarnContext(ctx, "ignored a UDP response with the wrong ID", "server", r.Addr, "id", int(respBytes[0])<<8|int(respBytes[1]))
+			continue
+		}
+		if exactQuestion && !sameQuestion(msgBytes, respBytes[:n]) {
+			slog.WarnContext(ctx, "ignored a UDP response without the 0x20 case of the question", "server", r.Addr)
+			continue
+		}
+		break
+	}
+
+	// The TC flag is bit 1 of the third header byte
+	if n >= 3 && respBytes[2]&0x02 != 0 {
+		return (&TCP{Addr: r.Addr, Dialer: r.Dialer}).ExchangeRaw(ctx, msgBytes)
+	}
+	recordTrace(ctx, "udp", r.Addr, start, len(msgBytes), n)
+	return respBytes[:n], nil
+}
+
+// mixCase returns name with the case of each letter chosen at random
+func mixCase(name string) string {
+	b := []byte(name)
+	bits := make([]byte, (len(b)+7)/8)
+	rand.Read(bits)
+	for i, c := range b {
+		if lower := c | 0x20; 'a' <= lower && lower <= 'z' {
+			b[i] = lower ^ (bits[i/8] >> (i % 8) & 1 << 5)
+		}
+	}
+	return string(b)
+}
+
+// restoreCase puts the name of the query back into resp where the server
+// echoed the 0x20 mixed version
+func restoreCase(resp *dns.Msg, mixed, name string) {
+	for i := range resp.Question {
+		if resp.Question[i].Name == mixed {
+			resp.Question[i].Name = name
+		}
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Name == mixed {
+				h.Name = name
+			}
+		}
+	}
+}
+
+// sameQuestion reports whether the packed response repeats the first
+// question of the packed query exactly, case included. A question name
+// right after the header is never compressed.
+func sameQuestion(query, resp []byte) bool {
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5 // the root label, type and class
+	if end > len(query) || end > len(resp) {
+		return false
+	}
+	return string(query[12:end]) == string(resp[12:end])
+}
@@ -0,0 +1,54 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// WireMessage is a DNS message as a transport sent or received it, after
+// decryption for the encrypted ones
+type WireMessage struct {
+	Time      time.Time
+	Transport string // as in Trace
+	Server    string // host:port or URL
+	// Local and Remote are the addresses of the socket, nil when the
+	// transport keeps them to itself, as HTTP clients do
+	Local, Remote net.Addr
+	Data          []byte // the message, a response when its QR bit is set
+}
+
+// endpoints is implemented by connections that know their addresses
+type endpoints interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+type wireTapKey struct{}
+
+// WithWireTap returns a context that makes transports pass every message
+// they send or receive to tap, which must not keep Data, after the taps
+// ctx already has
+func WithWireTap(ctx context.Context, tap func(WireMessage)) context.Context {
+	if prev, _ := ctx.Value(wireTapKey{}).(func(WireMessage)); prev != nil {
+		next := tap
+		tap = func(m WireMessage) {
+			prev(m)
+			next(m)
+		}
+	}
+	return context.WithValue(ctx, wireTapKey{}, tap)
+}
+
+// tapWire passes a message to the tap of ctx, if any
+func tapWire(ctx context.Context, transport, server string, conn endpoints, b []byte) {
+	tap, _ := ctx.Value(wireTapKey{}).(func(WireMessage))
+	if tap == nil {
+		return
+	}
+	m := WireMessage{Time: time.Now(), Transport: transport, Server: server, Data: b}
+	if conn != nil {
+		m.Local, m.Remote = conn.LocalAddr(), conn.RemoteAddr()
+	}
+	tap(m)
+}
@@ -0,0 +1,213 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Transfer fetches zones from a server over TCP, in full with AXFR (RFC
+// 5936) or as the changes since a known serial with IXFR (RFC 1995). The
+// response spans as many messages as the zone needs.
+type Transfer struct {
+	Addr string // host:port
+	// TSIG, when set, signs the request, and every response message must
+	// then carry a valid signature
+	TSIG *TSIGKey
+	// Dialer opens the connection, a plain net.Dialer when nil
+	Dialer *Dialer
+}
+
+// NewTransfer returns a Transfer from the server at the host:port address
+func NewTransfer(addr string, key *TSIGKey) *Transfer {
+	return &Transfer{Addr: addr, TSIG: key}
+}
+
+// AXFR returns all records of zone in the order the server sent them,
+// starting and ending with the zone's SOA record
+func (t *Transfer) AXFR(ctx context.Context, zone string) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(zone))
+	return t.transfer(ctx, m, 0)
+}
+
+// IXFR returns the changes to zone since serial in the IXFR format: the
+// current SOA, then for every version a deletion sequence and an addition
+// sequence each opened by a SOA, then the current SOA again. A lone SOA
+// means the zone is unchanged, and servers that cannot send the changes
+// answer with the whole zone as AXFR does; ApplyIXFR handles all three.
+func (t *Transfer) IXFR(ctx context.Context, zone string, serial uint32) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetIxfr(dns.Fqdn(zone), serial, ".", ".")
+	return t.transfer(ctx, m, serial)
+}
+
+func (t *Transfer) transfer(ctx context.Context, m *dns.Msg, serial uint32) ([]dns.RR, error) {
+	zone := m.Question[0].Name
+	var msgBytes []byte
+	var mac string
+	var err error
+	if t.TSIG != nil {
+		msgBytes, mac, err = t.TSIG.sign(m)
+	} else {
+		msgBytes, err = packQuery(m, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := (&TCP{Addr: t.Addr, Dialer: t.Dialer}).dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer bindContext(ctx, conn)()
+	if err := writeStreamMessage(conn, msgBytes); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	state := xfrState{ixfr: m.Question[0].Qtype == dns.TypeIXFR}
+	var records []dns.RR
+	for n := 0; ; n++ {
+		respBytes, err := readStreamMessage(conn)
+		if err != nil {
+			return nil, contextError(ctx, fmt.Errorf("transfer of %s after %d records: %w", zone, len(records), err))
+		}
+		resp, err := unpackResponse(respBytes)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Id != m.Id {
+			return nil, fmt.Errorf("response ID %d does not match query ID %d", resp.Id, m.Id)
+		}
+		if err := tsigError(resp); err != nil {
+			return nil, err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("transfer of %s refused: %w", zone, &RcodeError{Rcode: resp.Rcode})
+		}
+		if t.TSIG != nil {
+			if mac, err = t.TSIG.verify(respBytes, resp, mac, n > 0); err != nil {
+				return nil, fmt.Errorf("message %d of the transfer of %s: %w", n+1, zone, err)
+			}
+		}
+
+		for i, rr := range resp.Answer {
+			done, err := state.add(rr)
+			if err != nil {
+				return nil, fmt.Errorf("transfer of %s: %w", zone, err)
+			}
+			records = append(records, rr)
+			if done {
+				if i != len(resp.Answer)-1 {
+					return nil, fmt.Errorf("transfer of %s: records after the closing SOA", zone)
+				}
+				return records, nil
+			}
+		}
+		// An IXFR answer of just the SOA says the zone has not changed
+		if state.ixfr && len(records) == 1 && !serialNewer(state.serial, serial) {
+			return records, nil
+		}
+	}
+}
+
+// xfrState follows the records of a transfer to find where it ends
+type xfrState struct {
+	ixfr   bool   // an IXFR was requested
+	n      int    // records seen
+	diffs  bool   // the response is incremental rather than a full zone
+	del    bool   // the next SOA of an incremental response opens deletions
+	serial uint32 // serial of the opening SOA, the current version
+}
+
+// add reports whether rr is the closing SOA of the transfer
+func (s *xfrState) add(rr dns.RR) (bool, error) {
+	soa, isSOA := rr.(*dns.SOA)
+	s.n++
+	switch {
+	case s.n == 1:
+		if !isSOA {
+			return false, fmt.Errorf("response does not start with a SOA record")
+		}
+		s.serial = soa.Serial
+		return false, nil
+	case !isSOA:
+		return false, nil
+	case s.n == 2 && s.ixfr && soa.Serial != s.serial:
+		// Opens the deletions from the client's version
+		s.diffs = true
+		return false, nil
+	case !s.diffs:
+		return true, nil
+	case s.del && soa.Serial == s.serial:
+		return true, nil
+	default:
+		s.del = !s.del
+		return false, nil
+	}
+}
+
+// serialNewer reports whether serial a is newer than b in the serial number
+// arithmetic of RFC 1982
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// ApplyIXFR applies the result of an IXFR to the records of the zone at the
+// client's version, which start with its SOA, and returns the zone at the
+// current version, again starting with its SOA. A full-zone answer
+// replaces the records.
+func ApplyIXFR(zone, ixfr []dns.RR) ([]dns.RR, error) {
+	if len(ixfr) == 0 {
+		return nil, fmt.Errorf("empty IXFR response")
+	}
+	if len(zone) == 0 {
+		return nil, fmt.Errorf("no zone to apply the IXFR response to")
+	}
+	current, ok := zone[0].(*dns.SOA)
+	if !ok {
+		return nil, fmt.Errorf("zone does not start with a SOA record")
+	}
+	if len(ixfr) == 1 {
+		return zone, nil
+	}
+	if _, ok := ixfr[1].(*dns.SOA); !ok || len(ixfr) == 2 {
+		// A full zone, with the SOA at both ends
+		return ixfr[:len(ixfr)-1], nil
+	}
+
+	records := append([]dns.RR{}, zone[1:]...)
+	deleting := false
+	for _, rr := range ixfr[1 : len(ixfr)-1] {
+		if soa, ok := rr.(*dns.SOA); ok {
+			deleting = !deleting
+			if deleting {
+				if soa.Serial != current.Serial {
+					return nil, fmt.Errorf("IXFR deletes from serial %d, but the zone is at serial %d", soa.Serial, current.Serial)
+				}
+			} else {
+				current = soa
+			}
+			continue
+		}
+		if deleting {
+			records = removeRR(records, rr)
+		} else {
+			records = append(records, rr)
+		}
+	}
+	return append([]dns.RR{current}, records...), nil
+}
+
+// removeRR removes the records equal to rr, ignoring their TTLs
+func removeRR(records []dns.RR, rr dns.RR) []dns.RR {
+	kept := records[:0]
+	for _, r := range records {
+		if !dns.IsDuplicate(r, rr) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
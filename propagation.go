@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// publicResolver is a resolver that propagation asks
+type publicResolver struct {
+	name     string
+	location string
+	server   string // as given to -server
+	server6  string // used instead with -6, "" leaves it out
+}
+
+// publicResolvers are the open resolvers propagation asks by default: the
+// big anycast services and regional ones that cache on their own
+var publicResolvers = []publicResolver{
+	{"Google", "anycast", "8.8.8.8", "2001:4860:4860::8888"},
+	{"Google", "anycast", "8.8.4.4", "2001:4860:4860::8844"},
+	{"Cloudflare", "anycast", "1.1.1.1", "2606:4700:4700::1111"},
+	{"Cloudflare", "anycast", "1.0.0.1", "2606:4700:4700::1001"},
+	{"Quad9", "anycast", "9.9.9.9", "2620:fe::fe"},
+	{"Quad9", "anycast", "149.112.112.112", "2620:fe::9"},
+	{"OpenDNS", "anycast", "208.67.222.222", "2620:119:35::35"},
+	{"OpenDNS", "anycast", "208.67.220.220", "2620:119:53::53"},
+	{"AdGuard", "anycast", "94.140.14.140", "2a10:50c0::1:ff"},
+	{"Control D", "anycast", "76.76.2.0", "2606:1a40::"},
+	{"Hurricane Electric", "US", "74.82.42.42", "2001:470:20::2"},
+	{"CIRA Canadian Shield", "Canada", "149.112.121.10", "2620:10a:80bb::10"},
+	{"DNS.WATCH", "Germany", "84.200.69.80", "2001:1608:10:25::1c04:b12f"},
+	{"UncensoredDNS", "Denmark", "91.239.100.100", "2001:67c:28a4::"},
+	{"Yandex", "Russia", "77.88.8.8", "2a02:6b8::feed:0ff"},
+	{"114DNS", "China", "114.114.114.114", ""},
+	{"AliDNS", "China", "223.5.5.5", "2400:3200::1"},
+	{"DNSPod", "China", "119.29.29.29", ""},
+	{"Quad101", "Taiwan", "101.101.101.101", "2001:de4::101"},
+}
+
+// propagationResult is what one resolver answered
+type propagationResult struct {
+	resolver publicResolver
+	resp     *dns.Msg
+	err      error
+	data     []string // data of the records of the queried type, sorted
+	ttl      uint32
+	updated  bool
+}
+
+// runPropagation implements the propagation subcommand: it asks public
+// resolvers around the world for a record and reports which of them have
+// the new value, given with -expect or else taken from the authoritative
+// servers. It exits with status 1 until all of them have it.
+func runPropagation(args []string) {
+	fs := flag.NewFlagSet("propagation", flag.ExitOnError)
+	typeName := fs.String("type", "A", "record `type` to query")
+	expect := fs.String("expect", "", "the new record data, comma separated `values` such as 192.0.2.10 (default the answer of the authoritative servers)")
+	resolversFile := fs.String("resolvers", "", "also ask the resolvers in this `file`, a name, a server as given to -server and optionally a location per line")
+	builtin := fs.Bool("builtin", true, "ask the built-in list of public resolvers, -builtin=false asks only those of -resolvers")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each resolver after this `duration`")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s propagation [flags] <domain> [type]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "propagation"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) < 1 || len(args) > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if len(args) == 2 {
+		*typeName = args[1]
+	}
+	qtype, err := parseType(*typeName)
+	if err != nil {
+		fatal(err.Error())
+	}
+	domain, err := toASCII(args[0])
+	if err != nil {
+		fatal(err.Error())
+	}
+	domain = dns.Fqdn(domain)
+
+	var resolvers []publicResolver
+	if *builtin {
+		resolvers = append(resolvers, publicResolvers...)
+	}
+	if *resolversFile != "" {
+		extra, err := readPublicResolvers(*resolversFile)
+		if err != nil {
+			fatal("failed to read the resolvers", "err", err)
+		}
+		resolvers = append(resolvers, extra...)
+	}
+	if opts.ipv6 {
+		resolvers = slices.DeleteFunc(resolvers, func(p publicResolver) bool { return p.server6 == "" })
+	}
+	if len(resolvers) == 0 {
+		fatal("no resolvers to ask")
+	}
+
+	want := splitValues(*expect)
+	source := "-expect"
+	if len(want) == 0 {
+		if want, err = authoritativeData(domain, qtype, *timeout, opts.family()); err != nil {
+			fatal("failed to ask the authoritative servers, give the new value with -expect", "err", err)
+		}
+		source = "the authoritative servers"
+	}
+
+	results := make([]propagationResult, len(resolvers))
+	var wg sync.WaitGroup
+	for i, p := range resolvers {
+		server := p.server
+		if opts.ipv6 {
+			server = p.server6
+		}
+		upstreams, err := parseUpstreams("udp", server, 0)
+		if err != nil {
+			fatal(err.Error(), "resolver", p.name)
+		}
+		r, err := opts.buildResolver(upstreams)
+		if err != nil {
+			fatal(err.Error())
+		}
+		results[i].resolver = p
+		wg.Add(1)
+		go func(res *propagationResult) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			res.resp, res.err = r.Query(ctx, domain, qtype)
+			if res.err == nil {
+				res.data, res.ttl = recordData(res.resp, qtype)
+				if len(res.data) == 0 {
+					res.ttl = negativeTTL(res.resp)
+				}
+				res.updated = hasValues(res.data, want, source == "-expect")
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	fmt.Printf("New value of %s %s from %s: %s\n\n", domain, typeString(qtype), source, describeData(want))
+	updated := printPropagation(results, opts.ipv6)
+	fmt.Printf("\n%d of %d resolvers have the new value\n", updated, len(results))
+	if updated == len(results) {
+		return
+	}
+	var stale uint32
+	for _, res := range results {
+		if res.err == nil && !res.updated {
+			stale = max(stale, res.ttl)
+		}
+	}
+	if stale > 0 {
+		fmt.Printf("The other answers expire from those caches within %v\n", time.Duration(stale)*time.Second)
+	}
+	os.Exit(1)
+}
+
+// readPublicResolvers reads a -resolvers file, skipping blank lines and #
+// comments
+func readPublicResolvers(path string) ([]publicResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var resolvers []publicResolver
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: want a name and a server", path, line)
+		}
+		p := publicResolver{name: fields[0], server: fields[1], server6: fields[1]}
+		if len(fields) > 2 {
+			p.location = strings.Join(fields[2:], " ")
+		}
+		resolvers = append(resolvers, p)
+	}
+	return resolvers, scanner.Err()
+}
+
+// authoritativeData resolves the record from the root, so that no cache
+// stands between the answer and the zone
+func authoritativeData(name string, qtype uint16, timeout time.Duration, family int) ([]string, error) {
+	it := resolver.NewIterator()
+	it.Family = family
+	it.Timeout = timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 4*timeout)
+	defer cancel()
+	resp, err := it.Query(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("the authoritative servers answer %s", rcodeString(resp.Rcode))
+	}
+	data, _ := recordData(resp, qtype)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("the authoritative servers have no %s records for %s", typeString(qtype), name)
+	}
+	return data, nil
+}
+
+// recordData returns the data of the answer records of type qtype, sorted
+// and normalized, and the smallest TTL among them
+func recordData(resp *dns.Msg, qtype uint16) ([]string, uint32) {
+	var data []string
+	var ttl uint32
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		if len(data) == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		data = append(data, normalizeValue(rrData(rr)))
+	}
+	sort.Strings(data)
+	return data, ttl
+}
+
+// negativeTTL is how long a denial is cached, RFC 2308 section 5
+func negativeTTL(resp *dns.Msg) uint32 {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	return 0
+}
+
+// splitValues splits the -expect list and normalizes its values
+func splitValues(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, normalizeValue(v))
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// normalizeValue lowercases record data and strips the dot that ends
+// names, so that values typed on the command line match
+func normalizeValue(v string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(v)), ".")
+}
+
+// hasValues reports whether data is the new value: the same records as
+// want, or with -expect at least those given
+func hasValues(data, want []string, subset bool) bool {
+	if !subset {
+		return slices.Equal(data, want)
+	}
+	for _, v := range want {
+		if !slices.Contains(data, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func describeData(data []string) string {
+	if len(data) == 0 {
+		return "no records"
+	}
+	return strings.Join(data, ", ")
+}
+
+// printPropagation prints a line per resolver and returns how many have
+// the new value
+func printPropagation(results []propagationResult, ipv6 bool) int {
+	updated := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOLVER\tSERVER\tLOCATION\tSTATUS\tTTL\tANSWER")
+	for _, res := range results {
+		p := res.resolver
+		server := p.server
+		if ipv6 {
+			server = p.server6
+		}
+		location := p.location
+		if location == "" {
+			location = "-"
+		}
+		switch {
+		case res.err != nil:
+			fmt.Fprintf(w, "%s\t%s\t%s\tERROR\t-\t%v\n", p.name, server, location, res.err)
+			continue
+		case res.updated:
+			updated++
+			fmt.Fprintf(w, "%s\t%s\t%s\tnew\t%d\t%s\n", p.name, server, location, res.ttl, describeData(res.data))
+		case res.resp.Rcode != dns.RcodeSuccess:
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t-\n", p.name, server, location, rcodeString(res.resp.Rcode), res.ttl)
+		default:
+			fmt.Fprintf(w, "%s\t%s\t%s\told\t%d\t%s\n", p.name, server, location, res.ttl, describeData(res.data))
+		}
+	}
+	w.Flush()
+	return updated
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// craftOptions control the expert-only message crafting used to test how
+// servers cope with technically invalid queries. None of this is needed for
+// normal lookups.
+type craftOptions struct {
+	rawHex  string // complete message in hex or base64, sent verbatim
+	rawFile string // file holding a complete message in wire format, - for standard input
+	answers stringList
+	counts  [4]int // QDCOUNT, ANCOUNT, NSCOUNT, ARCOUNT overrides, -1 keeps the real value
+}
+
+// stringList collects a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// active reports whether any crafting option was given
+func (c *craftOptions) active() bool {
+	if c.rawHex != "" || c.rawFile != "" || len(c.answers) > 0 {
+		return true
+	}
+	for _, n := range c.counts {
+		if n >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// craftQuery builds the wire bytes for a crafted query. A raw message is
+// decoded and used as is; otherwise a normal query is built, the extra answer
+// records are added and the header counts are overwritten after packing, which
+// bypasses every consistency check done by the dns package.
+func craftQuery(domain string, qtype uint16, c *craftOptions) ([]byte, error) {
+	var msgBytes []byte
+	switch {
+	case c.rawHex != "" && c.rawFile != "":
+		return nil, fmt.Errorf("-raw and -raw-file exclude each other")
+	case c.rawHex != "":
+		b, err := decodeRawMessage(c.rawHex)
+		if err != nil {
+			return nil, err
+		}
+		msgBytes = b
+	case c.rawFile == "-":
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the raw message: %v", err)
+		}
+		msgBytes = b
+	case c.rawFile != "":
+		b, err := os.ReadFile(c.rawFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the raw message: %v", err)
+		}
+		msgBytes = b
+	default:
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(domain), qtype)
+		m.RecursionDesired = true
+		for _, s := range c.answers {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid answer record %q: %v", s, err)
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+		b, err := m.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pack DNS message: %v", err)
+		}
+		msgBytes = b
+	}
+
+	for i, n := range c.counts {
+		if n < 0 {
+			continue
+		}
+		if len(msgBytes) < 12 {
+			return nil, fmt.Errorf("message too short (%d bytes) to override header counts", len(msgBytes))
+		}
+		binary.BigEndian.PutUint16(msgBytes[4+2*i:], uint16(n))
+	}
+	return msgBytes, nil
+}
+
+// decodeRawMessage decodes a message given in hex, with any spacing, or in
+// base64, standard or URL safe as in DoH GET requests, padded or not
+func decodeRawMessage(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid raw message, want hex or base64")
+}
+
+// newWireDump returns a wire tap printing every message in format, hex or
+// base64, before the usual output
+func newWireDump(format string) (func(resolver.WireMessage), error) {
+	var encode func([]byte) string
+	switch strings.ToLower(format) {
+	case "hex":
+		encode = hex.Dump
+	case "base64":
+		encode = func(b []byte) string { return base64.StdEncoding.EncodeToString(b) + "\n" }
+	default:
+		return nil, fmt.Errorf("invalid -wire format %q, use hex or base64", format)
+	}
+	var mu sync.Mutex
+	return func(m resolver.WireMessage) {
+		what, dir := "Query", "to"
+		if len(m.Data) > 2 && m.Data[2]&0x80 != 0 {
+			what, dir = "Response", "from"
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Printf(";; %s, %d bytes, %s %s %s\n%s\n", what, len(m.Data), m.Transport, dir, m.Server, encode(m.Data))
+	}, nil
+}
+
+// printRawReply shows the reply as a DNS message when it parses and falls
+// back to a hex dump when it does not
+func printRawReply(reply []byte) {
+	resp := new(dns.Msg)
+	if err := resp.Unpack(reply); err != nil {
+		fmt.Printf("Reply (%d bytes) could not be parsed: %v\n", len(reply), err)
+		fmt.Print(hex.Dump(reply))
+		return
+	}
+	fmt.Println(resp)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// Default DNSBL zones for IP addresses and for domains
+var (
+	defaultIPZones     = []string{"zen.spamhaus.org", "bl.spamcop.net", "b.barracudacentral.org", "dnsbl.sorbs.net", "psbl.surriel.com"}
+	defaultDomainZones = []string{"dbl.spamhaus.org", "multi.surbl.org", "multi.uribl.com"}
+)
+
+// rblCodes maps the return codes of well-known zones onto what they mean
+var rblCodes = map[string]map[string]string{
+	"zen.spamhaus.org": {
+		"127.0.0.2":  "SBL: spam source",
+		"127.0.0.3":  "SBL CSS: snowshoe spam",
+		"127.0.0.4":  "XBL: exploited or infected host",
+		"127.0.0.5":  "XBL: exploited or infected host",
+		"127.0.0.6":  "XBL: exploited or infected host",
+		"127.0.0.7":  "XBL: exploited or infected host",
+		"127.0.0.9":  "DROP: hijacked or leased to spammers",
+		"127.0.0.10": "PBL: end-user range (ISP)",
+		"127.0.0.11": "PBL: end-user range (Spamhaus)",
+	},
+	"dbl.spamhaus.org": {
+		"127.0.1.2":   "spam domain",
+		"127.0.1.4":   "phishing domain",
+		"127.0.1.5":   "malware domain",
+		"127.0.1.6":   "botnet C&C domain",
+		"127.0.1.102": "abused legit spam",
+		"127.0.1.103": "abused legit spammed redirector",
+		"127.0.1.104": "abused legit phish",
+		"127.0.1.105": "abused legit malware",
+		"127.0.1.106": "abused legit botnet C&C",
+	},
+	"dnsbl.sorbs.net": {
+		"127.0.0.2":  "open HTTP proxy",
+		"127.0.0.3":  "open SOCKS proxy",
+		"127.0.0.4":  "open proxy",
+		"127.0.0.5":  "open SMTP relay",
+		"127.0.0.6":  "spam source",
+		"127.0.0.7":  "vulnerable web server",
+		"127.0.0.8":  "asked not to be tested",
+		"127.0.0.9":  "zombie network",
+		"127.0.0.10": "dynamic IP range",
+		"127.0.0.11": "bad configuration",
+		"127.0.0.12": "sends no mail",
+		"127.0.0.14": "no server",
+	},
+	"bl.spamcop.net":         {"127.0.0.2": "spam source"},
+	"b.barracudacentral.org": {"127.0.0.2": "poor reputation"},
+	"psbl.surriel.com":       {"127.0.0.2": "spam source"},
+}
+
+// rblBits maps the bits of the last octet of zones that combine their
+// lists in one code onto the lists
+var rblBits = map[string][]rblBit{
+	"multi.surbl.org": {{8, "phishing"}, {16, "malware"}, {64, "abuse"}, {128, "cracked site"}},
+	"multi.uribl.com": {{2, "black"}, {4, "grey"}, {8, "red"}, {16, "gold"}},
+}
+
+type rblBit struct {
+	bit  byte
+	list string
+}
+
+// rblErrorCodes are the codes Spamhaus answers with when it refuses a
+// query, which say nothing about the address or domain
+var rblErrorCodes = map[string]string{
+	"127.255.255.252": "query error: typo in the zone name",
+	"127.255.255.254": "query refused: public or open resolvers are not allowed, use your own resolver",
+	"127.255.255.255": "query refused: too many queries",
+}
+
+// rblResult is the lookup of one target in one zone
+type rblResult struct {
+	Zone    string   `json:"zone"`
+	Listed  bool     `json:"listed"`
+	Codes   []string `json:"codes,omitempty"`
+	Reasons []string `json:"reasons,omitempty"` // the decoded codes
+	TXT     string   `json:"txt,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// rblCheck is the lookups of one IP address or domain
+type rblCheck struct {
+	Target  string      `json:"target"`
+	Query   string      `json:"query"` // the name looked up under each zone
+	Results []rblResult `json:"results"`
+}
+
+// runRBL implements the rbl subcommand: it checks IP addresses and domains
+// against DNS blocklists, querying the A record of the reversed address, or
+// the domain, under each zone and decoding the return codes. It exits with
+// status 1 when a target is listed anywhere.
+func runRBL(args []string) {
+	fs := flag.NewFlagSet("rbl", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	zonesFlag := fs.String("zones", "", "comma separated DNSBL `zones` to check (default "+strings.Join(defaultIPZones, ",")+" for addresses and "+strings.Join(defaultDomainZones, ",")+" for domains)")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each lookup after this `duration`")
+	jsonOut := fs.Bool("json", false, "print the results as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rbl [flags] <address or domain>...\n\nPublic blocklists such as Spamhaus refuse queries from public resolvers, so query your own resolver with -server.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "rbl"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var zones []string
+	for _, zone := range strings.Split(*zonesFlag, ",") {
+		if zone = strings.Trim(strings.TrimSpace(zone), "."); zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+	l := &srvLookup{r: r, timeout: *timeout}
+
+	checks := make([]rblCheck, len(args))
+	for i, target := range args {
+		query, ip, err := rblQuery(target)
+		if err != nil {
+			fatal(err.Error())
+		}
+		checkZones := zones
+		if checkZones == nil {
+			checkZones = defaultDomainZones
+			if ip {
+				checkZones = defaultIPZones
+			}
+		}
+		checks[i] = rblCheck{Target: target, Query: query, Results: make([]rblResult, len(checkZones))}
+		for j, zone := range checkZones {
+			checks[i].Results[j].Zone = zone
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range checks {
+		for j := range checks[i].Results {
+			wg.Add(1)
+			go func(query string, res *rblResult) {
+				defer wg.Done()
+				l.rbl(query, res)
+			}(checks[i].Query, &checks[i].Results[j])
+		}
+	}
+	wg.Wait()
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(checks); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printRBL(checks)
+	}
+	for _, c := range checks {
+		for _, res := range c.Results {
+			if res.Listed {
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// rblQuery returns the name to look up under each zone for target: the
+// octets of an IPv4 address or the nibbles of an IPv6 address in reverse,
+// as for reverse DNS, or a domain as it is. It also reports whether target
+// is an address.
+func rblQuery(target string) (string, bool, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		arpa, err := dns.ReverseAddr(target)
+		if err != nil {
+			return "", false, err
+		}
+		if ip.To4() != nil {
+			return strings.TrimSuffix(arpa, "in-addr.arpa."), true, nil
+		}
+		return strings.TrimSuffix(arpa, "ip6.arpa."), true, nil
+	}
+	name, err := toASCII(target)
+	if err != nil {
+		return "", false, err
+	}
+	invalid := func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.')
+	}
+	if _, ok := dns.IsDomainName(name); !ok || strings.Trim(name, ".") == "" || strings.IndexFunc(name, invalid) >= 0 {
+		return "", false, fmt.Errorf("%q is neither an IP address nor a domain", target)
+	}
+	return dns.Fqdn(strings.ToLower(name)), false, nil
+}
+
+// rbl looks up query under the zone of res and fills in the result. An
+// NXDOMAIN means not listed; listings are A records in 127.0.0.0/8, whose
+// reason list operators often give in a TXT record as well.
+func (l *srvLookup) rbl(query string, res *rblResult) {
+	name := query + res.Zone + "."
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	ctx = resolver.WithTraceID(ctx, resolver.NewTraceID())
+	resp, err := l.r.Query(ctx, name, dns.TypeA)
+	if err != nil {
+		res.Error = err.Error()
+		return
+	}
+	switch resp.Rcode {
+	case dns.RcodeNameError:
+		return
+	case dns.RcodeSuccess:
+	default:
+		res.Error = rcodeString(resp.Rcode)
+		return
+	}
+	for _, rr := range resp.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		code := a.A.String()
+		if msg, ok := rblErrorCodes[code]; ok && strings.HasSuffix(res.Zone, "spamhaus.org") {
+			res.Error = msg
+			return
+		}
+		if !a.A.IsLoopback() {
+			res.Error = fmt.Sprintf("unexpected answer %s, the resolver may rewrite NXDOMAIN", code)
+			return
+		}
+		res.Codes = append(res.Codes, code)
+		res.Reasons = append(res.Reasons, rblReasons(res.Zone, a.A)...)
+	}
+	if res.Listed = len(res.Codes) > 0; !res.Listed {
+		return
+	}
+	if resp, err := l.r.Query(ctx, name, dns.TypeTXT); err == nil {
+		for _, rr := range resp.Answer {
+			if txt, ok := rr.(*dns.TXT); ok {
+				res.TXT = strings.Join(txt.Txt, "")
+				break
+			}
+		}
+	}
+}
+
+// rblReasons decodes one return code of zone, or gives none when the zone
+// is not a known one
+func rblReasons(zone string, code net.IP) []string {
+	zone = strings.ToLower(zone)
+	if codes, ok := rblCodes[zone]; ok {
+		if reason, ok := codes[code.String()]; ok {
+			return []string{reason}
+		}
+		return nil
+	}
+	var reasons []string
+	if bits, ok := rblBits[zone]; ok {
+		last := code.To4()[3]
+		for _, b := range bits {
+			if last&b.bit != 0 {
+				reasons = append(reasons, b.list)
+			}
+		}
+	}
+	return reasons
+}
+
+// printRBL prints a line per zone under each target: listed or not, with
+// the decoded codes and the TXT reason
+func printRBL(checks []rblCheck) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, c := range checks {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s:\n", c.Target)
+		for _, res := range c.Results {
+			status, details := "ok", ""
+			switch {
+			case res.Error != "":
+				status, details = "error", res.Error
+			case res.Listed:
+				status = "LISTED"
+				details = strings.Join(res.Codes, ", ")
+				if len(res.Reasons) > 0 {
+					details += " (" + strings.Join(res.Reasons, ", ") + ")"
+				}
+				if res.TXT != "" {
+					details += ": " + res.TXT
+				}
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", res.Zone, status, details)
+		}
+	}
+	w.Flush()
+}
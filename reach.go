@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// connectionAttemptDelay is the time Happy Eyeballs waits for a connection
+// attempt before starting the next one (RFC 8305 section 5)
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// reachAttempt is one TCP connection attempt to an address of the host
+type reachAttempt struct {
+	Address   string  `json:"address"`
+	Family    string  `json:"family"`
+	Connected bool    `json:"connected"`
+	RTTMillis float64 `json:"rtt_ms,omitempty"` // the time the handshake took
+	Error     string  `json:"error,omitempty"`
+
+	rtt time.Duration
+}
+
+// reachFamily sums up the attempts over one address family
+type reachFamily struct {
+	Family     string  `json:"family"`
+	Addresses  int     `json:"addresses"`
+	Reachable  int     `json:"reachable"`
+	BestMillis float64 `json:"best_ms,omitempty"`
+	DNSError   string  `json:"dns_error,omitempty"`
+}
+
+// reachWinner is the connection Happy Eyeballs would end up with
+type reachWinner struct {
+	Address    string  `json:"address"`
+	Family     string  `json:"family"`
+	AfterMilli float64 `json:"after_ms"`
+}
+
+// reachJSON is the -json rendering of the reach subcommand
+type reachJSON struct {
+	Host          string         `json:"host"`
+	Port          int            `json:"port"`
+	Attempts      []reachAttempt `json:"attempts"`
+	Families      []reachFamily  `json:"families"`
+	HappyEyeballs *reachWinner   `json:"happy_eyeballs,omitempty"`
+}
+
+// runReach implements the reach subcommand: it resolves the A and AAAA
+// records of a host and connects to a TCP port on every address at once,
+// reporting which ones answer and how fast for each family, so that a name
+// that does not resolve can be told apart from a host that cannot be
+// reached. It exits with status 1 when no address is reachable.
+func runReach(args []string) {
+	fs := flag.NewFlagSet("reach", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "DNS server `port` for servers given without one")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on the lookup after this `duration`")
+	connectTimeout := fs.Duration("connect-timeout", 3*time.Second, "give up on each connection after this `duration`")
+	jsonOut := fs.Bool("json", false, "print the attempts and the summary as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s reach [flags] <host> <port>\n       %s reach [flags] <host:port>\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "reach"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	host, tcpPort, err := reachTarget(args)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		os.Exit(2)
+	}
+	domain, err := toASCII(host)
+	if err != nil {
+		fatal(err.Error())
+	}
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	out := reachJSON{Host: host, Port: tcpPort, Attempts: []reachAttempt{}}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		family := reachFamily{Family: "IPv6"}
+		if qtype == dns.TypeA {
+			family.Family = "IPv4"
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			// An address is reached as it is
+			if (ip.To4() != nil) == (qtype == dns.TypeA) {
+				out.Attempts = append(out.Attempts, reachAttempt{Address: ip.String(), Family: family.Family})
+			}
+			out.Families = append(out.Families, family)
+			continue
+		}
+		res := followChain(ctx, r, dns.Fqdn(domain), qtype, defaultChainDepth)
+		switch {
+		case res.err != nil:
+			family.DNSError = res.err.Error()
+		case res.rcode != dns.RcodeSuccess:
+			family.DNSError = rcodeString(res.rcode)
+		case len(res.addrs) == 0:
+			family.DNSError = "no " + typeString(qtype) + " records"
+		}
+		for _, addr := range res.addrs {
+			out.Attempts = append(out.Attempts, reachAttempt{Address: addr.Address, Family: family.Family})
+		}
+		out.Families = append(out.Families, family)
+	}
+
+	var wg sync.WaitGroup
+	for i := range out.Attempts {
+		wg.Add(1)
+		go func(a *reachAttempt) {
+			defer wg.Done()
+			a.connect(tcpPort, *connectTimeout)
+		}(&out.Attempts[i])
+	}
+	wg.Wait()
+	for i := range out.Families {
+		f := &out.Families[i]
+		for _, a := range out.Attempts {
+			if a.Family != f.Family {
+				continue
+			}
+			f.Addresses++
+			if a.Connected {
+				f.Reachable++
+				if f.BestMillis == 0 || a.RTTMillis < f.BestMillis {
+					f.BestMillis = a.RTTMillis
+				}
+			}
+		}
+	}
+	out.HappyEyeballs = happyEyeballs(out.Attempts)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printReach(out)
+	}
+	if out.HappyEyeballs == nil {
+		os.Exit(1)
+	}
+}
+
+// reachTarget takes the host and port from the arguments
+func reachTarget(args []string) (string, int, error) {
+	var host, portText string
+	switch len(args) {
+	case 1:
+		var err error
+		if host, portText, err = net.SplitHostPort(args[0]); err != nil {
+			return "", 0, fmt.Errorf("want a host and a port: %v", err)
+		}
+	case 2:
+		host, portText = args[0], args[1]
+	default:
+		return "", 0, fmt.Errorf("want a host and a port")
+	}
+	tcpPort, err := strconv.Atoi(portText)
+	if err != nil {
+		if tcpPort, err = net.LookupPort("tcp", portText); err != nil {
+			return "", 0, fmt.Errorf("invalid port %q", portText)
+		}
+	}
+	if tcpPort < 1 || tcpPort > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", portText)
+	}
+	return host, tcpPort, nil
+}
+
+// connect opens a TCP connection to the address and closes it again,
+// recording how long the handshake took or why it failed
+func (a *reachAttempt) connect(port int, timeout time.Duration) {
+	d := net.Dialer{Timeout: timeout}
+	start := time.Now()
+	conn, err := d.Dial("tcp", net.JoinHostPort(a.Address, strconv.Itoa(port)))
+	a.rtt = time.Since(start)
+	if err != nil {
+		a.Error = dialError(err)
+		return
+	}
+	conn.Close()
+	a.Connected = true
+	a.RTTMillis = float64(a.rtt.Microseconds()) / 1000
+}
+
+// dialError names the usual ways a connection fails
+func dialError(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "network unreachable"
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return "host unreachable"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timed out"
+	}
+	return err.Error()
+}
+
+// happyEyeballs works out which connection a Happy Eyeballs client (RFC
+// 8305) would get from the attempts, which all started at once: it tries
+// the addresses alternating between the families, IPv6 first, starting
+// the next attempt when the previous one fails or after
+// connectionAttemptDelay, and keeps the first to connect. It returns nil
+// when none does.
+func happyEyeballs(attempts []reachAttempt) *reachWinner {
+	var v6, v4 []reachAttempt
+	for _, a := range attempts {
+		if a.Family == "IPv6" {
+			v6 = append(v6, a)
+		} else {
+			v4 = append(v4, a)
+		}
+	}
+	var order []reachAttempt
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			order = append(order, v6[i])
+		}
+		if i < len(v4) {
+			order = append(order, v4[i])
+		}
+	}
+	var winner *reachAttempt
+	var best, start time.Duration
+	for i := range order {
+		a := &order[i]
+		if a.Connected && (winner == nil || start+a.rtt < best) {
+			winner, best = a, start+a.rtt
+		}
+		next := connectionAttemptDelay
+		if !a.Connected && a.rtt < next {
+			next = a.rtt
+		}
+		if start += next; winner != nil && start >= best {
+			break
+		}
+	}
+	if winner == nil {
+		return nil
+	}
+	return &reachWinner{Address: winner.Address, Family: winner.Family, AfterMilli: float64(best.Microseconds()) / 1000}
+}
+
+// printReach prints a line per attempt, the fastest first within each
+// family, then the summary of each family and the Happy Eyeballs pick
+func printReach(out reachJSON) {
+	sort.SliceStable(out.Attempts, func(i, j int) bool {
+		a, b := out.Attempts[i], out.Attempts[j]
+		if a.Family != b.Family {
+			return a.Family == "IPv6"
+		}
+		return a.Connected && (!b.Connected || a.rtt < b.rtt)
+	})
+	fmt.Printf("%s port %d\n", out.Host, out.Port)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, a := range out.Attempts {
+		status := a.Error
+		if a.Connected {
+			status = fmt.Sprintf("connected in %.1f ms", a.RTTMillis)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", a.Family, a.Address, status)
+	}
+	w.Flush()
+	for _, f := range out.Families {
+		switch {
+		case f.Addresses == 0 && f.DNSError != "":
+			fmt.Printf("%s: no addresses (%s)\n", f.Family, f.DNSError)
+		case f.Addresses == 0:
+			fmt.Printf("%s: no addresses\n", f.Family)
+		case f.Reachable == 0:
+			fmt.Printf("%s: unreachable, 0 of %d addresses\n", f.Family, f.Addresses)
+		default:
+			fmt.Printf("%s: reachable, %d of %d addresses, best %.1f ms\n", f.Family, f.Reachable, f.Addresses, f.BestMillis)
+		}
+	}
+	if he := out.HappyEyeballs; he != nil {
+		fmt.Printf("Happy Eyeballs: %s to %s after %.1f ms\n", he.Family, he.Address, he.AfterMilli)
+	} else {
+		fmt.Println("Happy Eyeballs: no connection")
+	}
+}
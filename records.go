@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// jsonTXT is the decoded form of a TXT record: its character strings, which
+// hold at most 255 bytes each, and the text they make joined
+type jsonTXT struct {
+	Text    string   `json:"text"`
+	Strings []string `json:"strings"`
+}
+
+// jsonSOA labels the fields of an SOA record, the timers in seconds
+type jsonSOA struct {
+	PrimaryNS string `json:"primary_ns"`
+	Contact   string `json:"contact"` // the mailbox as an email address
+	Serial    uint32 `json:"serial"`
+	Refresh   uint32 `json:"refresh"`
+	Retry     uint32 `json:"retry"`
+	Expire    uint32 `json:"expire"`
+	Minimum   uint32 `json:"minimum"` // the negative caching TTL (RFC 2308)
+}
+
+// jsonDNSKEY is the decoded form of a DNSKEY or CDNSKEY record
+type jsonDNSKEY struct {
+	KeyTag    uint16   `json:"key_tag"`
+	Flags     []string `json:"flags"`
+	Role      string   `json:"role"`
+	Algorithm string   `json:"algorithm"`
+	KeyBits   int      `json:"key_bits,omitempty"`
+}
+
+// jsonDS is the decoded form of a DS or CDS record
+type jsonDS struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  string `json:"algorithm"`
+	DigestType string `json:"digest_type"`
+}
+
+// jsonRRSIG is the decoded form of an RRSIG record
+type jsonRRSIG struct {
+	TypeCovered string    `json:"type_covered"`
+	Signer      string    `json:"signer"`
+	KeyTag      uint16    `json:"key_tag"`
+	Algorithm   string    `json:"algorithm"`
+	Inception   time.Time `json:"inception"`
+	Expiration  time.Time `json:"expiration"`
+}
+
+// newJSONTXT decodes a TXT record, or returns nil for others
+func newJSONTXT(rr dns.RR) *jsonTXT {
+	txt, ok := rr.(*dns.TXT)
+	if !ok {
+		return nil
+	}
+	out := &jsonTXT{Strings: make([]string, len(txt.Txt))}
+	for i, s := range txt.Txt {
+		out.Strings[i] = unescapeTXT(s)
+	}
+	out.Text = strings.Join(out.Strings, "")
+	return out
+}
+
+// newJSONSOA labels an SOA record, or returns nil for others
+func newJSONSOA(rr dns.RR) *jsonSOA {
+	soa, ok := rr.(*dns.SOA)
+	if !ok {
+		return nil
+	}
+	return &jsonSOA{PrimaryNS: soa.Ns, Contact: soaContact(soa.Mbox), Serial: soa.Serial, Refresh: soa.Refresh, Retry: soa.Retry, Expire: soa.Expire, Minimum: soa.Minttl}
+}
+
+// soaContact turns the RNAME of an SOA record into the email address it
+// stands for: the first unescaped dot is the @
+func soaContact(mbox string) string {
+	mbox = strings.TrimSuffix(mbox, ".")
+	for i := 0; i < len(mbox); i++ {
+		switch mbox[i] {
+		case '\\':
+			i++
+		case '.':
+			return strings.ReplaceAll(mbox[:i], `\.`, ".") + "@" + mbox[i+1:]
+		}
+	}
+	return mbox
+}
+
+// newJSONDNSKEY decodes a DNSKEY or CDNSKEY record, or returns nil for others
+func newJSONDNSKEY(rr dns.RR) *jsonDNSKEY {
+	var key *dns.DNSKEY
+	switch rr := rr.(type) {
+	case *dns.DNSKEY:
+		key = rr
+	case *dns.CDNSKEY:
+		key = &rr.DNSKEY
+	default:
+		return nil
+	}
+	out := &jsonDNSKEY{KeyTag: key.KeyTag(), Flags: []string{}, Algorithm: algorithmName(key.Algorithm), KeyBits: keyBits(key)}
+	for _, f := range []struct {
+		bit  uint16
+		name string
+	}{{dns.ZONE, "zone"}, {dns.REVOKE, "revoke"}, {dns.SEP, "sep"}} {
+		if key.Flags&f.bit != 0 {
+			out.Flags = append(out.Flags, f.name)
+		}
+	}
+	switch {
+	case key.Flags&dns.REVOKE != 0:
+		out.Role = "revoked"
+	case key.Flags&dns.ZONE == 0:
+		out.Role = "not a zone key"
+	case key.Flags&dns.SEP != 0:
+		out.Role = "KSK"
+	default:
+		out.Role = "ZSK"
+	}
+	return out
+}
+
+// keyBits returns the size of the public key of key, 0 when it cannot be
+// told
+func keyBits(key *dns.DNSKEY) int {
+	b, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil || len(b) == 0 {
+		return 0
+	}
+	switch key.Algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.RSAMD5:
+		// RFC 3110: the exponent length, in one byte or a zero and two, the
+		// exponent, then the modulus
+		n, rest := int(b[0]), b[1:]
+		if n == 0 && len(b) >= 3 {
+			n, rest = int(b[1])<<8|int(b[2]), b[3:]
+		}
+		if n >= len(rest) {
+			return 0
+		}
+		modulus := rest[n:]
+		for len(modulus) > 0 && modulus[0] == 0 {
+			modulus = modulus[1:]
+		}
+		if len(modulus) == 0 {
+			return 0
+		}
+		bits := len(modulus) * 8
+		for top := modulus[0]; top&0x80 == 0; top <<= 1 {
+			bits--
+		}
+		return bits
+	case dns.ECDSAP256SHA256, dns.ECDSAP384SHA384:
+		return len(b) / 2 * 8
+	case dns.ED25519:
+		return 256
+	case dns.ED448:
+		return 456
+	}
+	return 0
+}
+
+// newJSONDS decodes a DS or CDS record, or returns nil for others
+func newJSONDS(rr dns.RR) *jsonDS {
+	var ds *dns.DS
+	switch rr := rr.(type) {
+	case *dns.DS:
+		ds = rr
+	case *dns.CDS:
+		ds = &rr.DS
+	default:
+		return nil
+	}
+	return &jsonDS{KeyTag: ds.KeyTag, Algorithm: algorithmName(ds.Algorithm), DigestType: digestName(ds.DigestType)}
+}
+
+// newJSONRRSIG decodes an RRSIG record, or returns nil for others
+func newJSONRRSIG(rr dns.RR) *jsonRRSIG {
+	sig, ok := rr.(*dns.RRSIG)
+	if !ok {
+		return nil
+	}
+	return &jsonRRSIG{
+		TypeCovered: typeString(sig.TypeCovered),
+		Signer:      sig.SignerName,
+		KeyTag:      sig.KeyTag,
+		Algorithm:   algorithmName(sig.Algorithm),
+		Inception:   time.Unix(int64(sig.Inception), 0).UTC(),
+		Expiration:  time.Unix(int64(sig.Expiration), 0).UTC(),
+	}
+}
+
+// algorithmName names a DNSSEC algorithm with its number, as in
+// ECDSAP256SHA256 (13)
+func algorithmName(alg uint8) string {
+	if name, ok := dns.AlgorithmToString[alg]; ok {
+		return fmt.Sprintf("%s (%d)", name, alg)
+	}
+	return fmt.Sprintf("unknown (%d)", alg)
+}
+
+// digestName names a DS digest type with its number, as in SHA256 (2)
+func digestName(t uint8) string {
+	if name, ok := dns.HashToString[t]; ok {
+		return fmt.Sprintf("%s (%d)", name, t)
+	}
+	return fmt.Sprintf("unknown (%d)", t)
+}
+
+// describeRecord explains rr in lines for the default output, or returns
+// nil for types whose presentation form says it all
+func describeRecord(rr dns.RR) []string {
+	if lines := describeSVCB(rr); lines != nil {
+		return lines
+	}
+	rrtype := typeString(rr.Header().Rrtype)
+	if t := newJSONTXT(rr); t != nil && len(t.Strings) > 1 {
+		return []string{fmt.Sprintf("TXT of %d strings, joined: %s", len(t.Strings), strconv.Quote(t.Text))}
+	}
+	if s := newJSONSOA(rr); s != nil {
+		return []string{
+			fmt.Sprintf("SOA primary %s, contact %s, serial %d", s.PrimaryNS, s.Contact, s.Serial),
+			fmt.Sprintf("  refresh %s, retry %s, expire %s, negative TTL %s", ttlDuration(s.Refresh), ttlDuration(s.Retry), ttlDuration(s.Expire), ttlDuration(s.Minimum)),
+		}
+	}
+	if k := newJSONDNSKEY(rr); k != nil {
+		line := fmt.Sprintf("%s key tag %d, %s", rrtype, k.KeyTag, k.Role)
+		if len(k.Flags) > 0 {
+			line += " (" + strings.Join(k.Flags, ", ") + ")"
+		}
+		line += ", " + k.Algorithm
+		if k.KeyBits > 0 {
+			line += fmt.Sprintf(", %d-bit key", k.KeyBits)
+		}
+		return []string{line}
+	}
+	if d := newJSONDS(rr); d != nil {
+		return []string{fmt.Sprintf("%s for key tag %d, %s, digest %s", rrtype, d.KeyTag, d.Algorithm, d.DigestType)}
+	}
+	if s := newJSONRRSIG(rr); s != nil {
+		const layout = "2006-01-02 15:04 UTC"
+		return []string{fmt.Sprintf("RRSIG over %s by %s key tag %d, %s, valid %s to %s", s.TypeCovered, s.Signer, s.KeyTag, s.Algorithm, s.Inception.Format(layout), s.Expiration.Format(layout))}
+	}
+	return nil
+}
+
+// ttlDuration writes seconds the way zone files abbreviate them, then the
+// seconds themselves, as in 1d12h (129600)
+func ttlDuration(secs uint32) string {
+	if secs < 60 {
+		return fmt.Sprintf("%ds", secs)
+	}
+	var b strings.Builder
+	rest := secs
+	for _, u := range []struct {
+		secs uint32
+		unit string
+	}{{7 * 86400, "w"}, {86400, "d"}, {3600, "h"}, {60, "m"}, {1, "s"}} {
+		if rest >= u.secs {
+			fmt.Fprintf(&b, "%d%s", rest/u.secs, u.unit)
+			rest %= u.secs
+		}
+	}
+	return fmt.Sprintf("%s (%d)", b.String(), secs)
+}
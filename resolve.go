@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// defaultChainDepth is the number of CNAME and DNAME hops followed unless
+// -depth says otherwise
+const defaultChainDepth = 8
+
+// chainHop is one CNAME or DNAME step from a name to its target
+type chainHop struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	TTL    uint32 `json:"ttl"`
+}
+
+// resolvedAddr is one address at the end of the chain
+type resolvedAddr struct {
+	Address string `json:"address"`
+	Type    string `json:"type"`
+	TTL     uint32 `json:"ttl"`
+}
+
+// chainResult is the outcome of following the chain for one address type
+type chainResult struct {
+	hops  []chainHop
+	name  string // where the chain ended
+	addrs []resolvedAddr
+	rcode int
+	err   error
+}
+
+// resolveJSON is the -json rendering of the resolve subcommand
+type resolveJSON struct {
+	Name      string            `json:"name"`
+	Canonical string            `json:"canonical"`
+	Chain     []chainHop        `json:"chain"`
+	Addresses []resolvedAddr    `json:"addresses"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// runResolve implements the resolve subcommand: like getaddrinfo it follows
+// CNAME and DNAME records to the canonical name and collects its A and AAAA
+// records, but shows every hop of the chain on the way. It exits with
+// status 1 when no address is found.
+func runResolve(args []string) {
+	fs := flag.NewFlagSet("resolve", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on the lookup after this `duration`")
+	depth := fs.Int("depth", defaultChainDepth, "follow at most `n` CNAME and DNAME hops")
+	jsonOut := fs.Bool("json", false, "print the chain and the addresses as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s resolve [flags] <domain>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "resolve"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	domain, err := toASCII(args[0])
+	if err != nil {
+		fatal(err.Error())
+	}
+	domain = dns.Fqdn(domain)
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	results := make([]chainResult, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = followChain(ctx, r, domain, qtype, *depth)
+		}()
+	}
+	wg.Wait()
+
+	// Both lookups walk the same chain, the first one to get anywhere shows it
+	chain := results[0]
+	if chain.err != nil {
+		chain = results[1]
+	}
+	var addrs []resolvedAddr
+	errs := map[string]string{}
+	for i, res := range results {
+		addrs = append(addrs, res.addrs...)
+		switch {
+		case res.err != nil:
+			errs[typeString(qtypes[i])] = res.err.Error()
+		case res.rcode != dns.RcodeSuccess:
+			errs[typeString(qtypes[i])] = rcodeString(res.rcode)
+		}
+	}
+
+	if *jsonOut {
+		out := resolveJSON{Name: domain, Canonical: chain.name, Chain: chain.hops, Addresses: addrs}
+		if out.Chain == nil {
+			out.Chain = []chainHop{}
+		}
+		if out.Addresses == nil {
+			out.Addresses = []resolvedAddr{}
+		}
+		if len(errs) > 0 {
+			out.Errors = errs
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printResolve(domain, chain, addrs, errs)
+	}
+	if len(addrs) == 0 {
+		os.Exit(1)
+	}
+}
+
+// followChain looks up name and follows the CNAME and DNAME records in the
+// answers until it reaches a name that owns records of qtype, or none. A
+// chain the server did not follow to the end is picked up with a query for
+// the last target.
+func followChain(ctx context.Context, r resolver.Resolver, name string, qtype uint16, depth int) chainResult {
+	res := chainResult{name: name}
+	seen := map[string]bool{strings.ToLower(name): true}
+	for {
+		resp, err := r.Query(resolver.WithTraceID(ctx, resolver.NewTraceID()), res.name, qtype)
+		if err != nil {
+			res.err = err
+			return res
+		}
+		res.rcode = resp.Rcode
+		followed := false
+		for {
+			hop, ok := nextHop(resp.Answer, res.name)
+			if !ok {
+				break
+			}
+			if len(res.hops) == depth {
+				res.err = fmt.Errorf("chain from %s is longer than %d hops", name, depth)
+				return res
+			}
+			target := strings.ToLower(hop.Target)
+			if seen[target] {
+				res.err = fmt.Errorf("%s %s %s closes a loop", hop.Name, hop.Type, hop.Target)
+				return res
+			}
+			seen[target] = true
+			res.hops = append(res.hops, hop)
+			res.name = hop.Target
+			followed = true
+		}
+		for _, rr := range resp.Answer {
+			h := rr.Header()
+			if h.Rrtype != qtype || !strings.EqualFold(h.Name, res.name) {
+				continue
+			}
+			addr := resolvedAddr{Type: typeString(h.Rrtype), TTL: h.Ttl}
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr.Address = rr.A.String()
+			case *dns.AAAA:
+				addr.Address = rr.AAAA.String()
+			}
+			res.addrs = append(res.addrs, addr)
+		}
+		// NXDOMAIN after a hop is about the target (RFC 6604), and an SOA
+		// says the target has no records of qtype
+		if len(res.addrs) > 0 || !followed || resp.Rcode != dns.RcodeSuccess || hasSOA(resp.Ns) {
+			return res
+		}
+	}
+}
+
+// nextHop finds the record in answer that redirects name: a CNAME it owns,
+// or a DNAME owned by one of its parents. Resolvers send the CNAME they
+// synthesized from a DNAME along with it, that hop is reported as the DNAME.
+func nextHop(answer []dns.RR, name string) (chainHop, bool) {
+	var cname *dns.CNAME
+	var dname *dns.DNAME
+	for _, rr := range answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				cname = rr
+			}
+		case *dns.DNAME:
+			if !strings.EqualFold(rr.Hdr.Name, name) && dns.IsSubDomain(rr.Hdr.Name, name) {
+				dname = rr
+			}
+		}
+	}
+	if dname != nil {
+		// The labels below the DNAME owner move under its target, RFC 6672
+		prefix := name[:len(name)-len(dname.Hdr.Name)]
+		hop := chainHop{Name: name, Type: "DNAME", Target: prefix + dname.Target, TTL: dname.Hdr.Ttl}
+		if cname == nil || strings.EqualFold(cname.Target, hop.Target) {
+			return hop, true
+		}
+	}
+	if cname != nil {
+		return chainHop{Name: name, Type: "CNAME", Target: cname.Target, TTL: cname.Hdr.Ttl}, true
+	}
+	return chainHop{}, false
+}
+
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.SOA); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// printResolve shows the chain, then the addresses it ended at
+func printResolve(domain string, chain chainResult, addrs []resolvedAddr, errs map[string]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, hop := range chain.hops {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", toUnicode(hop.Name), hop.TTL, hop.Type, toUnicode(hop.Target))
+	}
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", toUnicode(chain.name), addr.TTL, addr.Type, addr.Address)
+	}
+	w.Flush()
+	for _, key := range sortedKeys(errs) {
+		fmt.Printf(";; %s: %s\n", key, errs[key])
+	}
+	if len(addrs) == 0 {
+		fmt.Printf(";; no addresses for %s\n", toUnicode(domain))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// routeUsage is the help of the -route flag of serve
+const routeUsage = "send the queries under these zones to their own upstreams instead, comma separated `zone=servers` rules such as corp.example=10.0.0.53+10.0.0.54, the servers of a rule joined with + or named by an upstream group of the config file"
+
+// routeBuilder builds the resolvers of -route rules, keeping those whose
+// servers are unchanged from one reload to the next so that their
+// connections and health state live on
+type routeBuilder struct {
+	opts   *options
+	method string
+	built  map[string]resolver.Resolver // by servers as given
+}
+
+// build parses rules into routes, leaving the resolvers already built
+// alone on error
+func (b *routeBuilder) build(rules string) (map[string]resolver.Resolver, error) {
+	routes := map[string]resolver.Resolver{}
+	built := map[string]resolver.Resolver{}
+	for _, rule := range strings.Split(rules, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		zone, servers, ok := strings.Cut(rule, "=")
+		zone, servers = strings.TrimSpace(zone), strings.TrimSpace(servers)
+		if !ok || servers == "" {
+			return nil, fmt.Errorf("invalid -route %q, want zone=servers such as corp.example=10.0.0.53", rule)
+		}
+		if _, ok := dns.IsDomainName(zone); !ok {
+			return nil, fmt.Errorf("invalid zone %q in -route", zone)
+		}
+		if _, dup := routes[dns.Fqdn(strings.ToLower(zone))]; dup {
+			return nil, fmt.Errorf("-route gives the zone %s twice", zone)
+		}
+		r, ok := built[servers]
+		if !ok {
+			if r, ok = b.built[servers]; !ok {
+				upstreams, err := parseUpstreams(b.method, strings.ReplaceAll(servers, "+", ","), 0)
+				if err != nil {
+					return nil, fmt.Errorf("-route %s: %v", zone, err)
+				}
+				if r, err = b.opts.buildResolver(upstreams); err != nil {
+					return nil, fmt.Errorf("-route %s: %v", zone, err)
+				}
+			}
+			built[servers] = r
+		}
+		routes[dns.Fqdn(strings.ToLower(zone))] = r
+	}
+	b.built = built
+	return routes, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+const (
+	// rrlPrefix4 and rrlPrefix6 group clients into the netblocks that
+	// share a budget, as BIND does by default
+	rrlPrefix4 = 24
+	rrlPrefix6 = 56
+	// maxRRLBuckets is how many netblock and response pairs are tracked
+	// before those whose buckets have refilled are forgotten
+	maxRRLBuckets = 100000
+)
+
+// rrlAction is what happens to a response over its rate
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip // send an empty truncated response, so real clients retry over TCP
+)
+
+// rrlKey identifies the responses that share a budget: those to one
+// netblock that are alike, being the same answer, a denial from the same
+// zone or an error
+type rrlKey struct {
+	netblock string
+	kind     string
+}
+
+type rrlBucket struct {
+	tokenBucket
+	limited int // responses over the rate since the last slip
+}
+
+// responseLimiter is Response Rate Limiting for the authoritative answers
+// of serve over UDP, where a spoofed source turns the forwarder into an
+// amplifier: each netblock gets rate alike responses per second, and the
+// ones over it are dropped except every slip-th, which is sent truncated.
+// A nil *responseLimiter sends everything.
+type responseLimiter struct {
+	rate    float64
+	burst   float64 // a second of responses, and at least one
+	slip    int     // 0 drops every response over the rate
+	metrics *metrics
+
+	mu      sync.Mutex
+	buckets map[rrlKey]*rrlBucket
+}
+
+// newResponseLimiter returns a limiter for rate responses per second, or
+// nil when rate is not positive
+func newResponseLimiter(rate float64, slip int) *responseLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &responseLimiter{rate: rate, burst: max(1, rate), slip: slip, buckets: map[rrlKey]*rrlBucket{}}
+}
+
+// ServeDNS implements resolver.Handler, limiting the answers of the
+// handlers after it that come from local data over UDP
+func (l *responseLimiter) ServeDNS(ctx context.Context, req *resolver.Request, next resolver.Next) (*dns.Msg, error) {
+	resp, err := next(ctx, req)
+	if err != nil || resp == nil || !req.UDP() || req.Trace.Transport != "local" {
+		return resp, err
+	}
+	switch l.account(req.ClientIP(), resp, time.Now()) {
+	case rrlDrop:
+		l.metrics.observeRefused("rrl")
+		return nil, nil
+	case rrlSlip:
+		l.metrics.observeRefused("rrl")
+		resp = new(dns.Msg)
+		resp.SetReply(req.Msg)
+		resp.Truncated = true
+	}
+	return resp, nil
+}
+
+// account charges resp to the budget of the netblock of ip and returns
+// what to do with it
+func (l *responseLimiter) account(ip net.IP, resp *dns.Msg, now time.Time) rrlAction {
+	if l == nil || ip == nil {
+		return rrlSend
+	}
+	key := rrlKey{netblock: netblock(ip), kind: responseKind(resp)}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= maxRRLBuckets {
+			l.forget(now)
+		}
+		b = &rrlBucket{tokenBucket: tokenBucket{tokens: l.burst, last: now}}
+		l.buckets[key] = b
+	}
+	if b.take(now, l.rate, l.burst) {
+		b.limited = 0
+		return rrlSend
+	}
+	b.limited++
+	if l.slip > 0 && b.limited%l.slip == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// forget drops the buckets that have refilled, which takes a second as
+// they hold one second of responses, or longer below one a second. The
+// caller holds l.mu.
+func (l *responseLimiter) forget(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// netblock returns the network of ip that shares a budget with it
+func netblock(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rrlPrefix4, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(rrlPrefix6, 128)).String()
+}
+
+// responseKind tells alike responses apart: answers by name and type, and
+// denials by the zone they come from, so that a flood of random names
+// under one zone counts as one response
+func responseKind(resp *dns.Msg) string {
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0 && len(resp.Question) == 1:
+		q := resp.Question[0]
+		return "answer " + strings.ToLower(q.Name) + " " + typeString(q.Qtype)
+	case resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError:
+		zone := "."
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				zone = strings.ToLower(soa.Hdr.Name)
+			}
+		}
+		return "denial " + zone
+	}
+	return "error"
+}
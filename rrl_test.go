@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResponseLimiter(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("host1.lan.", dns.TypeA)
+	resp.Answer = append(resp.Answer, &dns.A{Hdr: dns.RR_Header{Name: "host1.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 10)})
+	client := net.IPv4(198, 51, 100, 7)
+	start := time.Now()
+
+	for _, tt := range []struct {
+		name  string
+		rate  float64
+		every time.Duration // between responses
+		want  []rrlAction
+	}{
+		{"within the rate", 2, 500 * time.Millisecond, []rrlAction{rrlSend, rrlSend, rrlSend, rrlSend}},
+		{"over the rate", 2, 0, []rrlAction{rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip}},
+		{"below one a second", 0.5, time.Second, []rrlAction{rrlSend, rrlDrop, rrlSend, rrlDrop, rrlSend}},
+		{"below one a second, over it", 0.5, 0, []rrlAction{rrlSend, rrlDrop, rrlSlip}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newResponseLimiter(tt.rate, 2)
+			for i, want := range tt.want {
+				if got := l.account(client, resp, start.Add(time.Duration(i)*tt.every)); got != want {
+					t.Errorf("response %d: action %d, want %d", i, got, want)
+				}
+			}
+		})
+	}
+
+	// Another netblock has its own budget
+	l := newResponseLimiter(0.5, 2)
+	l.account(client, resp, start)
+	if got := l.account(net.IPv4(203, 0, 113, 7), resp, start); got != rrlSend {
+		t.Errorf("another netblock got action %d, want it sent", got)
+	}
+}
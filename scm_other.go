@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// runningService only hooks into the Windows service manager; systemd and
+// launchd stop serve with SIGTERM and systemd reloads it with SIGHUP
+func runningService(chan<- os.Signal) func() {
+	return func() {}
+}
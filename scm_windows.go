@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// runningService hooks serve into the Windows service manager when it runs
+// as a service: stop and shutdown requests arrive on signals as SIGTERM,
+// parameter changes as SIGHUP, and the log goes to
+// %ProgramData%\<service name>\<service name>.log. It returns the function
+// that reports the service stopped, to call before exiting.
+func runningService(signals chan<- os.Signal) func() {
+	if ok, err := svc.IsWindowsService(); err != nil || !ok {
+		return func() {}
+	}
+	h := &scmHandler{signals: signals, name: make(chan string, 1), stopped: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run("", h); err != nil {
+			fatal("cannot run as a service", "err", err)
+		}
+	}()
+	select {
+	case name := <-h.name:
+		dir := filepath.Join(os.Getenv("ProgramData"), name)
+		if err := os.MkdirAll(dir, 0o755); err == nil {
+			if f, err := os.OpenFile(filepath.Join(dir, name+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err == nil {
+				os.Stderr = f
+			}
+		}
+	case <-done:
+	}
+	return func() {
+		close(h.stopped)
+		<-done
+	}
+}
+
+// scmHandler turns the requests of the service manager into signals
+type scmHandler struct {
+	signals chan<- os.Signal
+	name    chan string
+	stopped chan struct{} // closed once serve is done
+}
+
+// Execute implements svc.Handler
+func (h *scmHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	if len(args) > 0 {
+		h.name <- args[0]
+	} else {
+		h.name <- "tmp-dns"
+	}
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case <-h.stopped:
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				go func() { h.signals <- syscall.SIGTERM }()
+			case svc.ParamChange:
+				status <- svc.Status{State: svc.Running, Accepts: accepts}
+				go func() { h.signals <- syscall.SIGHUP }()
+			}
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// runServe implements the serve subcommand: a local forwarder that accepts
+// plain DNS over UDP and TCP and sends the queries on to the upstreams,
+// typically over an encrypted transport
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":53", "`address` to listen on for UDP and TCP queries, unless systemd passes the sockets")
+	upstreamList := fs.String("upstream", defaultServers["http"], "upstream `servers`, comma separated, as host[:port], a URL such as tls://host, quic://host or https://host/dns-query, or an sdns:// stamp")
+	routeRules := fs.String("route", "", routeUsage)
+	method := fs.String("method", "udp", "`method` for upstreams given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on an upstream query after this `duration`")
+	cacheSize := fs.Int("cache", resolver.DefaultCacheSize, "cache up to `n` responses, 0 disables the cache")
+	negativeTTL := fs.Duration("negative-ttl", resolver.DefaultMaxNegativeTTL, "keep NXDOMAIN and NODATA answers for their SOA minimum but at most this `long`, 0 disables negative caching")
+	servfailTTL := fs.Duration("servfail-ttl", 5*time.Second, "answer SERVFAIL from the cache for this `long` after an upstream failure, 0 disables")
+	serveStale := fs.Duration("serve-stale", 0, "answer from entries expired less than this `long` ago, with a short TTL, while the upstreams fail (RFC 8767), 0 disables")
+	staleTTL := fs.Duration("stale-ttl", resolver.DefaultStaleTTL, "the most TTL of stale answers, and how `long` one is served before the upstream is asked again")
+	staleTimeout := fs.Duration("stale-timeout", 1800*time.Millisecond, "answer stale when the upstream has not answered a question with an expired entry within this `duration`, 0 waits for the upstream")
+	dedup := fs.Bool("dedup", true, "send identical queries in flight at once upstream only once, sharing the answer")
+	prefetch := fs.Int("prefetch", 3, "refresh entries asked for `n` times in their last tenth of TTL before they expire, 0 disables")
+	cacheFile := fs.String("cache-file", "", "keep the cache in this `file` across restarts, saved every -cache-save and on shutdown")
+	cacheFileSize := fs.Int("cache-file-size", 64, "keep the cache file below this many `megabytes`, dropping the entries closest to expiry")
+	cacheSave := fs.Duration("cache-save", 5*time.Minute, "save the cache to -cache-file this `often`, 0 only on shutdown")
+	metricsAddr := fs.String("metrics", "", "serve Prometheus metrics at /metrics on this `address`, such as :9153")
+	apiAddr := fs.String("api", "", "serve a REST resolution API at /resolve on this `address`, such as :8053, answering through the same cache, local data and upstreams")
+	pcapFile := fs.String("pcap", "", pcapUsage)
+	hostsFiles := fs.String("hosts", "", "answer A, AAAA and PTR queries for the names in these /etc/hosts style `files`, comma separated")
+	zoneFiles := fs.String("zone-file", "", "answer queries inside the zones of these RFC 1035 master `files`, comma separated, authoritatively")
+	localTTL := fs.Duration("local-ttl", 5*time.Minute, "TTL of the answers from -hosts files and for blocked names")
+	blocklists := fs.String("blocklist", "", "answer queries for the names on these block `lists`, comma separated files or URLs in hosts, adblock or plain format, instead of forwarding them")
+	allowlists := fs.String("allowlist", "", "never block the names on these `lists`, comma separated files or URLs")
+	blockResponse := fs.String("block-response", "nxdomain", "how to answer blocked names: nxdomain, null (0.0.0.0 and ::) or a sinkhole `address`")
+	minTTL := fs.Duration("min-ttl", 0, "raise the TTLs of forwarded answers, and how long the cache keeps them, to at least this `duration`, 0 for none")
+	maxTTL := fs.Duration("max-ttl", 0, "lower the TTLs of forwarded answers, and how long the cache keeps them, to at most this `duration`, 0 for none")
+	ttlOverrides := fs.String("ttl-override", "", "give the forwarded answers under these zones a fixed TTL, comma separated `zone=duration` pairs such as corp.example.com=30s")
+	flattenCNAMEs := fs.Bool("flatten-cnames", false, "follow CNAME chains upstream and answer A and AAAA queries with the final addresses only, as records of the name asked for")
+	dns64Prefix := fs.String("dns64", "", "synthesize AAAA records for names with only A records from this NAT64 `prefix`, such as "+resolver.WellKnownNAT64Prefix+" (RFC 6147)")
+	blockRefresh := fs.Duration("blocklist-refresh", 24*time.Hour, "reload the block and allow lists this often, 0 loads them once")
+	allowClients := fs.String("allow-clients", "", "only answer clients in these `networks`, comma separated CIDRs or addresses")
+	denyClients := fs.String("deny-clients", "", "never answer clients in these `networks`, comma separated CIDRs or addresses")
+	rateLimit := fs.Float64("rate-limit", 0, "answer each client address at most this many `queries` per second, 0 for no limit")
+	rateBurst := fs.Int("rate-burst", 0, "let a client send up to `n` queries at once before -rate-limit applies (default the rate, at least 1)")
+	limitResponse := fs.String("limit-response", "refused", "how to answer clients outside -allow-clients, in -deny-clients or over -rate-limit: refused or drop")
+	rrlRate := fs.Float64("rrl", 0, "Response Rate Limiting: send each client netblock at most this many alike `responses` per second from -hosts and -zone-file over UDP, 0 disables")
+	rrlSlip := fs.Int("rrl-slip", 2, "send every `n`th response over -rrl truncated instead of dropping it, so real clients retry over TCP, 0 drops them all")
+	drainTimeout := fs.Duration("drain-timeout", 10*time.Second, "on SIGINT or SIGTERM, wait this `long` for the queries in flight to be answered before exiting")
+	opts := options{keepalive: true, health: 10 * time.Second}
+	opts.register(fs)
+	var tap dnstapOptions
+	tap.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	given := givenFlags(fs)
+	if err := cfg.apply(fs, "serve"); err != nil {
+		fatal(err.Error())
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	serviceStopped := runningService(signals)
+	logs.setup()
+
+	if opts.ddr && !flagSet(fs, "upstream") {
+		// DDR upgrades the resolvers the network handed out
+		conf, err := loadSystemConfig()
+		if err != nil {
+			fatal(err.Error())
+		}
+		*upstreamList, *method = conf.servers(), "udp"
+	}
+	upstreams, err := parseUpstreams(*method, *upstreamList, 0)
+	if err != nil {
+		fatal(err.Error())
+	}
+	var m *metrics
+	if *metricsAddr != "" {
+		m = newMetrics()
+		opts.metrics = m
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+	router := resolver.NewRouter(r)
+	routes := routeBuilder{opts: &opts, method: *method}
+	var cache *resolver.Cache
+	lastRules := ""
+
+	// The routes, the local data and the filter are read again on SIGHUP
+	// and swapped in for the queries that follow, those in flight finishing
+	// with the old ones
+	var local, blocker swapHandler
+	var current *filter
+	loadData := func() error {
+		rs, err := routes.build(*routeRules)
+		if err != nil {
+			return err
+		}
+		l, err := loadLocalData(*hostsFiles, *zoneFiles, uint32(localTTL.Seconds()))
+		if err != nil {
+			return fmt.Errorf("failed to load local data: %v", err)
+		}
+		f, err := newFilter(*blocklists, *allowlists, *blockResponse, uint32(localTTL.Seconds()))
+		if err != nil {
+			return err
+		}
+		if f != nil && *blockRefresh > 0 {
+			go f.refresh(*blockRefresh)
+		}
+		router.SetRoutes(rs)
+		if *routeRules != lastRules && cache != nil {
+			// The answers of the old routes are not those of the new ones
+			cache.Flush()
+		}
+		lastRules = *routeRules
+		local.set(l)
+		blocker.set(f)
+		current.stop()
+		current = f
+		return nil
+	}
+	if err := loadData(); err != nil {
+		fatal(err.Error())
+	}
+	r = router
+	if *flattenCNAMEs {
+		r = resolver.NewFlatten(r)
+	}
+	if *dns64Prefix != "" {
+		if r, err = resolver.NewDNS64(r, *dns64Prefix); err != nil {
+			fatal(err.Error())
+		}
+	}
+	if *minTTL > 0 || *maxTTL > 0 || *ttlOverrides != "" {
+		if r, err = newTTLPolicy(r, *minTTL, *maxTTL, *ttlOverrides); err != nil {
+			fatal(err.Error())
+		}
+	}
+	if *dedup {
+		d := resolver.NewDedup(r)
+		if m != nil {
+			m.dedup = d
+		}
+		r = d
+	}
+	saveCache := func() {}
+	if *cacheFile != "" && *cacheSize <= 0 {
+		fatal("-cache-file needs the cache, -cache is 0")
+	}
+	if *cacheSize > 0 {
+		cache = resolver.NewCache(r, *cacheSize)
+		cache.MaxNegativeTTL = *negativeTTL
+		cache.ServfailTTL = *servfailTTL
+		cache.Prefetch = *prefetch
+		cache.MaxStale = *serveStale
+		cache.StaleTTL = *staleTTL
+		cache.StaleTimeout = *staleTimeout
+		if m != nil {
+			m.cache = cache
+		}
+		r = cache
+		if *cacheFile != "" {
+			saveCache = persistCache(cache, *cacheFile, int64(*cacheFileSize)<<20, *cacheSave)
+		}
+	}
+	if m != nil {
+		serveMetrics(*metricsAddr, m)
+	}
+
+	capture, err := openPcap(*pcapFile)
+	if err != nil {
+		fatal("failed to create the pcap file", "err", err)
+	}
+	limits, err := newClientLimits(*allowClients, *denyClients, *rateLimit, *rateBurst, *limitResponse)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	// Each query passes the handlers in this order, the first to answer
+	// ending its way down
+	chain := resolver.NewChain(queryContext(capture, *timeout), resolver.HandlerFunc(logQueries))
+	if limits != nil {
+		limits.metrics = m
+		chain.Use(limits)
+	}
+	tapLogger := tap.open()
+	if tapLogger != nil {
+		chain.Use(tapLogger)
+	}
+	if rrl := newResponseLimiter(*rrlRate, *rrlSlip); rrl != nil {
+		rrl.metrics = m
+		chain.Use(rrl)
+	}
+	if m != nil {
+		chain.Use(m)
+	}
+	chain.Use(&local, &blocker, resolver.Forward(r))
+	if *apiAddr != "" {
+		serveAPI(*apiAddr, chain)
+	}
+
+	packetConns, listeners, err := activatedSockets()
+	if err != nil {
+		fatal(err.Error())
+	}
+	errs := make(chan error, 2+len(packetConns)+len(listeners))
+	var servers []*dns.Server
+	for _, pc := range packetConns {
+		srv := &dns.Server{PacketConn: pc, Handler: chain}
+		servers = append(servers, srv)
+		go func() { errs <- srv.ActivateAndServe() }()
+	}
+	for _, l := range listeners {
+		srv := &dns.Server{Listener: l, Handler: chain}
+		servers = append(servers, srv)
+		go func() { errs <- srv.ActivateAndServe() }()
+	}
+	if len(servers) > 0 {
+		slog.Info("forwarding DNS", "sockets", len(servers), "upstreams", *upstreamList)
+	} else {
+		for _, network := range []string{"udp", "tcp"} {
+			srv := &dns.Server{Addr: *listen, Net: network, Handler: chain}
+			servers = append(servers, srv)
+			go func() { errs <- srv.ListenAndServe() }()
+		}
+		slog.Info("forwarding DNS", "listen", *listen, "upstreams", *upstreamList)
+	}
+	for {
+		select {
+		case err := <-errs:
+			fatal("server failed", "err", err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadServe(fs, &cfg, given, loadData)
+				continue
+			}
+			slog.Info("shutting down", "signal", sig.String())
+			drain(servers, *drainTimeout)
+			saveCache()
+			tapLogger.close()
+			closePcap(capture)
+			serviceStopped()
+			os.Exit(0)
+		}
+	}
+}
+
+// newTTLPolicy parses -min-ttl, -max-ttl and -ttl-override into a policy
+// in front of r
+func newTTLPolicy(r resolver.Resolver, minTTL, maxTTL time.Duration, overrides string) (*resolver.TTLPolicy, error) {
+	if minTTL < 0 || maxTTL < 0 || maxTTL > 0 && minTTL > maxTTL {
+		return nil, fmt.Errorf("invalid TTL bounds: -min-ttl %v and -max-ttl %v", minTTL, maxTTL)
+	}
+	p := resolver.NewTTLPolicy(r, minTTL, maxTTL)
+	for _, pair := range strings.Split(overrides, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		zone, value, ok := strings.Cut(pair, "=")
+		ttl, err := time.ParseDuration(value)
+		if !ok || err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid -ttl-override %q, want zone=duration such as example.com=30s", pair)
+		}
+		if _, ok := dns.IsDomainName(zone); !ok {
+			return nil, fmt.Errorf("invalid zone %q in -ttl-override", zone)
+		}
+		p.Override(zone, ttl)
+	}
+	return p, nil
+}
+
+// serveReloadable are the flags of serve that SIGHUP applies, the others
+// taking a restart
+var serveReloadable = map[string]bool{
+	"route": true, "hosts": true, "zone-file": true, "local-ttl": true,
+	"blocklist": true, "allowlist": true, "block-response": true, "blocklist-refresh": true,
+}
+
+// reloadServe reads the config file again and, with the flags it gives,
+// the routes, the hosts and zone files and the block and allow lists. On
+// any error the server goes on with what it had.
+func reloadServe(fs *flag.FlagSet, cfg *configFile, given map[string]bool, loadData func() error) {
+	slog.Info("reloading the configuration")
+	changed, err := cfg.reload(fs, "serve", given)
+	if err != nil {
+		slog.Error("failed to reload the config file, keeping the old settings", "err", err)
+		return
+	}
+	var restart []string
+	for _, name := range changed {
+		if !serveReloadable[name] {
+			restart = append(restart, "-"+name)
+		}
+	}
+	if len(restart) > 0 {
+		slog.Warn("changed settings take a restart", "flags", strings.Join(restart, ", "))
+	}
+	if err := loadData(); err != nil {
+		slog.Error("failed to reload the routes, local data and filter lists, keeping the old ones", "err", err)
+		return
+	}
+	slog.Info("reloaded the configuration", "changed", len(changed))
+}
+
+// drain stops the servers from taking queries and waits up to timeout for
+// those in flight to be answered
+func drain(servers []*dns.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.ShutdownContext(ctx); errors.Is(err, context.DeadlineExceeded) {
+				slog.Warn("gave up on the queries in flight", "net", srv.Net, "after", timeout)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// swapHandler is a link of the chain whose handler can be replaced while
+// queries are served; each query keeps the one it started with
+type swapHandler struct {
+	current atomic.Pointer[resolver.Handler]
+}
+
+// set replaces the handler, nil passing every query on
+func (s *swapHandler) set(h resolver.Handler) {
+	s.current.Store(&h)
+}
+
+// ServeDNS implements resolver.Handler
+func (s *swapHandler) ServeDNS(ctx context.Context, req *resolver.Request, next resolver.Next) (*dns.Msg, error) {
+	if h := s.current.Load(); h != nil && *h != nil {
+		return (*h).ServeDNS(ctx, req, next)
+	}
+	return next(ctx, req)
+}
+
+// persistCache fills cache from file, then saves it there every interval.
+// It returns the function that saves it, for shutting down.
+func persistCache(cache *resolver.Cache, file string, maxBytes int64, interval time.Duration) func() {
+	n, err := cache.Load(file)
+	if err != nil {
+		slog.Warn("starting with a partly loaded cache", "file", file, "err", err)
+	}
+	slog.Info("loaded the cache", "file", file, "entries", n)
+
+	save := func() {
+		if n, err := cache.Save(file, maxBytes); err != nil {
+			slog.Warn("failed to save the cache", "file", file, "err", err)
+		} else {
+			slog.Debug("saved the cache", "file", file, "entries", n)
+		}
+	}
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				save()
+			}
+		}()
+	}
+	return save
+}
+
+// queryContext returns the handler that gives each query its context: a
+// trace ID tying its log records together, the pcap capture and the
+// timeout for the upstream query
+func queryContext(capture *pcapWriter, timeout time.Duration) resolver.Handler {
+	return resolver.HandlerFunc(func(ctx context.Context, req *resolver.Request, next resolver.Next) (*dns.Msg, error) {
+		ctx, cancel := context.WithTimeout(resolver.WithTraceID(capture.context(ctx), resolver.NewTraceID()), timeout)
+		defer cancel()
+		return next(ctx, req)
+	})
+}
+
+// logQueries is the handler that logs each query and how it was answered
+func logQueries(ctx context.Context, req *resolver.Request, next resolver.Next) (*dns.Msg, error) {
+	slog.DebugContext(ctx, "query received", "question", questionString(req.Msg), "client", req.Client.String())
+	resp, err := next(ctx, req)
+	switch {
+	case err != nil:
+		slog.WarnContext(ctx, "forwarding failed", "question", questionString(req.Msg), "client", req.Client.String(), "err", err)
+	case resp == nil:
+		slog.DebugContext(ctx, "query dropped", "question", questionString(req.Msg))
+	default:
+		t := req.Trace
+		slog.DebugContext(ctx, "query answered", "rcode", dns.RcodeToString[resp.Rcode], "transport", t.Transport, "server", t.Server, "rtt", t.RTT)
+	}
+	return resp, err
+}
+
+// questionString describes the question of m for log messages
+func questionString(m *dns.Msg) string {
+	if len(m.Question) == 0 {
+		return "empty query"
+	}
+	q := m.Question[0]
+	return q.Name + " " + typeString(q.Qtype)
+}
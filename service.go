@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// serviceSpec is what service install registers with the service manager
+type serviceSpec struct {
+	name   string
+	exe    string   // absolute path of the executable
+	args   []string // the serve flags, -listen included unless socket is set
+	listen string   // the -listen address, for the socket unit as well
+	socket bool     // let the service manager open the sockets
+}
+
+func runService(args []string) {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	name := fs.String("name", "tmp-dns", "`name` of the service")
+	listen := fs.String("listen", ":53", "`address` the service answers on, passed to serve as -listen")
+	socket := fs.Bool("socket", false, "install: let systemd open the sockets and start serve on the first query (Linux only)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s service install|uninstall|start|stop|status [flags] [-- serve flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+	spec := serviceSpec{name: *name, listen: *listen, socket: *socket}
+
+	var err error
+	switch action {
+	case "install":
+		for _, arg := range fs.Args() {
+			if flagName(arg) == "listen" {
+				fatal("give the address as service install -listen, not as a serve flag")
+			}
+		}
+		if spec.exe, err = os.Executable(); err == nil {
+			spec.exe, err = filepath.EvalSymlinks(spec.exe)
+		}
+		if err != nil {
+			fatal(fmt.Sprintf("cannot find the executable: %v", err))
+		}
+		spec.args = append([]string{"serve"}, fs.Args()...)
+		if !spec.socket {
+			spec.args = append(spec.args, "-listen", spec.listen)
+		}
+		err = installService(spec)
+	case "uninstall":
+		err = uninstallService(spec)
+	case "start", "stop", "status":
+		if fs.NArg() > 0 {
+			fatal("serve flags are only taken by service install")
+		}
+		err = controlService(spec, action)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+}
+
+// flagName returns the name of the flag arg sets, "" for a value
+func flagName(arg string) string {
+	if !strings.HasPrefix(arg, "-") {
+		return ""
+	}
+	name := strings.TrimLeft(arg, "-")
+	name, _, _ = strings.Cut(name, "=")
+	return name
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// launchdDir is where service install puts the launch daemon
+const launchdDir = "/Library/LaunchDaemons"
+
+// installService writes a launch daemon running serve at boot and keeping
+// it running, logging to /var/log/<name>.log
+func installService(spec serviceSpec) error {
+	if spec.socket {
+		return errors.New("-socket is only supported with systemd")
+	}
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t<string>%s</string>\n", plistEscape(spec.name))
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{spec.exe}, spec.args...) {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", plistEscape(arg))
+	}
+	b.WriteString("\t</array>\n\t<key>RunAtLoad</key>\n\t<true/>\n\t<key>KeepAlive</key>\n\t<true/>\n")
+	fmt.Fprintf(&b, "\t<key>StandardErrorPath</key>\n\t<string>/var/log/%s.log</string>\n", plistEscape(spec.name))
+	b.WriteString("</dict>\n</plist>\n")
+
+	if err := os.WriteFile(launchdPlist(spec), []byte(b.String()), 0o644); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%v (service install needs root)", err)
+		}
+		return err
+	}
+	fmt.Printf("installed %s, start it with %s service start -name %s\n", launchdPlist(spec), os.Args[0], spec.name)
+	return nil
+}
+
+// uninstallService unloads the launch daemon and removes it
+func uninstallService(spec serviceSpec) error {
+	if launchctl("print", "system/"+spec.name) == nil {
+		if err := launchctl("bootout", "system/"+spec.name); err != nil {
+			return err
+		}
+	}
+	return os.Remove(launchdPlist(spec))
+}
+
+// controlService loads, unloads or shows the launch daemon
+func controlService(spec serviceSpec, action string) error {
+	switch action {
+	case "start":
+		return launchctl("bootstrap", "system", launchdPlist(spec))
+	case "stop":
+		return launchctl("bootout", "system/"+spec.name)
+	}
+	cmd := exec.Command("launchctl", "print", "system/"+spec.name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func launchdPlist(spec serviceSpec) string {
+	return filepath.Join(launchdDir, spec.name+".plist")
+}
+
+// plistEscape escapes s for the text of a plist element
+func plistEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// launchctl runs launchctl quietly, its output only reported on failure
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
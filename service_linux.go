@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// systemdUnitDir is where service install puts the units
+const systemdUnitDir = "/etc/systemd/system"
+
+// installService writes a systemd unit running serve, and with -socket a
+// socket unit handing it the listening sockets, and enables them
+func installService(spec serviceSpec) error {
+	unit := serviceUnit(spec)
+	units := []string{spec.name + ".service"}
+	if spec.socket {
+		socket, err := socketUnit(spec)
+		if err != nil {
+			return err
+		}
+		if err := writeUnit(spec.name+".socket", socket); err != nil {
+			return err
+		}
+		units = []string{spec.name + ".socket"}
+	}
+	if err := writeUnit(spec.name+".service", unit); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl(append([]string{"enable"}, units...)...); err != nil {
+		return err
+	}
+	fmt.Printf("installed %s, start it with %s service start -name %s\n", filepath.Join(systemdUnitDir, spec.name+".service"), os.Args[0], spec.name)
+	return nil
+}
+
+// uninstallService stops and disables the units and removes them
+func uninstallService(spec serviceSpec) error {
+	units := []string{spec.name + ".service"}
+	if _, err := os.Stat(filepath.Join(systemdUnitDir, spec.name+".socket")); err == nil {
+		units = append(units, spec.name+".socket")
+	}
+	if err := systemctl(append([]string{"disable", "--now"}, units...)...); err != nil {
+		return err
+	}
+	for _, unit := range units {
+		if err := os.Remove(filepath.Join(systemdUnitDir, unit)); err != nil {
+			return err
+		}
+	}
+	return systemctl("daemon-reload")
+}
+
+// controlService starts, stops or shows the status of the service, through
+// its socket unit when it has one
+func controlService(spec serviceSpec, action string) error {
+	units := []string{spec.name + ".service"}
+	if _, err := os.Stat(filepath.Join(systemdUnitDir, spec.name+".socket")); err == nil {
+		switch action {
+		case "start":
+			units = []string{spec.name + ".socket"}
+		case "stop":
+			units = append([]string{spec.name + ".socket"}, units...)
+		}
+	}
+	return systemctl(append([]string{action}, units...)...)
+}
+
+// serviceUnit renders the systemd service unit. serve runs as a dynamic
+// user with only the capability to bind port 53, and reloads on SIGHUP.
+func serviceUnit(spec serviceSpec) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=tmp-dns forwarder\n")
+	fmt.Fprintf(&b, "Wants=network-online.target nss-lookup.target\nAfter=network-online.target\nBefore=nss-lookup.target\n")
+	if spec.socket {
+		fmt.Fprintf(&b, "Requires=%s.socket\n", spec.name)
+	}
+	fmt.Fprintf(&b, "\n[Service]\nExecStart=%s\n", systemdCommand(append([]string{spec.exe}, spec.args...)))
+	fmt.Fprintf(&b, "ExecReload=/bin/kill -HUP $MAINPID\nRestart=on-failure\n")
+	fmt.Fprintf(&b, "DynamicUser=yes\nStateDirectory=%s\nAmbientCapabilities=CAP_NET_BIND_SERVICE\nCapabilityBoundingSet=CAP_NET_BIND_SERVICE\n", spec.name)
+	fmt.Fprintf(&b, "\n[Install]\nWantedBy=multi-user.target\n")
+	if spec.socket {
+		fmt.Fprintf(&b, "Also=%s.socket\n", spec.name)
+	}
+	return b.String()
+}
+
+// socketUnit renders the systemd socket unit for the -listen address
+func socketUnit(spec serviceSpec) (string, error) {
+	host, port, err := net.SplitHostPort(spec.listen)
+	if err != nil {
+		return "", fmt.Errorf("invalid -listen address %q: %v", spec.listen, err)
+	}
+	addr := port
+	if host != "" {
+		addr = net.JoinHostPort(host, port)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=tmp-dns forwarder sockets\n")
+	fmt.Fprintf(&b, "\n[Socket]\nListenDatagram=%s\nListenStream=%s\n", addr, addr)
+	fmt.Fprintf(&b, "\n[Install]\nWantedBy=sockets.target\n")
+	return b.String(), nil
+}
+
+// systemdCommand quotes args for an ExecStart line, escaping the specifier
+// and variable expansion systemd does
+func systemdCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		arg = strings.ReplaceAll(arg, "%", "%%")
+		arg = strings.ReplaceAll(arg, "$", "$$")
+		if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+			quoted[i] = arg
+			continue
+		}
+		arg = strings.ReplaceAll(arg, `\`, `\\`)
+		quoted[i] = `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+func writeUnit(name, content string) error {
+	if err := os.WriteFile(filepath.Join(systemdUnitDir, name), []byte(content), 0o644); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%v (service install needs root)", err)
+		}
+		return err
+	}
+	return nil
+}
+
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+var errNoServiceManager = errors.New("service is only supported with systemd, launchd and the Windows service manager")
+
+func installService(serviceSpec) error { return errNoServiceManager }
+
+func uninstallService(serviceSpec) error { return errNoServiceManager }
+
+func controlService(serviceSpec, string) error { return errNoServiceManager }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceWait bounds how long start and stop wait for the service, past
+// the -drain-timeout of a stopping serve
+const serviceWait = 30 * time.Second
+
+// installService registers serve as an automatically started service that
+// the service manager restarts when it fails
+func installService(spec serviceSpec) error {
+	if spec.socket {
+		return errors.New("-socket is only supported with systemd")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("cannot connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(spec.name, spec.exe, mgr.Config{
+		DisplayName: spec.name,
+		Description: "tmp-dns DNS forwarder",
+		StartType:   mgr.StartAutomatic,
+	}, spec.args...)
+	if err != nil {
+		return fmt.Errorf("cannot create service %s: %v", spec.name, err)
+	}
+	defer s.Close()
+	restart := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}
+	if err := s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("cannot set the recovery actions of %s: %v", spec.name, err)
+	}
+	fmt.Printf("installed service %s, start it with %s service start -name %s\n", spec.name, os.Args[0], spec.name)
+	return nil
+}
+
+// uninstallService stops the service if it runs and deletes it
+func uninstallService(spec serviceSpec) error {
+	m, s, err := openService(spec.name)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+		if err := stopService(s); err != nil {
+			return err
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("cannot delete service %s: %v", spec.name, err)
+	}
+	return nil
+}
+
+// controlService starts, stops or shows the state of the service
+func controlService(spec serviceSpec, action string) error {
+	m, s, err := openService(spec.name)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	switch action {
+	case "start":
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("cannot start service %s: %v", spec.name, err)
+		}
+		return waitService(s, svc.Running)
+	case "stop":
+		return stopService(s)
+	}
+	status, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("cannot query service %s: %v", spec.name, err)
+	}
+	fmt.Printf("%s: %s\n", spec.name, serviceStates[status.State])
+	return nil
+}
+
+var serviceStates = map[svc.State]string{
+	svc.Stopped:         "stopped",
+	svc.StartPending:    "starting",
+	svc.StopPending:     "stopping",
+	svc.Running:         "running",
+	svc.ContinuePending: "continuing",
+	svc.PausePending:    "pausing",
+	svc.Paused:          "paused",
+}
+
+func openService(name string) (*mgr.Mgr, *mgr.Service, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot connect to the service manager: %v", err)
+	}
+	s, err := m.OpenService(name)
+	if err != nil {
+		m.Disconnect()
+		return nil, nil, fmt.Errorf("cannot open service %s: %v", name, err)
+	}
+	return m, s, nil
+}
+
+func stopService(s *mgr.Service) error {
+	if _, err := s.Control(svc.Stop); err != nil {
+		return fmt.Errorf("cannot stop service %s: %v", s.Name, err)
+	}
+	return waitService(s, svc.Stopped)
+}
+
+// waitService polls the service until it reaches state
+func waitService(s *mgr.Service, state svc.State) error {
+	deadline := time.Now().Add(serviceWait)
+	for {
+		status, err := s.Query()
+		if err != nil {
+			return fmt.Errorf("cannot query service %s: %v", s.Name, err)
+		}
+		if status.State == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s is still %s after %v", s.Name, serviceStates[status.State], serviceWait)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// shellCommands are the commands of the shell, anything else is a query
+var shellCommands = []string{"server", "set", "history", "help", "exit", "quit"}
+
+// shellSettings are the names set takes, with the values to complete
+var shellSettings = map[string][]string{
+	"type":    nil, // the record types
+	"timeout": nil,
+	"output":  {"plain", "short", "verbose", "json"},
+	"method":  {"udp", "tcp", "tls", "quic", "http", "json", "odoh", "mdns"},
+}
+
+// shellHistorySize caps the lines kept in the history file
+const shellHistorySize = 1000
+
+// shell is the state of an interactive session: the resolver for the
+// current servers, built again only when they change so that pooled
+// connections carry over from query to query
+type shell struct {
+	opts    *options
+	port    int
+	method  string
+	servers string // as given to server, empty for the default of method
+	qtype   uint16
+	timeout time.Duration
+	output  string
+	r       resolver.Resolver
+}
+
+// runShell implements the shell subcommand: an interactive session like
+// the one of nslookup, where the server, type and output are set once for
+// the queries that follow
+func runShell(args []string) {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json, odoh or mdns")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	typeName := fs.String("type", "A", "record `type` to query until set type changes it")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each query after this `duration`")
+	historyFile := fs.String("history", defaultHistoryFile(), "keep the command history in this `file`, empty for none")
+	opts := options{keepalive: true}
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s shell [flags]\n\nType help in the shell for its commands.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := cfg.apply(fs, "shell"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	qtype, err := parseType(*typeName)
+	if err != nil {
+		fatal(err.Error())
+	}
+	sh := &shell{opts: &opts, port: *port, method: *method, qtype: qtype, timeout: *timeout, output: "plain"}
+	if err := sh.setServers(*serverFlag); err != nil {
+		fatal(err.Error())
+	}
+
+	e := newLineEditor(os.Stdin, os.Stdout)
+	e.complete = sh.complete
+	e.history = loadHistory(*historyFile)
+	prompt := ""
+	if e.terminal {
+		prompt = "> "
+		fmt.Printf("Default server: %s\n", sh.serverLabel())
+	}
+	for {
+		line, err := e.readLine(prompt)
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fatal("failed to read the input", "err", err)
+			}
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if e.remember(line) && *historyFile != "" {
+			appendHistory(*historyFile, line)
+		}
+		if !sh.run(line, e.history) {
+			break
+		}
+	}
+}
+
+// run carries out one line and reports whether the session goes on
+func (sh *shell) run(line string, history []string) bool {
+	words := strings.Fields(line)
+	switch strings.ToLower(words[0]) {
+	case "exit", "quit":
+		return false
+	case "help", "?":
+		printShellHelp()
+	case "history":
+		for i, h := range history {
+			fmt.Printf("%5d  %s\n", i+1, h)
+		}
+	case "server":
+		if len(words) == 1 {
+			fmt.Printf("Default server: %s\n", sh.serverLabel())
+			break
+		}
+		if err := sh.setServers(strings.Join(words[1:], ",")); err != nil {
+			fmt.Printf(";; %v\n", err)
+			break
+		}
+		fmt.Printf("Default server: %s\n", sh.serverLabel())
+	case "set":
+		if len(words) == 1 {
+			sh.printSettings()
+		}
+		for _, setting := range words[1:] {
+			if err := sh.set(setting); err != nil {
+				fmt.Printf(";; %v\n", err)
+			}
+		}
+	default:
+		sh.query(words)
+	}
+	return true
+}
+
+// setServers rebuilds the resolver for servers, or the default servers of
+// the method when empty
+func (sh *shell) setServers(servers string) error {
+	spec := servers
+	if spec == "" {
+		spec = sh.opts.defaultServer(sh.method)
+	}
+	upstreams, err := parseUpstreams(sh.method, spec, sh.port)
+	if err != nil {
+		return err
+	}
+	r, err := sh.opts.buildResolver(upstreams)
+	if err != nil {
+		return err
+	}
+	sh.servers, sh.r = servers, r
+	return nil
+}
+
+// serverLabel names the servers queries go to
+func (sh *shell) serverLabel() string {
+	if sh.servers != "" {
+		return sh.servers
+	}
+	return sh.opts.defaultServer(sh.method) + " (" + sh.method + ")"
+}
+
+// set changes one name=value setting. A bare record type sets the type,
+// as nslookup takes set type=mx and set mx alike.
+func (sh *shell) set(setting string) error {
+	name, value, ok := strings.Cut(setting, "=")
+	name = strings.ToLower(name)
+	if !ok {
+		if _, err := parseType(name); err == nil {
+			name, value = "type", setting
+		} else if name == "all" {
+			sh.printSettings()
+			return nil
+		} else {
+			return fmt.Errorf("want set name=value, such as set type=MX")
+		}
+	}
+	switch name {
+	case "type", "querytype", "q":
+		qtype, err := parseType(value)
+		if err != nil {
+			return err
+		}
+		sh.qtype = qtype
+	case "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q: %v", value, err)
+		}
+		sh.timeout = d
+	case "output":
+		switch value {
+		case "plain", "short", "verbose", "json":
+			sh.output = value
+		default:
+			return fmt.Errorf("invalid output %q, want plain, short, verbose or json", value)
+		}
+	case "method":
+		old := sh.method
+		sh.method = value
+		if err := sh.setServers(sh.servers); err != nil {
+			sh.method = old
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown setting %q, want type, timeout, output or method", name)
+	}
+	return nil
+}
+
+func (sh *shell) printSettings() {
+	fmt.Printf("  server  = %s\n  method  = %s\n  type    = %s\n  timeout = %v\n  output  = %s\n", sh.serverLabel(), sh.method, typeString(sh.qtype), sh.timeout, sh.output)
+}
+
+// query resolves a name, given with optional types, the way the query
+// command prints it. An IP address is looked up by PTR, and Ctrl-C gives
+// up on the query rather than the session.
+func (sh *shell) query(words []string) {
+	name := words[0]
+	qtypes := []uint16{sh.qtype}
+	if net.ParseIP(name) != nil {
+		arpa, err := dns.ReverseAddr(name)
+		if err != nil {
+			fmt.Printf(";; %v\n", err)
+			return
+		}
+		name, qtypes[0] = arpa, dns.TypePTR
+	}
+	if len(words) > 1 {
+		var err error
+		if qtypes, err = parseTypes(strings.Join(words[1:], ",")); err != nil {
+			fmt.Printf(";; %v\n", err)
+			return
+		}
+	}
+	domain, err := toASCII(name)
+	if err != nil {
+		fmt.Printf(";; %v\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sh.timeout)
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for i, qtype := range qtypes {
+		if i > 0 && sh.output != "short" {
+			fmt.Println()
+		}
+		var trace resolver.Trace
+		sent := time.Now()
+		resp, err := sh.r.Query(resolver.WithTrace(resolver.WithTraceID(ctx, resolver.NewTraceID()), &trace), domain, qtype)
+		if err != nil {
+			class := classify(nil, err)
+			if sh.output == "json" {
+				printShellJSON(batchJSON{Name: dns.Fqdn(domain), Type: typeString(qtype), Error: err.Error(), ErrorClass: class.String()})
+				continue
+			}
+			fmt.Printf(";; %s query failed (%s): %v\n", typeString(qtype), class, err)
+			continue
+		}
+		switch sh.output {
+		case "short":
+			printShort(resp)
+		case "verbose":
+			printVerbose(os.Stdout, resp, trace, sent)
+		case "json":
+			out := newJSONResponse(resp, trace)
+			printShellJSON(batchJSON{Name: dns.Fqdn(domain), Type: typeString(qtype), ErrorClass: out.ErrorClass, jsonResponse: &out})
+		default:
+			printHeading(domain, false)
+			if resp.Rcode != dns.RcodeSuccess {
+				fmt.Printf(";; %s\n", rcodeString(resp.Rcode))
+			} else if len(resp.Answer) == 0 {
+				fmt.Printf(";; no %s records\n", typeString(qtype))
+			}
+			printAnswers(resp, false)
+		}
+	}
+}
+
+func printShellJSON(line batchJSON) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(line)
+}
+
+// complete returns the candidates for the last word of line: commands and
+// names queried before for the first word, then settings, their values or
+// record types
+func (sh *shell) complete(line string) []string {
+	words := strings.Fields(line)
+	if strings.HasSuffix(line, " ") || len(words) == 0 {
+		words = append(words, "")
+	}
+	last := words[len(words)-1]
+	if len(words) == 1 {
+		return shellCommands
+	}
+	switch strings.ToLower(words[0]) {
+	case "server", "history", "help", "exit", "quit":
+		return nil
+	case "set":
+		name, _, ok := strings.Cut(last, "=")
+		if !ok {
+			var names []string
+			for name := range shellSettings {
+				names = append(names, name+"=")
+			}
+			sort.Strings(names)
+			return names
+		}
+		if values := shellSettings[strings.ToLower(name)]; values != nil {
+			return values
+		}
+		if strings.EqualFold(name, "type") {
+			return recordTypeNames()
+		}
+		return nil
+	}
+	return recordTypeNames()
+}
+
+// recordTypeNames returns the names of the record types, sorted
+func recordTypeNames() []string {
+	names := make([]string, 0, len(dns.StringToType))
+	for name := range dns.StringToType {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func printShellHelp() {
+	fmt.Print(`Commands:
+  <name> [types]        query the name, an address by PTR, for the set type or the given ones
+  server [servers]      show the servers, or query these from now on, as -server takes them
+  set                   show the settings
+  set type=MX           query this record type, set mx does the same
+  set timeout=2s        give up on each query after this long
+  set output=short      print plain, short, verbose or json output
+  set method=tls        reach servers given without a scheme with this method
+  history               list the commands entered so far
+  exit                  leave the shell, as Ctrl-D does
+`)
+}
+
+// defaultHistoryFile is ~/.tmp-dns_history, or none without a home
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".tmp-dns_history")
+}
+
+// loadHistory reads the last shellHistorySize lines of the history file
+func loadHistory(path string) []string {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > shellHistorySize {
+		lines = lines[len(lines)-shellHistorySize:]
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	return lines
+}
+
+// appendHistory adds line to the history file, which is private as the
+// names looked up may be
+func appendHistory(path, line string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
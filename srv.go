@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// srvTarget is one SRV record, in the order clients should try it, with
+// its target's addresses as host:port pairs
+type srvTarget struct {
+	Priority  uint16   `json:"priority"`
+	Weight    uint16   `json:"weight"`
+	Target    string   `json:"target"`
+	Port      uint16   `json:"port"`
+	Addresses []string `json:"addresses"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// naptrEntry is one NAPTR record and what its flags lead to: SRV targets
+// for "s", addresses for "a"
+type naptrEntry struct {
+	Order       uint16      `json:"order"`
+	Preference  uint16      `json:"preference"`
+	Flags       string      `json:"flags"`
+	Service     string      `json:"service"`
+	Regexp      string      `json:"regexp,omitempty"`
+	Replacement string      `json:"replacement"`
+	Targets     []srvTarget `json:"targets,omitempty"`
+	Addresses   []string    `json:"addresses,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// srvJSON is the -json rendering of the srv subcommand
+type srvJSON struct {
+	Name    string       `json:"name"`
+	Targets []srvTarget  `json:"targets,omitempty"`
+	NAPTR   []naptrEntry `json:"naptr,omitempty"`
+}
+
+// srvLookup resolves SRV records and the addresses of their targets
+type srvLookup struct {
+	r       resolver.Resolver
+	timeout time.Duration
+}
+
+// runSRV implements the srv subcommand: service discovery as RFC 2782
+// describes it. The SRV records of a service are put in the order clients
+// try them, by priority and then weighted at random, and their targets
+// resolved to host:port pairs. Given a bare domain it starts from the
+// NAPTR records instead (RFC 3403), as SIP and ENUM clients do. It exits
+// with status 1 when no address is found.
+func runSRV(args []string) {
+	fs := flag.NewFlagSet("srv", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each lookup after this `duration`")
+	naptrService := fs.String("naptr-service", "", "with a bare domain, only follow NAPTR records for this `service`, such as SIP+D2T")
+	jsonOut := fs.Bool("json", false, "print the targets and their addresses as JSON")
+	var opts options
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s srv [flags] <service> <proto> <domain>\n\nThe service can also be given as _service._proto <domain> or _service._proto.domain. A domain on its own is looked up with NAPTR first.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "srv"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	name, naptr, err := srvName(args)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		os.Exit(2)
+	}
+	if name, err = toASCII(name); err != nil {
+		fatal(err.Error())
+	}
+	name = dns.Fqdn(name)
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+	l := &srvLookup{r: r, timeout: *timeout}
+
+	out := srvJSON{Name: name}
+	if naptr {
+		out.NAPTR, err = l.naptr(name, *naptrService)
+	} else {
+		out.Targets, err = l.srv(name)
+	}
+	if err != nil {
+		fatal("service lookup failed", "name", name, "err", err)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		printSRV(out)
+	}
+	if !out.found() {
+		os.Exit(1)
+	}
+}
+
+// srvName builds the name to look up from the arguments, and reports
+// whether it is a bare domain to start from NAPTR records for
+func srvName(args []string) (string, bool, error) {
+	switch len(args) {
+	case 1:
+		return args[0], !strings.HasPrefix(args[0], "_"), nil
+	case 2:
+		return strings.TrimSuffix(args[0], ".") + "." + args[1], false, nil
+	case 3:
+		return "_" + strings.TrimPrefix(args[0], "_") + "._" + strings.TrimPrefix(args[1], "_") + "." + args[2], false, nil
+	}
+	return "", false, fmt.Errorf("want a service, a protocol and a domain")
+}
+
+// srv looks up the SRV records of name and resolves their targets
+func (l *srvLookup) srv(name string) ([]srvTarget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	resp, err := l.r.Query(resolver.WithTraceID(ctx, resolver.NewTraceID()), name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s", rcodeString(resp.Rcode))
+	}
+	var records []*dns.SRV
+	for _, rr := range resp.Answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			records = append(records, srv)
+		}
+	}
+	// A lone SRV record pointing at the root says there is no such service
+	if len(records) == 1 && records[0].Target == "." {
+		return nil, fmt.Errorf("%s is decidedly not available", name)
+	}
+
+	records = orderSRV(records)
+	targets := make([]srvTarget, len(records))
+	var wg sync.WaitGroup
+	for i, srv := range records {
+		targets[i] = srvTarget{Priority: srv.Priority, Weight: srv.Weight, Target: srv.Target, Port: srv.Port}
+		wg.Add(1)
+		go func(t *srvTarget) {
+			defer wg.Done()
+			addrs, err := l.addresses(resp.Extra, t.Target)
+			for _, addr := range addrs {
+				t.Addresses = append(t.Addresses, net.JoinHostPort(addr, strconv.Itoa(int(t.Port))))
+			}
+			if err != nil {
+				t.Error = err.Error()
+			}
+		}(&targets[i])
+	}
+	wg.Wait()
+	return targets, nil
+}
+
+// orderSRV sorts records by priority and, within a priority, by the
+// weighted random selection of RFC 2782
+func orderSRV(records []*dns.SRV) []*dns.SRV {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	ordered := make([]*dns.SRV, 0, len(records))
+	for start := 0; start < len(records); {
+		end := start
+		for end < len(records) && records[end].Priority == records[start].Priority {
+			end++
+		}
+		group := append([]*dns.SRV(nil), records[start:end]...)
+		// Records of weight 0 go first, so they only win when the draw is 0
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Weight == 0 && group[j].Weight != 0 })
+		for len(group) > 0 {
+			total := 0
+			for _, srv := range group {
+				total += int(srv.Weight)
+			}
+			pick, sum := rand.Intn(total+1), 0
+			for i, srv := range group {
+				if sum += int(srv.Weight); sum >= pick {
+					ordered = append(ordered, srv)
+					group = append(group[:i], group[i+1:]...)
+					break
+				}
+			}
+		}
+		start = end
+	}
+	return ordered
+}
+
+// addresses returns the IPv4 and IPv6 addresses of target, from the
+// additional section when the server sent them along, else from A and
+// AAAA queries
+func (l *srvLookup) addresses(extra []dns.RR, target string) ([]string, error) {
+	var addrs []string
+	for _, rr := range extra {
+		if !strings.EqualFold(rr.Header().Name, target) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	var errs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		res := followChain(ctx, l.r, target, qtype, defaultChainDepth)
+		for _, addr := range res.addrs {
+			addrs = append(addrs, addr.Address)
+		}
+		switch {
+		case res.err != nil:
+			errs = append(errs, typeString(qtype)+": "+res.err.Error())
+		case res.rcode != dns.RcodeSuccess:
+			errs = append(errs, typeString(qtype)+": "+rcodeString(res.rcode))
+		}
+	}
+	if len(errs) > 0 {
+		return addrs, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return addrs, nil
+}
+
+// naptr looks up the NAPTR records of name in order and preference, and
+// follows the terminal "s" and "a" rules among them
+func (l *srvLookup) naptr(name, service string) ([]naptrEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	resp, err := l.r.Query(resolver.WithTraceID(ctx, resolver.NewTraceID()), name, dns.TypeNAPTR)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s", rcodeString(resp.Rcode))
+	}
+	var records []*dns.NAPTR
+	for _, rr := range resp.Answer {
+		if naptr, ok := rr.(*dns.NAPTR); ok && (service == "" || strings.EqualFold(naptr.Service, service)) {
+			records = append(records, naptr)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Order != records[j].Order {
+			return records[i].Order < records[j].Order
+		}
+		return records[i].Preference < records[j].Preference
+	})
+
+	entries := make([]naptrEntry, len(records))
+	for i, rr := range records {
+		e := naptrEntry{Order: rr.Order, Preference: rr.Preference, Flags: rr.Flags, Service: rr.Service, Regexp: rr.Regexp, Replacement: rr.Replacement}
+		var err error
+		switch strings.ToLower(rr.Flags) {
+		case "s":
+			e.Targets, err = l.srv(rr.Replacement)
+		case "a":
+			e.Addresses, err = l.addresses(resp.Extra, rr.Replacement)
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+// found reports whether the lookup came up with any address
+func (s srvJSON) found() bool {
+	for _, t := range s.Targets {
+		if len(t.Addresses) > 0 {
+			return true
+		}
+	}
+	for _, e := range s.NAPTR {
+		if len(e.Addresses) > 0 || (srvJSON{Targets: e.Targets}).found() {
+			return true
+		}
+	}
+	return false
+}
+
+// printSRV prints one line per target in the order to try them, with the
+// NAPTR record each group came from
+func printSRV(out srvJSON) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if out.NAPTR == nil {
+		printSRVTargets(w, "", out.Targets)
+	}
+	for _, e := range out.NAPTR {
+		fmt.Fprintf(w, "NAPTR %d %d %q %q %q %s\n", e.Order, e.Preference, e.Flags, e.Service, e.Regexp, e.Replacement)
+		printSRVTargets(w, "  ", e.Targets)
+		if len(e.Addresses) > 0 {
+			fmt.Fprintf(w, "  %s\t\t\t%s\n", e.Replacement, strings.Join(e.Addresses, ", "))
+		}
+		if e.Error != "" {
+			fmt.Fprintf(w, "  ;; %s\n", e.Error)
+		}
+	}
+	w.Flush()
+	if len(out.Targets) == 0 && len(out.NAPTR) == 0 {
+		fmt.Printf(";; no records for %s\n", out.Name)
+	}
+}
+
+func printSRVTargets(w *tabwriter.Writer, indent string, targets []srvTarget) {
+	for _, t := range targets {
+		addrs := strings.Join(t.Addresses, ", ")
+		if t.Error != "" {
+			addrs = strings.TrimPrefix(addrs+", ;; "+t.Error, ", ")
+		}
+		fmt.Fprintf(w, "%s%d\t%d\t%s\t%s\n", indent, t.Priority, t.Weight, net.JoinHostPort(strings.TrimSuffix(t.Target, "."), strconv.Itoa(int(t.Port))), addrs)
+	}
+}
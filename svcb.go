@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// echVersion is the ECHConfig version of TLS Encrypted Client Hello, the one
+// that can be decoded
+const echVersion = 0xfe0d
+
+// jsonSVCB is the decoded form of an SVCB or HTTPS record (RFC 9460)
+type jsonSVCB struct {
+	Mode          string            `json:"mode"`
+	Priority      uint16            `json:"priority"`
+	Target        string            `json:"target"`
+	Mandatory     []string          `json:"mandatory,omitempty"`
+	ALPN          []string          `json:"alpn,omitempty"`
+	NoDefaultALPN bool              `json:"no_default_alpn,omitempty"`
+	Port          uint16            `json:"port,omitempty"`
+	IPv4Hint      []string          `json:"ipv4hint,omitempty"`
+	IPv6Hint      []string          `json:"ipv6hint,omitempty"`
+	ECH           []jsonECHConfig   `json:"ech,omitempty"`
+	DoHPath       string            `json:"dohpath,omitempty"`
+	Params        map[string]string `json:"params,omitempty"` // other keys in presentation form
+}
+
+// jsonECHConfig is one entry of an ECHConfigList. Only the version is set
+// for versions that cannot be decoded.
+type jsonECHConfig struct {
+	Version       string   `json:"version"`
+	ConfigID      *uint8   `json:"config_id,omitempty"`
+	KEM           string   `json:"kem,omitempty"`
+	PublicKey     string   `json:"public_key,omitempty"`
+	CipherSuites  []string `json:"cipher_suites,omitempty"`
+	MaxNameLength uint8    `json:"max_name_length,omitempty"`
+	PublicName    string   `json:"public_name,omitempty"`
+}
+
+// newJSONSVCB decodes rr, or returns nil when it is not an SVCB or HTTPS
+// record
+func newJSONSVCB(rr dns.RR) *jsonSVCB {
+	var svcb *dns.SVCB
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		svcb = rr
+	case *dns.HTTPS:
+		svcb = &rr.SVCB
+	default:
+		return nil
+	}
+
+	out := &jsonSVCB{Mode: "service", Priority: svcb.Priority, Target: svcb.Target}
+	if svcb.Priority == 0 {
+		out.Mode = "alias"
+	}
+	for _, kv := range svcb.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBMandatory:
+			for _, code := range kv.Code {
+				out.Mandatory = append(out.Mandatory, code.String())
+			}
+		case *dns.SVCBAlpn:
+			out.ALPN = kv.Alpn
+		case *dns.SVCBNoDefaultAlpn:
+			out.NoDefaultALPN = true
+		case *dns.SVCBPort:
+			out.Port = kv.Port
+		case *dns.SVCBIPv4Hint:
+			for _, ip := range kv.Hint {
+				out.IPv4Hint = append(out.IPv4Hint, ip.String())
+			}
+		case *dns.SVCBIPv6Hint:
+			for _, ip := range kv.Hint {
+				out.IPv6Hint = append(out.IPv6Hint, ip.String())
+			}
+		case *dns.SVCBECHConfig:
+			configs, err := parseECHConfigList(kv.ECH)
+			if err == nil {
+				out.ECH = configs
+				continue
+			}
+			out.setParam(kv)
+		case *dns.SVCBDoHPath:
+			out.DoHPath = kv.Template
+		default:
+			out.setParam(kv)
+		}
+	}
+	return out
+}
+
+func (s *jsonSVCB) setParam(kv dns.SVCBKeyValue) {
+	if s.Params == nil {
+		s.Params = map[string]string{}
+	}
+	s.Params[kv.Key().String()] = kv.String()
+}
+
+// describeSVCB explains rr in lines for the default output, or returns nil
+// when it is not an SVCB or HTTPS record
+func describeSVCB(rr dns.RR) []string {
+	s := newJSONSVCB(rr)
+	if s == nil {
+		return nil
+	}
+	rrtype := typeString(rr.Header().Rrtype)
+	target := s.Target
+	if target == "." {
+		target += " (the owner name)"
+	}
+	if s.Mode == "alias" {
+		return []string{fmt.Sprintf("%s alias to %s", rrtype, target)}
+	}
+
+	lines := []string{fmt.Sprintf("%s service, priority %d, target %s", rrtype, s.Priority, target)}
+	add := func(key string, values ...string) {
+		lines = append(lines, fmt.Sprintf("  %s: %s", key, strings.Join(values, ", ")))
+	}
+	if len(s.Mandatory) > 0 {
+		add("mandatory", s.Mandatory...)
+	}
+	if len(s.ALPN) > 0 {
+		alpn := strings.Join(s.ALPN, ", ")
+		if s.NoDefaultALPN {
+			alpn += " (no default)"
+		}
+		add("alpn", alpn)
+	}
+	if s.Port != 0 {
+		add("port", fmt.Sprint(s.Port))
+	}
+	if len(s.IPv4Hint) > 0 {
+		add("ipv4hint", s.IPv4Hint...)
+	}
+	if len(s.IPv6Hint) > 0 {
+		add("ipv6hint", s.IPv6Hint...)
+	}
+	for _, c := range s.ECH {
+		if c.ConfigID == nil {
+			add("ech", "version "+c.Version)
+			continue
+		}
+		add("ech", fmt.Sprintf("public name %s, config %d, %s with %s", c.PublicName, *c.ConfigID, c.KEM, strings.Join(c.CipherSuites, " or ")))
+	}
+	if s.DoHPath != "" {
+		add("dohpath", s.DoHPath)
+	}
+	for _, key := range sortedKeys(s.Params) {
+		add(key, s.Params[key])
+	}
+	return lines
+}
+
+// parseECHConfigList decodes the ECHConfigList carried by the ech key
+func parseECHConfigList(b []byte) ([]jsonECHConfig, error) {
+	r := &echReader{b: b}
+	list := r.vector16()
+	if r.err != nil || len(r.b) != 0 {
+		return nil, fmt.Errorf("malformed ECHConfigList")
+	}
+
+	var configs []jsonECHConfig
+	for l := (&echReader{b: list}); len(l.b) > 0; {
+		version := l.uint16()
+		contents := l.vector16()
+		if l.err != nil {
+			return nil, fmt.Errorf("truncated ECHConfig")
+		}
+		config := jsonECHConfig{Version: fmt.Sprintf("0x%04x", version)}
+		if version == echVersion {
+			c := &echReader{b: contents}
+			id := c.uint8()
+			config.ConfigID = &id
+			config.KEM = hpkeName(hpkeKEMNames, c.uint16())
+			config.PublicKey = base64.StdEncoding.EncodeToString(c.vector16())
+			for suites := (&echReader{b: c.vector16()}); len(suites.b) > 0 && suites.err == nil; {
+				kdf, aead := suites.uint16(), suites.uint16()
+				config.CipherSuites = append(config.CipherSuites, hpkeName(hpkeKDFNames, kdf)+"/"+hpkeName(hpkeAEADNames, aead))
+			}
+			config.MaxNameLength = c.uint8()
+			config.PublicName = string(c.vector8())
+			c.vector16() // extensions
+			if c.err != nil || len(c.b) != 0 {
+				return nil, fmt.Errorf("malformed ECHConfig contents")
+			}
+		}
+		configs = append(configs, config)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("empty ECHConfigList")
+	}
+	return configs, nil
+}
+
+// echReader reads the TLS presentation language fields of an ECHConfig,
+// remembering the first field that ran past the end
+type echReader struct {
+	b   []byte
+	err error
+}
+
+func (r *echReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = fmt.Errorf("truncated")
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *echReader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *echReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *echReader) vector8() []byte  { return r.next(int(r.uint8())) }
+func (r *echReader) vector16() []byte { return r.next(int(r.uint16())) }
+
+// HPKE algorithm names from RFC 9180
+var (
+	hpkeKEMNames = map[uint16]string{
+		0x0010: "P-256", 0x0011: "P-384", 0x0012: "P-521", 0x0020: "X25519", 0x0021: "X448",
+	}
+	hpkeKDFNames = map[uint16]string{
+		0x0001: "HKDF-SHA256", 0x0002: "HKDF-SHA384", 0x0003: "HKDF-SHA512",
+	}
+	hpkeAEADNames = map[uint16]string{
+		0x0001: "AES-128-GCM", 0x0002: "AES-256-GCM", 0x0003: "ChaCha20Poly1305", 0xffff: "export-only",
+	}
+)
+
+func hpkeName(names map[uint16]string, id uint16) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
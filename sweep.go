@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// sweepResult is the PTR lookup of one address of the range
+type sweepResult struct {
+	index int
+	addr  netip.Addr
+	names []string
+	rcode int
+	err   error
+}
+
+// sweepJSON is the -json line for one address
+type sweepJSON struct {
+	Address string   `json:"address"`
+	Names   []string `json:"names,omitempty"`
+	Rcode   string   `json:"rcode,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// runSweep implements the sweep subcommand: a PTR lookup for every address
+// of a CIDR range with a pool of workers, printing the names in address
+// order and summing up the addresses without one
+func runSweep(args []string) {
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "DNS `servers`, comma separated, as host[:port], a URL such as tls://host or https://host/dns-query, or an sdns:// stamp (default depends on the method)")
+	method := fs.String("method", "udp", "`method` for servers given without a scheme: udp, tcp, tls, quic, http, json or odoh")
+	port := fs.Int("port", 0, "server `port` for servers given without one")
+	workers := fs.Int("workers", 16, "look up to `n` addresses at once")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on each query after this `duration`")
+	limit := fs.Int("max", 65536, "refuse ranges of more than `n` addresses")
+	all := fs.Bool("all", false, "also print the addresses without a name")
+	jsonOut := fs.Bool("json", false, "print one JSON object per line instead of text")
+	var export exportOptions
+	export.register(fs)
+	opts := options{keepalive: true}
+	opts.register(fs)
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sweep [flags] <cidr>\n\nThe summary of the addresses without a name goes to standard error.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "sweep"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	prefix, err := netip.ParsePrefix(args[0])
+	if err != nil {
+		fatal("invalid range", "err", err)
+	}
+	prefix = prefix.Masked()
+	if hostBits := prefix.Addr().BitLen() - prefix.Bits(); hostBits >= 63 || 1<<hostBits > *limit {
+		fatal(fmt.Sprintf("%s has more than %d addresses, raise -max to sweep it", prefix, *limit))
+	}
+
+	servers := *serverFlag
+	if servers == "" {
+		servers = opts.defaultServer(*method)
+	}
+	upstreams, err := parseUpstreams(*method, servers, *port)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := opts.buildResolver(upstreams)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	var file *resultWriter
+	if export.active() {
+		if file, err = export.create(sweepCSVHeader); err != nil {
+			fatal(err.Error())
+		}
+	}
+
+	jobs := make(chan sweepResult)
+	results := make(chan sweepResult)
+	var wg sync.WaitGroup
+	for i := 0; i < max(*workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				results <- lookupPTR(r, job, *timeout)
+			}
+		}()
+	}
+	go func() {
+		index := 0
+		for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+			jobs <- sweepResult{index: index, addr: addr}
+			index++
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	// Results arrive in any order, hold them back until their turn
+	out := bufio.NewWriter(os.Stdout)
+	pending := map[int]sweepResult{}
+	next := 0
+	var summary sweepSummary
+	for res := range results {
+		pending[res.index] = res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			summary.add(res)
+			if len(res.names) == 0 && !*all {
+				continue
+			}
+			switch {
+			case file != nil:
+				if err := file.write(newSweepJSON(res), sweepCSVRows(res)); err != nil {
+					fatal("failed to write the results", "err", err)
+				}
+			case *jsonOut:
+				printSweepJSON(out, res)
+			default:
+				printSweepText(out, res)
+			}
+		}
+	}
+	out.Flush()
+	if file != nil {
+		if err := file.Close(); err != nil {
+			fatal(err.Error())
+		}
+	}
+	summary.print(os.Stderr, prefix)
+}
+
+// lookupPTR asks for the PTR records of the address of job
+func lookupPTR(r resolver.Resolver, job sweepResult, timeout time.Duration) sweepResult {
+	arpa, err := dns.ReverseAddr(job.addr.String())
+	if err != nil {
+		job.err = err
+		return job
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := r.Query(ctx, arpa, dns.TypePTR)
+	if err != nil {
+		job.err = err
+		return job
+	}
+	job.rcode = resp.Rcode
+	for _, rr := range resp.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			job.names = append(job.names, ptr.Ptr)
+		}
+	}
+	return job
+}
+
+func printSweepText(w io.Writer, res sweepResult) {
+	switch {
+	case res.err != nil:
+		fmt.Fprintf(w, "%s\tERROR\t%v\n", res.addr, res.err)
+	case len(res.names) == 0:
+		fmt.Fprintf(w, "%s\t%s\n", res.addr, dns.RcodeToString[res.rcode])
+	default:
+		fmt.Fprintf(w, "%s\t%s\n", res.addr, strings.Join(res.names, ", "))
+	}
+}
+
+// newSweepJSON returns the -json line for res
+func newSweepJSON(res sweepResult) sweepJSON {
+	line := sweepJSON{Address: res.addr.String(), Names: res.names}
+	if res.err != nil {
+		line.Error = res.err.Error()
+	} else {
+		line.Rcode = dns.RcodeToString[res.rcode]
+	}
+	return line
+}
+
+func printSweepJSON(w io.Writer, res sweepResult) {
+	b, err := json.Marshal(newSweepJSON(res))
+	if err != nil {
+		fatal(err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+// sweepCSVHeader names the columns of -o CSV files
+var sweepCSVHeader = []string{"address", "rcode", "error", "name"}
+
+// sweepCSVRows returns a CSV row per name of res, or one without a name
+func sweepCSVRows(res sweepResult) [][]string {
+	if res.err != nil {
+		return [][]string{{res.addr.String(), "", res.err.Error(), ""}}
+	}
+	if len(res.names) == 0 {
+		return [][]string{{res.addr.String(), dns.RcodeToString[res.rcode], "", ""}}
+	}
+	rows := make([][]string, len(res.names))
+	for i, name := range res.names {
+		rows[i] = []string{res.addr.String(), dns.RcodeToString[res.rcode], "", name}
+	}
+	return rows
+}
+
+// sweepSummary counts the results, which arrive in address order, and
+// gathers the addresses without a name into runs
+type sweepSummary struct {
+	named, unnamed, failed int
+	runs                   []sweepRun
+}
+
+// sweepRun is a run of consecutive addresses without a name, as offsets
+// into the range, which -max keeps within 64 bits
+type sweepRun struct {
+	start, count uint64
+}
+
+func (s *sweepSummary) add(res sweepResult) {
+	switch {
+	case res.err != nil:
+		s.failed++
+	case len(res.names) > 0:
+		s.named++
+		return
+	default:
+		s.unnamed++
+	}
+	offset := uint64(res.index)
+	if n := len(s.runs); n > 0 && s.runs[n-1].start+s.runs[n-1].count == offset {
+		s.runs[n-1].count++
+		return
+	}
+	s.runs = append(s.runs, sweepRun{start: offset, count: 1})
+}
+
+// print writes the counts and the runs without a name as CIDR blocks
+func (s *sweepSummary) print(w io.Writer, prefix netip.Prefix) {
+	fmt.Fprintf(w, ";; %s: %d addresses with a name, %d without, %d lookups failed\n", prefix, s.named, s.unnamed, s.failed)
+	if len(s.runs) == 0 {
+		return
+	}
+	fmt.Fprintln(w, ";; without a name:")
+	for _, run := range s.runs {
+		var blocks []string
+		for _, p := range runPrefixes(prefix.Addr(), run) {
+			blocks = append(blocks, p.String())
+		}
+		fmt.Fprintf(w, ";;   %s (%d)\n", strings.Join(blocks, " "), run.count)
+	}
+}
+
+// runPrefixes returns the fewest CIDR blocks that cover run, the largest
+// aligned block that fits each time
+func runPrefixes(base netip.Addr, run sweepRun) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for start, left := run.start, run.count; left > 0; {
+		size := uint64(1) << (bits.Len64(left) - 1)
+		if start != 0 {
+			size = min(size, start&-start)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addrAt(base, start), base.BitLen()-bits.TrailingZeros64(size)))
+		start += size
+		left -= size
+	}
+	return prefixes
+}
+
+// addrAt returns the address offset addresses after base
+func addrAt(base netip.Addr, offset uint64) netip.Addr {
+	b := base.AsSlice()
+	for i := len(b) - 1; i >= 0 && offset > 0; i-- {
+		sum := uint64(b[i]) + offset&0xff
+		b[i] = byte(sum)
+		offset = offset>>8 + sum>>8
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
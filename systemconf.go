@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// systemConfig is the configuration of the system stub resolver
+type systemConfig struct {
+	Servers []string // host:port
+	Search  []string
+	Ndots   int
+}
+
+// resolvConf is where Unix systems, macOS included, keep the stub resolver
+// configuration. On macOS it mirrors the primary resolver of the system
+// configuration.
+const resolvConf = "/etc/resolv.conf"
+
+// parseResolvConf reads the servers, search list and ndots of a
+// resolv.conf file
+func parseResolvConf(path string) (*systemConfig, error) {
+	cc, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the system resolver configuration: %v", err)
+	}
+	conf := &systemConfig{Search: cc.Search, Ndots: cc.Ndots}
+	for _, server := range cc.Servers {
+		conf.Servers = append(conf.Servers, net.JoinHostPort(server, cc.Port))
+	}
+	if len(conf.Servers) == 0 {
+		return nil, fmt.Errorf("%s lists no nameserver", path)
+	}
+	return conf, nil
+}
+
+// servers returns the servers as a -server list
+func (c *systemConfig) servers() string {
+	return strings.Join(c.Servers, ",")
+}
+
+// searchTry is one name of the search list that was tried for a query
+type searchTry struct {
+	Name    string `json:"name"`
+	Rcode   string `json:"rcode,omitempty"`
+	Answers int    `json:"answers"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newSearchTry(name string, resp *dns.Msg, err error) searchTry {
+	if err != nil {
+		return searchTry{Name: name, Error: err.Error()}
+	}
+	return searchTry{Name: name, Rcode: rcodeString(resp.Rcode), Answers: len(resp.Answer)}
+}
+
+// describeSearch sums up the names tried in one line, the one that answered
+// last
+func describeSearch(tries []searchTry) string {
+	parts := make([]string, len(tries))
+	for i, t := range tries {
+		switch {
+		case t.Error != "":
+			parts[i] = t.Name + " failed"
+		case t.Answers > 0:
+			parts[i] = t.Name + " answered"
+		case t.Rcode == "NOERROR":
+			parts[i] = t.Name + " NODATA"
+		default:
+			parts[i] = t.Name + " " + t.Rcode
+		}
+	}
+	return "searched " + strings.Join(parts, ", ")
+}
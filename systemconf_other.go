@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// loadSystemConfig reads the stub resolver configuration of the system
+func loadSystemConfig() (*systemConfig, error) {
+	return parseResolvConf(resolvConf)
+}
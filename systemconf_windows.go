@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// tcpipParameters is the registry key of the Windows DNS client settings
+const tcpipParameters = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters`
+
+// loadSystemConfig reads the DNS servers and the search list of the
+// Windows DNS client from the registry: the servers set by hand or learned
+// by DHCP on each interface, and the search list, or the primary DNS
+// suffixes when there is none. Windows has no ndots and tries names with a
+// dot as they are first, as ndots 1 does.
+func loadSystemConfig() (*systemConfig, error) {
+	params, err := registry.OpenKey(registry.LOCAL_MACHINE, tcpipParameters, registry.READ)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the system resolver configuration: %v", err)
+	}
+	defer params.Close()
+	conf := &systemConfig{Ndots: 1}
+	seen := make(map[string]bool)
+	addServers := func(k registry.Key) {
+		for _, name := range []string{"NameServer", "DhcpNameServer"} {
+			value, _, err := k.GetStringValue(name)
+			if err != nil || strings.TrimSpace(value) == "" {
+				continue
+			}
+			for _, server := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+				if addr := net.JoinHostPort(server, "53"); !seen[addr] {
+					seen[addr] = true
+					conf.Servers = append(conf.Servers, addr)
+				}
+			}
+			break // servers set by hand take the place of DHCP ones
+		}
+	}
+	addServers(params)
+	if ifaces, err := registry.OpenKey(params, "Interfaces", registry.READ); err == nil {
+		names, _ := ifaces.ReadSubKeyNames(-1)
+		for _, name := range names {
+			if k, err := registry.OpenKey(ifaces, name, registry.READ); err == nil {
+				addServers(k)
+				k.Close()
+			}
+		}
+		ifaces.Close()
+	}
+	if len(conf.Servers) == 0 {
+		return nil, fmt.Errorf("the registry lists no DNS server")
+	}
+
+	if list, _, err := params.GetStringValue("SearchList"); err == nil && strings.TrimSpace(list) != "" {
+		conf.Search = strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' })
+	} else {
+		for _, name := range []string{"Domain", "DhcpDomain"} {
+			if domain, _, err := params.GetStringValue(name); err == nil && domain != "" {
+				conf.Search = []string{domain}
+				break
+			}
+		}
+	}
+	return conf, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// makeRaw is not supported here, so the shell reads plain lines
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("line editing is only supported on Linux")
+}
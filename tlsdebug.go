@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// jsonTLS is the -tls-debug rendering of the connection that carried the
+// query
+type jsonTLS struct {
+	Version     string     `json:"version"`
+	CipherSuite string     `json:"cipher_suite"`
+	ALPN        string     `json:"alpn,omitempty"`
+	ServerName  string     `json:"server_name,omitempty"`
+	Resumed     bool       `json:"resumed,omitempty"`
+	Verified    bool       `json:"verified"` // false with -insecure
+	OCSP        string     `json:"ocsp"`
+	Chain       []jsonCert `json:"chain"`
+}
+
+// jsonCert is one certificate the server sent, leaf first
+type jsonCert struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Names     []string  `json:"names,omitempty"` // DNS names and IP addresses
+	Key       string    `json:"key"`
+	SPKIPin   string    `json:"spki_pin"`
+}
+
+func newJSONTLS(state *tls.ConnectionState) *jsonTLS {
+	out := &jsonTLS{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		ServerName:  state.ServerName,
+		Resumed:     state.DidResume,
+		Verified:    len(state.VerifiedChains) > 0,
+		OCSP:        ocspStatus(state),
+		Chain:       []jsonCert{},
+	}
+	for _, cert := range state.PeerCertificates {
+		c := jsonCert{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			Serial:    cert.SerialNumber.Text(16),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+			Names:     cert.DNSNames,
+			Key:       keyDescription(cert),
+			SPKIPin:   resolver.SPKIPin(cert.RawSubjectPublicKeyInfo),
+		}
+		for _, ip := range cert.IPAddresses {
+			c.Names = append(c.Names, ip.String())
+		}
+		out.Chain = append(out.Chain, c)
+	}
+	return out
+}
+
+// ocspStatus describes the stapled OCSP response, checking its signature
+// against the issuer when the server sent one
+func ocspStatus(state *tls.ConnectionState) string {
+	if len(state.OCSPResponse) == 0 {
+		return "not stapled"
+	}
+	if len(state.PeerCertificates) == 0 {
+		return "stapled, but there is no certificate to check it against"
+	}
+	var issuer *x509.Certificate
+	if len(state.PeerCertificates) > 1 {
+		issuer = state.PeerCertificates[1]
+	}
+	resp, err := ocsp.ParseResponseForCert(state.OCSPResponse, state.PeerCertificates[0], issuer)
+	if err != nil {
+		return fmt.Sprintf("invalid staple: %v", err)
+	}
+	next := "no next update"
+	if !resp.NextUpdate.IsZero() {
+		next = "next update " + resp.NextUpdate.Format(time.RFC3339)
+		if time.Now().After(resp.NextUpdate) {
+			next += ", expired"
+		}
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return fmt.Sprintf("good, produced %s, %s", resp.ProducedAt.Format(time.RFC3339), next)
+	case ocsp.Revoked:
+		return fmt.Sprintf("revoked at %s", resp.RevokedAt.Format(time.RFC3339))
+	default:
+		return fmt.Sprintf("unknown to the responder, %s", next)
+	}
+}
+
+// keyDescription names the public key type and size of cert
+func keyDescription(cert *x509.Certificate) string {
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + pub.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// printTLS writes the -tls-debug section, or says why there is none
+func printTLS(w io.Writer, trace resolver.Trace) {
+	if trace.TLS == nil {
+		fmt.Fprintf(w, ";; TLS: none, the query went over %s\n", trace.Transport)
+		return
+	}
+	t := newJSONTLS(trace.TLS)
+	fields := []string{t.Version, t.CipherSuite}
+	if t.ALPN != "" {
+		fields = append(fields, "ALPN "+t.ALPN)
+	}
+	if t.ServerName != "" {
+		fields = append(fields, "server name "+t.ServerName)
+	}
+	if t.Resumed {
+		fields = append(fields, "resumed")
+	}
+	if t.Verified {
+		fields = append(fields, "certificate verified")
+	} else {
+		fields = append(fields, "certificate NOT verified")
+	}
+	fmt.Fprintf(w, ";; TLS: %s\n", strings.Join(fields, ", "))
+	fmt.Fprintf(w, ";; OCSP: %s\n", t.OCSP)
+	for i, c := range t.Chain {
+		fmt.Fprintf(w, ";; Certificate %d: %s\n", i, c.Subject)
+		fmt.Fprintf(w, ";;   issuer %s, serial %s\n", c.Issuer, c.Serial)
+		fmt.Fprintf(w, ";;   valid %s to %s, %s key\n", c.NotBefore.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339), c.Key)
+		if len(c.Names) > 0 {
+			fmt.Fprintf(w, ";;   names %s\n", strings.Join(c.Names, ", "))
+		}
+		fmt.Fprintf(w, ";;   SPKI pin %s\n", c.SPKIPin)
+	}
+}
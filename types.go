@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// typeAliases maps commonly used spellings onto the names known to the dns package
+var typeAliases = map[string]string{
+	"*":    "ANY",
+	"ALL":  "ANY",
+	"IPV4": "A",
+	"IPV6": "AAAA",
+}
+
+// classAliases maps commonly used spellings onto the names known to the dns package
+var classAliases = map[string]string{
+	"*":        "ANY",
+	"INTERNET": "IN",
+	"CHAOS":    "CH",
+	"HESIOD":   "HS",
+}
+
+// parseType converts a user supplied record type such as "aaaa", "Mx",
+// "TYPE65" or "28" into its numeric value
+func parseType(s string) (uint16, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	if alias, ok := typeAliases[name]; ok {
+		name = alias
+	}
+	if t, ok := dns.StringToType[name]; ok {
+		return t, nil
+	}
+	if t, ok := parseNumeric(name, "TYPE"); ok {
+		return t, nil
+	}
+	return 0, fmt.Errorf("unknown record type %q, valid values are: %s (or TYPE<n>/<n>)",
+		s, strings.Join(validNames(dns.StringToType, typeAliases), ", "))
+}
+
+// parseTypes parses a comma separated list of record types such as
+// "A,AAAA,MX", leaving out repeats
+func parseTypes(s string) ([]uint16, error) {
+	var types []uint16
+	for _, name := range strings.Split(s, ",") {
+		t, err := parseType(name)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(types, t) {
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// parseClass converts a user supplied class such as "in", "Chaos" or
+// "CLASS3" into its numeric value
+func parseClass(s string) (uint16, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	if alias, ok := classAliases[name]; ok {
+		name = alias
+	}
+	if c, ok := dns.StringToClass[name]; ok {
+		return c, nil
+	}
+	if c, ok := parseNumeric(name, "CLASS"); ok {
+		return c, nil
+	}
+	return 0, fmt.Errorf("unknown class %q, valid values are: %s (or CLASS<n>/<n>)",
+		s, strings.Join(validNames(dns.StringToClass, classAliases), ", "))
+}
+
+// parseOpcode converts a user supplied opcode such as "notify", "STATUS"
+// or "4" into its numeric value
+func parseOpcode(s string) (int, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	if op, ok := dns.StringToOpcode[name]; ok {
+		return op, nil
+	}
+	if n, err := strconv.ParseUint(name, 10, 4); err == nil {
+		return int(n), nil
+	}
+	names := make([]string, 0, len(dns.StringToOpcode))
+	for name := range dns.StringToOpcode {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("unknown opcode %q, valid values are: %s (or 0-15)", s, strings.Join(names, ", "))
+}
+
+// parseNumeric accepts the RFC 3597 generic form (e.g. TYPE65) and bare numbers
+func parseNumeric(name, prefix string) (uint16, bool) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(n), true
+}
+
+// validNames returns the sorted list of names and aliases for error messages
+func validNames(known map[string]uint16, aliases map[string]string) []string {
+	names := make([]string, 0, len(known)+len(aliases))
+	for name := range known {
+		names = append(names, name)
+	}
+	for alias := range aliases {
+		if _, ok := known[alias]; !ok {
+			names = append(names, alias)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// typeString names a type, falling back to the RFC 3597 TYPE<n> form
+func typeString(t uint16) string {
+	if name, ok := dns.TypeToString[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
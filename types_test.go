@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint16
+	}{
+		{"A", dns.TypeA},
+		{"aaaa", dns.TypeAAAA},
+		{"Mx", dns.TypeMX},
+		{"txt", dns.TypeTXT},
+		{" ns ", dns.TypeNS},
+		{"*", dns.TypeANY},
+		{"all", dns.TypeANY},
+		{"ipv4", dns.TypeA},
+		{"IPv6", dns.TypeAAAA},
+		{"TYPE65534", 65534},
+		{"type65", dns.TypeHTTPS},
+		{"28", dns.TypeAAAA},
+	}
+	for _, tt := range tests {
+		got, err := parseType(tt.in)
+		if err != nil {
+			t.Errorf("parseType(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseType(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTypeRejects(t *testing.T) {
+	for _, in := range []string{"", "FOO", "A6X", "TYPE", "TYPE65536", "70000", "-1", "CLASS1"} {
+		_, err := parseType(in)
+		if err == nil {
+			t.Errorf("parseType(%q) succeeded, want an error", in)
+			continue
+		}
+		if !strings.Contains(err.Error(), "valid values are") || !strings.Contains(err.Error(), "AAAA") {
+			t.Errorf("parseType(%q) error %q does not list the valid values", in, err)
+		}
+	}
+}
+
+func TestParseClass(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint16
+	}{
+		{"IN", dns.ClassINET},
+		{"in", dns.ClassINET},
+		{"Internet", dns.ClassINET},
+		{"ch", dns.ClassCHAOS},
+		{"Chaos", dns.ClassCHAOS},
+		{"hesiod", dns.ClassHESIOD},
+		{"*", dns.ClassANY},
+		{"CLASS255", dns.ClassANY},
+		{"class3", dns.ClassCHAOS},
+		{"254", dns.ClassNONE},
+	}
+	for _, tt := range tests {
+		got, err := parseClass(tt.in)
+		if err != nil {
+			t.Errorf("parseClass(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseClass(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseClassRejects(t *testing.T) {
+	for _, in := range []string{"", "XX", "CLASS", "CLASS65536", "99999", "TYPE1"} {
+		_, err := parseClass(in)
+		if err == nil {
+			t.Errorf("parseClass(%q) succeeded, want an error", in)
+			continue
+		}
+		if !strings.Contains(err.Error(), "valid values are") || !strings.Contains(err.Error(), "CH") {
+			t.Errorf("parseClass(%q) error %q does not list the valid values", in, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// updateRcodeMeaning explains the rcodes a server answers a failed UPDATE
+// with (RFC 2136 section 2.2)
+var updateRcodeMeaning = map[int]string{
+	dns.RcodeYXDomain:  "a name required not to exist exists",
+	dns.RcodeNameError: "a name required to exist does not",
+	dns.RcodeYXRrset:   "an RRset required not to exist exists",
+	dns.RcodeNXRrset:   "an RRset required to exist does not",
+	dns.RcodeNotAuth:   "the server is not authoritative for the zone or did not accept the key",
+	dns.RcodeNotZone:   "a name is outside the zone",
+	dns.RcodeRefused:   "the server refused the update",
+}
+
+// updateOp is one -add or -delete flag, kept in command line order since
+// the server applies the changes in sequence
+type updateOp struct {
+	add  bool
+	spec string
+}
+
+// updateOpFlag appends the -add or -delete values to a shared list
+type updateOpFlag struct {
+	add bool
+	ops *[]updateOp
+}
+
+func (f updateOpFlag) String() string { return "" }
+
+func (f updateOpFlag) Set(v string) error {
+	*f.ops = append(*f.ops, updateOp{add: f.add, spec: v})
+	return nil
+}
+
+// runUpdate implements the update subcommand: a DNS UPDATE (RFC 2136) that
+// adds and deletes records in a zone on its primary server, guarded by
+// optional prerequisites and authenticated with TSIG
+func runUpdate(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	serverFlag := fs.String("server", "", "primary `server` of the zone, as host[:port]")
+	port := fs.Int("port", 0, "server `port` (default 53)")
+	method := fs.String("method", "udp", "`method` to send the update with: udp (falling back to TCP for large ones), tcp or tls")
+	zoneFlag := fs.String("zone", "", "`zone` to update, relative names in the records are inside it")
+	ttl := fs.Uint("ttl", 3600, "`TTL` for added records that do not give one")
+	timeout := fs.Duration("timeout", 5*time.Second, "give up on the update after this `duration`")
+	verbose := fs.Bool("verbose", false, "print the update message and the response")
+	tsig := fs.String("tsig", "", "sign the update with TSIG, the `key` given as [algorithm:]name:base64secret")
+	tsigFile := fs.String("tsig-file", "", "read the TSIG key from a BIND key `file`, as written by tsig-keygen")
+	var ops []updateOp
+	var prereqs stringList
+	fs.Var(updateOpFlag{add: true, ops: &ops}, "add", "add this `record`, such as \"www 300 A 192.0.2.1\" (repeatable)")
+	fs.Var(updateOpFlag{add: false, ops: &ops}, "delete", "delete the records matching `name [type [data]]`: everything at the name, one RRset or one record (repeatable)")
+	fs.Var(&prereqs, "prereq", "only apply the update if `condition` holds: yxdomain name, nxdomain name, yxrrset name type [data] or nxrrset name type (repeatable)")
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s update [flags] -server <primary> -zone <zone> -add|-delete ...\n\nChanges are applied in the order given, so -delete www A -add 'www A 192.0.2.1' replaces an RRset.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := cfg.apply(fs, "update"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if *serverFlag == "" || *zoneFlag == "" || len(ops) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	zone := dns.Fqdn(*zoneFlag)
+
+	m, err := newUpdateMsg(zone, uint32(*ttl), prereqs, ops)
+	if err != nil {
+		fatal(err.Error())
+	}
+	r, err := newUpdateResolver(*method, *serverFlag, *port, *tsig, *tsigFile)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if *verbose {
+		fmt.Println(m.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	resp, err := r.Exchange(ctx, m)
+	if err != nil {
+		fatal("update failed", "zone", zone, "err", err)
+	}
+	if *verbose {
+		fmt.Println(resp.String())
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		rcode := dns.RcodeToString[resp.Rcode]
+		if meaning, ok := updateRcodeMeaning[resp.Rcode]; ok {
+			rcode += ": " + meaning
+		}
+		fatal("update rejected", "zone", zone, "rcode", rcode)
+	}
+	fmt.Printf("Update of %s applied\n", zone)
+}
+
+// newUpdateResolver returns the transport for the update, signed when a
+// key is given. Updates are not idempotent, so there are no retries.
+func newUpdateResolver(method, server string, port int, tsig, tsigFile string) (resolver.Resolver, error) {
+	addr, err := serverAddress(method, server, port)
+	if err != nil {
+		return nil, err
+	}
+	var r resolver.RawExchanger
+	switch method {
+	case "udp":
+		r = resolver.NewUDP(addr)
+	case "tcp":
+		r = resolver.NewTCP(addr)
+	case "tls":
+		r = resolver.NewDoT(addr)
+	default:
+		return nil, fmt.Errorf("updates are sent over udp, tcp or tls, not %s", method)
+	}
+	key, err := loadTSIGKey(tsig, tsigFile)
+	if err != nil || key == nil {
+		return r, err
+	}
+	return resolver.NewSigned(r, key), nil
+}
+
+// newUpdateMsg builds the UPDATE message for zone from the flags
+func newUpdateMsg(zone string, ttl uint32, prereqs []string, ops []updateOp) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+
+	for _, spec := range prereqs {
+		fields := strings.Fields(spec)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid prerequisite %q", spec)
+		}
+		kind, rest := strings.ToLower(fields[0]), strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(spec), fields[0]))
+		rr, hasData, err := parseUpdateSpec(rest, zone, 0)
+		if err != nil {
+			return nil, fmt.Errorf("prerequisite %q: %v", spec, err)
+		}
+		typed := rr.Header().Rrtype != dns.TypeANY
+		switch {
+		case kind == "yxdomain" && len(fields) == 2:
+			m.NameUsed([]dns.RR{rr})
+		case kind == "nxdomain" && len(fields) == 2:
+			m.NameNotUsed([]dns.RR{rr})
+		case kind == "yxrrset" && hasData:
+			m.Used([]dns.RR{rr})
+		case kind == "yxrrset" && typed:
+			m.RRsetUsed([]dns.RR{rr})
+		case kind == "nxrrset" && typed && !hasData:
+			m.RRsetNotUsed([]dns.RR{rr})
+		default:
+			return nil, fmt.Errorf("invalid prerequisite %q, want yxdomain name, nxdomain name, yxrrset name type [data] or nxrrset name type", spec)
+		}
+	}
+
+	for _, op := range ops {
+		rr, hasData, err := parseUpdateSpec(op.spec, zone, ttl)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case op.add && !hasData:
+			return nil, fmt.Errorf("cannot add %q, it has no data", op.spec)
+		case op.add:
+			m.Insert([]dns.RR{rr})
+		case hasData:
+			m.Remove([]dns.RR{rr})
+		case rr.Header().Rrtype != dns.TypeANY:
+			m.RemoveRRset([]dns.RR{rr})
+		default:
+			m.RemoveName([]dns.RR{rr})
+		}
+	}
+	return m, nil
+}
+
+// parseUpdateSpec parses "name", "name type" or a whole record in master
+// file syntax, with names relative to zone and the TTL defaulting to ttl.
+// The returned record has type ANY when only a name was given, and the
+// boolean reports whether it carries data.
+func parseUpdateSpec(spec, zone string, ttl uint32) (dns.RR, bool, error) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 0:
+		return nil, false, fmt.Errorf("missing name")
+	case 1, 2:
+		name := fields[0]
+		switch {
+		case name == "@":
+			name = zone
+		case !dns.IsFqdn(name):
+			name += "." + zone
+		}
+		if !dns.IsSubDomain(zone, name) {
+			return nil, false, fmt.Errorf("%s is outside the zone %s", name, zone)
+		}
+		rrtype := uint16(dns.TypeANY)
+		if len(fields) == 2 {
+			t, err := parseType(fields[1])
+			if err != nil {
+				return nil, false, err
+			}
+			rrtype = t
+		}
+		return &dns.ANY{Hdr: dns.RR_Header{Name: dns.CanonicalName(name), Rrtype: rrtype, Class: dns.ClassINET}}, false, nil
+	}
+
+	zp := dns.NewZoneParser(strings.NewReader(fmt.Sprintf("$TTL %d\n%s", ttl, spec)), zone, "")
+	rr, ok := zp.Next()
+	if !ok {
+		if err := zp.Err(); err != nil {
+			return nil, false, fmt.Errorf("invalid record %q: %v", spec, err)
+		}
+		return nil, false, fmt.Errorf("invalid record %q", spec)
+	}
+	if !dns.IsSubDomain(zone, rr.Header().Name) {
+		return nil, false, fmt.Errorf("%s is outside the zone %s", rr.Header().Name, zone)
+	}
+	return rr, true, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"tmp-dns/pkg/resolver"
+)
+
+// printVerbose writes the whole response the way dig does: header and
+// flags, the OPT pseudo-section, every section, then the query statistics
+func printVerbose(w io.Writer, resp *dns.Msg, trace resolver.Trace, when time.Time) {
+	fmt.Fprintln(w, resp.String())
+	fmt.Fprintf(w, ";; Query time: %d msec\n", trace.RTT.Milliseconds())
+	transport := trace.Transport
+	if trace.Protocol != "" {
+		transport += ", " + trace.Protocol
+	}
+	fmt.Fprintf(w, ";; SERVER: %s (%s)\n", trace.Server, transport)
+	fmt.Fprintf(w, ";; WHEN: %s\n", when.Format(time.RFC1123))
+	fmt.Fprintf(w, ";; MSG SIZE  rcvd: %d\n", trace.ResponseSize)
+}
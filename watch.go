@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// watchOptions are the flags of watch mode, which repeats the query and
+// reports how the answer changes, for following DNS propagation
+type watchOptions struct {
+	interval     time.Duration
+	exitOnChange bool
+	hook         string
+}
+
+// register adds the watch flags to fs
+func (w *watchOptions) register(fs *flag.FlagSet) {
+	fs.DurationVar(&w.interval, "watch", 0, "repeat the query every `interval` and print changes to the answer until interrupted")
+	fs.BoolVar(&w.exitOnChange, "exit-on-change", false, "with -watch, exit with status 1 once the answer changes")
+	fs.StringVar(&w.hook, "on-change", "", "with -watch, run this shell `command` when the answer changes, with TMPDNS_NAME, TMPDNS_TYPE, TMPDNS_OLD and TMPDNS_NEW set")
+}
+
+// active reports whether watch mode was asked for
+func (w *watchOptions) active() bool {
+	return w.interval > 0
+}
+
+// watchSlack is how much later than the countdown predicts an answer may
+// expire before it counts as cached afresh, for TTLs rounded to seconds
+// and round trips
+const watchSlack = 2 * time.Second
+
+// watchState is what one poll saw
+type watchState struct {
+	rcode   string
+	answers []string
+	ttl     uint32
+}
+
+func (s watchState) String() string {
+	if len(s.answers) == 0 {
+		return s.rcode + ", no answer"
+	}
+	return strings.Join(s.answers, ", ")
+}
+
+// watchSeen aggregates the polls that saw one answer, or with -verbose one
+// record
+type watchSeen struct {
+	text        string
+	first, last time.Time
+	polls       int
+	ttl         uint32
+	expires     time.Time // when the TTL of the last poll runs out
+	steady      bool      // the TTL did not count down since the poll before
+}
+
+// see counts a poll at now with ttl and reports whether the answer expires
+// later than the countdown since the previous poll predicts, that is the
+// resolver cached it again. Servers that answer from their own data, not
+// a cache, give the same TTL every time.
+func (s *watchSeen) see(now time.Time, ttl uint32) bool {
+	expires := now.Add(time.Duration(ttl) * time.Second)
+	recached := s.polls > 0 && expires.Sub(s.expires) > watchSlack && ttl != s.ttl
+	s.steady = s.polls > 0 && ttl == s.ttl
+	if s.polls == 0 {
+		s.first = now
+	}
+	s.last, s.ttl, s.expires = now, ttl, expires
+	s.polls++
+	return recached
+}
+
+// countdown describes the TTL of the last poll: when it expires from the
+// cache of the resolver, unless it does not count down
+func (s *watchSeen) countdown() string {
+	if s.steady {
+		return fmt.Sprintf("TTL %d, not counting down", s.ttl)
+	}
+	return fmt.Sprintf("TTL %d, expires %s", s.ttl, s.expires.Format("15:04:05"))
+}
+
+// watchHistory is every answer and record a watch saw, in order of their
+// first poll
+type watchHistory struct {
+	answers, records []*watchSeen
+	byKey            map[string]*watchSeen
+	polls, failed    int
+}
+
+// seen returns the aggregate for key in list, adding one showing text when
+// it is new
+func (h *watchHistory) seen(list *[]*watchSeen, key, text string) *watchSeen {
+	if h.byKey == nil {
+		h.byKey = map[string]*watchSeen{}
+	}
+	s, ok := h.byKey[key]
+	if !ok {
+		s = &watchSeen{text: text}
+		h.byKey[key] = s
+		*list = append(*list, s)
+	}
+	return s
+}
+
+// run polls with ask every interval, printing the first answer and then one
+// line per poll: the TTL counting down to when the answer expires from the
+// resolver's cache while it is unchanged, or the records added and removed
+// when it changes. With verbose each poll also lists the records with
+// their own TTLs. Failed queries are reported and do not count as
+// changes. Ctrl-C stops it and prints how long each answer was seen.
+func (w *watchOptions) run(domain string, qtype uint16, timeout time.Duration, verbose bool, ask func(context.Context) (*dns.Msg, error)) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	var prev *watchState
+	var prevSeen *watchSeen
+	var history watchHistory
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-interrupt:
+				history.print(domain, qtype)
+				return
+			case <-ticker.C:
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp, err := ask(ctx)
+		cancel()
+		now := time.Now()
+		stamp := now.Format("15:04:05")
+		history.polls++
+		if err != nil {
+			history.failed++
+			fmt.Printf("%s  query failed: %v\n", stamp, err)
+			continue
+		}
+		answers, ttl := answerSet(resp)
+		cur := watchState{rcode: rcodeString(resp.Rcode), answers: answers, ttl: ttl}
+		seen := history.seen(&history.answers, "answer "+cur.rcode+" "+cur.String(), cur.String())
+		lastSeen := seen.last
+		recached := seen.see(now, ttl) && seen == prevSeen
+
+		switch {
+		case prev == nil:
+			fmt.Printf("%s  %s %s: %s", stamp, domain, typeString(qtype), cur)
+			if len(cur.answers) > 0 {
+				fmt.Printf(" (%s)", seen.countdown())
+			}
+			fmt.Println()
+		case seen == prevSeen:
+			switch {
+			case len(cur.answers) == 0:
+				fmt.Printf("%s  unchanged\n", stamp)
+			case recached:
+				fmt.Printf("%s  unchanged, cached again, %s\n", stamp, seen.countdown())
+			default:
+				fmt.Printf("%s  unchanged, %s\n", stamp, seen.countdown())
+			}
+		default:
+			fmt.Printf("%s  CHANGED after %s", stamp, watchPolls(prevSeen.polls))
+			if len(prev.answers) > 0 && !prevSeen.steady {
+				fmt.Printf(", the old answer was due to expire %s", prevSeen.expires.Format("15:04:05"))
+			}
+			if !lastSeen.IsZero() {
+				fmt.Printf(", back to the answer last seen %s", lastSeen.Format("15:04:05"))
+			}
+			fmt.Println()
+			printWatchChanges(*prev, cur)
+			if w.hook != "" {
+				w.runHook(domain, qtype, *prev, cur)
+			}
+			if w.exitOnChange {
+				os.Exit(1)
+			}
+		}
+		if verbose {
+			history.printRecords(resp, now)
+		}
+		prev, prevSeen = &cur, seen
+	}
+}
+
+func watchPolls(n int) string {
+	if n == 1 {
+		return "1 poll"
+	}
+	return fmt.Sprintf("%d polls", n)
+}
+
+// printRecords lists the records of resp, each with its own TTL countdown
+// and how often it was seen, for -verbose
+func (h *watchHistory) printRecords(resp *dns.Msg, now time.Time) {
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		text := typeString(hdr.Rrtype) + " " + strings.TrimSpace(rrData(rr))
+		seen := h.seen(&h.records, "record "+text, text)
+		if seen.last.Equal(now) {
+			continue // the same record twice in one answer
+		}
+		seen.see(now, hdr.Ttl)
+		fmt.Printf("          %s  %s, seen in %s since %s\n", text, seen.countdown(), watchPolls(seen.polls), seen.first.Format("15:04:05"))
+	}
+}
+
+// print summarizes the watch: every answer seen, when first and last and
+// in how many polls, then with -verbose the same for each record
+func (h *watchHistory) print(domain string, qtype uint16) {
+	fmt.Printf("\n--- %s %s watch: %s", domain, typeString(qtype), watchPolls(h.polls))
+	if h.failed > 0 {
+		fmt.Printf(", %d failed", h.failed)
+	}
+	if len(h.answers) == 1 {
+		fmt.Println(", the same answer throughout")
+	} else {
+		fmt.Printf(", %d different answers\n", len(h.answers))
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, s := range h.answers {
+		fmt.Fprintf(tw, "%s - %s\t%s\t%s\n", s.first.Format("15:04:05"), s.last.Format("15:04:05"), watchPolls(s.polls), s.text)
+	}
+	if len(h.records) > 0 {
+		fmt.Fprintln(tw, "records:")
+		for _, s := range h.records {
+			fmt.Fprintf(tw, "%s - %s\t%s\t%s\n", s.first.Format("15:04:05"), s.last.Format("15:04:05"), watchPolls(s.polls), s.text)
+		}
+	}
+	tw.Flush()
+}
+
+// printWatchChanges prints the rcode change and the records only in one of
+// the two states
+func printWatchChanges(prev, cur watchState) {
+	if prev.rcode != cur.rcode {
+		fmt.Printf("          rcode %s -> %s\n", prev.rcode, cur.rcode)
+	}
+	old := map[string]bool{}
+	for _, a := range prev.answers {
+		old[a] = true
+	}
+	now := map[string]bool{}
+	for _, a := range cur.answers {
+		now[a] = true
+		if !old[a] {
+			fmt.Printf("          + %s\n", a)
+		}
+	}
+	for _, a := range prev.answers {
+		if !now[a] {
+			fmt.Printf("          - %s\n", a)
+		}
+	}
+}
+
+// runHook runs the -on-change command with the change in its environment
+func (w *watchOptions) runHook(domain string, qtype uint16, prev, cur watchState) {
+	cmd := exec.Command("sh", "-c", w.hook)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", w.hook)
+	}
+	cmd.Env = append(os.Environ(),
+		"TMPDNS_NAME="+domain,
+		"TMPDNS_TYPE="+typeString(qtype),
+		"TMPDNS_OLD="+strings.Join(prev.answers, "\n"),
+		"TMPDNS_NEW="+strings.Join(cur.answers, "\n"),
+	)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		slog.Warn("-on-change command failed", "err", err)
+	}
+}
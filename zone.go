@@ -0,0 +1,244 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// runZone implements the zone subcommand, whose commands work on master
+// files without a server
+func runZone(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "Usage: %s zone check [flags] <file> [name [type]]\n", os.Args[0])
+		os.Exit(2)
+	}
+	runZoneCheck(args[1:])
+}
+
+// runZoneCheck implements zone check: it parses a master file and reports
+// the mistakes that make a zone misbehave once served, exiting with status
+// 1 when there are any. Given a name it answers that query from the file
+// instead, as serve -zone-file would.
+func runZoneCheck(args []string) {
+	fs := flag.NewFlagSet("zone check", flag.ExitOnError)
+	origin := fs.String("origin", "", "`zone` that relative names in the file belong to, when it does not set $ORIGIN")
+	var logs logOptions
+	logs.register(fs)
+	var cfg configFile
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s zone check [flags] <file> [name [type]]\n\nWith a name, the query is answered from the file and problems are only warned about.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	args = parseArgs(fs, args)
+	if err := cfg.apply(fs, "zone"); err != nil {
+		fatal(err.Error())
+	}
+	logs.setup()
+	if len(args) < 1 || len(args) > 3 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *origin != "" {
+		*origin = dns.Fqdn(*origin)
+	}
+
+	path := args[0]
+	z, err := readLocalZone(path, *origin)
+	if err != nil {
+		fatal(err.Error())
+	}
+	problems := z.check()
+
+	if len(args) == 1 {
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", path, problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		records := 0
+		for _, rrs := range z.records {
+			records += len(rrs)
+		}
+		fmt.Printf("%s: zone %s, serial %d, %d records, no problems found\n", path, z.origin, z.soa.Serial, records)
+		return
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", path, problem)
+	}
+	name, err := toASCII(args[1])
+	if err != nil {
+		fatal(err.Error())
+	}
+	qtype := dns.TypeA
+	if len(args) == 3 {
+		if qtype, err = parseType(args[2]); err != nil {
+			fatal(err.Error())
+		}
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	resp := (&localData{zones: []*localZone{z}}).answer(req)
+	if resp == nil {
+		fatal("the name is outside the zone", "name", req.Question[0].Name, "zone", z.origin)
+	}
+	fmt.Println(resp.String())
+}
+
+// check returns what is wrong with the zone, one problem per line in
+// canonical order of the names
+func (z *localZone) check() []string {
+	var problems []string
+	report := func(owner, format string, a ...any) {
+		problems = append(problems, owner+": "+fmt.Sprintf(format, a...))
+	}
+
+	owners := make([]string, 0, len(z.records))
+	for owner := range z.records {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool { return canonicalLess(owners[i], owners[j]) })
+
+	if !hasType(z.records[z.origin], dns.TypeNS) {
+		report(z.origin, "no NS records at the apex")
+	}
+	for _, owner := range owners {
+		rrs := z.records[owner]
+		z.checkData(owner, rrs, report)
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.NS:
+				z.checkTarget(owner, "NS", rr.Ns, true, report)
+			case *dns.MX:
+				if rr.Mx != "." { // a null MX, RFC 7505
+					z.checkTarget(owner, "MX", rr.Mx, true, report)
+				}
+			case *dns.SRV:
+				if rr.Target != "." {
+					z.checkTarget(owner, "SRV", rr.Target, true, report)
+				}
+			case *dns.CNAME:
+				z.checkTarget(owner, "CNAME", rr.Target, false, report)
+			case *dns.PTR:
+				z.checkTarget(owner, "PTR", rr.Ptr, false, report)
+			}
+		}
+	}
+	return problems
+}
+
+// checkData checks the records at one name against each other and against
+// the delegations above them
+func (z *localZone) checkData(owner string, rrs []dns.RR, report func(owner, format string, a ...any)) {
+	cnames, others := 0, 0
+	ttls := map[uint16]uint32{}
+	mixedTTLs := map[uint16]bool{}
+	for i, rr := range rrs {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dns.TypeCNAME:
+			cnames++
+		case dns.TypeRRSIG, dns.TypeNSEC:
+			// DNSSEC records sit next to a CNAME, RFC 4035 section 2.5
+		default:
+			others++
+		}
+		if ttl, seen := ttls[hdr.Rrtype]; !seen {
+			ttls[hdr.Rrtype] = hdr.Ttl
+		} else if ttl != hdr.Ttl && hdr.Rrtype != dns.TypeRRSIG && !mixedTTLs[hdr.Rrtype] {
+			report(owner, "the %s records have different TTLs, RFC 2181 section 5.2", typeString(hdr.Rrtype))
+			mixedTTLs[hdr.Rrtype] = true
+		}
+		for _, prev := range rrs[:i] {
+			if dns.IsDuplicate(prev, rr) {
+				report(owner, "duplicate record %s", rr)
+				break
+			}
+		}
+	}
+	if cnames > 1 {
+		report(owner, "more than one CNAME")
+	}
+	if cnames > 0 && others > 0 {
+		report(owner, "CNAME and other data, RFC 1034 section 3.6.2")
+	}
+
+	cut := z.delegation(owner)
+	if cut == "" {
+		return
+	}
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; {
+		case t == dns.TypeA || t == dns.TypeAAAA:
+			// Glue, whether an NS record needs it is checked with the NS
+		case owner == cut && (t == dns.TypeNS || t == dns.TypeDS || t == dns.TypeRRSIG || t == dns.TypeNSEC):
+		default:
+			report(owner, "%s record at or below the delegation to %s is never served", typeString(t), cut)
+		}
+	}
+}
+
+// checkTarget checks a name that a record of owner points to: that it
+// exists when it is in the zone, and holds addresses when the record needs
+// them, as glue when it is below a delegation
+func (z *localZone) checkTarget(owner, kind, target string, addresses bool, report func(owner, format string, a ...any)) {
+	target = strings.ToLower(target)
+	if !dns.IsSubDomain(z.origin, target) {
+		return
+	}
+	if cut := z.delegation(target); cut != "" {
+		if kind == "NS" && !hasType(z.records[target], dns.TypeA) && !hasType(z.records[target], dns.TypeAAAA) {
+			report(owner, "missing glue for the NS target %s below the delegation to %s", target, cut)
+		}
+		return
+	}
+	rrs, exists := z.lookup(target)
+	switch {
+	case !exists:
+		report(owner, "dangling %s target %s, which does not exist", kind, target)
+	case addresses && hasType(rrs, dns.TypeCNAME):
+		report(owner, "the %s target %s is an alias, RFC 2181 section 10.3", kind, target)
+	case addresses && !hasType(rrs, dns.TypeA) && !hasType(rrs, dns.TypeAAAA):
+		report(owner, "the %s target %s has no A or AAAA records", kind, target)
+	}
+}
+
+// delegation returns the topmost name at or above name, below the apex,
+// that has NS records, or "" when name is authoritative data of the zone
+func (z *localZone) delegation(name string) string {
+	cut := ""
+	for ; name != z.origin && dns.IsSubDomain(z.origin, name); name = parentName(name) {
+		if hasType(z.records[name], dns.TypeNS) {
+			cut = name
+		}
+	}
+	return cut
+}
+
+func hasType(rrs []dns.RR, t uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalLess orders lowercased names the way DNSSEC does, RFC 4034
+// section 6.1: by their labels from the right
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}